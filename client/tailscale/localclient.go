@@ -421,6 +421,16 @@ func (lc *LocalClient) BugReport(ctx context.Context, note string) (string, erro
 
 // DebugAction invokes a debug action, such as "rebind" or "restun".
 // These are development tools and subject to change or removal over time.
+// PrepareSuspend tells tailscaled that the OS is about to suspend, so it
+// can send WireGuard keepalives if the KeepAliveOnSuspend pref is set.
+func (lc *LocalClient) PrepareSuspend(ctx context.Context) error {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/prepare-suspend", 200, nil)
+	if err != nil {
+		return fmt.Errorf("error %w: %s", err, body)
+	}
+	return nil
+}
+
 func (lc *LocalClient) DebugAction(ctx context.Context, action string) error {
 	body, err := lc.send(ctx, "POST", "/localapi/v0/debug?action="+url.QueryEscape(action), 200, nil)
 	if err != nil {
@@ -1285,6 +1295,14 @@ func (lc *LocalClient) DeleteProfile(ctx context.Context, profile ipn.ProfileID)
 	return err
 }
 
+// MergeProfiles copies the prefs of the profile src into the profile dst
+// and deletes src. Both profiles must use the same control server. If src
+// is the current profile, dst becomes the current profile.
+func (lc *LocalClient) MergeProfiles(ctx context.Context, src, dst ipn.ProfileID) error {
+	_, err := lc.send(ctx, "POST", "/localapi/v0/profiles/"+url.PathEscape(string(src))+"/merge?into="+url.QueryEscape(string(dst)), http.StatusNoContent, nil)
+	return err
+}
+
 // QueryFeature makes a request for instructions on how to enable
 // a feature, such as Funnel, for the node's tailnet. If relevant,
 // this includes a control server URL the user can visit to enable
@@ -124,6 +124,11 @@ func runSet(ctx context.Context, args []string) (retErr error) {
 			return err
 		}
 	}
+	if setArgs.hostname != "" {
+		if err := maskedPrefs.Prefs.SetHostname(setArgs.hostname); err != nil {
+			return err
+		}
+	}
 
 	var advertiseExitNodeSet, advertiseRoutesSet bool
 	setFlagSet.Visit(func(f *flag.Flag) {
@@ -156,14 +161,16 @@ func runSet(ctx context.Context, args []string) (retErr error) {
 			return err
 		}
 	}
-	if maskedPrefs.AutoUpdateSet {
+	if maskedPrefs.AutoUpdateSet.CheckSet || maskedPrefs.AutoUpdateSet.ApplySet {
 		_, err := clientupdate.NewUpdater(clientupdate.Arguments{})
 		if errors.Is(err, errors.ErrUnsupported) {
 			return errors.New("automatic updates are not supported on this platform")
 		}
 	}
 	checkPrefs := curPrefs.Clone()
-	checkPrefs.ApplyEdits(maskedPrefs)
+	if err := checkPrefs.ApplyEdits(maskedPrefs); err != nil {
+		return err
+	}
 	if err := localClient.CheckPrefs(ctx, checkPrefs); err != nil {
 		return err
 	}
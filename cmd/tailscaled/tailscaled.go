@@ -32,6 +32,7 @@
 	"tailscale.com/cmd/tailscaled/childproc"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/envknob"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/conffile"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnserver"
@@ -495,6 +496,14 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 	dialer := &tsdial.Dialer{Logf: logf} // mutated below (before used)
 	sys.Set(dialer)
 
+	// The store is created before the engine so that the saved prefs can
+	// pick the TUN interface name; see tunNameFromStore.
+	store, err := store.New(logf, statePathOrDefault())
+	if err != nil {
+		return nil, fmt.Errorf("store.New: %w", err)
+	}
+	sys.Set(store)
+
 	onlyNetstack, err := createEngine(logf, sys)
 	if err != nil {
 		return nil, fmt.Errorf("createEngine: %w", err)
@@ -548,12 +557,6 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 
 	opts := ipnServerOpts()
 
-	store, err := store.New(logf, statePathOrDefault())
-	if err != nil {
-		return nil, fmt.Errorf("store.New: %w", err)
-	}
-	sys.Set(store)
-
 	if w, ok := sys.Tun.GetOK(); ok {
 		w.Start()
 	}
@@ -576,6 +579,46 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 	return lb, nil
 }
 
+// tunNameFromStore returns the TUN interface name requested by the saved
+// prefs of the profile that tailscaled will start with, or the empty
+// string to use the --tun flag as given.
+//
+// The prefs are only honored when --tun was left at its default, so an
+// explicit --tun always wins. UserspaceSockets selects userspace
+// networking; otherwise, on Linux only, Interface names the TUN device.
+func tunNameFromStore(logf logger.Logf, st ipn.StateStore) string {
+	if args.tunname != defaultTunName() || st == nil {
+		return ""
+	}
+	key, err := st.ReadState(ipn.CurrentProfileStateKey)
+	if err != nil || len(key) == 0 {
+		return ""
+	}
+	b, err := st.ReadState(ipn.StateKey(key))
+	if err != nil {
+		return ""
+	}
+	prefs, err := ipn.PrefsFromBytes(b)
+	if err != nil {
+		return ""
+	}
+	if prefs.UserspaceSockets {
+		if err := prefs.ValidateUserspaceSockets(runtime.GOOS); err != nil {
+			logf("ignoring UserspaceSockets pref: %v", err)
+		} else {
+			return "userspace-networking"
+		}
+	}
+	if runtime.GOOS != "linux" || prefs.Interface == "" {
+		return ""
+	}
+	if err := prefs.ValidateInterface(runtime.GOOS); err != nil {
+		logf("ignoring Interface pref: %v", err)
+		return ""
+	}
+	return prefs.Interface
+}
+
 // createEngine tries to the wgengine.Engine based on the order of tunnels
 // specified in the command line flags.
 //
@@ -585,8 +628,12 @@ func createEngine(logf logger.Logf, sys *tsd.System) (onlyNetstack bool, err err
 	if args.tunname == "" {
 		return false, errors.New("no --tun value specified")
 	}
+	tunname := args.tunname
+	if name := tunNameFromStore(logf, sys.StateStore.Get()); name != "" {
+		tunname = name
+	}
 	var errs []error
-	for _, name := range strings.Split(args.tunname, ",") {
+	for _, name := range strings.Split(tunname, ",") {
 		logf("wgengine.NewUserspaceEngine(tun %q) ...", name)
 		onlyNetstack, err = tryEngine(logf, sys, name)
 		if err == nil {
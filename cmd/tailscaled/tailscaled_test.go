@@ -4,9 +4,14 @@
 package main // import "tailscale.com/cmd/tailscaled"
 
 import (
+	"runtime"
 	"testing"
 
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tstest"
 	"tailscale.com/tstest/deptest"
+	"tailscale.com/util/cmpx"
 )
 
 func TestNothing(t *testing.T) {
@@ -32,3 +37,36 @@ func TestDeps(t *testing.T) {
 		},
 	}.Check(t)
 }
+
+func TestTunNameFromStore(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("test expectations are for Linux")
+	}
+	tests := []struct {
+		name    string
+		tunname string // --tun; empty means the default
+		prefs   *ipn.Prefs
+		want    string
+	}{
+		{name: "no_prefs"},
+		{name: "empty_prefs", prefs: &ipn.Prefs{}},
+		{name: "interface", prefs: &ipn.Prefs{Interface: "ts-tenant1"}, want: "ts-tenant1"},
+		{name: "bad_interface", prefs: &ipn.Prefs{Interface: "lo"}},
+		{name: "userspace", prefs: &ipn.Prefs{UserspaceSockets: true}, want: "userspace-networking"},
+		{name: "userspace_wins", prefs: &ipn.Prefs{UserspaceSockets: true, Interface: "ts-tenant1"}, want: "userspace-networking"},
+		{name: "explicit_tun", tunname: "tun-explicit", prefs: &ipn.Prefs{UserspaceSockets: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tstest.Replace(t, &args.tunname, cmpx.Or(tt.tunname, defaultTunName()))
+			st := new(mem.Store)
+			if tt.prefs != nil {
+				st.WriteState(ipn.CurrentProfileStateKey, []byte("profile-1"))
+				st.WriteState("profile-1", tt.prefs.ToBytes())
+			}
+			if got := tunNameFromStore(t.Logf, st); got != tt.want {
+				t.Errorf("tunNameFromStore = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
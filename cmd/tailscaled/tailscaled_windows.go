@@ -41,6 +41,7 @@
 	"golang.org/x/sys/windows/svc/eventlog"
 	"golang.zx2c4.com/wintun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/envknob"
 	"tailscale.com/logpolicy"
 	"tailscale.com/logtail/backoff"
@@ -158,7 +159,7 @@ func (service *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, ch
 	changes <- svc.Status{State: svc.StartPending}
 	syslogf("Service start pending")
 
-	svcAccepts := svc.AcceptStop
+	svcAccepts := svc.AcceptStop | svc.AcceptPowerEvent
 	if flushDNSOnSessionUnlock, _ := syspolicy.GetBoolean(syspolicy.FlushDNSOnSessionUnlock, false); flushDNSOnSessionUnlock {
 		svcAccepts |= svc.AcceptSessionChange
 	}
@@ -200,6 +201,9 @@ func (service *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, ch
 				syslogf("Service session change notification")
 				handleSessionChange(cmd)
 				changes <- cmd.CurrentStatus
+			case svc.PowerEvent:
+				handlePowerEvent(cmd)
+				changes <- cmd.CurrentStatus
 			case cmdUninstallWinTun:
 				syslogf("Stopping tailscaled child process and uninstalling WinTun")
 				// At this point, doneCh is the channel which will be closed when the
@@ -368,6 +372,36 @@ func handleSessionChange(chgRequest svc.ChangeRequest) {
 	}()
 }
 
+// pbtAPMSuspend is the PBT_APMSUSPEND power event type, sent when the
+// system is about to suspend.
+const pbtAPMSuspend = 0x4
+
+// isSuspendEvent reports whether chgRequest notifies that the system is
+// about to suspend.
+func isSuspendEvent(chgRequest svc.ChangeRequest) bool {
+	return chgRequest.Cmd == svc.PowerEvent && chgRequest.EventType == pbtAPMSuspend
+}
+
+// handlePowerEvent tells the tailscaled subprocess that the system is about
+// to suspend, so it can send WireGuard keepalives if the KeepAliveOnSuspend
+// pref is set. Windows only gives services a couple of seconds before it
+// suspends, so the request has a short timeout.
+func handlePowerEvent(chgRequest svc.ChangeRequest) {
+	if !isSuspendEvent(chgRequest) {
+		return
+	}
+
+	log.Printf("Received PBT_APMSUSPEND event, notifying tailscaled.")
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		var lc tailscale.LocalClient
+		if err := lc.PrepareSuspend(ctx); err != nil {
+			log.Printf("Error notifying tailscaled of suspend: %v", err)
+		}
+	}()
+}
+
 var (
 	kernel32           = windows.NewLazySystemDLL("kernel32.dll")
 	getTickCount64Proc = kernel32.NewProc("GetTickCount64")
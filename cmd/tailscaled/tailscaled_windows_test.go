@@ -0,0 +1,28 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+func TestIsSuspendEvent(t *testing.T) {
+	tests := []struct {
+		req  svc.ChangeRequest
+		want bool
+	}{
+		{svc.ChangeRequest{Cmd: svc.PowerEvent, EventType: pbtAPMSuspend}, true},
+		{svc.ChangeRequest{Cmd: svc.PowerEvent, EventType: 0x7}, false},  // PBT_APMRESUMESUSPEND
+		{svc.ChangeRequest{Cmd: svc.PowerEvent, EventType: 0x12}, false}, // PBT_APMRESUMEAUTOMATIC
+		{svc.ChangeRequest{Cmd: svc.SessionChange, EventType: pbtAPMSuspend}, false},
+		{svc.ChangeRequest{Cmd: svc.Stop}, false},
+	}
+	for _, tt := range tests {
+		if got := isSuspendEvent(tt.req); got != tt.want {
+			t.Errorf("isSuspendEvent(%v, %#x) = %v; want %v", cmdName(tt.req.Cmd), tt.req.EventType, got, tt.want)
+		}
+	}
+}
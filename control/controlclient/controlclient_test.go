@@ -4,8 +4,14 @@
 package controlclient
 
 import (
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
 )
 
 func fieldsOf(t reflect.Type) (fields []string) {
@@ -62,3 +68,71 @@ func TestStatusEqual(t *testing.T) {
 		}
 	}
 }
+
+type statusChan chan Status
+
+func (c statusChan) SetControlClientStatus(_ Client, st Status) { c <- st }
+
+func TestFileClient(t *testing.T) {
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			ID:       1,
+			StableID: "self",
+			Name:     "self.example.ts.net.",
+			User:     10,
+		}).View(),
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			10: {ID: 10, LoginName: "user@example.com"},
+		},
+	}
+	b, err := json.Marshal(nm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "netmap.json")
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFile(Options{ServerURL: "https://example.com", Observer: make(statusChan)}); err == nil {
+		t.Error("NewFile with https URL succeeded; want error")
+	}
+
+	sc := make(statusChan, 2)
+	c, err := NewFile(Options{ServerURL: "file://" + filepath.ToSlash(path), Observer: sc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	c.Login(nil, LoginDefault)
+
+	if st := <-sc; !st.LoginFinished() {
+		t.Errorf("first status = %v; want logged in", st.state)
+	}
+	st := <-sc
+	if st.state != StateSynchronized || st.Err != nil {
+		t.Fatalf("second status = %v, %v; want synchronized", st.state, st.Err)
+	}
+	if got := st.NetMap.SelfNode.StableID(); got != "self" {
+		t.Errorf("netmap self node = %q; want %q", got, "self")
+	}
+	if got := st.Persist.NodeID(); got != "self" {
+		t.Errorf("Persist.NodeID = %q; want %q", got, "self")
+	}
+	if got := st.Persist.UserProfile().LoginName(); got != "user@example.com" {
+		t.Errorf("Persist.UserProfile.LoginName = %q; want %q", got, "user@example.com")
+	}
+}
+
+func TestFileClientMissingFile(t *testing.T) {
+	sc := make(statusChan, 1)
+	c, err := NewFile(Options{ServerURL: "file://" + filepath.ToSlash(filepath.Join(t.TempDir(), "missing.json")), Observer: sc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Shutdown()
+	c.Login(nil, LoginDefault)
+	if st := <-sc; st.Err == nil || st.NetMap != nil {
+		t.Errorf("status = %v, %v; want error and no netmap", st.Err, st.NetMap)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package controlclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
+)
+
+var _ Client = (*FileClient)(nil)
+
+// FileClient is a Client that reads a network map from a local JSON file,
+// such as one captured with "tailscale debug netmap", instead of connecting
+// to a control server. It is used for file:// control URLs, for testing
+// against a fixed netmap.
+//
+// Only Login does anything: it loads the file and reports it to the
+// Observer as if the node had logged in and received the netmap. All other
+// methods are no-ops.
+type FileClient struct {
+	path     string
+	persist  persist.Persist
+	observer Observer
+	logf     logger.Logf
+
+	observerQueue execQueue
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewFile returns a new FileClient reading the netmap file named by
+// opts.ServerURL, which must be a file:// URL.
+func NewFile(opts Options) (*FileClient, error) {
+	path, err := fileControlPath(opts.ServerURL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Observer == nil {
+		return nil, errors.New("missing required Options.Observer")
+	}
+	if opts.Logf == nil {
+		opts.Logf = func(fmt string, args ...any) {}
+	}
+	return &FileClient{
+		path:     path,
+		persist:  *opts.Persist.Clone(),
+		observer: opts.Observer,
+		logf:     opts.Logf,
+	}, nil
+}
+
+// fileControlPath returns the local path named by the file:// URL
+// serverURL.
+func fileControlPath(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("control URL %q is not a file:// URL", serverURL)
+	}
+	if u.Path == "" {
+		return "", fmt.Errorf("control URL %q has no path", serverURL)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// loadNetmapFile reads a JSON-encoded netmap from path.
+func loadNetmapFile(path string) (*netmap.NetworkMap, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	nm := new(netmap.NetworkMap)
+	if err := json.Unmarshal(b, nm); err != nil {
+		return nil, fmt.Errorf("parsing netmap file %s: %w", path, err)
+	}
+	return nm, nil
+}
+
+// Login loads the netmap file and reports it to the Observer. The node's
+// Persist takes its NodeID and UserProfile from the netmap's self node.
+func (c *FileClient) Login(*tailcfg.Oauth2Token, LoginFlags) {
+	c.logf("client.Login: reading netmap from %s", c.path)
+	nm, err := loadNetmapFile(c.path)
+	if err != nil {
+		c.sendStatus(Status{Err: err, state: StateNotAuthenticated})
+		return
+	}
+	p := c.persist.Clone()
+	if nm.SelfNode.Valid() {
+		p.NodeID = nm.SelfNode.StableID()
+		if up, ok := nm.UserProfiles[nm.User()]; ok {
+			p.UserProfile = up
+		}
+	}
+	c.sendStatus(Status{state: StateAuthenticated})
+	c.sendStatus(Status{NetMap: nm, Persist: p.View(), state: StateSynchronized})
+}
+
+func (c *FileClient) sendStatus(st Status) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.observerQueue.Add(func() {
+		c.observer.SetControlClientStatus(c, st)
+	})
+}
+
+// Shutdown stops reporting status to the Observer.
+func (c *FileClient) Shutdown() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.observerQueue.shutdown()
+	c.mu.Unlock()
+}
+
+// Logout is a no-op; there is no control server to log out from.
+func (c *FileClient) Logout(context.Context) error { return nil }
+
+func (c *FileClient) SetPaused(bool)                     {}
+func (c *FileClient) AuthCantContinue() bool             { return false }
+func (c *FileClient) SetHostinfo(*tailcfg.Hostinfo)      {}
+func (c *FileClient) SetNetInfo(*tailcfg.NetInfo)        {}
+func (c *FileClient) SetTKAHead(string)                  {}
+func (c *FileClient) UpdateEndpoints([]tailcfg.Endpoint) {}
@@ -119,7 +119,7 @@ func (c *ConfigVAlpha) ToPrefs() (MaskedPrefs, error) {
 	}
 	if c.AutoUpdate != nil {
 		mp.AutoUpdate = *c.AutoUpdate
-		mp.AutoUpdateSet = true
+		mp.AutoUpdateSet = AutoUpdatePrefsMask{CheckSet: true, ApplySet: true, ApplyWindowSet: true, ChannelSet: true}
 	}
 	return mp, nil
 }
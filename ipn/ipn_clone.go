@@ -8,10 +8,12 @@
 import (
 	"maps"
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
+	"tailscale.com/types/ptr"
 )
 
 // Clone makes a deep copy of Prefs.
@@ -24,36 +26,109 @@ func (src *Prefs) Clone() *Prefs {
 	*dst = *src
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
+	dst.AutoUpdate = *src.AutoUpdate.Clone()
+	if dst.StatsInterval != nil {
+		dst.StatsInterval = ptr.To(*src.StatsInterval)
+	}
+	dst.ExitNodeIDs = append(src.ExitNodeIDs[:0:0], src.ExitNodeIDs...)
+	dst.CacheDNSFor = append(src.CacheDNSFor[:0:0], src.CacheDNSFor...)
+	dst.LocallyServedPorts = append(src.LocallyServedPorts[:0:0], src.LocallyServedPorts...)
+	if dst.RouteAllFilter != nil {
+		dst.RouteAllFilter = ptr.To(*src.RouteAllFilter)
+	}
+	if dst.TrafficShaping != nil {
+		dst.TrafficShaping = ptr.To(*src.TrafficShaping)
+	}
+	if dst.WireGuardRoamInterval != nil {
+		dst.WireGuardRoamInterval = ptr.To(*src.WireGuardRoamInterval)
+	}
+	dst.AllowedSources = append(src.AllowedSources[:0:0], src.AllowedSources...)
+	if dst.DNSTTLOverride != nil {
+		dst.DNSTTLOverride = ptr.To(*src.DNSTTLOverride)
+	}
+	dst.ExitNodeFallbacks = append(src.ExitNodeFallbacks[:0:0], src.ExitNodeFallbacks...)
+	if dst.RoutePropagationFilter != nil {
+		dst.RoutePropagationFilter = ptr.To(*src.RoutePropagationFilter)
+	}
+	dst.LocalForwardPorts = append(src.LocalForwardPorts[:0:0], src.LocalForwardPorts...)
+	dst.SSHTrustedUserCAKeys = append(src.SSHTrustedUserCAKeys[:0:0], src.SSHTrustedUserCAKeys...)
 	dst.Persist = src.Persist.Clone()
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _PrefsCloneNeedsRegeneration = Prefs(struct {
-	ControlURL             string
-	RouteAll               bool
-	AllowSingleHosts       bool
-	ExitNodeID             tailcfg.StableNodeID
-	ExitNodeIP             netip.Addr
-	ExitNodeAllowLANAccess bool
-	CorpDNS                bool
-	RunSSH                 bool
-	WantRunning            bool
-	LoggedOut              bool
-	ShieldsUp              bool
-	AdvertiseTags          []string
-	Hostname               string
-	NotepadURLs            bool
-	ForceDaemon            bool
-	Egg                    bool
-	AdvertiseRoutes        []netip.Prefix
-	NoSNAT                 bool
-	NetfilterMode          preftype.NetfilterMode
-	OperatorUser           string
-	ProfileName            string
-	AutoUpdate             AutoUpdatePrefs
-	PostureChecking        bool
-	Persist                *persist.Persist
+	ControlURL                  string
+	RouteAll                    bool
+	AllowSingleHosts            bool
+	ExitNodeID                  tailcfg.StableNodeID
+	ExitNodeIP                  netip.Addr
+	ExitNodeAllowLANAccess      bool
+	CorpDNS                     bool
+	RunSSH                      bool
+	WantRunning                 bool
+	LoggedOut                   bool
+	ShieldsUp                   bool
+	AdvertiseTags               []string
+	Hostname                    string
+	NotepadURLs                 bool
+	ForceDaemon                 bool
+	Egg                         bool
+	AdvertiseRoutes             []netip.Prefix
+	NoSNAT                      bool
+	NetfilterMode               preftype.NetfilterMode
+	OperatorUser                string
+	ProfileName                 string
+	AutoUpdate                  AutoUpdatePrefs
+	PostureChecking             bool
+	TailscaleSSHMaxSessions     int
+	StatsInterval               *time.Duration
+	ExitNodeIDs                 []tailcfg.StableNodeID
+	ExitNodeRotate              bool
+	ExitNodeRotateInterval      time.Duration
+	NoControlURLNormalizeOnLoad bool
+	PrivacyMode                 string
+	SSHCertAuth                 bool
+	NameserverPolicy            string
+	ProfileDescription          string
+	Interface                   string
+	TunnelProtocol              string
+	TailnetName                 string
+	ShieldsUpMode               string
+	PeerRoutePropagation        bool
+	WireGuardPQEnabled          bool
+	CacheDNSFor                 []string
+	CacheDNSTTL                 time.Duration
+	UserspaceSockets            bool
+	AuditLog                    bool
+	AuditLogPath                string
+	LocallyServedPorts          []uint16
+	KeepAliveOnSuspend          bool
+	MetricsPort                 uint16
+	RouteAllFilter              *netip.Prefix
+	TrafficShaping              *TrafficShapingPrefs
+	TailscaleIPv4Only           bool
+	TailscaleIPv6Only           bool
+	DiagnosticsEnabled          bool
+	DiagnosticsUploadURL        string
+	WireGuardRoamInterval       *time.Duration
+	PeerMetricsEnabled          bool
+	AllowedSources              []netip.Prefix
+	TailscaleZoneID             string
+	HeadscaleCompatibility      bool
+	SchemaVersion               int
+	DNSTTLOverride              *time.Duration
+	MaxLogLineLength            int
+	ConnectionPriorityMode      string
+	PostureCheckPolicy          string
+	PacketFilterLogging         bool
+	ExitNodeCountry             string
+	SSHKeyPath                  string
+	ExitNodeFallbacks           []tailcfg.StableNodeID
+	RoutePropagationFilter      *netip.Prefix
+	LocalForwardPorts           []ForwardPort
+	SSHTrustedUserCAKeys        []string
+	Persist                     *persist.Persist
 }{})
 
 // Clone makes a deep copy of ServeConfig.
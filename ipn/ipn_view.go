@@ -9,6 +9,7 @@
 	"encoding/json"
 	"errors"
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
@@ -86,36 +87,184 @@ func (v PrefsView) NoSNAT() bool                          { return v.ж.NoSNAT }
 func (v PrefsView) NetfilterMode() preftype.NetfilterMode { return v.ж.NetfilterMode }
 func (v PrefsView) OperatorUser() string                  { return v.ж.OperatorUser }
 func (v PrefsView) ProfileName() string                   { return v.ж.ProfileName }
-func (v PrefsView) AutoUpdate() AutoUpdatePrefs           { return v.ж.AutoUpdate }
+func (v PrefsView) AutoUpdate() AutoUpdatePrefs           { return *v.ж.AutoUpdate.Clone() }
 func (v PrefsView) PostureChecking() bool                 { return v.ж.PostureChecking }
-func (v PrefsView) Persist() persist.PersistView          { return v.ж.Persist.View() }
+func (v PrefsView) TailscaleSSHMaxSessions() int          { return v.ж.TailscaleSSHMaxSessions }
+func (v PrefsView) StatsInterval() *time.Duration {
+	if v.ж.StatsInterval == nil {
+		return nil
+	}
+	x := *v.ж.StatsInterval
+	return &x
+}
+
+func (v PrefsView) ExitNodeIDs() views.Slice[tailcfg.StableNodeID] {
+	return views.SliceOf(v.ж.ExitNodeIDs)
+}
+func (v PrefsView) ExitNodeRotate() bool                  { return v.ж.ExitNodeRotate }
+func (v PrefsView) ExitNodeRotateInterval() time.Duration { return v.ж.ExitNodeRotateInterval }
+func (v PrefsView) NoControlURLNormalizeOnLoad() bool     { return v.ж.NoControlURLNormalizeOnLoad }
+func (v PrefsView) PrivacyMode() string                   { return v.ж.PrivacyMode }
+func (v PrefsView) SSHCertAuth() bool                     { return v.ж.SSHCertAuth }
+func (v PrefsView) NameserverPolicy() string              { return v.ж.NameserverPolicy }
+func (v PrefsView) ProfileDescription() string            { return v.ж.ProfileDescription }
+func (v PrefsView) Interface() string                     { return v.ж.Interface }
+func (v PrefsView) TunnelProtocol() string                { return v.ж.TunnelProtocol }
+func (v PrefsView) TailnetName() string                   { return v.ж.TailnetName }
+func (v PrefsView) ShieldsUpMode() string                 { return v.ж.ShieldsUpMode }
+func (v PrefsView) PeerRoutePropagation() bool            { return v.ж.PeerRoutePropagation }
+func (v PrefsView) WireGuardPQEnabled() bool              { return v.ж.WireGuardPQEnabled }
+func (v PrefsView) CacheDNSFor() views.Slice[string]      { return views.SliceOf(v.ж.CacheDNSFor) }
+func (v PrefsView) CacheDNSTTL() time.Duration            { return v.ж.CacheDNSTTL }
+func (v PrefsView) UserspaceSockets() bool                { return v.ж.UserspaceSockets }
+func (v PrefsView) AuditLog() bool                        { return v.ж.AuditLog }
+func (v PrefsView) AuditLogPath() string                  { return v.ж.AuditLogPath }
+func (v PrefsView) LocallyServedPorts() views.Slice[uint16] {
+	return views.SliceOf(v.ж.LocallyServedPorts)
+}
+func (v PrefsView) KeepAliveOnSuspend() bool { return v.ж.KeepAliveOnSuspend }
+func (v PrefsView) MetricsPort() uint16      { return v.ж.MetricsPort }
+func (v PrefsView) RouteAllFilter() *netip.Prefix {
+	if v.ж.RouteAllFilter == nil {
+		return nil
+	}
+	x := *v.ж.RouteAllFilter
+	return &x
+}
+
+func (v PrefsView) TrafficShaping() *TrafficShapingPrefs {
+	if v.ж.TrafficShaping == nil {
+		return nil
+	}
+	x := *v.ж.TrafficShaping
+	return &x
+}
+
+func (v PrefsView) TailscaleIPv4Only() bool      { return v.ж.TailscaleIPv4Only }
+func (v PrefsView) TailscaleIPv6Only() bool      { return v.ж.TailscaleIPv6Only }
+func (v PrefsView) DiagnosticsEnabled() bool     { return v.ж.DiagnosticsEnabled }
+func (v PrefsView) DiagnosticsUploadURL() string { return v.ж.DiagnosticsUploadURL }
+func (v PrefsView) WireGuardRoamInterval() *time.Duration {
+	if v.ж.WireGuardRoamInterval == nil {
+		return nil
+	}
+	x := *v.ж.WireGuardRoamInterval
+	return &x
+}
+
+func (v PrefsView) PeerMetricsEnabled() bool { return v.ж.PeerMetricsEnabled }
+func (v PrefsView) AllowedSources() views.Slice[netip.Prefix] {
+	return views.SliceOf(v.ж.AllowedSources)
+}
+func (v PrefsView) TailscaleZoneID() string      { return v.ж.TailscaleZoneID }
+func (v PrefsView) HeadscaleCompatibility() bool { return v.ж.HeadscaleCompatibility }
+func (v PrefsView) SchemaVersion() int           { return v.ж.SchemaVersion }
+func (v PrefsView) DNSTTLOverride() *time.Duration {
+	if v.ж.DNSTTLOverride == nil {
+		return nil
+	}
+	x := *v.ж.DNSTTLOverride
+	return &x
+}
+
+func (v PrefsView) MaxLogLineLength() int          { return v.ж.MaxLogLineLength }
+func (v PrefsView) ConnectionPriorityMode() string { return v.ж.ConnectionPriorityMode }
+func (v PrefsView) PostureCheckPolicy() string     { return v.ж.PostureCheckPolicy }
+func (v PrefsView) PacketFilterLogging() bool      { return v.ж.PacketFilterLogging }
+func (v PrefsView) ExitNodeCountry() string        { return v.ж.ExitNodeCountry }
+func (v PrefsView) SSHKeyPath() string             { return v.ж.SSHKeyPath }
+func (v PrefsView) ExitNodeFallbacks() views.Slice[tailcfg.StableNodeID] {
+	return views.SliceOf(v.ж.ExitNodeFallbacks)
+}
+func (v PrefsView) RoutePropagationFilter() *netip.Prefix {
+	if v.ж.RoutePropagationFilter == nil {
+		return nil
+	}
+	x := *v.ж.RoutePropagationFilter
+	return &x
+}
+
+func (v PrefsView) LocalForwardPorts() views.Slice[ForwardPort] {
+	return views.SliceOf(v.ж.LocalForwardPorts)
+}
+func (v PrefsView) SSHTrustedUserCAKeys() views.Slice[string] {
+	return views.SliceOf(v.ж.SSHTrustedUserCAKeys)
+}
+func (v PrefsView) Persist() persist.PersistView { return v.ж.Persist.View() }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _PrefsViewNeedsRegeneration = Prefs(struct {
-	ControlURL             string
-	RouteAll               bool
-	AllowSingleHosts       bool
-	ExitNodeID             tailcfg.StableNodeID
-	ExitNodeIP             netip.Addr
-	ExitNodeAllowLANAccess bool
-	CorpDNS                bool
-	RunSSH                 bool
-	WantRunning            bool
-	LoggedOut              bool
-	ShieldsUp              bool
-	AdvertiseTags          []string
-	Hostname               string
-	NotepadURLs            bool
-	ForceDaemon            bool
-	Egg                    bool
-	AdvertiseRoutes        []netip.Prefix
-	NoSNAT                 bool
-	NetfilterMode          preftype.NetfilterMode
-	OperatorUser           string
-	ProfileName            string
-	AutoUpdate             AutoUpdatePrefs
-	PostureChecking        bool
-	Persist                *persist.Persist
+	ControlURL                  string
+	RouteAll                    bool
+	AllowSingleHosts            bool
+	ExitNodeID                  tailcfg.StableNodeID
+	ExitNodeIP                  netip.Addr
+	ExitNodeAllowLANAccess      bool
+	CorpDNS                     bool
+	RunSSH                      bool
+	WantRunning                 bool
+	LoggedOut                   bool
+	ShieldsUp                   bool
+	AdvertiseTags               []string
+	Hostname                    string
+	NotepadURLs                 bool
+	ForceDaemon                 bool
+	Egg                         bool
+	AdvertiseRoutes             []netip.Prefix
+	NoSNAT                      bool
+	NetfilterMode               preftype.NetfilterMode
+	OperatorUser                string
+	ProfileName                 string
+	AutoUpdate                  AutoUpdatePrefs
+	PostureChecking             bool
+	TailscaleSSHMaxSessions     int
+	StatsInterval               *time.Duration
+	ExitNodeIDs                 []tailcfg.StableNodeID
+	ExitNodeRotate              bool
+	ExitNodeRotateInterval      time.Duration
+	NoControlURLNormalizeOnLoad bool
+	PrivacyMode                 string
+	SSHCertAuth                 bool
+	NameserverPolicy            string
+	ProfileDescription          string
+	Interface                   string
+	TunnelProtocol              string
+	TailnetName                 string
+	ShieldsUpMode               string
+	PeerRoutePropagation        bool
+	WireGuardPQEnabled          bool
+	CacheDNSFor                 []string
+	CacheDNSTTL                 time.Duration
+	UserspaceSockets            bool
+	AuditLog                    bool
+	AuditLogPath                string
+	LocallyServedPorts          []uint16
+	KeepAliveOnSuspend          bool
+	MetricsPort                 uint16
+	RouteAllFilter              *netip.Prefix
+	TrafficShaping              *TrafficShapingPrefs
+	TailscaleIPv4Only           bool
+	TailscaleIPv6Only           bool
+	DiagnosticsEnabled          bool
+	DiagnosticsUploadURL        string
+	WireGuardRoamInterval       *time.Duration
+	PeerMetricsEnabled          bool
+	AllowedSources              []netip.Prefix
+	TailscaleZoneID             string
+	HeadscaleCompatibility      bool
+	SchemaVersion               int
+	DNSTTLOverride              *time.Duration
+	MaxLogLineLength            int
+	ConnectionPriorityMode      string
+	PostureCheckPolicy          string
+	PacketFilterLogging         bool
+	ExitNodeCountry             string
+	SSHKeyPath                  string
+	ExitNodeFallbacks           []tailcfg.StableNodeID
+	RoutePropagationFilter      *netip.Prefix
+	LocalForwardPorts           []ForwardPort
+	SSHTrustedUserCAKeys        []string
+	Persist                     *persist.Persist
 }{})
 
 // View returns a readonly view of ServeConfig.
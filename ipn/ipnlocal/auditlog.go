@@ -0,0 +1,279 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/key"
+)
+
+// prefsAuditRecord is a single line of the prefs audit log enabled by
+// ipn.Prefs.AuditLog.
+//
+// Records form a chain: each one holds the MAC of the record before it, so
+// that modifying, removing or reordering records is detected by
+// verifyPrefsAuditLog.
+type prefsAuditRecord struct {
+	Time time.Time
+	// Changed maps the name of each changed ipn.Prefs field to its new
+	// value, as JSON.
+	Changed map[string]json.RawMessage
+	// Prev is the MAC of the previous record, or empty for the first one.
+	Prev string
+	// MAC is the hex HMAC-SHA256 of the JSON encoding of this record with
+	// an empty MAC, keyed by prefsAuditKey.
+	MAC string
+}
+
+// prefsAuditKey derives the audit log HMAC key from the machine key.
+func prefsAuditKey(mk key.MachinePrivate) ([]byte, error) {
+	text, err := mk.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	io.WriteString(h, "tailscale prefs audit log v1\n")
+	h.Write(text)
+	return h.Sum(nil), nil
+}
+
+// mac returns the hex MAC of r, ignoring r.MAC.
+func (r prefsAuditRecord) mac(hmacKey []byte) (string, error) {
+	r.MAC = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, hmacKey)
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// changedPrefsFields returns the ipn.Prefs fields that differ between
+// oldp and newp, as found by ipn.Prefs.ChangedFields, mapped to their new
+// values. The values are taken from newp.SanitizeForExport, so that the log
+// records that OperatorUser or DiagnosticsUploadURL changed without holding
+// the user name or upload credentials.
+func changedPrefsFields(oldp, newp *ipn.Prefs) (map[string]json.RawMessage, error) {
+	names := oldp.ChangedFields(newp)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sv := reflect.ValueOf(newp.SanitizeForExport()).Elem()
+	changed := make(map[string]json.RawMessage, len(names))
+	for _, name := range names {
+		b, err := json.Marshal(sv.FieldByName(name).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		changed[name] = b
+	}
+	return changed, nil
+}
+
+// checkPrefsAuditLogPath reports an error if path, an ipn.Prefs.AuditLogPath,
+// is not within varRoot, the tailscaled state directory. Keeping the log
+// there stops local users who may edit prefs from having tailscaled, which
+// often runs as root, create or append to files elsewhere.
+func checkPrefsAuditLogPath(varRoot, path string) error {
+	if varRoot == "" {
+		return errors.New("AuditLogPath requires a tailscaled state directory")
+	}
+	rel, err := filepath.Rel(filepath.Clean(varRoot), filepath.Clean(path))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("AuditLogPath %q must be within the state directory %q", path, varRoot)
+	}
+	return nil
+}
+
+// lastPrefsAuditMAC returns the MAC of the last record in the audit log
+// read from r, or the empty string if the log is empty.
+func lastPrefsAuditMAC(r io.Reader) (string, error) {
+	var last []byte
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if line := bytes.TrimSpace(sc.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	if last == nil {
+		return "", nil
+	}
+	var rec prefsAuditRecord
+	if err := json.Unmarshal(last, &rec); err != nil {
+		return "", fmt.Errorf("parsing last record: %w", err)
+	}
+	return rec.MAC, nil
+}
+
+// prefsAuditTail is the end of a prefs audit log as of the last append to
+// it, so that the next append needn't rescan the log for the previous MAC.
+type prefsAuditTail struct {
+	path string
+	size int64 // size of the log after the last append
+	mac  string
+}
+
+// appendPrefsAuditLog appends a record of the changes from oldp to newp, made
+// at now, to the audit log at path. It does nothing if no fields changed.
+// The log is opened with openPrefsAuditLog, which refuses symlinks and files
+// that tailscaled doesn't own.
+//
+// tail is the log's end as of the previous append, and is updated. If it's
+// for a different path, or the log has since changed size, the previous MAC
+// is instead read from the log with lastPrefsAuditMAC.
+func appendPrefsAuditLog(path string, hmacKey []byte, oldp, newp *ipn.Prefs, now time.Time, tail *prefsAuditTail) error {
+	changed, err := changedPrefsFields(oldp, newp)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := openPrefsAuditLog(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	prev := tail.mac
+	if tail.path != path || tail.size != fi.Size() {
+		if prev, err = lastPrefsAuditMAC(f); err != nil {
+			return err
+		}
+	}
+	r := prefsAuditRecord{
+		Time:    now.UTC(),
+		Changed: changed,
+		Prev:    prev,
+	}
+	if r.MAC, err = r.mac(hmacKey); err != nil {
+		return err
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	*tail = prefsAuditTail{} // in case the write fails partway
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	*tail = prefsAuditTail{path: path, size: fi.Size() + int64(len(line)), mac: r.MAC}
+	return nil
+}
+
+var errPrefsAuditLogTampered = errors.New("prefs audit log failed verification")
+
+// verifyPrefsAuditLog reads a prefs audit log from r and reports an error
+// wrapping errPrefsAuditLogTampered if any record's MAC is wrong or the
+// chain of records is broken.
+func verifyPrefsAuditLog(r io.Reader, hmacKey []byte) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	prev := ""
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec prefsAuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("%w: record %d: %v", errPrefsAuditLogTampered, n, err)
+		}
+		if rec.Prev != prev {
+			return fmt.Errorf("%w: record %d: chain broken", errPrefsAuditLogTampered, n)
+		}
+		want, err := rec.mac(hmacKey)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal([]byte(rec.MAC), []byte(want)) {
+			return fmt.Errorf("%w: record %d: bad MAC", errPrefsAuditLogTampered, n)
+		}
+		prev = rec.MAC
+	}
+	return sc.Err()
+}
+
+// prefsAuditLogWriterLocked returns a func that appends the change from oldp
+// to newp to the prefs audit log, or nil if neither has ipn.Prefs.AuditLog
+// set. The record goes to newp's log or, when the audit log is being turned
+// off, to oldp's. Errors are logged, not returned, so that they don't block
+// the prefs change.
+//
+// b.mu must be held. The returned func does file I/O, so it must be called
+// without b.mu held.
+func (b *LocalBackend) prefsAuditLogWriterLocked(oldp, newp ipn.PrefsView) func() {
+	var path string
+	switch {
+	case newp.AuditLog():
+		path = newp.AuditLogPath()
+	case oldp.Valid() && oldp.AuditLog():
+		path = oldp.AuditLogPath()
+	default:
+		return nil
+	}
+	if err := checkPrefsAuditLogPath(b.TailscaleVarRoot(), path); err != nil {
+		b.logf("prefs audit log: %v", err)
+		return nil
+	}
+	var old *ipn.Prefs
+	if oldp.Valid() {
+		old = oldp.AsStruct()
+	}
+	newPrefs := newp.AsStruct()
+	mk := b.machinePrivKey // normally set by Start
+	now := b.clock.Now()
+	return func() {
+		if mk.IsZero() {
+			b.mu.Lock()
+			err := b.initMachineKeyLocked()
+			mk = b.machinePrivKey
+			b.mu.Unlock()
+			if err != nil {
+				b.logf("prefs audit log: %v", err)
+				return
+			}
+		}
+		hmacKey, err := prefsAuditKey(mk)
+		if err != nil {
+			b.logf("prefs audit log: %v", err)
+			return
+		}
+		b.prefsAuditMu.Lock()
+		defer b.prefsAuditMu.Unlock()
+		if err := appendPrefsAuditLog(path, hmacKey, old, newPrefs, now, &b.prefsAuditTail); err != nil {
+			b.logf("prefs audit log: %v", err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !unix
+
+package ipnlocal
+
+import (
+	"fmt"
+	"os"
+)
+
+// openPrefsAuditLog opens the prefs audit log at path for reading and
+// appending, creating it if needed. It refuses anything but a regular file.
+//
+// TODO: check the file's owner, as the unix version does.
+func openPrefsAuditLog(path string) (*os.File, error) {
+	if fi, err := os.Lstat(path); err == nil && !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	return os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+}
@@ -203,16 +203,60 @@ func (b *LocalBackend) handleC2NUpdatePost(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if w := b.Prefs().AutoUpdate().ApplyWindow; w != nil && !w.Contains(b.clock.Now()) {
+		b.logf("c2n: outside auto-update window %v; deferring update", w)
+		b.clock.AfterFunc(updateWindowRecheckInterval, func() { b.applyDeferredC2NUpdate(cmdTS) })
+		res.Deferred = true
+		return
+	}
+	if err := b.startC2NUpdate(cmdTS); err != nil {
+		res.Err = err.Error()
+		return
+	}
+	res.Started = true
+}
+
+// updateWindowRecheckInterval is how often a c2n update deferred by
+// Prefs.AutoUpdate.ApplyWindow checks whether the window has opened.
+const updateWindowRecheckInterval = 15 * time.Minute
+
+// applyDeferredC2NUpdate starts an update that was deferred because it was
+// requested outside Prefs.AutoUpdate.ApplyWindow, if the window is now
+// open, or else checks again after updateWindowRecheckInterval. The update
+// is dropped if the backend has shut down or auto-updates were disabled in
+// the meantime.
+func (b *LocalBackend) applyDeferredC2NUpdate(cmdTS string) {
+	b.mu.Lock()
+	shutdown := b.shutdownCalled
+	b.mu.Unlock()
+	au := b.Prefs().AutoUpdate()
+	if shutdown || !(envknob.AllowsRemoteUpdate() || au.Apply) {
+		b.logf("c2n: dropping deferred update; auto-updates are off")
+		b.setC2NUpdateStarted(false)
+		return
+	}
+	if w := au.ApplyWindow; w != nil && !w.Contains(b.clock.Now()) {
+		b.clock.AfterFunc(updateWindowRecheckInterval, func() { b.applyDeferredC2NUpdate(cmdTS) })
+		return
+	}
+	if err := b.startC2NUpdate(cmdTS); err != nil {
+		b.logf("c2n: deferred update failed: %v", err)
+		b.setC2NUpdateStarted(false)
+	}
+}
+
+// startC2NUpdate runs "tailscale update" using the cmd/tailscale binary at
+// cmdTS in the background, clearing the c2n update started flag when it
+// finishes.
+func (b *LocalBackend) startC2NUpdate(cmdTS string) error {
 	cmd := exec.Command(cmdTS, "update", "--yes")
 	buf := new(bytes.Buffer)
 	cmd.Stdout = buf
 	cmd.Stderr = buf
 	b.logf("c2n: running %q", strings.Join(cmd.Args, " "))
 	if err := cmd.Start(); err != nil {
-		res.Err = fmt.Sprintf("failed to start cmd/tailscale update: %v", err)
-		return
+		return fmt.Errorf("failed to start cmd/tailscale update: %v", err)
 	}
-	res.Started = true
 
 	// Run update asynchronously and respond that it started.
 	go func() {
@@ -223,6 +267,7 @@ func (b *LocalBackend) handleC2NUpdatePost(w http.ResponseWriter, r *http.Reques
 		}
 		b.setC2NUpdateStarted(false)
 	}()
+	return nil
 }
 
 func (b *LocalBackend) handleC2NPostureIdentityGet(w http.ResponseWriter, r *http.Request) {
@@ -243,7 +288,9 @@ func (b *LocalBackend) handleC2NPostureIdentityGet(w http.ResponseWriter, r *htt
 		)
 	}
 
-	if choice.ShouldEnable(b.Prefs().PostureChecking()) {
+	// Headscale doesn't support posture checking, so never report serial
+	// numbers in Headscale compatibility mode.
+	if choice.ShouldEnable(b.Prefs().PostureChecking()) && !b.Prefs().HeadscaleCompatibility() {
 		sns, err := posture.GetSerialNumbers(b.logf)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -251,6 +298,7 @@ func (b *LocalBackend) handleC2NPostureIdentityGet(w http.ResponseWriter, r *htt
 		}
 
 		res.SerialNumbers = sns
+		res.PostureCheckPolicy = b.Prefs().PostureCheckPolicy()
 	} else {
 		res.PostureDisabled = true
 	}
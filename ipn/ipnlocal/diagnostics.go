@@ -0,0 +1,194 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/hostinfo"
+	"tailscale.com/ipn"
+	"tailscale.com/net/tshttpproxy"
+	"tailscale.com/tailcfg"
+	"tailscale.com/version"
+)
+
+const (
+	// diagnosticsCheckInterval is how often the diagnostics uploader
+	// checks connectivity.
+	diagnosticsCheckInterval = 30 * time.Second
+
+	// diagnosticsLossThreshold is how long connectivity must have been
+	// lost before a diagnostics bundle is uploaded.
+	diagnosticsLossThreshold = 5 * time.Minute
+
+	// diagnosticsUploadTimeout bounds a single diagnostics upload.
+	diagnosticsUploadTimeout = 30 * time.Second
+)
+
+// diagnosticsUploader is the background uploader enabled by
+// ipn.Prefs.DiagnosticsEnabled.
+type diagnosticsUploader struct {
+	url    string
+	cancel context.CancelFunc
+}
+
+// diagnosticsTrigger decides when to upload a diagnostics bundle: once per
+// outage, after connectivity has been lost for diagnosticsLossThreshold.
+type diagnosticsTrigger struct {
+	lostSince time.Time // when the current outage began, or zero if healthy
+	uploaded  bool      // whether a bundle was uploaded for the current outage
+}
+
+// update records whether connectivity was healthy at now, and reports
+// whether a diagnostics bundle should be uploaded.
+func (t *diagnosticsTrigger) update(now time.Time, healthy bool) bool {
+	if healthy {
+		*t = diagnosticsTrigger{}
+		return false
+	}
+	if t.lostSince.IsZero() {
+		t.lostSince = now
+	}
+	if t.uploaded || now.Sub(t.lostSince) < diagnosticsLossThreshold {
+		return false
+	}
+	t.uploaded = true
+	return true
+}
+
+// diagnosticsBundle is the JSON body of a diagnostics upload.
+type diagnosticsBundle struct {
+	Time      time.Time
+	LostSince time.Time
+	Version   string
+	Hostinfo  *tailcfg.Hostinfo
+	State     string
+	NodeID    tailcfg.StableNodeID `json:",omitempty"`
+	Health    string               `json:",omitempty"`
+}
+
+// postDiagnostics uploads body to url using c. It is overridden by tests.
+var postDiagnostics = func(ctx context.Context, c *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %v", res.Status)
+	}
+	return nil
+}
+
+// newDiagnosticsHTTPClient returns the HTTP client for diagnostics uploads.
+// Like the control client's, it dials with the backend's system dialer,
+// outside the tailnet, and honors the system's HTTP proxy settings, so that
+// uploads work when connectivity through Tailscale is what's lost.
+func (b *LocalBackend) newDiagnosticsHTTPClient() *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = tshttpproxy.ProxyFromEnvironment
+	tshttpproxy.SetTransportGetProxyConnectHeader(tr)
+	tr.DialContext = b.Dialer().SystemDial
+	return &http.Client{
+		Transport: tr,
+		Timeout:   diagnosticsUploadTimeout,
+	}
+}
+
+// updateDiagnosticsLocked starts or stops the diagnostics uploader so that
+// it runs only if p enables it with an upload URL, restarting it if the URL
+// changed.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateDiagnosticsLocked(p ipn.PrefsView) {
+	var url string
+	if p.Valid() && p.DiagnosticsEnabled() {
+		url = p.DiagnosticsUploadURL()
+	}
+	if b.diagnostics != nil {
+		if b.diagnostics.url == url {
+			return
+		}
+		b.stopDiagnosticsLocked()
+	}
+	if url == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(b.ctx)
+	b.diagnostics = &diagnosticsUploader{url: url, cancel: cancel}
+	go b.runDiagnosticsUploader(ctx, url)
+}
+
+// stopDiagnosticsLocked stops the diagnostics uploader, if it is running.
+//
+// b.mu must be held.
+func (b *LocalBackend) stopDiagnosticsLocked() {
+	if b.diagnostics == nil {
+		return
+	}
+	b.diagnostics.cancel()
+	b.diagnostics = nil
+}
+
+// runDiagnosticsUploader periodically checks connectivity and uploads a
+// diagnostics bundle to url after an extended loss, until ctx is done.
+func (b *LocalBackend) runDiagnosticsUploader(ctx context.Context, url string) {
+	ticker, tickerChannel := b.clock.NewTicker(diagnosticsCheckInterval)
+	defer ticker.Stop()
+	c := b.newDiagnosticsHTTPClient()
+	defer c.CloseIdleConnections()
+	var trigger diagnosticsTrigger
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tickerChannel:
+			if trigger.update(now, health.OverallError() == nil) {
+				b.uploadDiagnostics(ctx, c, url, trigger.lostSince)
+			}
+		}
+	}
+}
+
+// uploadDiagnostics uploads a diagnostics bundle describing an outage that
+// began at lostSince to url using c, logging any failure.
+func (b *LocalBackend) uploadDiagnostics(ctx context.Context, c *http.Client, url string, lostSince time.Time) {
+	bundle := diagnosticsBundle{
+		Time:      b.clock.Now().UTC(),
+		LostSince: lostSince.UTC(),
+		Version:   version.Long(),
+		Hostinfo:  hostinfo.New(),
+	}
+	if err := health.OverallError(); err != nil {
+		bundle.Health = err.Error()
+	}
+	b.mu.Lock()
+	bundle.State = b.state.String()
+	if nm := b.netMap; nm != nil && nm.SelfNode.Valid() {
+		bundle.NodeID = nm.SelfNode.StableID()
+	}
+	b.mu.Unlock()
+
+	body, err := json.Marshal(bundle)
+	if err != nil {
+		b.logf("diagnostics: %v", err)
+		return
+	}
+	if err := postDiagnostics(ctx, c, url, body); err != nil {
+		b.logf("diagnostics upload failed: %v", err)
+		return
+	}
+	b.logf("diagnostics: uploaded bundle for connectivity lost since %v", lostSince.Format(time.RFC3339))
+}
@@ -8,6 +8,7 @@
 	"net/netip"
 	"reflect"
 	"testing"
+	"time"
 
 	"tailscale.com/ipn"
 	"tailscale.com/net/dns"
@@ -15,6 +16,7 @@
 	"tailscale.com/tstest"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/ptr"
 	"tailscale.com/util/cloudenv"
 	"tailscale.com/util/cmpx"
 	"tailscale.com/util/dnsname"
@@ -327,12 +329,121 @@ func TestDNSConfigForNetmap(t *testing.T) {
 				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
 			},
 		},
+		{
+			name: "nameserver_policy_auto_follows_corp_dns",
+			nm: &netmap.NetworkMap{
+				DNS: tailcfg.DNSConfig{
+					Domains: []string{"example.com"},
+				},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS:          false,
+				NameserverPolicy: ipn.NameserverPolicyAuto,
+			},
+			want: &dns.Config{
+				Hosts:  map[dnsname.FQDN][]netip.Addr{},
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+			},
+		},
+		{
+			name: "nameserver_policy_system_only",
+			nm: &netmap.NetworkMap{
+				DNS: tailcfg.DNSConfig{
+					Domains:   []string{"example.com"},
+					Resolvers: []*dnstype.Resolver{{Addr: "8.8.8.8"}},
+				},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS:          true,
+				NameserverPolicy: ipn.NameserverPolicySystemOnly,
+			},
+			want: &dns.Config{
+				Hosts:  map[dnsname.FQDN][]netip.Addr{},
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+			},
+		},
+		{
+			name: "nameserver_policy_tailscale_only",
+			nm: &netmap.NetworkMap{
+				DNS: tailcfg.DNSConfig{
+					Domains: []string{"example.com"},
+					FallbackResolvers: []*dnstype.Resolver{
+						{Addr: "8.8.4.4"},
+					},
+				},
+			},
+			prefs: &ipn.Prefs{
+				CorpDNS:          false,
+				NameserverPolicy: ipn.NameserverPolicyTailscaleOnly,
+			},
+			want: &dns.Config{
+				Hosts:         map[dnsname.FQDN][]netip.Addr{},
+				Routes:        map[dnsname.FQDN][]*dnstype.Resolver{},
+				SearchDomains: []dnsname.FQDN{"example.com."},
+				DefaultResolvers: []*dnstype.Resolver{
+					{Addr: "8.8.4.4"},
+				},
+			},
+		},
+		{
+			name: "cache_dns_for_default_ttl",
+			nm:   &netmap.NetworkMap{},
+			prefs: &ipn.Prefs{
+				CorpDNS:     true,
+				CacheDNSFor: []string{"*.example.com"},
+			},
+			want: &dns.Config{
+				Hosts:        map[dnsname.FQDN][]netip.Addr{},
+				Routes:       map[dnsname.FQDN][]*dnstype.Resolver{},
+				CacheDomains: []string{"*.example.com"},
+				CacheTTL:     ipn.DefaultCacheDNSTTL,
+			},
+		},
+		{
+			name: "cache_dns_for_custom_ttl",
+			nm:   &netmap.NetworkMap{},
+			prefs: &ipn.Prefs{
+				CorpDNS:     true,
+				CacheDNSFor: []string{"*.example.com"},
+				CacheDNSTTL: time.Minute,
+			},
+			want: &dns.Config{
+				Hosts:        map[dnsname.FQDN][]netip.Addr{},
+				Routes:       map[dnsname.FQDN][]*dnstype.Resolver{},
+				CacheDomains: []string{"*.example.com"},
+				CacheTTL:     time.Minute,
+			},
+		},
+		{
+			name: "dns_ttl_override",
+			nm:   &netmap.NetworkMap{},
+			prefs: &ipn.Prefs{
+				CorpDNS:        true,
+				DNSTTLOverride: ptr.To(30 * time.Second),
+			},
+			want: &dns.Config{
+				Hosts:       map[dnsname.FQDN][]netip.Addr{},
+				Routes:      map[dnsname.FQDN][]*dnstype.Resolver{},
+				TTLOverride: 30 * time.Second,
+			},
+		},
+		{
+			name: "cache_dns_for_without_corp_dns",
+			nm:   &netmap.NetworkMap{},
+			prefs: &ipn.Prefs{
+				CacheDNSFor: []string{"*.example.com"},
+			},
+			want: &dns.Config{
+				Hosts:  map[dnsname.FQDN][]netip.Addr{},
+				Routes: map[dnsname.FQDN][]*dnstype.Resolver{},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			verOS := cmpx.Or(tt.os, "linux")
 			var log tstest.MemLogger
-			got := dnsConfigForNetmap(tt.nm, peersMap(tt.peers), tt.prefs.View(), log.Logf, verOS)
+			got := dnsConfigForNetmap(tt.nm, peersMap(tt.peers), tt.prefs.View(), 0, log.Logf, verOS)
 			if !reflect.DeepEqual(got, tt.want) {
 				gotj, _ := json.MarshalIndent(got, "", "\t")
 				wantj, _ := json.MarshalIndent(tt.want, "", "\t")
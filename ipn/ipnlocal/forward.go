@@ -0,0 +1,200 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/util/mak"
+	"tailscale.com/util/multierr"
+	"tailscale.com/util/set"
+)
+
+// portForwardDialTimeout is how long a connection accepted for an entry of
+// ipn.Prefs.LocalForwardPorts waits to connect to the peer.
+const portForwardDialTimeout = 30 * time.Second
+
+// warnPortForwards is set when some entries of ipn.Prefs.LocalForwardPorts
+// can't listen on their local port.
+var warnPortForwards = health.NewWarnable(health.WithMapDebugFlag("warn-local-forward-ports-unhealthy"))
+
+// updatePortForwardsLocked starts and stops listeners on 127.0.0.1 so that
+// there is one for each entry of p.LocalForwardPorts, or none if p is
+// invalid. Listeners for entries that didn't change keep running, and
+// connections already accepted are not interrupted by removing their
+// entry.
+//
+// New entries are recorded with a nil listener, and listening for them is
+// left to the returned func, if non-nil, which the caller must run once it
+// has released b.mu.
+//
+// b.mu must be held.
+func (b *LocalBackend) updatePortForwardsLocked(p ipn.PrefsView) (start func()) {
+	want := set.Set[ipn.ForwardPort]{}
+	if p.Valid() {
+		fps := p.LocalForwardPorts()
+		for i := 0; i < fps.Len(); i++ {
+			want.Add(fps.At(i))
+		}
+	}
+	// Close removed listeners first, so that a changed entry can reuse
+	// its local port.
+	for fp, ln := range b.portForwards {
+		if !want.Contains(fp) {
+			if ln != nil {
+				ln.Close()
+			}
+			delete(b.portForwards, fp)
+		}
+	}
+	var added []ipn.ForwardPort
+	for fp := range want {
+		if _, ok := b.portForwards[fp]; ok {
+			continue
+		}
+		mak.Set(&b.portForwards, fp, nil)
+		added = append(added, fp)
+	}
+	if len(added) == 0 {
+		// Entries that failed to listen were dropped from
+		// b.portForwards, so every wanted entry is listening or about
+		// to be.
+		warnPortForwards.Set(nil)
+		return nil
+	}
+	return func() { b.startPortForwards(added) }
+}
+
+// startPortForwards listens for each of fps and serves connections on
+// them, skipping entries removed in the meantime. Failures to listen are
+// reported as a health warning, and the entries are tried again on the
+// next prefs change.
+//
+// b.mu must not be held.
+func (b *LocalBackend) startPortForwards(fps []ipn.ForwardPort) {
+	lns := make([]net.Listener, len(fps))
+	errs := make([]error, len(fps))
+	for i, fp := range fps {
+		lns[i], errs[i] = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(fp.LocalPort))))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var failed []error
+	for i, fp := range fps {
+		ln, err := lns[i], errs[i]
+		if cur, ok := b.portForwards[fp]; !ok || cur != nil {
+			if ln != nil {
+				ln.Close()
+			}
+			continue
+		}
+		if err != nil {
+			b.logf("port forward %v: %v", fp, err)
+			failed = append(failed, fmt.Errorf("port forward %v: %w", fp, err))
+			delete(b.portForwards, fp)
+			continue
+		}
+		b.portForwards[fp] = ln
+		b.logf("port forward %v listening on %v", fp, ln.Addr())
+		go b.servePortForward(ln, fp)
+	}
+	warnPortForwards.Set(multierr.New(failed...))
+}
+
+// stopPortForwardsLocked closes all port forwarding listeners.
+//
+// b.mu must be held.
+func (b *LocalBackend) stopPortForwardsLocked() {
+	for fp, ln := range b.portForwards {
+		if ln != nil {
+			ln.Close()
+		}
+		delete(b.portForwards, fp)
+	}
+}
+
+// servePortForward accepts connections on ln, the listener for fp, until
+// it is closed.
+func (b *LocalBackend) servePortForward(ln net.Listener, fp ipn.ForwardPort) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				b.logf("port forward %v: %v", fp, err)
+			}
+			return
+		}
+		go b.forwardConn(c, fp)
+	}
+}
+
+// forwardConn relays c, accepted by the listener for fp, to fp's peer and
+// port, closing both connections once either side is done.
+func (b *LocalBackend) forwardConn(c net.Conn, fp ipn.ForwardPort) {
+	defer c.Close()
+	addr, err := b.portForwardAddr(fp)
+	if err != nil {
+		b.logf("port forward %v: %v", fp, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), portForwardDialTimeout)
+	dst, err := b.dialer.UserDial(ctx, "tcp", addr.String())
+	cancel()
+	if err != nil {
+		b.logf("port forward %v: %v", fp, err)
+		return
+	}
+	defer dst.Close()
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(dst, c)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(c, dst)
+		errc <- err
+	}()
+	<-errc
+}
+
+// portForwardAddr returns the address that connections for fp are
+// forwarded to: fp.RemotePort on a Tailscale IP of fp.RemotePeer,
+// preferring IPv4.
+func (b *LocalBackend) portForwardAddr(fp ipn.ForwardPort) (netip.AddrPort, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap == nil {
+		return netip.AddrPort{}, errors.New("no netmap")
+	}
+	peer, ok := b.netMap.PeerWithStableID(fp.RemotePeer)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("peer %v not found", fp.RemotePeer)
+	}
+	var ip netip.Addr
+	addrs := peer.Addresses()
+	for i := 0; i < addrs.Len(); i++ {
+		a := addrs.At(i)
+		if !a.IsSingleIP() || !tsaddr.IsTailscaleIP(a.Addr()) {
+			continue
+		}
+		if !ip.IsValid() || (a.Addr().Is4() && !ip.Is4()) {
+			ip = a.Addr()
+		}
+	}
+	if !ip.IsValid() {
+		return netip.AddrPort{}, fmt.Errorf("peer %v has no Tailscale IP", fp.RemotePeer)
+	}
+	return netip.AddrPortFrom(ip, fp.RemotePort), nil
+}
@@ -59,6 +59,7 @@
 	"tailscale.com/net/netutil"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/net/tstun"
 	"tailscale.com/paths"
 	"tailscale.com/portlist"
 	"tailscale.com/syncs"
@@ -154,6 +155,7 @@ type LocalBackend struct {
 	logf                  logger.Logf        // general logging
 	keyLogf               logger.Logf        // for printing list of peers on change
 	statsLogf             logger.Logf        // for printing peers stats on change
+	maxLogLineLen         *atomic.Int64      // line length cap of logf, from prefs; or nil if uncapped
 	sys                   *tsd.System
 	e                     wgengine.Engine // non-nil; TODO(bradfitz): remove; use sys
 	store                 ipn.StateStore  // non-nil; TODO(bradfitz): remove; use sys
@@ -197,14 +199,23 @@ type LocalBackend struct {
 	shouldInterceptTCPPortAtomic syncs.AtomicValue[func(uint16) bool]
 	numClientStatusCalls         atomic.Uint32
 
+	// prefsAuditMu serializes appends to the prefs audit log, which are
+	// made without mu held, and guards prefsAuditTail.
+	prefsAuditMu   sync.Mutex
+	prefsAuditTail prefsAuditTail
+
 	// The mutex protects the following elements.
 	mu             sync.Mutex
 	conf           *conffile.Config // latest parsed config, or nil if not in declarative mode
 	pm             *profileManager  // mu guards access
 	filterHash     deephash.Sum
-	httpTestClient *http.Client // for controlclient. nil by default, used by tests.
-	ccGen          clientGen    // function for producing controlclient; lazily populated
-	sshServer      SSHServer    // or nil, initialized lazily.
+	httpTestClient *http.Client             // for controlclient. nil by default, used by tests.
+	ccGen          clientGen                // function for producing controlclient; lazily populated
+	sshServer      SSHServer                // or nil, initialized lazily.
+	metricsServer  *metricsServer           // or nil; see updateMetricsServerLocked
+	trafficShaping *ipn.TrafficShapingPrefs // or nil; see updateTrafficShapingLocked
+	peerStats      *tstun.PeerStats         // or nil; see updatePeerStatsLocked
+	diagnostics    *diagnosticsUploader     // or nil; see updateDiagnosticsLocked
 	notify         func(ipn.Notify)
 	cc             controlclient.Client
 	ccAuto         *controlclient.Auto // if cc is of type *controlclient.Auto
@@ -213,6 +224,11 @@ type LocalBackend struct {
 	state          ipn.State
 	capFileSharing bool // whether netMap contains the file sharing capability
 	capTailnetLock bool // whether netMap contains the tailnet lock capability
+	// exitNodeFallbackIndex is which exit node is in use: 0 for
+	// Prefs.ExitNodeID, or i+1 for Prefs.ExitNodeFallbacks[i]. It's
+	// runtime state, reset when the exit node list changes; see
+	// selectExitNode.
+	exitNodeFallbackIndex int
 	// hostinfo is mutated in-place while mu is held.
 	hostinfo *tailcfg.Hostinfo
 	// netMap is the most recently set full netmap from the controlclient.
@@ -261,6 +277,19 @@ type LocalBackend struct {
 	componentLogUntil       map[string]componentLogState
 	// c2nUpdateStatus is the status of c2n-triggered client update.
 	c2nUpdateStatus updateStatus
+	// exitNodeRotateTimer fires every exitNodeRotateEvery to advance the
+	// exit node when Prefs.ExitNodeRotate is set; nil otherwise.
+	exitNodeRotateTimer tstime.TimerController
+	exitNodeRotateEvery time.Duration
+	// roamHandshakeTimer fires every roamHandshakeEvery to initiate
+	// WireGuard handshakes when Prefs.WireGuardRoamInterval is set; nil
+	// otherwise.
+	roamHandshakeTimer tstime.TimerController
+	roamHandshakeEvery time.Duration
+	// portForwards are the listeners for Prefs.LocalForwardPorts, by
+	// entry, or nil while one is being opened; see
+	// updatePortForwardsLocked.
+	portForwards map[ipn.ForwardPort]net.Listener
 
 	// ServeConfig fields. (also guarded by mu)
 	lastServeConfJSON   mem.RO              // last JSON that was parsed into serveConfig
@@ -328,7 +357,9 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 		if err != nil {
 			return nil, err
 		}
-		p.ApplyEdits(&mp)
+		if err := p.ApplyEdits(&mp); err != nil {
+			return nil, err
+		}
 		if err := pm.SetPrefs(p.View(), ""); err != nil {
 			return nil, err
 		}
@@ -345,10 +376,15 @@ func NewLocalBackend(logf logger.Logf, logID logid.PublicID, sys *tsd.System, lo
 	portpoll := new(portlist.Poller)
 	clock := tstime.StdClock{}
 
+	maxLogLineLen := new(atomic.Int64)
+	maxLogLineLen.Store(ipn.DefaultMaxLogLineLength)
+	logf = logger.WithMaxLineLength(logf, func() int { return int(maxLogLineLen.Load()) })
+
 	b := &LocalBackend{
 		ctx:                 ctx,
 		ctxCancel:           cancel,
 		logf:                logf,
+		maxLogLineLen:       maxLogLineLen,
 		keyLogf:             logger.LogOnChange(logf, 5*time.Minute, clock.Now),
 		statsLogf:           logger.LogOnChange(logf, 5*time.Minute, clock.Now),
 		sys:                 sys,
@@ -635,6 +671,11 @@ func (b *LocalBackend) Shutdown() {
 		b.sshServer.Shutdown()
 		b.sshServer = nil
 	}
+	b.stopExitNodeRotationLocked()
+	b.stopRoamHandshakesLocked()
+	b.stopMetricsServerLocked()
+	b.stopPortForwardsLocked()
+	b.stopDiagnosticsLocked()
 	b.closePeerAPIListenersLocked()
 	if b.debugSink != nil {
 		b.e.InstallCaptureHook(nil)
@@ -744,14 +785,14 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 				if !prefs.RouteAll() && b.netMap.AnyPeersAdvertiseRoutes() {
 					s.Health = append(s.Health, healthmsg.WarnAcceptRoutesOff)
 				}
-				if !prefs.ExitNodeID().IsZero() {
-					if exitPeer, ok := b.netMap.PeerWithStableID(prefs.ExitNodeID()); ok {
+				if exitNodeID := effectiveExitNodeID(prefs, b.peers, b.exitNodeFallbackIndex); !exitNodeID.IsZero() {
+					if exitPeer, ok := b.netMap.PeerWithStableID(exitNodeID); ok {
 						var online = false
 						if v := exitPeer.Online(); v != nil {
 							online = *v
 						}
 						s.ExitNodeStatus = &ipnstate.ExitNodeStatus{
-							ID:           prefs.ExitNodeID(),
+							ID:           exitNodeID,
 							Online:       online,
 							TailscaleIPs: exitPeer.Addresses().AsSlice(),
 						}
@@ -821,7 +862,11 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 	for id, up := range b.netMap.UserProfiles {
 		sb.AddUser(id, up)
 	}
-	exitNodeID := b.pm.CurrentPrefs().ExitNodeID()
+	exitNodeID := effectiveExitNodeID(b.pm.CurrentPrefs(), b.peers, b.exitNodeFallbackIndex)
+	var counts map[netip.Addr]tstun.PeerCounts
+	if b.peerStats != nil {
+		counts = b.peerStats.Snapshot()
+	}
 	for _, p := range b.peers {
 		var lastSeen time.Time
 		if p.LastSeen() != nil {
@@ -851,6 +896,9 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			Location:        p.Hostinfo().Location(),
 		}
 		peerStatusFromNode(ps, p)
+		if counts != nil {
+			ps.Stats = peerStatsForAddrs(counts, tailscaleIPs)
+		}
 
 		p4, p6 := peerAPIPorts(p)
 		if u := peerAPIURL(nodeIP(p, netip.Addr.Is4), p4); u != "" {
@@ -1089,6 +1137,9 @@ func (b *LocalBackend) SetControlClientStatus(c controlclient.Client, st control
 	if setExitNodeID(prefs, st.NetMap) {
 		prefsChanged = true
 	}
+	if setTailnetName(prefs, st.NetMap) {
+		prefsChanged = true
+	}
 
 	// Perform all mutations of prefs based on the netmap here.
 	if prefsChanged {
@@ -1097,6 +1148,13 @@ func (b *LocalBackend) SetControlClientStatus(c controlclient.Client, st control
 			b.logf("Failed to save new controlclient state: %v", err)
 		}
 	}
+	// Profiles created before LoginProfile.TailnetMagicDNSName existed
+	// only learn it from the first netmap received while they're current.
+	if st.NetMap != nil {
+		if err := b.pm.BackfillTailnetMagicDNSName(st.NetMap.MagicDNSSuffix()); err != nil {
+			b.logf("Failed to backfill profile MagicDNS name: %v", err)
+		}
+	}
 	// initTKALocked is dependent on CurrentProfile.ID, which is initialized
 	// (for new profiles) on the first call to b.pm.SetPrefs.
 	if err := b.initTKALocked(); err != nil {
@@ -1127,14 +1185,29 @@ func (b *LocalBackend) SetControlClientStatus(c controlclient.Client, st control
 			b.tkaFilterNetmapLocked(st.NetMap)
 		}
 		b.setNetMapLocked(st.NetMap)
+		b.updateExitNodeFallbackIndexLocked(prefs.View())
 		b.updateFilterLocked(st.NetMap, prefs.View())
 	}
+	// With PeerRoutePropagation, the advertised routes depend on the
+	// netmap, so refresh Hostinfo.RoutableIPs when it changes.
+	var propagatedHi *tailcfg.Hostinfo
+	if st.NetMap != nil && prefs.PeerRoutePropagation && prefs.RouteAll && b.hostinfo != nil {
+		newHi := b.hostinfo.Clone()
+		b.applyPrefsToHostinfoLocked(newHi, prefs.View())
+		if !b.hostinfo.Equal(newHi) {
+			b.hostinfo = newHi
+			propagatedHi = newHi
+		}
+	}
 	b.mu.Unlock()
 
 	// Now complete the lock-free parts of what we started while locked.
 	if prefsChanged {
 		b.send(ipn.Notify{Prefs: ptr.To(prefs.View())})
 	}
+	if propagatedHi != nil {
+		b.doSetHostinfoFilterServices(propagatedHi)
+	}
 
 	if st.NetMap != nil {
 		if envknob.NoLogsNoSupport() && hasCapability(st.NetMap, tailcfg.CapabilityDataPlaneAuditLogs) {
@@ -1265,6 +1338,88 @@ func (b *LocalBackend) updateNetmapDeltaLocked(muts []netmap.NodeMutation) (hand
 	return true
 }
 
+// effectiveExitNodeID returns the ID of the exit node to use for prefs,
+// given the current peers and the fallback index of the exit node in use.
+// See selectExitNode.
+func effectiveExitNodeID(prefs ipn.PrefsView, peers map[tailcfg.NodeID]tailcfg.NodeView, fallbackIndex int) tailcfg.StableNodeID {
+	id, _ := selectExitNode(prefs, peers, fallbackIndex)
+	return id
+}
+
+// selectExitNode returns the ID of the exit node to use for prefs, given
+// the current peers, along with its fallback index: 0 for
+// prefs.ExitNodeID, or i+1 for prefs.ExitNodeFallbacks[i]. fallbackIndex
+// is that of the exit node in use, as last returned. A peer is available
+// if it's present and not known to be offline. In order of priority, the
+// exit node is:
+//
+//   - the one at fallbackIndex, if available, so that a working fallback
+//     isn't dropped as soon as an earlier node returns;
+//   - otherwise the first available of prefs.ExitNodeID and then
+//     prefs.ExitNodeFallbacks;
+//   - otherwise, if prefs.ExitNodeCountry is set, the exit node with the
+//     lowest StableID among the available peers offering exit routes and
+//     located in that country;
+//   - otherwise prefs.ExitNodeID, unchanged, so that traffic for the exit
+//     node's routes is dropped rather than leaking out the local network.
+//
+// It returns the empty string if prefs.ExitNodeID is not set.
+func selectExitNode(prefs ipn.PrefsView, peers map[tailcfg.NodeID]tailcfg.NodeView, fallbackIndex int) (id tailcfg.StableNodeID, newFallbackIndex int) {
+	primary := prefs.ExitNodeID()
+	if primary.IsZero() {
+		return "", 0
+	}
+	available := func(p tailcfg.NodeView) bool {
+		online := p.Online()
+		return online == nil || *online
+	}
+	candidates := append([]tailcfg.StableNodeID{primary}, prefs.ExitNodeFallbacks().AsSlice()...)
+	up := make(map[tailcfg.StableNodeID]bool, len(candidates))
+	country := prefs.ExitNodeCountry()
+	var inCountry tailcfg.StableNodeID
+	for _, p := range peers {
+		if !available(p) {
+			continue
+		}
+		if slices.Contains(candidates, p.StableID()) {
+			up[p.StableID()] = true
+		}
+		if country == "" || !tsaddr.ContainsExitRoutes(p.AllowedIPs()) {
+			continue
+		}
+		if loc := p.Hostinfo().Location(); loc == nil || loc.CountryCode != country {
+			continue
+		}
+		if inCountry.IsZero() || p.StableID() < inCountry {
+			inCountry = p.StableID()
+		}
+	}
+	if i := fallbackIndex; i > 0 && i < len(candidates) && up[candidates[i]] {
+		return candidates[i], i
+	}
+	for i, c := range candidates {
+		if up[c] {
+			return c, i
+		}
+	}
+	if !inCountry.IsZero() {
+		return inCountry, 0
+	}
+	return primary, 0
+}
+
+// updateExitNodeFallbackIndexLocked updates b.exitNodeFallbackIndex to
+// match the exit node selectExitNode picks for prefs from the current
+// peers. It does nothing until there's a netmap.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateExitNodeFallbackIndexLocked(prefs ipn.PrefsView) {
+	if b.netMap == nil {
+		return
+	}
+	_, b.exitNodeFallbackIndex = selectExitNode(prefs, b.peers, b.exitNodeFallbackIndex)
+}
+
 // setExitNodeID updates prefs to reference an exit node by ID, rather
 // than by IP. It returns whether prefs was mutated.
 func setExitNodeID(prefs *ipn.Prefs, nm *netmap.NetworkMap) (prefsChanged bool) {
@@ -1302,6 +1457,123 @@ func setExitNodeID(prefs *ipn.Prefs, nm *netmap.NetworkMap) (prefsChanged bool)
 	return prefsChanged
 }
 
+// setTailnetName sets prefs.TailnetName to the tailnet name in nm, if any.
+// It reports whether prefs was mutated.
+func setTailnetName(prefs *ipn.Prefs, nm *netmap.NetworkMap) (prefsChanged bool) {
+	if nm == nil || nm.Domain == "" || prefs.TailnetName == nm.Domain {
+		return false
+	}
+	prefs.TailnetName = nm.Domain
+	return true
+}
+
+// effectiveTunnelProtocol returns the tunnel protocol actually used for the
+// requested Prefs.TunnelProtocol value. Only WireGuard is implemented for
+// now, so it is always ipn.TunnelProtocolWireGuard.
+func effectiveTunnelProtocol(requested string) string {
+	return ipn.TunnelProtocolWireGuard
+}
+
+// updateExitNodeRotationLocked starts, restarts or stops the exit node
+// rotation timer to match prefs.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateExitNodeRotationLocked(prefs ipn.PrefsView) {
+	if !prefs.Valid() || !prefs.ExitNodeRotate() || b.shutdownCalled {
+		b.stopExitNodeRotationLocked()
+		return
+	}
+	every := prefs.ExitNodeRotateIntervalOrDefault()
+	if b.exitNodeRotateTimer != nil && b.exitNodeRotateEvery == every {
+		return
+	}
+	b.stopExitNodeRotationLocked()
+	b.exitNodeRotateEvery = every
+	b.exitNodeRotateTimer = b.clock.AfterFunc(every, b.rotateExitNode)
+}
+
+// stopExitNodeRotationLocked stops the exit node rotation timer, if any.
+//
+// b.mu must be held.
+func (b *LocalBackend) stopExitNodeRotationLocked() {
+	if b.exitNodeRotateTimer != nil {
+		b.exitNodeRotateTimer.Stop()
+		b.exitNodeRotateTimer = nil
+	}
+	b.exitNodeRotateEvery = 0
+}
+
+// updateRoamHandshakesLocked starts, restarts or stops the periodic
+// WireGuard handshakes to match prefs.WireGuardRoamInterval.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateRoamHandshakesLocked(prefs ipn.PrefsView) {
+	if !prefs.Valid() || prefs.WireGuardRoamInterval() == nil || b.shutdownCalled {
+		b.stopRoamHandshakesLocked()
+		return
+	}
+	every := *prefs.WireGuardRoamInterval()
+	if b.roamHandshakeTimer != nil && b.roamHandshakeEvery == every {
+		return
+	}
+	b.stopRoamHandshakesLocked()
+	b.roamHandshakeEvery = every
+	b.roamHandshakeTimer = b.clock.AfterFunc(every, b.sendRoamHandshakes)
+}
+
+// stopRoamHandshakesLocked stops the periodic WireGuard handshakes, if any.
+//
+// b.mu must be held.
+func (b *LocalBackend) stopRoamHandshakesLocked() {
+	if b.roamHandshakeTimer != nil {
+		b.roamHandshakeTimer.Stop()
+		b.roamHandshakeTimer = nil
+	}
+	b.roamHandshakeEvery = 0
+}
+
+// sendRoamHandshakes is called by roamHandshakeTimer to initiate WireGuard
+// handshakes with active peers and schedule the next ones.
+func (b *LocalBackend) sendRoamHandshakes() {
+	b.mu.Lock()
+	if b.roamHandshakeTimer == nil {
+		b.mu.Unlock()
+		return
+	}
+	b.roamHandshakeTimer = b.clock.AfterFunc(b.roamHandshakeEvery, b.sendRoamHandshakes)
+	running := b.state == ipn.Running
+	b.mu.Unlock()
+
+	if running {
+		b.e.SendHandshakes()
+	}
+}
+
+// rotateExitNode is called by exitNodeRotateTimer to advance the exit node
+// to the next entry of Prefs.ExitNodeIDs and schedule the next rotation.
+func (b *LocalBackend) rotateExitNode() {
+	b.mu.Lock()
+	prefs := b.pm.CurrentPrefs()
+	if b.shutdownCalled || !prefs.ExitNodeRotate() {
+		b.stopExitNodeRotationLocked()
+		b.mu.Unlock()
+		return
+	}
+	b.exitNodeRotateTimer = b.clock.AfterFunc(b.exitNodeRotateEvery, b.rotateExitNode)
+	mp := &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			ExitNodeID: prefs.NextExitNodeID(),
+		},
+		ExitNodeIDSet: true,
+		ExitNodeIPSet: true,
+	}
+	b.mu.Unlock()
+
+	if _, err := b.EditPrefs(mp); err != nil {
+		b.logf("rotating exit node: %v", err)
+	}
+}
+
 // setWgengineStatus is the callback by the wireguard engine whenever it posts a new status.
 // This updates the endpoints both in the backend and in the control client.
 func (b *LocalBackend) setWgengineStatus(s *wgengine.Status, err error) {
@@ -1420,6 +1692,9 @@ func (b *LocalBackend) getNewControlClientFunc() clientGen {
 		// default to make any future call to
 		// SetControlClientGetterForTesting panic.
 		b.ccGen = func(opts controlclient.Options) (controlclient.Client, error) {
+			if ipn.IsFileControlURL(opts.ServerURL) {
+				return controlclient.NewFile(opts)
+			}
 			return controlclient.New(opts)
 		}
 	}
@@ -1559,10 +1834,21 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	}
 
 	prefs := b.pm.CurrentPrefs()
+	startMetricsServer := b.updateMetricsServerLocked(prefs)
+	startPortForwards := b.updatePortForwardsLocked(prefs)
+	b.updateTrafficShapingLocked(prefs)
+	b.updatePeerStatsLocked(prefs)
+	b.updateDiagnosticsLocked(prefs)
 	wantRunning := prefs.WantRunning()
 	if wantRunning {
 		if err := b.initMachineKeyLocked(); err != nil {
 			b.mu.Unlock()
+			if startMetricsServer != nil {
+				startMetricsServer()
+			}
+			if startPortForwards != nil {
+				startPortForwards()
+			}
 			return fmt.Errorf("initMachineKeyLocked: %w", err)
 		}
 	}
@@ -1573,7 +1859,12 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	if inServerMode := prefs.ForceDaemon(); inServerMode || runtime.GOOS == "windows" {
 		b.logf("Start: serverMode=%v", inServerMode)
 	}
+	if tp := prefs.TunnelProtocol(); tp != "" {
+		b.logf("Start: tunnelProtocol=%q; using %s", tp, effectiveTunnelProtocol(tp))
+	}
 	b.applyPrefsToHostinfoLocked(hostinfo, prefs)
+	b.updateExitNodeRotationLocked(prefs)
+	b.updateRoamHandshakesLocked(prefs)
 
 	b.setNetMapLocked(nil)
 	persistv := prefs.Persist().AsStruct()
@@ -1583,6 +1874,13 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	b.updateFilterLocked(nil, ipn.PrefsView{})
 	b.mu.Unlock()
 
+	if startMetricsServer != nil {
+		startMetricsServer()
+	}
+	if startPortForwards != nil {
+		startPortForwards()
+	}
+
 	if b.portpoll != nil {
 		b.portpollOnce.Do(func() {
 			go b.readPoller()
@@ -1701,6 +1999,28 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 
 var warnInvalidUnsignedNodes = health.NewWarnable()
 
+var warnInvalidPrefs = health.NewWarnable()
+
+// updateInvalidPrefsWarning sets or clears the health warning about invalid
+// settings in p, the current prefs. Saved prefs that fail validation are
+// still loaded, so that no settings are silently lost; the warning tells
+// the user which ones need fixing.
+func updateInvalidPrefsWarning(p ipn.PrefsView) {
+	warnInvalidPrefs.Set(invalidPrefsWarning(p))
+}
+
+// invalidPrefsWarning returns the health warning for p, or nil if p is
+// valid or not set.
+func invalidPrefsWarning(p ipn.PrefsView) error {
+	if !p.Valid() {
+		return nil
+	}
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("some preferences are invalid and may not take effect; change them with \"tailscale set\": %w", err)
+	}
+	return nil
+}
+
 // updateFilterLocked updates the packet filter in wgengine based on the
 // given netMap and user preferences.
 //
@@ -1717,7 +2037,12 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 		packetFilter []filter.Match
 		localNetsB   netipx.IPSetBuilder
 		logNetsB     netipx.IPSetBuilder
-		shieldsUp    = !prefs.Valid() || prefs.ShieldsUp() // Be conservative when not ready
+		selfNetsB    netipx.IPSetBuilder
+		allowedSrcsB netipx.IPSetBuilder
+		localPorts   []uint16
+		shieldsUp    = !prefs.Valid() || prefs.ShieldsUpBlocksInbound() // Be conservative when not ready
+		blockOut     = prefs.Valid() && prefs.ShieldsUpBlocksOutbound()
+		logDecision  = prefs.Valid() && prefs.PacketFilterLogging()
 	)
 	// Log traffic for Tailscale IPs.
 	logNetsB.AddPrefix(tsaddr.CGNATRange())
@@ -1727,6 +2052,7 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 		addrs = netMap.GetAddresses()
 		for i := range addrs.LenIter() {
 			localNetsB.AddPrefix(addrs.At(i))
+			selfNetsB.AddPrefix(addrs.At(i))
 		}
 		packetFilter = netMap.PacketFilter
 
@@ -1739,6 +2065,13 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 		}
 	}
 	if prefs.Valid() {
+		localPorts = prefs.LocallyServedPorts().AsSlice()
+		if shieldsUp || blockOut {
+			as := prefs.AllowedSources()
+			for i := 0; i < as.Len(); i++ {
+				allowedSrcsB.AddPrefix(as.At(i))
+			}
+		}
 		ar := prefs.AdvertiseRoutes()
 		for i := 0; i < ar.Len(); i++ {
 			r := ar.At(i)
@@ -1771,6 +2104,8 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 	}
 	localNets, _ := localNetsB.IPSet()
 	logNets, _ := logNetsB.IPSet()
+	selfNets, _ := selfNetsB.IPSet()
+	allowedSrcs, _ := allowedSrcsB.IPSet()
 	var sshPol tailcfg.SSHPolicy
 	if haveNetmap && netMap.SSHPolicy != nil {
 		sshPol = *netMap.SSHPolicy
@@ -1783,8 +2118,12 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 		LocalNets   []netipx.IPRange
 		LogNets     []netipx.IPRange
 		ShieldsUp   bool
+		BlockOut    bool
 		SSHPolicy   tailcfg.SSHPolicy
-	}{haveNetmap, addrs, packetFilter, localNets.Ranges(), logNets.Ranges(), shieldsUp, sshPol})
+		LocalPorts  []uint16
+		AllowedSrcs []netipx.IPRange
+		LogDecision bool
+	}{haveNetmap, addrs, packetFilter, localNets.Ranges(), logNets.Ranges(), shieldsUp, blockOut, sshPol, localPorts, allowedSrcs.Ranges(), logDecision})
 	if !changed {
 		return
 	}
@@ -1796,13 +2135,31 @@ func (b *LocalBackend) updateFilterLocked(netMap *netmap.NetworkMap, prefs ipn.P
 	}
 
 	oldFilter := b.e.GetFilter()
+	var f *filter.Filter
 	if shieldsUp {
 		b.logf("[v1] netmap packet filter: (shields up)")
-		b.setFilter(filter.NewShieldsUpFilter(localNets, logNets, oldFilter, b.logf))
+		f = filter.NewShieldsUpFilter(localNets, logNets, oldFilter, b.logf)
 	} else {
 		b.logf("[v1] netmap packet filter: %v filters", len(packetFilter))
-		b.setFilter(filter.New(packetFilter, localNets, logNets, oldFilter, b.logf))
+		f = filter.New(packetFilter, localNets, logNets, oldFilter, b.logf)
+	}
+	if len(localPorts) > 0 {
+		b.logf("[v1] netmap packet filter: locally served ports %v", localPorts)
+		f.AllowLocalPorts(selfNets, localPorts)
+	}
+	if blockOut {
+		b.logf("[v1] netmap packet filter: (shields up, outbound)")
+		f.BlockOutbound()
+	}
+	if rs := allowedSrcs.Ranges(); len(rs) > 0 {
+		b.logf("[v1] netmap packet filter: (shields up) allowed sources %v", rs)
+		f.AllowSources(allowedSrcs)
+	}
+	if logDecision {
+		b.logf("[v1] netmap packet filter: logging all decisions")
+		f.LogDecisions()
 	}
+	b.setFilter(f)
 
 	if b.sshServer != nil {
 		go b.sshServer.OnPolicyChange()
@@ -2506,10 +2863,26 @@ func (b *LocalBackend) setTCPPortsIntercepted(ports []uint16) {
 	b.shouldInterceptTCPPortAtomic.Store(f)
 }
 
-// setAtomicValuesFromPrefsLocked populates sshAtomicBool, containsViaIPFuncAtomic
-// and shouldInterceptTCPPortAtomic from the prefs p, which may be !Valid().
+// setAtomicValuesFromPrefsLocked populates sshAtomicBool, maxLogLineLen,
+// containsViaIPFuncAtomic and shouldInterceptTCPPortAtomic from the prefs
+// p, which may be !Valid(), and updates the invalid prefs health warning.
 func (b *LocalBackend) setAtomicValuesFromPrefsLocked(p ipn.PrefsView) {
+	updateInvalidPrefsWarning(p)
 	b.sshAtomicBool.Store(p.Valid() && p.RunSSH() && envknob.CanSSHD())
+	if b.maxLogLineLen != nil {
+		n := ipn.DefaultMaxLogLineLength
+		if p.Valid() {
+			n = p.MaxLogLineLengthOrDefault()
+		}
+		b.maxLogLineLen.Store(int64(n))
+	}
+	if mc, ok := b.sys.MagicSock.GetOK(); ok {
+		mode := ipn.ConnectionPriorityLatency
+		if p.Valid() {
+			mode = p.ConnectionPriorityModeOrDefault()
+		}
+		mc.SetConnectionPriorityMode(mode)
+	}
 
 	if !p.Valid() {
 		b.containsViaIPFuncAtomic.Store(tsaddr.FalseContainsIPFunc())
@@ -2523,6 +2896,67 @@ func (b *LocalBackend) setAtomicValuesFromPrefsLocked(p ipn.PrefsView) {
 	}
 }
 
+// updateTrafficShapingLocked installs a tstun.Shaper enforcing
+// p.TrafficShaping on the tun device, or removes it if p has no limits.
+// Existing token buckets are kept if the limits are unchanged.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateTrafficShapingLocked(p ipn.PrefsView) {
+	var ts *ipn.TrafficShapingPrefs
+	if p.Valid() {
+		ts = p.TrafficShaping()
+	}
+	if ts != nil && *ts == (ipn.TrafficShapingPrefs{}) {
+		ts = nil
+	}
+	if ts == nil && b.trafficShaping == nil || ts != nil && b.trafficShaping != nil && *ts == *b.trafficShaping {
+		return
+	}
+	tunWrap, ok := b.sys.Tun.GetOK()
+	if !ok {
+		return
+	}
+	b.trafficShaping = ts
+	if ts == nil {
+		tunWrap.SetShaper(nil)
+		return
+	}
+	b.logf("traffic shaping: %v", strings.TrimSpace(ts.Pretty()))
+	tunWrap.SetShaper(tstun.NewShaper(ts.DownloadKbps, ts.UploadKbps, ts.BurstKb))
+}
+
+// updatePeerStatsLocked starts counting packets per peer on the tun device
+// if p.PeerMetricsEnabled is set, or stops counting if it isn't.
+//
+// b.mu must be held.
+func (b *LocalBackend) updatePeerStatsLocked(p ipn.PrefsView) {
+	want := p.Valid() && p.PeerMetricsEnabled()
+	if want == (b.peerStats != nil) {
+		return
+	}
+	tunWrap, ok := b.sys.Tun.GetOK()
+	if !ok {
+		return
+	}
+	if want {
+		b.peerStats = tstun.NewPeerStats()
+	} else {
+		b.peerStats = nil
+	}
+	tunWrap.SetPeerStats(b.peerStats)
+}
+
+// peerStatsForAddrs returns the sum of counts for addrs.
+func peerStatsForAddrs(counts map[netip.Addr]tstun.PeerCounts, addrs []netip.Addr) *ipnstate.PeerStats {
+	ps := new(ipnstate.PeerStats)
+	for _, a := range addrs {
+		c := counts[a]
+		ps.TxPackets += c.TxPackets
+		ps.RxPackets += c.RxPackets
+	}
+	return ps
+}
+
 // State returns the backend state machine's current state.
 func (b *LocalBackend) State() ipn.State {
 	b.mu.Lock()
@@ -2732,7 +3166,7 @@ func (b *LocalBackend) shouldUploadServices() bool {
 	if !p.Valid() || b.netMap == nil {
 		return false // default to safest setting
 	}
-	return !p.ShieldsUp() && b.netMap.CollectServices
+	return !p.ShieldsUpBlocksInbound() && b.netMap.CollectServices
 }
 
 // SetCurrentUserID is used to implement support for multi-user systems (only
@@ -2778,6 +3212,12 @@ func (b *LocalBackend) checkPrefsLocked(p *ipn.Prefs) error {
 		return errors.New("can't reconfigure tailscaled when using a config file; config file is locked")
 	}
 	var errs []error
+	if err := p.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, w := range p.Warnings() {
+		b.logf("warning: %s", w)
+	}
 	if p.Hostname == "badhostname.tailscale." {
 		// Keep this one just for testing.
 		errs = append(errs, errors.New("bad hostname [test]"))
@@ -2785,6 +3225,11 @@ func (b *LocalBackend) checkPrefsLocked(p *ipn.Prefs) error {
 	if err := b.checkProfileNameLocked(p); err != nil {
 		errs = append(errs, err)
 	}
+	if p.AuditLog && p.AuditLogPath != "" {
+		if err := checkPrefsAuditLogPath(b.TailscaleVarRoot(), p.AuditLogPath); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if err := b.checkSSHPrefsLocked(p); err != nil {
 		errs = append(errs, err)
 	}
@@ -2879,22 +3324,54 @@ func (b *LocalBackend) checkExitNodePrefsLocked(p *ipn.Prefs) error {
 }
 
 func (b *LocalBackend) checkFunnelEnabledLocked(p *ipn.Prefs) error {
-	if p.ShieldsUp && b.serveConfig.IsFunnelOn() {
+	if p.ShieldsUpBlocksInbound() && b.serveConfig.IsFunnelOn() {
 		return errors.New("Cannot enable shields-up when Funnel is enabled.")
 	}
 	return nil
 }
 
+// checkHostPrefs reports an error if mp sets OperatorUser to a user that
+// doesn't exist on this machine, or turns on RunSSH where the Tailscale SSH
+// helper binary is missing. These checks look up local users and files, so
+// they are done only for the fields mp edits, and without b.mu held.
+func checkHostPrefs(mp *ipn.MaskedPrefs) error {
+	var errs []error
+	if mp.OperatorUserSet {
+		if err := mp.Prefs.ValidateOperatorUser(runtime.GOOS); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if mp.RunSSHSet {
+		if err := mp.Prefs.ValidateSSHAvailability(runtime.GOOS); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return multierr.New(errs...)
+}
+
 func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (ipn.PrefsView, error) {
+	if err := checkHostPrefs(mp); err != nil {
+		b.logf("EditPrefs check error: %v", err)
+		return ipn.PrefsView{}, err
+	}
 	b.mu.Lock()
 	if mp.EggSet {
 		mp.EggSet = false
 		b.egg = true
 		go b.doSetHostinfoFilterServices(b.hostinfo.Clone())
 	}
+	if err := mp.Validate(); err != nil {
+		b.mu.Unlock()
+		b.logf("EditPrefs check error: %v", err)
+		return ipn.PrefsView{}, err
+	}
 	p0 := b.pm.CurrentPrefs()
 	p1 := b.pm.CurrentPrefs().AsStruct()
-	p1.ApplyEdits(mp)
+	if err := p1.ApplyEdits(mp); err != nil {
+		b.mu.Unlock()
+		b.logf("EditPrefs apply error: %v", err)
+		return ipn.PrefsView{}, err
+	}
 	if err := b.checkPrefsLocked(p1); err != nil {
 		b.mu.Unlock()
 		b.logf("EditPrefs check error: %v", err)
@@ -2967,15 +3444,27 @@ func (b *LocalBackend) wantIngressLocked() bool {
 func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) ipn.PrefsView {
 	netMap := b.netMap
 	b.setAtomicValuesFromPrefsLocked(newp.View())
+	startMetricsServer := b.updateMetricsServerLocked(newp.View())
+	startPortForwards := b.updatePortForwardsLocked(newp.View())
+	b.updateTrafficShapingLocked(newp.View())
+	b.updatePeerStatsLocked(newp.View())
+	b.updateDiagnosticsLocked(newp.View())
 
 	oldp := b.pm.CurrentPrefs()
 	if oldp.Valid() {
 		newp.Persist = oldp.Persist().AsStruct() // caller isn't allowed to override this
+		newp.TailnetName = oldp.TailnetName()    // nor this; it comes from the netmap
 	}
 	// findExitNodeIDLocked returns whether it updated b.prefs, but
 	// everything in this function treats b.prefs as completely new
 	// anyway. No-op if no exit node resolution is needed.
 	setExitNodeID(newp, netMap)
+	// The fallback index refers to the old exit node list, so it no
+	// longer means anything once that changes.
+	if oldp.ExitNodeID() != newp.ExitNodeID || !slices.Equal(oldp.ExitNodeFallbacks().AsSlice(), newp.ExitNodeFallbacks) {
+		b.exitNodeFallbackIndex = 0
+	}
+	b.updateExitNodeFallbackIndexLocked(newp.View())
 	// We do this to avoid holding the lock while doing everything else.
 
 	oldHi := b.hostinfo
@@ -3016,10 +3505,23 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) ipn
 	if err := b.pm.SetPrefs(prefs, b.netMap.MagicDNSSuffix()); err != nil {
 		b.logf("failed to save new controlclient state: %v", err)
 	}
+	writeAuditLog := b.prefsAuditLogWriterLocked(oldp, prefs)
 	b.lastProfileID = b.pm.CurrentProfile().ID
+	b.updateExitNodeRotationLocked(prefs)
+	b.updateRoamHandshakesLocked(prefs)
 	b.mu.Unlock()
 
-	if oldp.ShieldsUp() != newp.ShieldsUp || hostInfoChanged {
+	if writeAuditLog != nil {
+		writeAuditLog()
+	}
+	if startMetricsServer != nil {
+		startMetricsServer()
+	}
+	if startPortForwards != nil {
+		startPortForwards()
+	}
+
+	if oldp.EffectiveShieldsUpMode() != newp.EffectiveShieldsUpMode() || hostInfoChanged {
 		b.doSetHostinfoFilterServices(newHi)
 	}
 
@@ -3038,10 +3540,33 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) ipn
 		b.authReconfig()
 	}
 
+	if controlURLChangeNeedsReauth(oldp, prefs) {
+		b.logf("control URL changed from %q to %q; re-authentication needed", oldp.ControlURL(), prefs.ControlURL())
+		b.enterState(ipn.NeedsLogin)
+	}
+
 	b.send(ipn.Notify{Prefs: &prefs})
 	return prefs
 }
 
+// controlURLChangeNeedsReauth reports whether a prefs change moves the node
+// off a custom control server. The node's session with the old server
+// doesn't carry over, so rather than leaving it silently disconnected, the
+// backend enters NeedsLogin and the UI, seeing that state, starts an
+// interactive login against the new server. Changes away from an empty or
+// default ControlURL, as on first login, don't need re-authentication.
+func controlURLChangeNeedsReauth(oldp, newp ipn.PrefsView) bool {
+	if !oldp.Valid() || !newp.Valid() {
+		return false
+	}
+	oldURL := oldp.ControlURL()
+	if oldURL == "" || oldURL == ipn.DefaultControlURL {
+		return false
+	}
+	newURL := newp.ControlURLOrDefault()
+	return oldp.ControlURLOrDefault() != newURL && !ipn.IsFileControlURL(newURL)
+}
+
 // GetPeerAPIPort returns the port number for the peerapi server
 // running on the provided IP.
 func (b *LocalBackend) GetPeerAPIPort(ip netip.Addr) (port uint16, ok bool) {
@@ -3212,8 +3737,9 @@ func (b *LocalBackend) authReconfig() {
 	nm := b.netMap
 	hasPAC := b.prevIfState.HasPAC()
 	disableSubnetsIfPAC := hasCapability(nm, tailcfg.NodeAttrDisableSubnetsIfPAC)
-	dohURL, dohURLOK := exitNodeCanProxyDNS(nm, b.peers, prefs.ExitNodeID())
-	dcfg := dnsConfigForNetmap(nm, b.peers, prefs, b.logf, version.OS())
+	exitNodeID := effectiveExitNodeID(prefs, b.peers, b.exitNodeFallbackIndex)
+	dohURL, dohURLOK := exitNodeCanProxyDNS(nm, b.peers, exitNodeID)
+	dcfg := dnsConfigForNetmap(nm, b.peers, prefs, b.exitNodeFallbackIndex, b.logf, version.OS())
 	b.mu.Unlock()
 
 	if blocked {
@@ -3229,13 +3755,11 @@ func (b *LocalBackend) authReconfig() {
 		return
 	}
 
-	var flags netmap.WGConfigFlags
+	// The deprecated Prefs.AllowSingleHosts is always treated as true.
+	flags := netmap.AllowSingleHosts
 	if prefs.RouteAll() {
 		flags |= netmap.AllowSubnetRoutes
 	}
-	if prefs.AllowSingleHosts() {
-		flags |= netmap.AllowSingleHosts
-	}
 	if hasPAC && disableSubnetsIfPAC {
 		if flags&netmap.AllowSubnetRoutes != 0 {
 			b.logf("authReconfig: have PAC; disabling subnet routes")
@@ -3252,11 +3776,22 @@ func (b *LocalBackend) authReconfig() {
 		b.dialer.SetExitDNSDoH("")
 	}
 
-	cfg, err := nmcfg.WGCfg(nm, b.logf, flags, prefs.ExitNodeID())
+	if exitNodeID != prefs.ExitNodeID() {
+		b.logf("authReconfig: exit node %v unavailable; using %v", prefs.ExitNodeID(), exitNodeID)
+	}
+	cfg, err := nmcfg.WGCfg(nm, b.logf, flags, exitNodeID)
 	if err != nil {
 		b.logf("wgcfg: %v", err)
 		return
 	}
+	if f := prefs.RouteAllFilter(); f != nil && flags&netmap.AllowSubnetRoutes != 0 {
+		dropSubnetRoutesOutside(cfg, nm, *f)
+	}
+	if v4, v6 := prefs.TailscaleIPv4Only(), prefs.TailscaleIPv6Only(); v4 != v6 {
+		keepOnlyTailscaleAddrFamily(cfg, nm, v4)
+	}
+	cfg.NetworkLogging.PollPeriod = prefs.StatsIntervalOrDefault()
+	cfg.PostQuantum = prefs.WireGuardPQEnabled()
 
 	oneCGNATRoute := shouldUseOneCGNATRoute(b.logf, b.sys.ControlKnobs(), version.OS())
 	rcfg := b.routerConfig(cfg, prefs, oneCGNATRoute)
@@ -3265,11 +3800,54 @@ func (b *LocalBackend) authReconfig() {
 	if err == wgengine.ErrNoChanges {
 		return
 	}
-	b.logf("[v1] authReconfig: ra=%v dns=%v 0x%02x: %v", prefs.RouteAll(), prefs.CorpDNS(), flags, err)
+	b.logf("[v1] authReconfig: ra=%v dns=%v 0x%02x: %v", prefs.RouteAll(), prefs.UseTailscaleDNS(), flags, err)
 
 	b.initPeerAPIListener()
 }
 
+// dropSubnetRoutesOutside removes the subnet routes in cfg's peers that
+// aren't contained within filter, as set by ipn.Prefs.RouteAllFilter.
+// Peers' own addresses and exit node routes are kept.
+func dropSubnetRoutesOutside(cfg *wgcfg.Config, nm *netmap.NetworkMap, filter netip.Prefix) {
+	peerAddrs := make(map[key.NodePublic]views.Slice[netip.Prefix], len(nm.Peers))
+	for _, p := range nm.Peers {
+		peerAddrs[p.Key()] = p.Addresses()
+	}
+	filter = filter.Masked()
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		addrs := peerAddrs[p.PublicKey]
+		p.AllowedIPs = slices.DeleteFunc(p.AllowedIPs, func(r netip.Prefix) bool {
+			if r.Bits() == 0 || views.SliceContains(addrs, r) {
+				return false
+			}
+			return r.Bits() < filter.Bits() || !filter.Contains(r.Addr())
+		})
+	}
+}
+
+// keepOnlyTailscaleAddrFamily removes the Tailscale addresses of one
+// address family from cfg, as set by ipn.Prefs.TailscaleIPv4Only and
+// TailscaleIPv6Only. If is4 is true, only IPv4 Tailscale addresses are kept
+// for both the node itself and its peers; otherwise only IPv6 ones are.
+// Subnet and exit node routes are kept.
+func keepOnlyTailscaleAddrFamily(cfg *wgcfg.Config, nm *netmap.NetworkMap, is4 bool) {
+	otherFamily := func(pfx netip.Prefix) bool { return pfx.Addr().Is4() != is4 }
+	cfg.Addresses = slices.DeleteFunc(cfg.Addresses, otherFamily)
+
+	peerAddrs := make(map[key.NodePublic]views.Slice[netip.Prefix], len(nm.Peers))
+	for _, p := range nm.Peers {
+		peerAddrs[p.Key()] = p.Addresses()
+	}
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		addrs := peerAddrs[p.PublicKey]
+		p.AllowedIPs = slices.DeleteFunc(p.AllowedIPs, func(r netip.Prefix) bool {
+			return otherFamily(r) && views.SliceContains(addrs, r)
+		})
+	}
+}
+
 // shouldUseOneCGNATRoute reports whether we should prefer to make one big
 // CGNAT /10 route rather than a /32 per peer.
 //
@@ -3305,10 +3883,12 @@ func shouldUseOneCGNATRoute(logf logger.Logf, controlKnobs *controlknobs.Knobs,
 
 // dnsConfigForNetmap returns a *dns.Config for the given netmap,
 // prefs, client OS version, and cloud hosting environment.
+// exitNodeFallbackIndex is that of the exit node in use; see
+// selectExitNode.
 //
 // The versionOS is a Tailscale-style version ("iOS", "macOS") and not
 // a runtime.GOOS.
-func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.NodeView, prefs ipn.PrefsView, logf logger.Logf, versionOS string) *dns.Config {
+func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.NodeView, prefs ipn.PrefsView, exitNodeFallbackIndex int, logf logger.Logf, versionOS string) *dns.Config {
 	if nm == nil {
 		return nil
 	}
@@ -3390,10 +3970,18 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.
 		dcfg.Hosts[fqdn] = append(dcfg.Hosts[fqdn], ip)
 	}
 
-	if !prefs.CorpDNS() {
+	if !prefs.UseTailscaleDNS() {
 		return dcfg
 	}
 
+	if prefs.CacheDNSFor().Len() > 0 {
+		dcfg.CacheDomains = prefs.CacheDNSFor().AsSlice()
+		dcfg.CacheTTL = prefs.CacheDNSTTLOrDefault()
+	}
+	if d := prefs.DNSTTLOverride(); d != nil {
+		dcfg.TTLOverride = *d
+	}
+
 	for _, dom := range nm.DNS.Domains {
 		fqdn, err := dnsname.ToFQDN(dom)
 		if err != nil {
@@ -3413,7 +4001,8 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.
 
 	// If we're using an exit node and that exit node is new enough (1.19.x+)
 	// to run a DoH DNS proxy, then send all our DNS traffic through it.
-	if dohURL, ok := exitNodeCanProxyDNS(nm, peers, prefs.ExitNodeID()); ok {
+	exitNodeID := effectiveExitNodeID(prefs, peers, exitNodeFallbackIndex)
+	if dohURL, ok := exitNodeCanProxyDNS(nm, peers, exitNodeID); ok {
 		addDefault([]*dnstype.Resolver{{Addr: dohURL}})
 		return dcfg
 	}
@@ -3424,7 +4013,7 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.
 	if len(nm.DNS.Resolvers) > 0 {
 		addDefault(nm.DNS.Resolvers)
 	} else {
-		if resolvers, ok := wireguardExitNodeDNSResolvers(nm, peers, prefs.ExitNodeID()); ok {
+		if resolvers, ok := wireguardExitNodeDNSResolvers(nm, peers, exitNodeID); ok {
 			addDefault(resolvers)
 		}
 	}
@@ -3456,7 +4045,11 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, peers map[tailcfg.NodeID]tailcfg.
 	switch {
 	case len(dcfg.DefaultResolvers) != 0:
 		// Default resolvers already set.
-	case !prefs.ExitNodeID().IsZero():
+	case prefs.NameserverPolicy() == ipn.NameserverPolicyTailscaleOnly:
+		// The user asked for all queries to go through Tailscale's
+		// resolver rather than the system's.
+		addDefault(nm.DNS.FallbackResolvers)
+	case !exitNodeID.IsZero():
 		// When using an exit node, we send all DNS traffic to the exit node, so
 		// we don't need a fallback resolver.
 		//
@@ -3748,6 +4341,48 @@ func peerRoutes(logf logger.Logf, peers []wgcfg.Peer, cgnatThreshold int) (route
 	return routes
 }
 
+// appendPropagatedPeerRoutes appends to routes the subnet routes that peers
+// in nm are primary for, for Prefs.PeerRoutePropagation. Default routes
+// (exit nodes) and routes already in routes are skipped. If filter is
+// non-nil, as set by Prefs.RoutePropagationFilter, routes not contained
+// within it are skipped too.
+//
+// Once advertised, a propagated route may be made primary on this node,
+// which would then route it back to itself. To avoid such loops and the
+// primary flapping between nodes, routes that this node is already primary
+// for, and the routes of peers known to be offline (whose primary routes
+// control would hand over), are skipped as well.
+func appendPropagatedPeerRoutes(routes []netip.Prefix, nm *netmap.NetworkMap, filter *netip.Prefix) []netip.Prefix {
+	if nm == nil {
+		return routes
+	}
+	var f netip.Prefix
+	if filter != nil {
+		f = filter.Masked()
+	}
+	var selfPrimary views.Slice[netip.Prefix]
+	if nm.SelfNode.Valid() {
+		selfPrimary = nm.SelfNode.PrimaryRoutes()
+	}
+	for _, peer := range nm.Peers {
+		if online := peer.Online(); online != nil && !*online {
+			continue
+		}
+		pr := peer.PrimaryRoutes()
+		for i := range pr.LenIter() {
+			r := pr.At(i).Masked()
+			if r.Bits() == 0 || slices.Contains(routes, r) || views.SliceContains(selfPrimary, r) {
+				continue
+			}
+			if f.IsValid() && (r.Bits() < f.Bits() || !f.Contains(r.Addr())) {
+				continue
+			}
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
 // routerConfig produces a router.Config from a wireguard config and IPN prefs.
 func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs ipn.PrefsView, oneCGNATRoute bool) *router.Config {
 	singleRouteThreshold := 10_000
@@ -3836,16 +4471,20 @@ func (b *LocalBackend) applyPrefsToHostinfoLocked(hi *tailcfg.Hostinfo, prefs ip
 		hi.Hostname = h
 	}
 	hi.RoutableIPs = prefs.AdvertiseRoutes().AsSlice()
+	if prefs.PeerRoutePropagation() && prefs.RouteAll() {
+		hi.RoutableIPs = appendPropagatedPeerRoutes(hi.RoutableIPs, b.netMap, prefs.RoutePropagationFilter())
+	}
 	hi.RequestTags = prefs.AdvertiseTags().AsSlice()
-	hi.ShieldsUp = prefs.ShieldsUp()
+	hi.ShieldsUp = prefs.ShieldsUpBlocksInbound()
 	hi.AllowsUpdate = envknob.AllowsRemoteUpdate() || prefs.AutoUpdate().Apply
+	hi.Location = locationWithZone(hi.Location, prefs.TailscaleZoneID())
 
 	var sshHostKeys []string
 	if prefs.RunSSH() && envknob.CanSSHD() {
 		// TODO(bradfitz): this is called with b.mu held. Not ideal.
 		// If the filesystem gets wedged or something we could block for
 		// a long time. But probably fine.
-		sshHostKeys = b.getSSHHostKeyPublicStrings()
+		sshHostKeys = b.getSSHHostKeyPublicStrings(prefs.SSHKeyPath())
 	}
 	hi.SSH_HostKeys = sshHostKeys
 
@@ -3858,6 +4497,24 @@ func (b *LocalBackend) applyPrefsToHostinfoLocked(hi *tailcfg.Hostinfo, prefs ip
 	hi.WireIngress = b.wantIngressLocked()
 }
 
+// locationWithZone returns a copy of loc with its Zone set to zone, or nil
+// if that copy would be empty. loc may be nil.
+func locationWithZone(loc *tailcfg.Location, zone string) *tailcfg.Location {
+	if loc == nil {
+		if zone == "" {
+			return nil
+		}
+		loc = new(tailcfg.Location)
+	} else {
+		loc = loc.Clone()
+	}
+	loc.Zone = zone
+	if *loc == (tailcfg.Location{}) {
+		return nil
+	}
+	return loc
+}
+
 // enterState transitions the backend into newState, updating internal
 // state and propagating events out as needed.
 //
@@ -4120,6 +4777,9 @@ func (b *LocalBackend) ResetForClientDisconnect() {
 	b.authURLSticky = ""
 	b.activeLogin = ""
 	b.setAtomicValuesFromPrefsLocked(ipn.PrefsView{})
+	b.stopMetricsServerLocked()
+	b.stopPortForwardsLocked()
+	b.stopDiagnosticsLocked()
 	b.enterStateLockedOnEntry(ipn.Stopped)
 }
 
@@ -4881,6 +5541,19 @@ func peerCanProxyDNS(p tailcfg.NodeView) bool {
 	return false
 }
 
+// PrepareForSuspend is called when the OS is about to suspend. If the
+// KeepAliveOnSuspend pref is set, it sends a WireGuard keepalive to every
+// peer so their sessions are still fresh when this node resumes. It reports
+// whether the keepalives were sent.
+func (b *LocalBackend) PrepareForSuspend() bool {
+	if !b.Prefs().KeepAliveOnSuspend() {
+		return false
+	}
+	b.logf("sending WireGuard keepalives before suspend")
+	b.e.SendKeepalives()
+	return true
+}
+
 func (b *LocalBackend) DebugRebind() error {
 	b.magicConn().Rebind()
 	return nil
@@ -5215,6 +5888,7 @@ func (b *LocalBackend) resetForProfileChangeLockedOnEntry() error {
 		return nil
 	}
 	b.setNetMapLocked(nil) // Reset netmap.
+	b.exitNodeFallbackIndex = 0
 	// Reset the NetworkMap in the engine
 	b.e.SetNetworkMap(new(netmap.NetworkMap))
 	if err := b.initTKALocked(); err != nil {
@@ -5246,6 +5920,31 @@ func (b *LocalBackend) DeleteProfile(p ipn.ProfileID) error {
 	return b.resetForProfileChangeLockedOnEntry()
 }
 
+// MergeProfiles merges the profile src into dst and deletes src, copying
+// src's prefs into dst; see profileManager.Merge for which fields take
+// priority. If either profile is the current one, the backend is restarted
+// on the merged profile, which notifies watchers of the new prefs. Otherwise
+// watchers are sent the unchanged current prefs so they reload the profile
+// list.
+func (b *LocalBackend) MergeProfiles(src, dst ipn.ProfileID) error {
+	b.mu.Lock()
+	cur := b.pm.CurrentProfile().ID
+	needToRestart := src != dst && (cur == src || cur == dst)
+	if err := b.pm.Merge(src, dst); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	if !needToRestart {
+		prefs := b.pm.CurrentPrefs()
+		b.mu.Unlock()
+		if src != dst {
+			b.send(ipn.Notify{Prefs: &prefs})
+		}
+		return nil
+	}
+	return b.resetForProfileChangeLockedOnEntry()
+}
+
 // CurrentProfile returns the current LoginProfile.
 // The value may be zero if the profile is not persisted.
 func (b *LocalBackend) CurrentProfile() ipn.LoginProfile {
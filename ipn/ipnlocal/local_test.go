@@ -5,20 +5,34 @@
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"go4.org/netipx"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/packet"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsd"
 	"tailscale.com/tstest"
@@ -27,6 +41,7 @@
 	"tailscale.com/types/logger"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/persist"
 	"tailscale.com/types/ptr"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/set"
@@ -441,6 +456,962 @@ func TestLazyMachineKeyGeneration(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 }
 
+func TestEffectiveExitNodeID(t *testing.T) {
+	exitRoutes := []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.1/32"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/0"),
+	}
+	node := func(id tailcfg.NodeID, stableID tailcfg.StableNodeID, country string, online bool, exit bool) tailcfg.NodeView {
+		n := &tailcfg.Node{
+			ID:         id,
+			StableID:   stableID,
+			Online:     ptr.To(online),
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Hostinfo: (&tailcfg.Hostinfo{
+				Location: &tailcfg.Location{CountryCode: country},
+			}).View(),
+		}
+		if exit {
+			n.AllowedIPs = exitRoutes
+		}
+		return n.View()
+	}
+	peers := []tailcfg.NodeView{
+		node(1, "ca-1", "CA", true, true),
+		node(2, "de-2", "DE", true, true),
+		node(3, "de-1", "DE", false, true), // offline
+		node(4, "de-0", "DE", true, false), // not an exit node
+		node(5, "de-3", "DE", true, true),
+	}
+	tests := []struct {
+		name  string
+		prefs ipn.Prefs
+		peers []tailcfg.NodeView
+		want  tailcfg.StableNodeID
+	}{
+		{
+			name:  "none",
+			prefs: ipn.Prefs{ExitNodeCountry: "DE"},
+			peers: peers,
+			want:  "",
+		},
+		{
+			name:  "id_available",
+			prefs: ipn.Prefs{ExitNodeID: "ca-1", ExitNodeCountry: "DE"},
+			peers: peers,
+			want:  "ca-1",
+		},
+		{
+			name:  "id_gone_no_country",
+			prefs: ipn.Prefs{ExitNodeID: "gone"},
+			peers: peers,
+			want:  "gone",
+		},
+		{
+			name:  "id_gone_country",
+			prefs: ipn.Prefs{ExitNodeID: "gone", ExitNodeCountry: "DE"},
+			peers: peers,
+			want:  "de-2",
+		},
+		{
+			name:  "id_offline_country",
+			prefs: ipn.Prefs{ExitNodeID: "de-1", ExitNodeCountry: "CA"},
+			peers: peers,
+			want:  "ca-1",
+		},
+		{
+			name:  "id_gone_no_match",
+			prefs: ipn.Prefs{ExitNodeID: "gone", ExitNodeCountry: "FR"},
+			peers: peers,
+			want:  "gone",
+		},
+		{
+			name:  "online_unknown",
+			prefs: ipn.Prefs{ExitNodeID: "x", ExitNodeCountry: "DE"},
+			peers: []tailcfg.NodeView{(&tailcfg.Node{ID: 9, StableID: "x"}).View()},
+			want:  "x",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := effectiveExitNodeID(tt.prefs.View(), peersMap(tt.peers), 0)
+			if got != tt.want {
+				t.Errorf("effectiveExitNodeID = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectExitNodeFallbacks(t *testing.T) {
+	node := func(id tailcfg.NodeID, stableID tailcfg.StableNodeID, online bool) tailcfg.NodeView {
+		return (&tailcfg.Node{
+			ID:         id,
+			StableID:   stableID,
+			Online:     ptr.To(online),
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+			Hostinfo: (&tailcfg.Hostinfo{
+				Location: &tailcfg.Location{CountryCode: "DE"},
+			}).View(),
+		}).View()
+	}
+	fallbacks := []tailcfg.StableNodeID{"fb1", "fb2"}
+	tests := []struct {
+		name      string
+		index     int
+		country   string
+		peers     []tailcfg.NodeView
+		want      tailcfg.StableNodeID
+		wantIndex int
+	}{
+		{
+			name:  "primary_up",
+			peers: []tailcfg.NodeView{node(1, "primary", true), node(2, "fb1", true)},
+			want:  "primary",
+		},
+		{
+			name:      "primary_gone",
+			peers:     []tailcfg.NodeView{node(2, "fb1", true), node(3, "fb2", true)},
+			want:      "fb1",
+			wantIndex: 1,
+		},
+		{
+			name:      "primary_and_first_offline",
+			peers:     []tailcfg.NodeView{node(1, "primary", false), node(2, "fb1", false), node(3, "fb2", true)},
+			want:      "fb2",
+			wantIndex: 2,
+		},
+		{
+			name:      "sticky",
+			index:     2,
+			peers:     []tailcfg.NodeView{node(1, "primary", true), node(2, "fb1", true), node(3, "fb2", true)},
+			want:      "fb2",
+			wantIndex: 2,
+		},
+		{
+			name:  "active_fails_back_to_primary",
+			index: 2,
+			peers: []tailcfg.NodeView{node(1, "primary", true), node(3, "fb2", false)},
+			want:  "primary",
+		},
+		{
+			name:      "fallbacks_before_country",
+			country:   "DE",
+			peers:     []tailcfg.NodeView{node(4, "a-de", true), node(3, "fb2", true)},
+			want:      "fb2",
+			wantIndex: 2,
+		},
+		{
+			name:    "country_after_fallbacks",
+			country: "DE",
+			peers:   []tailcfg.NodeView{node(4, "a-de", true), node(3, "fb2", false)},
+			want:    "a-de",
+		},
+		{
+			name:  "none",
+			index: 1,
+			peers: []tailcfg.NodeView{node(2, "fb1", false)},
+			want:  "primary",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefs := &ipn.Prefs{
+				ExitNodeID:        "primary",
+				ExitNodeFallbacks: fallbacks,
+				ExitNodeCountry:   tt.country,
+			}
+			got, gotIndex := selectExitNode(prefs.View(), peersMap(tt.peers), tt.index)
+			if got != tt.want || gotIndex != tt.wantIndex {
+				t.Errorf("selectExitNode = %q, %d; want %q, %d", got, gotIndex, tt.want, tt.wantIndex)
+			}
+
+			b := newTestLocalBackend(t)
+			b.mu.Lock()
+			b.setNetMapLocked(&netmap.NetworkMap{Peers: tt.peers})
+			b.exitNodeFallbackIndex = tt.index
+			b.updateExitNodeFallbackIndexLocked(prefs.View())
+			gotIndex = b.exitNodeFallbackIndex
+			b.mu.Unlock()
+			if gotIndex != tt.wantIndex {
+				t.Errorf("exitNodeFallbackIndex = %d; want %d", gotIndex, tt.wantIndex)
+			}
+		})
+	}
+}
+
+func TestExitNodeFallbackIndexReset(t *testing.T) {
+	node := func(id tailcfg.NodeID, stableID tailcfg.StableNodeID) tailcfg.NodeView {
+		return (&tailcfg.Node{
+			ID:       id,
+			StableID: stableID,
+			Online:   ptr.To(true),
+			Hostinfo: (&tailcfg.Hostinfo{}).View(),
+		}).View()
+	}
+	b := newTestLocalBackend(t)
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			ExitNodeID:        "primary",
+			ExitNodeFallbacks: []tailcfg.StableNodeID{"fb1", "fb2"},
+		},
+		ExitNodeIDSet:        true,
+		ExitNodeFallbacksSet: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The primary is gone and fb2 is in use, though fb1 is back.
+	b.mu.Lock()
+	b.setNetMapLocked(&netmap.NetworkMap{Peers: []tailcfg.NodeView{node(2, "fb1"), node(3, "fb2")}})
+	b.exitNodeFallbackIndex = 2
+	b.mu.Unlock()
+	index := func() int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.exitNodeFallbackIndex
+	}
+
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{Prefs: ipn.Prefs{Hostname: "foo"}, HostnameSet: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := index(); got != 2 {
+		t.Errorf("after unrelated edit, index = %d; want 2 kept", got)
+	}
+
+	// Reordering the fallbacks starts over from the front of the new list.
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:                ipn.Prefs{ExitNodeFallbacks: []tailcfg.StableNodeID{"fb2", "fb1"}},
+		ExitNodeFallbacksSet: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := index(); got != 1 {
+		t.Errorf("after editing ExitNodeFallbacks, index = %d; want 1", got)
+	}
+}
+
+func TestExitNodeRotation(t *testing.T) {
+	lb := newTestLocalBackend(t)
+	if err := lb.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	_, err := lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			ExitNodeIDs:    []tailcfg.StableNodeID{"n1", "n2", "n3"},
+			ExitNodeRotate: true,
+		},
+		ExitNodeIDsSet:    true,
+		ExitNodeRotateSet: true,
+	})
+	if err != nil {
+		t.Fatalf("EditPrefs: %v", err)
+	}
+	lb.mu.Lock()
+	armed := lb.exitNodeRotateTimer != nil
+	every := lb.exitNodeRotateEvery
+	lb.mu.Unlock()
+	if !armed {
+		t.Fatal("rotation timer not started")
+	}
+	if every != ipn.DefaultExitNodeRotateInterval {
+		t.Errorf("rotation interval = %v; want %v", every, ipn.DefaultExitNodeRotateInterval)
+	}
+
+	// Invoke the timer callback directly rather than waiting for it.
+	var got []tailcfg.StableNodeID
+	for i := 0; i < 4; i++ {
+		lb.rotateExitNode()
+		got = append(got, lb.Prefs().ExitNodeID())
+	}
+	want := []tailcfg.StableNodeID{"n1", "n2", "n3", "n1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rotation = %v; want %v", got, want)
+	}
+
+	_, err = lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:             ipn.Prefs{ExitNodeRotate: false},
+		ExitNodeRotateSet: true,
+	})
+	if err != nil {
+		t.Fatalf("EditPrefs: %v", err)
+	}
+	lb.mu.Lock()
+	armed = lb.exitNodeRotateTimer != nil
+	lb.mu.Unlock()
+	if armed {
+		t.Error("rotation timer still running after disabling rotation")
+	}
+}
+
+func TestSetTailnetName(t *testing.T) {
+	prefs := &ipn.Prefs{}
+	if setTailnetName(prefs, nil) {
+		t.Error("changed with nil netmap")
+	}
+	nm := &netmap.NetworkMap{Domain: "acme-corp.example"}
+	if !setTailnetName(prefs, nm) {
+		t.Error("not changed on first netmap")
+	}
+	if prefs.TailnetName != "acme-corp.example" {
+		t.Errorf("TailnetName = %q; want %q", prefs.TailnetName, "acme-corp.example")
+	}
+	if setTailnetName(prefs, nm) {
+		t.Error("changed on identical netmap")
+	}
+	if setTailnetName(prefs, &netmap.NetworkMap{}) || prefs.TailnetName != "acme-corp.example" {
+		t.Errorf("netmap without a domain cleared TailnetName to %q", prefs.TailnetName)
+	}
+}
+
+func TestTailnetNameReadOnly(t *testing.T) {
+	lb := newTestLocalBackend(t)
+	if err := lb.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	lb.mu.Lock()
+	p := lb.pm.CurrentPrefs().AsStruct()
+	setTailnetName(p, &netmap.NetworkMap{Domain: "acme-corp.example"})
+	if err := lb.pm.SetPrefs(p.View(), ""); err != nil {
+		lb.mu.Unlock()
+		t.Fatal(err)
+	}
+	lb.mu.Unlock()
+
+	_, err := lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:          ipn.Prefs{TailnetName: "evil"},
+		TailnetNameSet: true,
+	})
+	if err == nil {
+		t.Error("EditPrefs setting TailnetName succeeded; want error")
+	}
+
+	// Other edits keep the populated name.
+	got, err := lb.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:       ipn.Prefs{Hostname: "foo"},
+		HostnameSet: true,
+	})
+	if err != nil {
+		t.Fatalf("EditPrefs: %v", err)
+	}
+	if got.TailnetName() != "acme-corp.example" {
+		t.Errorf("TailnetName = %q; want %q", got.TailnetName(), "acme-corp.example")
+	}
+}
+
+func TestUpdateFilterShieldsUpMode(t *testing.T) {
+	lb := newTestLocalBackend(t)
+	tests := []struct {
+		prefs        *ipn.Prefs
+		wantInbound  bool
+		wantOutbound bool
+	}{
+		{&ipn.Prefs{}, false, false},
+		{&ipn.Prefs{ShieldsUp: true}, true, false},
+		{&ipn.Prefs{ShieldsUpMode: ipn.ShieldsUpModeAll}, true, true},
+		{&ipn.Prefs{ShieldsUpMode: ipn.ShieldsUpModeInboundOnly}, true, false},
+		{&ipn.Prefs{ShieldsUpMode: ipn.ShieldsUpModeOutboundOnly}, false, true},
+	}
+	for _, tt := range tests {
+		lb.mu.Lock()
+		lb.updateFilterLocked(&netmap.NetworkMap{}, tt.prefs.View())
+		f := lb.e.GetFilter()
+		lb.mu.Unlock()
+		if got := f.ShieldsUp(); got != tt.wantInbound {
+			t.Errorf("%v: filter ShieldsUp = %v; want %v", tt.prefs.Pretty(), got, tt.wantInbound)
+		}
+		if got := f.BlocksOutbound(); got != tt.wantOutbound {
+			t.Errorf("%v: filter BlocksOutbound = %v; want %v", tt.prefs.Pretty(), got, tt.wantOutbound)
+		}
+	}
+}
+
+func TestUpdateFilterLocallyServedPorts(t *testing.T) {
+	lb := newTestLocalBackend(t)
+	self := netip.MustParseAddr("100.64.1.1")
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			Addresses: []netip.Prefix{netip.PrefixFrom(self, 32)},
+		}).View(),
+	}
+	peer := netip.MustParseAddr("100.64.2.2")
+	tests := []struct {
+		prefs *ipn.Prefs
+		port  uint16
+		want  filter.Response
+	}{
+		{&ipn.Prefs{ShieldsUp: true}, 9090, filter.Drop},
+		{&ipn.Prefs{ShieldsUp: true, LocallyServedPorts: []uint16{9090}}, 9090, filter.Accept},
+		{&ipn.Prefs{ShieldsUp: true, LocallyServedPorts: []uint16{9090}}, 22, filter.Drop},
+		{&ipn.Prefs{LocallyServedPorts: []uint16{9090}}, 9090, filter.Accept},
+	}
+	for _, tt := range tests {
+		lb.mu.Lock()
+		lb.updateFilterLocked(nm, tt.prefs.View())
+		f := lb.e.GetFilter()
+		lb.mu.Unlock()
+		if got := f.CheckTCP(peer, self, tt.port); got != tt.want {
+			t.Errorf("%v: CheckTCP port %d = %v; want %v", tt.prefs.Pretty(), tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateFilterAllowedSources(t *testing.T) {
+	lb := newTestLocalBackend(t)
+	self := netip.MustParseAddr("100.64.1.1")
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			Addresses: []netip.Prefix{netip.PrefixFrom(self, 32)},
+		}).View(),
+	}
+	allowed := netip.MustParseAddr("100.64.2.2")
+	other := netip.MustParseAddr("100.64.3.3")
+	srcs := []netip.Prefix{netip.PrefixFrom(allowed, 32)}
+	tests := []struct {
+		prefs       *ipn.Prefs
+		src         netip.Addr
+		want        filter.Response
+		wantOutDrop bool // whether a packet to src is dropped
+	}{
+		{&ipn.Prefs{ShieldsUpMode: ipn.ShieldsUpModeAll}, allowed, filter.Drop, true},
+		{&ipn.Prefs{ShieldsUpMode: ipn.ShieldsUpModeAll, AllowedSources: srcs}, allowed, filter.Accept, false},
+		{&ipn.Prefs{ShieldsUpMode: ipn.ShieldsUpModeAll, AllowedSources: srcs}, other, filter.Drop, true},
+		{&ipn.Prefs{ShieldsUpMode: ipn.ShieldsUpModeOutboundOnly, AllowedSources: srcs}, allowed, filter.Drop, false},
+		// With shields down, the (empty) tailnet packet filter applies.
+		{&ipn.Prefs{AllowedSources: srcs}, allowed, filter.Drop, false},
+	}
+	for _, tt := range tests {
+		lb.mu.Lock()
+		lb.updateFilterLocked(nm, tt.prefs.View())
+		f := lb.e.GetFilter()
+		lb.mu.Unlock()
+		if got := f.CheckTCP(tt.src, self, 22); got != tt.want {
+			t.Errorf("%v: CheckTCP from %v = %v; want %v", tt.prefs.Pretty(), tt.src, got, tt.want)
+		}
+		var out packet.Parsed
+		out.Decode(packet.Generate(&packet.UDP4Header{
+			IP4Header: packet.IP4Header{Src: self, Dst: tt.src},
+			SrcPort:   4343,
+			DstPort:   53,
+		}, nil))
+		if got := f.RunOut(&out, 0) == filter.Drop; got != tt.wantOutDrop {
+			t.Errorf("%v: RunOut to %v dropped = %v; want %v", tt.prefs.Pretty(), tt.src, got, tt.wantOutDrop)
+		}
+	}
+}
+
+func TestPrepareForSuspend(t *testing.T) {
+	b := newTestLocalBackend(t)
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if b.PrepareForSuspend() {
+		t.Error("PrepareForSuspend sent keepalives without KeepAliveOnSuspend")
+	}
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:                 ipn.Prefs{KeepAliveOnSuspend: true},
+		KeepAliveOnSuspendSet: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !b.PrepareForSuspend() {
+		t.Error("PrepareForSuspend didn't send keepalives with KeepAliveOnSuspend")
+	}
+}
+
+func TestRoamHandshakes(t *testing.T) {
+	b := newTestLocalBackend(t)
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	timer := func() (armed bool, every time.Duration) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.roamHandshakeTimer != nil, b.roamHandshakeEvery
+	}
+	setInterval := func(d *time.Duration) {
+		t.Helper()
+		if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+			Prefs:                    ipn.Prefs{WireGuardRoamInterval: d},
+			WireGuardRoamIntervalSet: true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// By default, only WireGuard's own handshakes are done.
+	if armed, _ := timer(); armed {
+		t.Fatal("roam handshake timer running with nil WireGuardRoamInterval")
+	}
+
+	setInterval(ptr.To(5 * time.Second))
+	if armed, every := timer(); !armed || every != 5*time.Second {
+		t.Fatalf("timer armed=%v every=%v; want true, 5s", armed, every)
+	}
+	// Invoke the timer callback directly; it reschedules itself.
+	b.sendRoamHandshakes()
+	if armed, every := timer(); !armed || every != 5*time.Second {
+		t.Fatalf("after firing: timer armed=%v every=%v; want true, 5s", armed, every)
+	}
+
+	setInterval(ptr.To(10 * time.Second))
+	if armed, every := timer(); !armed || every != 10*time.Second {
+		t.Fatalf("timer armed=%v every=%v; want true, 10s", armed, every)
+	}
+
+	setInterval(nil)
+	if armed, _ := timer(); armed {
+		t.Error("roam handshake timer still running after clearing WireGuardRoamInterval")
+	}
+}
+
+func TestPeerMetricsStatus(t *testing.T) {
+	b := newTestLocalBackend(t)
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	peerKey := key.NewNode().Public()
+	b.mu.Lock()
+	b.setNetMapLocked(&netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			ID:        1,
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ID:        2,
+				Key:       peerKey,
+				Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				Hostinfo:  (&tailcfg.Hostinfo{}).View(),
+			}).View(),
+		},
+	})
+	b.mu.Unlock()
+	setEnabled := func(v bool) {
+		t.Helper()
+		if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+			Prefs:                 ipn.Prefs{PeerMetricsEnabled: v},
+			PeerMetricsEnabledSet: true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peerStats := func() *ipnstate.PeerStats {
+		t.Helper()
+		ps, ok := b.Status().Peer[peerKey]
+		if !ok {
+			t.Fatal("peer missing from Status")
+		}
+		return ps.Stats
+	}
+
+	if got := peerStats(); got != nil {
+		t.Errorf("Stats = %+v with PeerMetricsEnabled unset; want nil", got)
+	}
+	setEnabled(true)
+	if got := peerStats(); got == nil || *got != (ipnstate.PeerStats{}) {
+		t.Errorf("Stats = %+v with PeerMetricsEnabled; want zero counts", got)
+	}
+	setEnabled(false)
+	if got := peerStats(); got != nil {
+		t.Errorf("Stats = %+v after clearing PeerMetricsEnabled; want nil", got)
+	}
+}
+
+func TestPeerStatsForAddrs(t *testing.T) {
+	a1 := netip.MustParseAddr("100.64.0.2")
+	a2 := netip.MustParseAddr("fd7a:115c:a1e0::2")
+	other := netip.MustParseAddr("100.64.0.3")
+	counts := map[netip.Addr]tstun.PeerCounts{
+		a1:    {TxPackets: 1, RxPackets: 2},
+		a2:    {TxPackets: 10, RxPackets: 20},
+		other: {TxPackets: 100, RxPackets: 200},
+	}
+	got := peerStatsForAddrs(counts, []netip.Addr{a1, a2})
+	if want := (ipnstate.PeerStats{TxPackets: 11, RxPackets: 22}); *got != want {
+		t.Errorf("peerStatsForAddrs = %+v; want %+v", *got, want)
+	}
+}
+
+func TestAppendPropagatedPeerRoutes(t *testing.T) {
+	pfx := netip.MustParsePrefix
+	nm := &netmap.NetworkMap{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ID:            1,
+				PrimaryRoutes: []netip.Prefix{pfx("10.1.0.0/16"), pfx("0.0.0.0/0")},
+			}).View(),
+			(&tailcfg.Node{
+				ID:            2,
+				PrimaryRoutes: []netip.Prefix{pfx("10.2.0.0/16"), pfx("192.168.0.0/24")},
+			}).View(),
+			(&tailcfg.Node{ID: 3}).View(),
+		},
+	}
+	tests := []struct {
+		name   string
+		routes []netip.Prefix
+		nm     *netmap.NetworkMap
+		filter *netip.Prefix
+		want   []netip.Prefix
+	}{
+		{
+			name: "nil_netmap",
+			want: nil,
+		},
+		{
+			name: "peer_routes",
+			nm:   nm,
+			want: []netip.Prefix{pfx("10.1.0.0/16"), pfx("10.2.0.0/16"), pfx("192.168.0.0/24")},
+		},
+		{
+			name:   "keeps_own_routes_without_dups",
+			routes: []netip.Prefix{pfx("192.168.0.0/24"), pfx("172.16.0.0/12")},
+			nm:     nm,
+			want:   []netip.Prefix{pfx("192.168.0.0/24"), pfx("172.16.0.0/12"), pfx("10.1.0.0/16"), pfx("10.2.0.0/16")},
+		},
+		{
+			name:   "filter",
+			nm:     nm,
+			filter: ptr.To(pfx("10.0.0.0/8")),
+			want:   []netip.Prefix{pfx("10.1.0.0/16"), pfx("10.2.0.0/16")},
+		},
+		{
+			name:   "filter_narrower_than_route",
+			nm:     nm,
+			filter: ptr.To(pfx("10.1.2.0/24")),
+			want:   nil,
+		},
+		{
+			name:   "filter_not_masked",
+			routes: []netip.Prefix{pfx("172.16.0.0/12")},
+			nm:     nm,
+			filter: ptr.To(pfx("10.2.3.4/16")),
+			want:   []netip.Prefix{pfx("172.16.0.0/12"), pfx("10.2.0.0/16")},
+		},
+		{
+			// A route this node is primary for must not be propagated
+			// back to itself.
+			name: "skips_self_primary",
+			nm: &netmap.NetworkMap{
+				SelfNode: (&tailcfg.Node{
+					ID:            9,
+					PrimaryRoutes: []netip.Prefix{pfx("10.1.0.0/16")},
+				}).View(),
+				Peers: nm.Peers,
+			},
+			want: []netip.Prefix{pfx("10.2.0.0/16"), pfx("192.168.0.0/24")},
+		},
+		{
+			// Control hands an offline peer's routes over to another
+			// advertiser, which could be this node.
+			name: "skips_offline_peer",
+			nm: &netmap.NetworkMap{
+				Peers: []tailcfg.NodeView{
+					(&tailcfg.Node{
+						ID:            1,
+						Online:        ptr.To(false),
+						PrimaryRoutes: []netip.Prefix{pfx("10.1.0.0/16")},
+					}).View(),
+					(&tailcfg.Node{
+						ID:            2,
+						Online:        ptr.To(true),
+						PrimaryRoutes: []netip.Prefix{pfx("10.2.0.0/16")},
+					}).View(),
+				},
+			},
+			want: []netip.Prefix{pfx("10.2.0.0/16")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := appendPropagatedPeerRoutes(slices.Clone(tt.routes), tt.nm, tt.filter)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The routes are only advertised when propagation is enabled.
+	lb := newTestLocalBackend(t)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.netMap = nm
+	hi := new(tailcfg.Hostinfo)
+	lb.applyPrefsToHostinfoLocked(hi, (&ipn.Prefs{RouteAll: true}).View())
+	if len(hi.RoutableIPs) != 0 {
+		t.Errorf("RoutableIPs without propagation = %v; want none", hi.RoutableIPs)
+	}
+	lb.applyPrefsToHostinfoLocked(hi, (&ipn.Prefs{RouteAll: true, PeerRoutePropagation: true}).View())
+	if want := tests[1].want; !reflect.DeepEqual(hi.RoutableIPs, want) {
+		t.Errorf("RoutableIPs with propagation = %v; want %v", hi.RoutableIPs, want)
+	}
+	lb.applyPrefsToHostinfoLocked(hi, (&ipn.Prefs{
+		RouteAll:               true,
+		PeerRoutePropagation:   true,
+		RoutePropagationFilter: ptr.To(pfx("192.168.0.0/16")),
+	}).View())
+	if want := []netip.Prefix{pfx("192.168.0.0/24")}; !reflect.DeepEqual(hi.RoutableIPs, want) {
+		t.Errorf("RoutableIPs with propagation filter = %v; want %v", hi.RoutableIPs, want)
+	}
+}
+
+func TestHostinfoZone(t *testing.T) {
+	lb := newTestLocalBackend(t)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	hi := &tailcfg.Hostinfo{Location: &tailcfg.Location{City: "Squamish"}}
+	orig := hi.Location
+	lb.applyPrefsToHostinfoLocked(hi, (&ipn.Prefs{TailscaleZoneID: "us-east-1a"}).View())
+	if want := (tailcfg.Location{City: "Squamish", Zone: "us-east-1a"}); hi.Location == nil || *hi.Location != want {
+		t.Errorf("Location = %+v; want %+v", hi.Location, want)
+	}
+	if orig.Zone != "" {
+		t.Errorf("original Location was modified: %+v", orig)
+	}
+
+	lb.applyPrefsToHostinfoLocked(hi, (&ipn.Prefs{}).View())
+	if want := (tailcfg.Location{City: "Squamish"}); hi.Location == nil || *hi.Location != want {
+		t.Errorf("Location after clearing zone = %+v; want %+v", hi.Location, want)
+	}
+
+	hi = new(tailcfg.Hostinfo)
+	lb.applyPrefsToHostinfoLocked(hi, (&ipn.Prefs{TailscaleZoneID: "zone-1"}).View())
+	if hi.Location == nil || hi.Location.Zone != "zone-1" {
+		t.Errorf("Location = %+v; want zone-1", hi.Location)
+	}
+	lb.applyPrefsToHostinfoLocked(hi, (&ipn.Prefs{}).View())
+	if hi.Location != nil {
+		t.Errorf("Location after clearing zone = %+v; want nil", hi.Location)
+	}
+}
+
+func TestInvalidPrefsWarning(t *testing.T) {
+	bad := &ipn.Prefs{AdvertiseRoutes: []netip.Prefix{netip.MustParsePrefix("10.1.2.3/8")}}
+	if err := invalidPrefsWarning(bad.View()); !errors.Is(err, ipn.ErrInvalidAdvertiseRoute) {
+		t.Errorf("invalidPrefsWarning(invalid) = %v; want ErrInvalidAdvertiseRoute", err)
+	}
+	if err := invalidPrefsWarning(ipn.NewPrefs().View()); err != nil {
+		t.Errorf("invalidPrefsWarning(valid) = %v; want nil", err)
+	}
+	if err := invalidPrefsWarning(ipn.PrefsView{}); err != nil {
+		t.Errorf("invalidPrefsWarning(unset) = %v; want nil", err)
+	}
+}
+
+func TestMergeProfilesNotCurrentNotifies(t *testing.T) {
+	b := newTestLocalBackend(t)
+	newProfile := func(node int) ipn.LoginProfile {
+		t.Helper()
+		b.pm.NewProfile()
+		p := b.pm.CurrentPrefs().AsStruct()
+		p.Persist = &persist.Persist{
+			NodeID: tailcfg.StableNodeID(fmt.Sprintf("node%d", node)),
+			UserProfile: tailcfg.UserProfile{
+				ID:        tailcfg.UserID(node),
+				LoginName: fmt.Sprintf("user%d@example.com", node),
+			},
+		}
+		if err := b.pm.SetPrefs(p.View(), ""); err != nil {
+			t.Fatal(err)
+		}
+		return b.pm.CurrentProfile()
+	}
+	dst := newProfile(1)
+	src := newProfile(2)
+	cur := newProfile(3)
+
+	var notified atomic.Bool
+	b.SetNotifyCallback(func(n ipn.Notify) {
+		if n.Prefs != nil {
+			notified.Store(true)
+		}
+	})
+	if err := b.MergeProfiles(src.ID, dst.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !notified.Load() {
+		t.Error("no prefs notification after merging profiles that aren't current")
+	}
+	if got := b.CurrentProfile().ID; got != cur.ID {
+		t.Errorf("current profile = %q; want %q", got, cur.ID)
+	}
+	if got := len(b.ListProfiles()); got != 2 {
+		t.Errorf("got %d profiles; want 2", got)
+	}
+}
+
+func TestControlURLChangeNeedsReauth(t *testing.T) {
+	const (
+		custom = "https://headscale.example.com"
+		other  = "https://other.example.com"
+	)
+	tests := []struct {
+		name   string
+		oldURL string
+		newURL string
+		want   bool
+	}{
+		{"first_set", "", custom, false},
+		{"from_default", ipn.DefaultControlURL, custom, false},
+		{"unchanged", custom, custom, false},
+		{"custom_to_custom", custom, other, true},
+		{"custom_to_default", custom, ipn.DefaultControlURL, true},
+		{"custom_to_empty", custom, "", true},
+		{"custom_to_file", custom, "file:///tmp/netmap.json", false},
+		{"login_synonym_to_default", "https://login.tailscale.com", ipn.DefaultControlURL, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldp := &ipn.Prefs{ControlURL: tt.oldURL}
+			newp := &ipn.Prefs{ControlURL: tt.newURL}
+			if got := controlURLChangeNeedsReauth(oldp.View(), newp.View()); got != tt.want {
+				t.Errorf("controlURLChangeNeedsReauth(%q, %q) = %v; want %v", tt.oldURL, tt.newURL, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditPrefsControlURLChangeNeedsLogin(t *testing.T) {
+	b := newTestLocalBackend(t)
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	var (
+		mu     sync.Mutex
+		states []ipn.State
+		browse []string
+	)
+	b.SetNotifyCallback(func(n ipn.Notify) {
+		mu.Lock()
+		defer mu.Unlock()
+		if n.State != nil {
+			states = append(states, *n.State)
+		}
+		if n.BrowseToURL != nil {
+			browse = append(browse, *n.BrowseToURL)
+		}
+	})
+	setURL := func(u string) {
+		t.Helper()
+		if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+			ControlURLSet: true,
+			Prefs:         ipn.Prefs{ControlURL: u},
+		}); err != nil {
+			t.Fatalf("EditPrefs(%q): %v", u, err)
+		}
+	}
+
+	setURL("https://headscale.example.com")
+	b.mu.Lock()
+	b.state = ipn.Running
+	b.mu.Unlock()
+	setURL("https://headscale.example.com")
+	setURL("https://other.example.com")
+
+	if got := b.State(); got != ipn.NeedsLogin {
+		t.Errorf("State = %v; want %v", got, ipn.NeedsLogin)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []ipn.State{ipn.NeedsLogin}; !slices.Equal(states, want) {
+		t.Errorf("State notifications = %v; want %v", states, want)
+	}
+	if len(browse) > 0 {
+		t.Errorf("BrowseToURL notifications = %q; want none", browse)
+	}
+}
+
+func TestMaxLogLineLength(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	sys := new(tsd.System)
+	sys.Set(new(mem.Store))
+	eng, err := wgengine.NewFakeUserspaceEngine(logger.Discard, sys.Set)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	sys.Set(eng)
+	b, err := NewLocalBackend(logf, logid.PublicID{}, sys, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	lastLine := func(msg string) string {
+		t.Helper()
+		b.logf("%s", msg)
+		mu.Lock()
+		defer mu.Unlock()
+		return lines[len(lines)-1]
+	}
+	long := strings.Repeat("x", 10000)
+	if got := lastLine(long); len(got) != ipn.DefaultMaxLogLineLength || !strings.HasSuffix(got, logger.TruncatedSuffix) {
+		t.Errorf("default: logged %d bytes; want %d ending in %q", len(got), ipn.DefaultMaxLogLineLength, logger.TruncatedSuffix)
+	}
+
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		MaxLogLineLengthSet: true,
+		Prefs:               ipn.Prefs{MaxLogLineLength: 300},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastLine(long); len(got) != 300 || !strings.HasSuffix(got, logger.TruncatedSuffix) {
+		t.Errorf("MaxLogLineLength=300: logged %d bytes; want 300 ending in %q", len(got), logger.TruncatedSuffix)
+	}
+	if got := lastLine(long[:300]); got != long[:300] {
+		t.Errorf("line at the limit was changed to %d bytes", len(got))
+	}
+}
+
+func TestEditPrefsChecksOperatorUser(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("OperatorUser isn't checked on %s", runtime.GOOS)
+	}
+	b := newTestLocalBackend(t)
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	const bogus = "tailscale-test-no-such-user"
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		OperatorUserSet: true,
+		Prefs:           ipn.Prefs{OperatorUser: bogus},
+	}); err == nil || !strings.Contains(err.Error(), "invalid OperatorUser") {
+		t.Fatalf("EditPrefs(OperatorUser=%q) = %v; want invalid OperatorUser error", bogus, err)
+	}
+
+	// Edits that don't touch OperatorUser don't look it up again, so an
+	// operator user deleted after it was set doesn't block other edits.
+	p := b.pm.CurrentPrefs().AsStruct()
+	p.OperatorUser = bogus
+	b.mu.Lock()
+	err := b.pm.SetPrefs(p.View(), "")
+	b.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+		HostnameSet: true,
+		Prefs:       ipn.Prefs{Hostname: "foo"},
+	}); err != nil {
+		t.Fatalf("EditPrefs(Hostname): %v", err)
+	}
+}
+
 func TestFileTargets(t *testing.T) {
 	b := new(LocalBackend)
 	_, err := b.FileTargets()
@@ -1112,7 +2083,7 @@ type tc struct {
 			}
 
 			prefs := &ipn.Prefs{ExitNodeID: tc.exitNode, CorpDNS: true}
-			got := dnsConfigForNetmap(nm, peersMap(tc.peers), prefs.View(), t.Logf, "")
+			got := dnsConfigForNetmap(nm, peersMap(tc.peers), prefs.View(), 0, t.Logf, "")
 			if !resolversEqual(t, got.DefaultResolvers, tc.wantDefaultResolvers) {
 				t.Errorf("DefaultResolvers: got %#v, want %#v", got.DefaultResolvers, tc.wantDefaultResolvers)
 			}
@@ -1157,3 +2128,507 @@ func routesEqual(t *testing.T, a, b map[dnsname.FQDN][]*dnstype.Resolver) bool {
 	}
 	return true
 }
+
+func TestMetricsServer(t *testing.T) {
+	freePort := func() uint16 {
+		t.Helper()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		return uint16(ln.Addr().(*net.TCPAddr).Port)
+	}
+	get := func(port uint16) error {
+		t.Helper()
+		res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			return fmt.Errorf("status %v", res.Status)
+		}
+		return nil
+	}
+	setPort := func(b *LocalBackend, port uint16) {
+		t.Helper()
+		if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+			Prefs:          ipn.Prefs{MetricsPort: port},
+			MetricsPortSet: true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := newTestLocalBackend(t)
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	b.mu.Lock()
+	ms := b.metricsServer
+	b.mu.Unlock()
+	if ms != nil {
+		t.Fatalf("metrics server running with MetricsPort 0")
+	}
+
+	port1 := freePort()
+	setPort(b, port1)
+	if err := get(port1); err != nil {
+		t.Fatalf("metrics on port %d: %v", port1, err)
+	}
+
+	// Changing the port restarts the server on the new port.
+	port2 := freePort()
+	setPort(b, port2)
+	if err := get(port2); err != nil {
+		t.Fatalf("metrics on new port %d: %v", port2, err)
+	}
+	if err := get(port1); err == nil {
+		t.Errorf("metrics still served on old port %d", port1)
+	}
+
+	// Zero disables it.
+	setPort(b, 0)
+	if err := get(port2); err == nil {
+		t.Errorf("metrics still served on port %d after disabling", port2)
+	}
+	b.mu.Lock()
+	ms = b.metricsServer
+	b.mu.Unlock()
+	if ms != nil {
+		t.Errorf("metrics server still set after disabling")
+	}
+
+	// A port that's already taken raises a health warning until the
+	// server listens successfully.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	setPort(b, uint16(taken.Addr().(*net.TCPAddr).Port))
+	if !slices.Contains(health.AppendWarnableDebugFlags(nil), "warn-metrics-port-unhealthy") {
+		t.Errorf("no health warning for metrics port in use")
+	}
+	b.mu.Lock()
+	ms = b.metricsServer
+	b.mu.Unlock()
+	if ms != nil {
+		t.Errorf("metrics server set after failing to listen")
+	}
+	port3 := freePort()
+	setPort(b, port3)
+	if err := get(port3); err != nil {
+		t.Fatalf("metrics on port %d: %v", port3, err)
+	}
+	if slices.Contains(health.AppendWarnableDebugFlags(nil), "warn-metrics-port-unhealthy") {
+		t.Errorf("health warning for metrics port still set after listening")
+	}
+	setPort(b, 0)
+}
+
+func TestDiagnosticsTrigger(t *testing.T) {
+	t0 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		after   time.Duration // since t0
+		healthy bool
+		want    bool
+	}{
+		{0, true, false},
+		{time.Minute, false, false}, // outage begins
+		{time.Minute + diagnosticsLossThreshold - time.Second, false, false},
+		{time.Minute + diagnosticsLossThreshold, false, true},
+		{time.Minute + 2*diagnosticsLossThreshold, false, false}, // once per outage
+		{20 * time.Minute, true, false},                          // recovered
+		{21 * time.Minute, false, false},                         // new outage
+		{21*time.Minute + diagnosticsLossThreshold, false, true},
+	}
+	var trigger diagnosticsTrigger
+	for i, st := range steps {
+		if got := trigger.update(t0.Add(st.after), st.healthy); got != st.want {
+			t.Errorf("step %d (after %v, healthy=%v): update = %v; want %v", i, st.after, st.healthy, got, st.want)
+		}
+	}
+}
+
+func TestDiagnosticsHTTPClient(t *testing.T) {
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	b := newTestLocalBackend(t)
+	c := b.newDiagnosticsHTTPClient()
+	if c.Timeout != diagnosticsUploadTimeout {
+		t.Errorf("Timeout = %v; want %v", c.Timeout, diagnosticsUploadTimeout)
+	}
+	if tr, ok := c.Transport.(*http.Transport); !ok || tr.Proxy == nil || tr.DialContext == nil {
+		t.Errorf("Transport = %#v; want an *http.Transport with Proxy and DialContext set", c.Transport)
+	}
+	if err := postDiagnostics(context.Background(), c, srv.URL, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "{}" {
+		t.Errorf("server got body %q; want {}", got)
+	}
+}
+
+func TestDiagnosticsUpload(t *testing.T) {
+	type upload struct {
+		url    string
+		bundle diagnosticsBundle
+	}
+	uploads := make(chan upload, 1)
+	tstest.Replace(t, &postDiagnostics, func(ctx context.Context, c *http.Client, url string, body []byte) error {
+		var u upload
+		u.url = url
+		if err := json.Unmarshal(body, &u.bundle); err != nil {
+			t.Errorf("bad bundle %q: %v", body, err)
+		}
+		uploads <- u
+		return nil
+	})
+	setDiagnostics := func(b *LocalBackend, enabled bool, url string) {
+		t.Helper()
+		if _, err := b.EditPrefs(&ipn.MaskedPrefs{
+			Prefs:                   ipn.Prefs{DiagnosticsEnabled: enabled, DiagnosticsUploadURL: url},
+			DiagnosticsEnabledSet:   true,
+			DiagnosticsUploadURLSet: true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	running := func(b *LocalBackend) string {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.diagnostics == nil {
+			return ""
+		}
+		return b.diagnostics.url
+	}
+
+	b := newTestLocalBackend(t)
+	if err := b.Start(ipn.Options{}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if got := running(b); got != "" {
+		t.Fatalf("diagnostics uploader running for %q while disabled", got)
+	}
+	const url = "https://diag.example.com/upload"
+	setDiagnostics(b, false, url)
+	if got := running(b); got != "" {
+		t.Fatalf("diagnostics uploader running for %q with DiagnosticsEnabled unset", got)
+	}
+	setDiagnostics(b, true, url)
+	if got := running(b); got != url {
+		t.Fatalf("diagnostics uploader URL = %q; want %q", got, url)
+	}
+
+	lostSince := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.uploadDiagnostics(context.Background(), b.newDiagnosticsHTTPClient(), url, lostSince)
+	select {
+	case u := <-uploads:
+		if u.url != url {
+			t.Errorf("uploaded to %q; want %q", u.url, url)
+		}
+		if !u.bundle.LostSince.Equal(lostSince) {
+			t.Errorf("LostSince = %v; want %v", u.bundle.LostSince, lostSince)
+		}
+		if u.bundle.Hostinfo == nil || u.bundle.State == "" || u.bundle.Version == "" {
+			t.Errorf("incomplete bundle: %+v", u.bundle)
+		}
+	default:
+		t.Fatal("no upload")
+	}
+
+	setDiagnostics(b, false, url)
+	if got := running(b); got != "" {
+		t.Errorf("diagnostics uploader still running for %q after disabling", got)
+	}
+}
+
+func TestDropSubnetRoutesOutside(t *testing.T) {
+	pp := netip.MustParsePrefix
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	nm := &netmap.NetworkMap{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{Key: k1, Addresses: []netip.Prefix{pp("100.64.0.1/32"), pp("fd7a:115c:a1e0::1/128")}}).View(),
+			(&tailcfg.Node{Key: k2, Addresses: []netip.Prefix{pp("100.64.0.2/32")}}).View(),
+		},
+	}
+	cfg := &wgcfg.Config{
+		Peers: []wgcfg.Peer{
+			{PublicKey: k1, AllowedIPs: []netip.Prefix{
+				pp("100.64.0.1/32"),
+				pp("fd7a:115c:a1e0::1/128"),
+				pp("10.1.0.0/16"),
+				pp("10.0.0.0/8"),
+				pp("192.168.1.0/24"),
+				pp("10.2.3.4/32"),
+				pp("fd00::/64"),
+			}},
+			{PublicKey: k2, AllowedIPs: []netip.Prefix{
+				pp("100.64.0.2/32"),
+				pp("0.0.0.0/0"),
+				pp("::/0"),
+				pp("172.16.0.0/12"),
+			}},
+		},
+	}
+	dropSubnetRoutesOutside(cfg, nm, pp("10.0.0.0/8"))
+	want := [][]netip.Prefix{
+		{pp("100.64.0.1/32"), pp("fd7a:115c:a1e0::1/128"), pp("10.1.0.0/16"), pp("10.0.0.0/8"), pp("10.2.3.4/32")},
+		{pp("100.64.0.2/32"), pp("0.0.0.0/0"), pp("::/0")},
+	}
+	for i, p := range cfg.Peers {
+		if !reflect.DeepEqual(p.AllowedIPs, want[i]) {
+			t.Errorf("peer %d AllowedIPs = %v; want %v", i, p.AllowedIPs, want[i])
+		}
+	}
+}
+
+func TestKeepOnlyTailscaleAddrFamily(t *testing.T) {
+	pp := netip.MustParsePrefix
+	k1 := key.NewNode().Public()
+	nm := &netmap.NetworkMap{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{Key: k1, Addresses: []netip.Prefix{pp("100.64.0.1/32"), pp("fd7a:115c:a1e0::1/128")}}).View(),
+		},
+	}
+	newCfg := func() *wgcfg.Config {
+		return &wgcfg.Config{
+			Addresses: []netip.Prefix{pp("100.64.0.9/32"), pp("fd7a:115c:a1e0::9/128")},
+			Peers: []wgcfg.Peer{
+				{PublicKey: k1, AllowedIPs: []netip.Prefix{
+					pp("100.64.0.1/32"),
+					pp("fd7a:115c:a1e0::1/128"),
+					pp("10.0.0.0/8"),
+					pp("fd00::/64"),
+				}},
+			},
+		}
+	}
+	tests := []struct {
+		name      string
+		is4       bool
+		wantAddrs []netip.Prefix
+		wantPeer  []netip.Prefix
+	}{
+		{
+			name:      "ipv4_only",
+			is4:       true,
+			wantAddrs: []netip.Prefix{pp("100.64.0.9/32")},
+			wantPeer:  []netip.Prefix{pp("100.64.0.1/32"), pp("10.0.0.0/8"), pp("fd00::/64")},
+		},
+		{
+			name:      "ipv6_only",
+			is4:       false,
+			wantAddrs: []netip.Prefix{pp("fd7a:115c:a1e0::9/128")},
+			wantPeer:  []netip.Prefix{pp("fd7a:115c:a1e0::1/128"), pp("10.0.0.0/8"), pp("fd00::/64")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newCfg()
+			keepOnlyTailscaleAddrFamily(cfg, nm, tt.is4)
+			if !reflect.DeepEqual(cfg.Addresses, tt.wantAddrs) {
+				t.Errorf("Addresses = %v; want %v", cfg.Addresses, tt.wantAddrs)
+			}
+			if got := cfg.Peers[0].AllowedIPs; !reflect.DeepEqual(got, tt.wantPeer) {
+				t.Errorf("peer AllowedIPs = %v; want %v", got, tt.wantPeer)
+			}
+		})
+	}
+}
+
+func TestApplyDeferredC2NUpdate(t *testing.T) {
+	lb := newTestLocalBackend(t)
+	setPrefs := func(au ipn.AutoUpdatePrefs) {
+		t.Helper()
+		p := lb.Prefs().AsStruct()
+		p.AutoUpdate = au
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		if err := lb.pm.SetPrefs(p.View(), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setTime := func(t time.Time) {
+		lb.clock = tstest.NewClock(tstest.ClockOpts{Start: t})
+	}
+	missingCmd := filepath.Join(t.TempDir(), "tailscale")
+
+	// Auto-updates turned off while the update was deferred: it's dropped.
+	setTime(time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local))
+	setPrefs(ipn.AutoUpdatePrefs{Check: true})
+	lb.setC2NUpdateStarted(true)
+	lb.applyDeferredC2NUpdate(missingCmd)
+	if lb.c2nUpdateStarted() {
+		t.Errorf("update still pending after auto-updates were turned off")
+	}
+
+	// Outside the window (Saturday 12:00), the update stays pending.
+	setPrefs(ipn.AutoUpdatePrefs{
+		Check:       true,
+		Apply:       true,
+		ApplyWindow: &ipn.UpdateWindow{StartHour: 22, EndHour: 6, Weekdays: 1<<time.Saturday | 1<<time.Sunday},
+	})
+	lb.setC2NUpdateStarted(true)
+	lb.applyDeferredC2NUpdate(missingCmd)
+	if !lb.c2nUpdateStarted() {
+		t.Errorf("update no longer pending before the window opened")
+	}
+
+	// Inside the window (Saturday 23:00), the update is started, which
+	// fails here because there's no cmd/tailscale.
+	setTime(time.Date(2024, 6, 1, 23, 0, 0, 0, time.Local))
+	lb.applyDeferredC2NUpdate(missingCmd)
+	if lb.c2nUpdateStarted() {
+		t.Errorf("update still pending after the window opened")
+	}
+}
+
+func TestLocalForwardPorts(t *testing.T) {
+	// echo stands in for the service on the peer.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	lb := newTestLocalBackend(t)
+	dialed := make(chan netip.AddrPort, 1)
+	lb.dialer.UseNetstackForIP = func(netip.Addr) bool { return true }
+	lb.dialer.NetstackDialTCP = func(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+		dialed <- dst
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", echo.Addr().String())
+	}
+
+	// A LocalPort of zero, which Prefs.Validate rejects, listens on an
+	// ephemeral port.
+	fp := ipn.ForwardPort{RemotePeer: "peer", RemotePort: 80}
+	missing := ipn.ForwardPort{RemotePeer: "missing", RemotePort: 80, Proto: "tcp"}
+	lb.mu.Lock()
+	lb.netMap = &netmap.NetworkMap{
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ID:       1,
+				StableID: "peer",
+				Addresses: []netip.Prefix{
+					netip.MustParsePrefix("fd7a:115c:a1e0::2/128"),
+					netip.MustParsePrefix("100.64.0.2/32"),
+				},
+			}).View(),
+		},
+	}
+	start := lb.updatePortForwardsLocked((&ipn.Prefs{LocalForwardPorts: []ipn.ForwardPort{fp, missing}}).View())
+	lb.mu.Unlock()
+	start()
+	lb.mu.Lock()
+	ln, missingLn := lb.portForwards[fp], lb.portForwards[missing]
+	lb.mu.Unlock()
+	if ln == nil || missingLn == nil {
+		t.Fatalf("listeners = %v, %v; want both", ln, missingLn)
+	}
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v; want %q", buf, err, "hello")
+	}
+	if got, want := <-dialed, netip.MustParseAddrPort("100.64.0.2:80"); got != want {
+		t.Errorf("dialed %v; want %v", got, want)
+	}
+
+	// Connections for a peer that isn't in the netmap are closed.
+	mc, err := net.Dial("tcp", missingLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	mc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if n, err := mc.Read(buf); err != io.EOF {
+		t.Errorf("read from forward to missing peer = %d, %v; want EOF", n, err)
+	}
+
+	// Removing an entry closes its listener, but not its connections.
+	lb.mu.Lock()
+	if start := lb.updatePortForwardsLocked((&ipn.Prefs{LocalForwardPorts: []ipn.ForwardPort{missing}}).View()); start != nil {
+		t.Errorf("removing an entry returned a func to start listeners")
+	}
+	_, stillListening := lb.portForwards[fp]
+	lb.mu.Unlock()
+	if stillListening {
+		t.Errorf("listener for removed entry %v still registered", fp)
+	}
+	if c2, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		c2.Close()
+		t.Errorf("listener for removed entry %v still accepting", fp)
+	}
+	if _, err := io.WriteString(c, "again"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "again" {
+		t.Errorf("after removing entry, read %q, %v; want %q", buf, err, "again")
+	}
+
+	// An entry whose local port is taken raises a health warning and is
+	// dropped, so that the next prefs change tries it again.
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	busy := ipn.ForwardPort{LocalPort: uint16(taken.Addr().(*net.TCPAddr).Port), RemotePeer: "peer", RemotePort: 80}
+	lb.mu.Lock()
+	start = lb.updatePortForwardsLocked((&ipn.Prefs{LocalForwardPorts: []ipn.ForwardPort{missing, busy}}).View())
+	lb.mu.Unlock()
+	start()
+	lb.mu.Lock()
+	_, busyListening := lb.portForwards[busy]
+	lb.mu.Unlock()
+	if busyListening {
+		t.Errorf("entry %v registered after failing to listen", busy)
+	}
+	if !slices.Contains(health.AppendWarnableDebugFlags(nil), "warn-local-forward-ports-unhealthy") {
+		t.Errorf("no health warning for port forward in use")
+	}
+	lb.mu.Lock()
+	if start := lb.updatePortForwardsLocked((&ipn.Prefs{LocalForwardPorts: []ipn.ForwardPort{missing}}).View()); start != nil {
+		t.Errorf("dropping the failed entry returned a func to start listeners")
+	}
+	lb.mu.Unlock()
+	if slices.Contains(health.AppendWarnableDebugFlags(nil), "warn-local-forward-ports-unhealthy") {
+		t.Errorf("health warning for port forward still set after removing it")
+	}
+
+	lb.mu.Lock()
+	lb.stopPortForwardsLocked()
+	n := len(lb.portForwards)
+	lb.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d listeners after stopPortForwardsLocked; want 0", n)
+	}
+}
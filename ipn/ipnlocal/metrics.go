@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/util/clientmetric"
+)
+
+// metricsServer is the localhost HTTP server enabled by
+// ipn.Prefs.MetricsPort.
+type metricsServer struct {
+	port uint16
+	srv  *http.Server
+}
+
+// serveMetrics writes the client metrics in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	clientmetric.WritePrometheusExpositionFormat(w)
+}
+
+// warnMetricsServer is set when the metrics server can't listen on
+// ipn.Prefs.MetricsPort.
+var warnMetricsServer = health.NewWarnable(health.WithMapDebugFlag("warn-metrics-port-unhealthy"))
+
+// updateMetricsServerLocked starts, stops or restarts the metrics server
+// so that it listens on the port in p.MetricsPort, or not at all if that is
+// zero or p is invalid.
+//
+// Listening is left to the returned func, if non-nil, which the caller
+// must run once it has released b.mu.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateMetricsServerLocked(p ipn.PrefsView) (start func()) {
+	var port uint16
+	if p.Valid() {
+		port = p.MetricsPort()
+	}
+	if b.metricsServer != nil {
+		if b.metricsServer.port == port {
+			return nil
+		}
+		b.stopMetricsServerLocked()
+	}
+	if port == 0 {
+		warnMetricsServer.Set(nil)
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	ms := &metricsServer{
+		port: port,
+		srv:  &http.Server{Handler: mux},
+	}
+	b.metricsServer = ms
+	return func() { b.startMetricsServer(ms) }
+}
+
+// startMetricsServer listens on ms.port and serves metrics there, unless
+// ms has been stopped or replaced in the meantime. A failure to listen is
+// reported as a health warning, and the port is tried again on the next
+// prefs change.
+//
+// b.mu must not be held.
+func (b *LocalBackend) startMetricsServer(ms *metricsServer) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(ms.port))))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.metricsServer != ms {
+		if ln != nil {
+			ln.Close()
+		}
+		return
+	}
+	if err != nil {
+		b.logf("metrics server: %v", err)
+		warnMetricsServer.Set(fmt.Errorf("metrics server can't listen on port %d: %w", ms.port, err))
+		b.metricsServer = nil
+		return
+	}
+	warnMetricsServer.Set(nil)
+	b.logf("metrics server listening on %v", ln.Addr())
+	go func() {
+		if err := ms.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			b.logf("metrics server: %v", err)
+		}
+	}()
+}
+
+// stopMetricsServerLocked stops the metrics server, if it is running.
+//
+// b.mu must be held.
+func (b *LocalBackend) stopMetricsServerLocked() {
+	if b.metricsServer == nil {
+		return
+	}
+	b.metricsServer.srv.Close()
+	b.metricsServer = nil
+}
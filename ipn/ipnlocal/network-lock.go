@@ -149,6 +149,10 @@ func (b *LocalBackend) tkaSyncIfNeeded(nm *netmap.NetworkMap, prefs ipn.PrefsVie
 	if b.tka == nil && !b.capTailnetLock {
 		return nil
 	}
+	if prefs.HeadscaleCompatibility() {
+		// Headscale doesn't implement tailnet lock.
+		return nil
+	}
 
 	if b.tka != nil || nm.TKAEnabled {
 		b.logf("tkaSyncIfNeeded: enabled=%v, head=%v", nm.TKAEnabled, nm.TKAHead)
@@ -177,6 +177,33 @@ func TestTKAEnablementFlow(t *testing.T) {
 	}
 }
 
+func TestTKASyncHeadscaleCompatibility(t *testing.T) {
+	pm := must.Get(newProfileManager(new(mem.Store), t.Logf))
+	must.Do(pm.SetPrefs((&ipn.Prefs{
+		ControlURL:             "https://headscale.example.com",
+		HeadscaleCompatibility: true,
+		Persist: &persist.Persist{
+			PrivateNodeKey: key.NewNode(),
+			NetworkLockKey: key.NewNLPrivate(),
+		},
+	}).View(), ""))
+	b := LocalBackend{
+		capTailnetLock: true,
+		varRoot:        t.TempDir(),
+		logf:           t.Logf,
+		pm:             pm,
+		store:          pm.Store(),
+	}
+
+	// With no control client, any attempt to bootstrap would fail.
+	if err := b.tkaSyncIfNeeded(&netmap.NetworkMap{TKAEnabled: true}, pm.CurrentPrefs()); err != nil {
+		t.Errorf("tkaSyncIfNeeded() failed: %v", err)
+	}
+	if b.tka != nil {
+		t.Error("tka was initialized in Headscale compatibility mode")
+	}
+}
+
 func TestTKADisablementFlow(t *testing.T) {
 	nodePriv := key.NewNode()
 
@@ -16,6 +16,7 @@
 
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
+	"tailscale.com/tstime"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/cmpx"
@@ -29,10 +30,15 @@
 // profileManager is a wrapper around a StateStore that manages
 // multiple profiles and the current profile.
 //
-// It is not safe for concurrent use.
+// It is not safe for concurrent use. It has no lock of its own: its only
+// user, LocalBackend, guards it with LocalBackend.mu, which is also held
+// for the backend state that must change together with the current
+// profile. Several methods, such as CurrentPrefs, return views of state
+// that is only consistent under that lock.
 type profileManager struct {
 	store ipn.StateStore
 	logf  logger.Logf
+	clock tstime.Clock
 
 	currentUserID  ipn.WindowsUserID
 	knownProfiles  map[ipn.ProfileID]*ipn.LoginProfile // always non-nil
@@ -58,11 +64,15 @@ func (pm *profileManager) CurrentUserID() ipn.WindowsUserID {
 }
 
 // SetCurrentUserID sets the current user ID. The uid is only non-empty
-// on Windows where we have a multi-user system.
+// on Windows where we have a multi-user system. It returns an error if uid is
+// non-empty but not valid.
 func (pm *profileManager) SetCurrentUserID(uid ipn.WindowsUserID) error {
 	if pm.currentUserID == uid {
 		return nil
 	}
+	if uid != "" && !uid.IsValid() {
+		return fmt.Errorf("invalid user ID %q", uid)
+	}
 	prev := pm.currentUserID
 	pm.currentUserID = uid
 	if uid == "" && prev != "" {
@@ -218,6 +228,9 @@ func (pm *profileManager) SetPrefs(prefsIn ipn.PrefsView, tailnetMagicDNSName st
 		// We don't know anything about this profile, so ignore it for now.
 		return pm.setPrefsLocked(prefs.View())
 	}
+	if err := newPersist.NodeID.Validate(); err != nil {
+		return err
+	}
 	up := newPersist.UserProfile
 	if up.DisplayName == "" {
 		up.DisplayName = up.LoginName
@@ -242,6 +255,8 @@ func (pm *profileManager) SetPrefs(prefsIn ipn.PrefsView, tailnetMagicDNSName st
 		// We didn't have an existing profile, so create a new one.
 		cp.ID, cp.Key = newUnusedID(pm.knownProfiles)
 		cp.LocalUserID = pm.currentUserID
+		cp.CreatedAt = pm.clock.Now()
+		cp.LastUsedAt = cp.CreatedAt
 	} else {
 		// This means that there was a force-reauth as a new node that
 		// we haven't seen before.
@@ -252,6 +267,7 @@ func (pm *profileManager) SetPrefs(prefsIn ipn.PrefsView, tailnetMagicDNSName st
 	} else {
 		cp.Name = up.LoginName
 	}
+	cp.Description = prefs.ProfileDescription
 	cp.ControlURL = prefs.ControlURL
 	cp.UserProfile = newPersist.UserProfile
 	cp.NodeID = newPersist.NodeID
@@ -284,6 +300,64 @@ func newUnusedID(knownProfiles map[ipn.ProfileID]*ipn.LoginProfile) (ipn.Profile
 	}
 }
 
+// newUnusedV2ID returns a new profile ID in the ipn.ProfileID.IsV2 format that
+// is not in knownProfiles.
+func newUnusedV2ID(knownProfiles map[ipn.ProfileID]*ipn.LoginProfile) ipn.ProfileID {
+	var idb [8]byte
+	for {
+		rand.Read(idb[:])
+		id := ipn.ProfileID(fmt.Sprintf("%x", idb))
+		if _, ok := knownProfiles[id]; ok {
+			continue
+		}
+		return id
+	}
+}
+
+// migrateCollidingV1IDs gives a new ipn.ProfileID.IsV2 ID to each profile
+// with an ipn.ProfileID.IsV1 ID that collides with a V2 ID, that is, one that
+// is the first four characters of another profile's V2 ID. Those two IDs
+// can't be told apart wherever IDs are shortened to their V1 length.
+// Profiles that don't collide keep their IDs.
+//
+// A migrated profile keeps its state key, so only its entry in the known
+// profiles and its serve config move.
+func (pm *profileManager) migrateCollidingV1IDs() error {
+	var colliding []ipn.ProfileID
+	for id := range pm.knownProfiles {
+		if !id.IsV2() {
+			continue
+		}
+		if v1 := id[:4]; pm.knownProfiles[v1] != nil {
+			colliding = append(colliding, v1)
+		}
+	}
+	if len(colliding) == 0 {
+		return nil
+	}
+	slices.Sort(colliding)
+	colliding = slices.Compact(colliding)
+	for _, oldID := range colliding {
+		prof := pm.knownProfiles[oldID]
+		newID := newUnusedV2ID(pm.knownProfiles)
+		if sc, err := pm.store.ReadState(ipn.ServeConfigKey(oldID)); err == nil {
+			if err := pm.WriteState(ipn.ServeConfigKey(newID), sc); err != nil {
+				return err
+			}
+			if err := pm.WriteState(ipn.ServeConfigKey(oldID), nil); err != nil {
+				return err
+			}
+		} else if err != ipn.ErrStateNotExist {
+			return err
+		}
+		delete(pm.knownProfiles, oldID)
+		prof.ID = newID
+		pm.knownProfiles[newID] = prof
+		pm.logf("migrated profile ID %q to %q", oldID, newID)
+	}
+	return pm.writeKnownProfiles()
+}
+
 // setPrefsLocked sets the current profile's prefs to the provided value.
 // It also saves the prefs to the StateStore, if the current profile
 // is not new.
@@ -314,7 +388,46 @@ func (pm *profileManager) Profiles() []ipn.LoginProfile {
 	allProfiles := pm.allProfiles()
 	out := make([]ipn.LoginProfile, 0, len(allProfiles))
 	for _, p := range allProfiles {
-		out = append(out, *p)
+		cp := *p
+		cp.Tags = slices.Clone(p.Tags)
+		out = append(out, cp)
+	}
+	return out
+}
+
+// SetProfileTags replaces the tags of the profile with the given id. An
+// empty tags removes all tags. It returns errProfileNotFound if the profile
+// does not exist, and an error if any tag is invalid per
+// ipn.ValidateProfileTags.
+func (pm *profileManager) SetProfileTags(id ipn.ProfileID, tags []string) error {
+	kp, ok := pm.knownProfiles[id]
+	if !ok {
+		return errProfileNotFound
+	}
+	if kp.LocalUserID != pm.currentUserID {
+		return fmt.Errorf("profile %q is not owned by current user", id)
+	}
+	if err := ipn.ValidateProfileTags(tags); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		kp.Tags = nil
+	} else {
+		kp.Tags = slices.Clone(tags)
+	}
+	return pm.writeKnownProfiles()
+}
+
+// ListByTag returns copies of the current user's profiles that have the
+// given tag. The returned profiles are sorted by Name.
+func (pm *profileManager) ListByTag(tag string) []*ipn.LoginProfile {
+	var out []*ipn.LoginProfile
+	for _, p := range pm.matchingProfiles(func(p *ipn.LoginProfile) bool {
+		return slices.Contains(p.Tags, tag)
+	}) {
+		cp := *p
+		cp.Tags = slices.Clone(p.Tags)
+		out = append(out, &cp)
 	}
 	return out
 }
@@ -339,14 +452,45 @@ func (pm *profileManager) SwitchProfile(id ipn.ProfileID) error {
 	if err != nil {
 		return err
 	}
+	// Persist the selection before switching in memory, so that the switch
+	// survives a crash right after we return, and a failed write leaves
+	// the current profile unchanged.
+	if err := pm.writeUserSelectedProfile(kp.Key); err != nil {
+		return err
+	}
 	pm.prefs = prefs
 	pm.currentProfile = kp
-	return pm.setAsUserSelectedProfileLocked()
+	kp.LastUsedAt = pm.clock.Now()
+	if err := pm.writeKnownProfiles(); err != nil {
+		// The switch itself has been persisted; only the timestamp is lost.
+		pm.logf("recording LastUsedAt of profile %q: %v", kp.ID, err)
+	}
+	return nil
+}
+
+// BackfillTailnetMagicDNSName records name as the TailnetMagicDNSName of
+// the current profile if the profile is persisted and doesn't have one yet,
+// as is the case for profiles created before the field existed. It is a
+// no-op if name is empty or the field is already set.
+func (pm *profileManager) BackfillTailnetMagicDNSName(name string) error {
+	cp := pm.currentProfile
+	if name == "" || cp.ID == "" || cp.TailnetMagicDNSName != "" {
+		return nil
+	}
+	cp.TailnetMagicDNSName = name
+	return pm.writeKnownProfiles()
 }
 
 func (pm *profileManager) setAsUserSelectedProfileLocked() error {
+	return pm.writeUserSelectedProfile(pm.currentProfile.Key)
+}
+
+// writeUserSelectedProfile records key as the selected profile of the
+// current user in the StateStore. The write is synchronous; for the default
+// file-backed store it is done with atomicfile.WriteFile.
+func (pm *profileManager) writeUserSelectedProfile(key ipn.StateKey) error {
 	k := ipn.CurrentProfileKey(string(pm.currentUserID))
-	return pm.WriteState(k, []byte(pm.currentProfile.Key))
+	return pm.WriteState(k, []byte(key))
 }
 
 func (pm *profileManager) loadSavedPrefs(key ipn.StateKey) (ipn.PrefsView, error) {
@@ -358,19 +502,30 @@ func (pm *profileManager) loadSavedPrefs(key ipn.StateKey) (ipn.PrefsView, error
 		return ipn.PrefsView{}, err
 	}
 	savedPrefs, err := ipn.PrefsFromBytes(bs)
-	if err != nil {
-		return ipn.PrefsView{}, fmt.Errorf("PrefsFromBytes: %v", err)
+	if errors.Is(err, ipn.ErrInvalidPrefs) {
+		// Keep the user's settings as they are rather than refusing the
+		// whole profile; the health warning set by
+		// updateInvalidPrefsWarning tells them what to fix.
+		pm.logf("saved prefs for %q are invalid: %v", key, err)
+	} else if err != nil {
+		return ipn.PrefsView{}, fmt.Errorf("PrefsFromBytes: %w", err)
 	}
 	pm.logf("using backend prefs for %q: %v", key, savedPrefs.Pretty())
 
 	// Ignore any old stored preferences for https://login.tailscale.com
 	// as the control server that would override the new default of
-	// controlplane.tailscale.com.
-	if savedPrefs.ControlURL != "" &&
+	// controlplane.tailscale.com, unless the user opted out of that
+	// normalization.
+	if !savedPrefs.NoControlURLNormalizeOnLoad &&
+		savedPrefs.ControlURL != "" &&
 		savedPrefs.ControlURL != ipn.DefaultControlURL &&
 		ipn.IsLoginServerSynonym(savedPrefs.ControlURL) {
 		savedPrefs.ControlURL = ""
 	}
+	savedPrefs.MigrateShieldsUp()
+	if savedPrefs.MigrateAllowSingleHosts() {
+		pm.logf("prefs for %q had deprecated AllowSingleHosts=false; using true", key)
+	}
 	return savedPrefs.View(), nil
 }
 
@@ -411,6 +566,77 @@ func (pm *profileManager) DeleteProfile(id ipn.ProfileID) error {
 	return pm.writeKnownProfiles()
 }
 
+// Merge combines the profile src into dst and deletes src. It is meant for
+// cleaning up a duplicate profile created by re-authenticating against the
+// same control server.
+//
+// The saved prefs of src are copied into dst and take priority over dst's,
+// except for the fields that identify dst and its node, which are kept from
+// dst: Persist (the node key and login), ControlURL, ProfileName,
+// ProfileDescription, and the read-only TailnetName. If src is the current
+// profile, dst becomes the current profile.
+//
+// Merging a profile into itself is a no-op. It returns errProfileNotFound
+// if either profile does not exist, and an error if the two profiles use
+// different control servers.
+func (pm *profileManager) Merge(src, dst ipn.ProfileID) error {
+	if src == dst {
+		return nil
+	}
+	srcProf, ok := pm.knownProfiles[src]
+	if !ok {
+		return errProfileNotFound
+	}
+	dstProf, ok := pm.knownProfiles[dst]
+	if !ok {
+		return errProfileNotFound
+	}
+	for _, kp := range []*ipn.LoginProfile{srcProf, dstProf} {
+		if kp.LocalUserID != pm.currentUserID {
+			return fmt.Errorf("profile %q is not owned by current user", kp.ID)
+		}
+	}
+	srcPrefs, err := pm.loadSavedPrefs(srcProf.Key)
+	if err != nil {
+		return err
+	}
+	dstPrefs, err := pm.loadSavedPrefs(dstProf.Key)
+	if err != nil {
+		return err
+	}
+	if su, du := srcPrefs.ControlURLOrDefault(), dstPrefs.ControlURLOrDefault(); su != du {
+		return fmt.Errorf("cannot merge profiles with different control servers %q and %q", su, du)
+	}
+
+	merged := srcPrefs.AsStruct()
+	merged.Persist = dstPrefs.Persist().AsStruct()
+	merged.ControlURL = dstPrefs.ControlURL()
+	merged.ProfileName = dstPrefs.ProfileName()
+	merged.ProfileDescription = dstPrefs.ProfileDescription()
+	merged.TailnetName = dstPrefs.TailnetName()
+	if err := pm.writePrefsToStore(dstProf.Key, merged.View()); err != nil {
+		return err
+	}
+	dstProf.Description = merged.ProfileDescription
+
+	switch pm.currentProfile.ID {
+	case src:
+		pm.currentProfile = dstProf
+		pm.prefs = merged.View()
+		if err := pm.setAsUserSelectedProfileLocked(); err != nil {
+			return err
+		}
+	case dst:
+		pm.prefs = merged.View()
+	}
+
+	if err := pm.WriteState(srcProf.Key, nil); err != nil {
+		return err
+	}
+	delete(pm.knownProfiles, src)
+	return pm.writeKnownProfiles()
+}
+
 // DeleteAllProfiles removes all known profiles and switches to a new empty
 // profile.
 func (pm *profileManager) DeleteAllProfiles() error {
@@ -437,12 +663,28 @@ func (pm *profileManager) writeKnownProfiles() error {
 	return pm.WriteState(ipn.KnownProfilesStateKey, b)
 }
 
-// NewProfile creates and switches to a new unnamed profile. The new profile is
-// not persisted until SetPrefs is called with a logged-in user.
+// NewProfile creates and switches to a new unnamed profile with the default
+// prefs. The new profile is not persisted until SetPrefs is called with a
+// logged-in user.
 func (pm *profileManager) NewProfile() {
+	pm.CreateProfile(nil)
+}
+
+// CreateProfile is like NewProfile, but the new profile starts with
+// initialPrefs rather than the default prefs, or with the defaults if
+// initialPrefs is nil. This avoids a second write of the prefs to the
+// StateStore: they are written together with the profile on the first
+// SetPrefs with a logged-in user. The Persist field of initialPrefs is
+// ignored, as a new profile has no node identity yet.
+func (pm *profileManager) CreateProfile(initialPrefs *ipn.Prefs) {
 	metricNewProfile.Add(1)
 
 	pm.prefs = defaultPrefs
+	if initialPrefs != nil {
+		prefs := initialPrefs.Clone()
+		prefs.Persist = nil
+		pm.prefs = prefs.View()
+	}
 	pm.currentProfile = &ipn.LoginProfile{}
 }
 
@@ -549,6 +791,10 @@ func newProfileManagerWithGOOS(store ipn.StateStore, logf logger.Logf, goos stri
 		store:         store,
 		knownProfiles: knownProfiles,
 		logf:          logf,
+		clock:         tstime.StdClock{},
+	}
+	if err := pm.migrateCollidingV1IDs(); err != nil {
+		return nil, fmt.Errorf("migrating profile IDs: %w", err)
 	}
 
 	if stateKey != "" {
@@ -559,7 +805,11 @@ func newProfileManagerWithGOOS(store ipn.StateStore, logf logger.Logf, goos stri
 		}
 		if pm.currentProfile == nil {
 			if suf, ok := strings.CutPrefix(string(stateKey), "user-"); ok {
-				pm.currentUserID = ipn.WindowsUserID(suf)
+				if uid := ipn.WindowsUserID(suf); uid.IsValid() {
+					pm.currentUserID = uid
+				} else {
+					pm.logf("ignoring invalid user ID %q in auto-start key", suf)
+				}
 			}
 			pm.NewProfile()
 		} else {
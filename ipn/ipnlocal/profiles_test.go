@@ -4,19 +4,30 @@
 package ipnlocal
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/netip"
 	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/store"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/persist"
+	"tailscale.com/util/mak"
 	"tailscale.com/util/must"
 )
 
@@ -75,6 +86,605 @@ func TestProfileCurrentUserSwitch(t *testing.T) {
 	}
 }
 
+func TestProfileSetCurrentUserIDInvalid(t *testing.T) {
+	pm, err := newProfileManagerWithGOOS(new(mem.Store), logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := ipn.WindowsUserID(u.Uid)
+	if err := pm.SetCurrentUserID(uid); err != nil {
+		t.Fatalf("SetCurrentUserID(%q): %v", uid, err)
+	}
+	if got := pm.CurrentUserID(); got != uid {
+		t.Fatalf("CurrentUserID = %q; want %q", got, uid)
+	}
+
+	if runtime.GOOS == "windows" {
+		if err := pm.SetCurrentUserID("not-a-sid"); err == nil {
+			t.Error("SetCurrentUserID with invalid SID succeeded")
+		}
+		if got := pm.CurrentUserID(); got != uid {
+			t.Errorf("CurrentUserID = %q after invalid SetCurrentUserID; want %q", got, uid)
+		}
+	}
+
+	// An empty uid is how a local user logs out; it's always accepted.
+	if err := pm.SetCurrentUserID(""); err != nil {
+		t.Fatalf("SetCurrentUserID(\"\"): %v", err)
+	}
+	if got := pm.CurrentUserID(); got != "" {
+		t.Errorf("CurrentUserID = %q; want empty", got)
+	}
+}
+
+func TestProfileDescription(t *testing.T) {
+	pm, err := newProfileManagerWithGOOS(new(mem.Store), logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pm.CurrentPrefs().AsStruct()
+	p.ProfileDescription = "Production subnet router for EU region"
+	p.Persist = &persist.Persist{
+		NodeID:         "node1",
+		PrivateNodeKey: key.NewNode(),
+		UserProfile: tailcfg.UserProfile{
+			ID:        1,
+			LoginName: "user@example.com",
+		},
+	}
+	if err := pm.SetPrefs(p.View(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pm.CurrentProfile().Description, p.ProfileDescription; got != want {
+		t.Errorf("Description = %q; want %q", got, want)
+	}
+
+	p.ProfileDescription = ""
+	if err := pm.SetPrefs(p.View(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := pm.CurrentProfile().Description; got != "" {
+		t.Errorf("Description = %q after clearing; want empty", got)
+	}
+}
+
+func TestProfileInvalidNodeID(t *testing.T) {
+	pm, err := newProfileManagerWithGOOS(new(mem.Store), logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pm.CurrentPrefs().AsStruct()
+	p.Persist = &persist.Persist{
+		NodeID:         "node 1\n",
+		PrivateNodeKey: key.NewNode(),
+		UserProfile: tailcfg.UserProfile{
+			ID:        1,
+			LoginName: "user@example.com",
+		},
+	}
+	if err := pm.SetPrefs(p.View(), ""); !errors.Is(err, tailcfg.ErrInvalidNodeID) {
+		t.Fatalf("SetPrefs with invalid NodeID = %v; want ErrInvalidNodeID", err)
+	}
+	if got := len(pm.Profiles()); got != 0 {
+		t.Errorf("got %d profiles after invalid NodeID; want 0", got)
+	}
+
+	p.Persist.NodeID = "node1"
+	if err := pm.SetPrefs(p.View(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pm.CurrentProfile().NodeID, p.Persist.NodeID; got != want {
+		t.Errorf("NodeID = %q; want %q", got, want)
+	}
+}
+
+func TestProfileMerge(t *testing.T) {
+	newProfile := func(t *testing.T, pm *profileManager, node int, controlURL string, edit func(*ipn.Prefs)) ipn.LoginProfile {
+		t.Helper()
+		pm.NewProfile()
+		p := pm.CurrentPrefs().AsStruct()
+		p.ControlURL = controlURL
+		p.Persist = &persist.Persist{
+			NodeID:         tailcfg.StableNodeID(fmt.Sprintf("node%d", node)),
+			PrivateNodeKey: key.NewNode(),
+			UserProfile: tailcfg.UserProfile{
+				ID:        tailcfg.UserID(node),
+				LoginName: fmt.Sprintf("user%d@example.com", node),
+			},
+		}
+		edit(p)
+		if err := pm.SetPrefs(p.View(), ""); err != nil {
+			t.Fatal(err)
+		}
+		return pm.CurrentProfile()
+	}
+	newManager := func(t *testing.T) *profileManager {
+		t.Helper()
+		pm, err := newProfileManagerWithGOOS(new(mem.Store), logger.Discard, "linux")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pm
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		pm := newManager(t)
+		dst := newProfile(t, pm, 1, "", func(p *ipn.Prefs) {
+			p.Hostname = "dst-host"
+			p.ShieldsUp = true
+			p.ExitNodeAllowLANAccess = true
+			p.ProfileName = "dst-name"
+		})
+		src := newProfile(t, pm, 2, "", func(p *ipn.Prefs) {
+			p.Hostname = "src-host"
+			p.OperatorUser = "alice"
+			p.ShieldsUp = false
+			p.ExitNodeAllowLANAccess = false
+			p.ProfileName = "src-name"
+		})
+		if err := pm.Merge(src.ID, dst.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := pm.knownProfiles[src.ID]; ok {
+			t.Errorf("src profile %q still known after merge", src.ID)
+		}
+		if got := pm.CurrentProfile().ID; got != dst.ID {
+			t.Errorf("current profile = %q; want %q", got, dst.ID)
+		}
+		got := pm.CurrentPrefs()
+		if got.Hostname() != "src-host" {
+			t.Errorf("Hostname = %q; want %q", got.Hostname(), "src-host")
+		}
+		if got.OperatorUser() != "alice" {
+			t.Errorf("OperatorUser = %q; want %q", got.OperatorUser(), "alice")
+		}
+		if got.ShieldsUp() {
+			t.Error("ShieldsUp = true; want false taken from src")
+		}
+		if got.ExitNodeAllowLANAccess() {
+			t.Error("ExitNodeAllowLANAccess = true; want false taken from src")
+		}
+		if name := got.ProfileName(); name != "dst-name" {
+			t.Errorf("ProfileName = %q; want dst-name kept from dst", name)
+		}
+		if nid := got.Persist().NodeID(); nid != "node1" {
+			t.Errorf("Persist.NodeID = %q; want node1 kept from dst", nid)
+		}
+		saved, err := pm.loadSavedPrefs(dst.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !saved.Equals(got) {
+			t.Errorf("saved prefs = %v; want %v", saved.Pretty(), got.Pretty())
+		}
+		if bs, err := pm.store.ReadState(src.Key); err == nil && len(bs) > 0 {
+			t.Errorf("src prefs still in store")
+		}
+	})
+
+	t.Run("same-id", func(t *testing.T) {
+		pm := newManager(t)
+		prof := newProfile(t, pm, 1, "", func(p *ipn.Prefs) {})
+		before := pm.CurrentPrefs()
+		if err := pm.Merge(prof.ID, prof.ID); err != nil {
+			t.Fatal(err)
+		}
+		if len(pm.Profiles()) != 1 {
+			t.Errorf("got %d profiles; want 1", len(pm.Profiles()))
+		}
+		if !pm.CurrentPrefs().Equals(before) {
+			t.Errorf("prefs changed by no-op merge")
+		}
+	})
+
+	t.Run("different-control-url", func(t *testing.T) {
+		pm := newManager(t)
+		dst := newProfile(t, pm, 1, "", func(p *ipn.Prefs) {})
+		src := newProfile(t, pm, 2, "https://headscale.example.com", func(p *ipn.Prefs) {})
+		err := pm.Merge(src.ID, dst.ID)
+		if err == nil {
+			t.Fatal("Merge succeeded; want error")
+		}
+		if len(pm.Profiles()) != 2 {
+			t.Errorf("got %d profiles after failed merge; want 2", len(pm.Profiles()))
+		}
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		pm := newManager(t)
+		dst := newProfile(t, pm, 1, "", func(p *ipn.Prefs) {})
+		if err := pm.Merge("nope", dst.ID); err != errProfileNotFound {
+			t.Errorf("Merge = %v; want errProfileNotFound", err)
+		}
+	})
+
+}
+
+// failingWriteStore is an ipn.StateStore whose writes fail once failWrites
+// is set.
+type failingWriteStore struct {
+	mem.Store
+	failWrites bool
+}
+
+func (s *failingWriteStore) WriteState(id ipn.StateKey, bs []byte) error {
+	if s.failWrites {
+		return errors.New("write failed")
+	}
+	return s.Store.WriteState(id, bs)
+}
+
+func TestLoadSavedPrefsMigratesAllowSingleHosts(t *testing.T) {
+	store := new(mem.Store)
+	pm, err := newProfileManagerWithGOOS(store, logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = ipn.StateKey("profile-1ab3")
+	store.WriteState(key, []byte(`{"ControlURL":"https://controlplane.tailscale.com","AllowSingleHosts":false}`))
+	p, err := pm.loadSavedPrefs(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.AllowSingleHosts() {
+		t.Errorf("AllowSingleHosts = false after load; want true")
+	}
+}
+
+// countingWriteStore is an ipn.StateStore that counts writes per key.
+type countingWriteStore struct {
+	mem.Store
+	writes map[ipn.StateKey]int
+}
+
+func (s *countingWriteStore) WriteState(id ipn.StateKey, bs []byte) error {
+	mak.Set(&s.writes, id, s.writes[id]+1)
+	return s.Store.WriteState(id, bs)
+}
+
+func TestCreateProfile(t *testing.T) {
+	login := func(t *testing.T, pm *profileManager) ipn.LoginProfile {
+		t.Helper()
+		p := pm.CurrentPrefs().AsStruct()
+		p.Persist = &persist.Persist{
+			NodeID:         "node1",
+			PrivateNodeKey: key.NewNode(),
+			UserProfile: tailcfg.UserProfile{
+				ID:        1,
+				LoginName: "user1@example.com",
+			},
+		}
+		if err := pm.SetPrefs(p.View(), ""); err != nil {
+			t.Fatal(err)
+		}
+		return pm.CurrentProfile()
+	}
+
+	tests := []struct {
+		name    string
+		initial *ipn.Prefs
+		want    func(ipn.PrefsView) bool
+	}{
+		{
+			name:    "nil",
+			initial: nil,
+			want:    func(p ipn.PrefsView) bool { return p.Equals(defaultPrefs) },
+		},
+		{
+			name: "custom",
+			initial: &ipn.Prefs{
+				ControlURL:  "https://control.example.com",
+				Hostname:    "custom",
+				WantRunning: true,
+				Persist:     &persist.Persist{NodeID: "stale"},
+			},
+			want: func(p ipn.PrefsView) bool {
+				return p.ControlURL() == "https://control.example.com" && p.Hostname() == "custom" && p.WantRunning() && !p.Persist().Valid()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := new(countingWriteStore)
+			pm, err := newProfileManagerWithGOOS(store, logger.Discard, "linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.writes = nil
+
+			pm.CreateProfile(tt.initial)
+			if !tt.want(pm.CurrentPrefs()) {
+				t.Fatalf("CurrentPrefs() = %v", pm.CurrentPrefs().Pretty())
+			}
+			if len(store.writes) != 0 {
+				t.Fatalf("CreateProfile wrote to the store: %v", store.writes)
+			}
+
+			prof := login(t, pm)
+			if got := store.writes[prof.Key]; got != 1 {
+				t.Errorf("profile prefs written %d times; want 1", got)
+			}
+			saved, err := pm.loadSavedPrefs(prof.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := saved.AsStruct()
+			p.Persist = nil
+			if !tt.want(p.View()) {
+				t.Errorf("saved prefs = %v", saved.Pretty())
+			}
+		})
+	}
+}
+
+func TestSwitchProfilePersistsSelection(t *testing.T) {
+	newProfile := func(t *testing.T, pm *profileManager, node int) ipn.LoginProfile {
+		t.Helper()
+		pm.NewProfile()
+		p := pm.CurrentPrefs().AsStruct()
+		p.Persist = &persist.Persist{
+			NodeID:         tailcfg.StableNodeID(fmt.Sprintf("node%d", node)),
+			PrivateNodeKey: key.NewNode(),
+			UserProfile: tailcfg.UserProfile{
+				ID:        tailcfg.UserID(node),
+				LoginName: fmt.Sprintf("user%d@example.com", node),
+			},
+		}
+		if err := pm.SetPrefs(p.View(), ""); err != nil {
+			t.Fatal(err)
+		}
+		return pm.CurrentProfile()
+	}
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tailscaled.state")
+		st, err := store.NewFileStore(logger.Discard, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pm, err := newProfileManagerWithGOOS(st, logger.Discard, "linux")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p1 := newProfile(t, pm, 1)
+		newProfile(t, pm, 2)
+		if err := pm.SwitchProfile(p1.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// A fresh store reads the file from disk, as after a crash.
+		st2, err := store.NewFileStore(logger.Discard, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := st2.ReadState(ipn.CurrentProfileStateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ipn.StateKey(got) != p1.Key {
+			t.Errorf("current profile on disk = %q; want %q", got, p1.Key)
+		}
+	})
+
+	t.Run("write_error", func(t *testing.T) {
+		st := new(failingWriteStore)
+		pm, err := newProfileManagerWithGOOS(st, logger.Discard, "linux")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p1 := newProfile(t, pm, 1)
+		p2 := newProfile(t, pm, 2)
+		st.failWrites = true
+		if err := pm.SwitchProfile(p1.ID); err == nil {
+			t.Fatal("SwitchProfile succeeded; want error")
+		}
+		if got := pm.CurrentProfile().ID; got != p2.ID {
+			t.Errorf("current profile after failed switch = %q; want %q", got, p2.ID)
+		}
+	})
+}
+
+func TestProfileTimestamps(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: start})
+	st := new(mem.Store)
+	pm, err := newProfileManagerWithGOOS(st, logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.clock = clock
+
+	newProfile := func(node int) ipn.LoginProfile {
+		t.Helper()
+		pm.NewProfile()
+		p := pm.CurrentPrefs().AsStruct()
+		p.Persist = &persist.Persist{
+			NodeID:         tailcfg.StableNodeID(fmt.Sprintf("node%d", node)),
+			PrivateNodeKey: key.NewNode(),
+			UserProfile: tailcfg.UserProfile{
+				ID:        tailcfg.UserID(node),
+				LoginName: fmt.Sprintf("user%d@example.com", node),
+			},
+		}
+		if err := pm.SetPrefs(p.View(), ""); err != nil {
+			t.Fatal(err)
+		}
+		return pm.CurrentProfile()
+	}
+
+	p1 := newProfile(1)
+	if !p1.CreatedAt.Equal(start) || !p1.LastUsedAt.Equal(start) {
+		t.Errorf("new profile CreatedAt, LastUsedAt = %v, %v; want %v", p1.CreatedAt, p1.LastUsedAt, start)
+	}
+
+	clock.Advance(time.Hour)
+	newProfile(2)
+	// Saving prefs again doesn't change the creation time.
+	p2 := newProfile(2)
+	if want := start.Add(time.Hour); !p2.CreatedAt.Equal(want) {
+		t.Errorf("p2.CreatedAt = %v; want %v", p2.CreatedAt, want)
+	}
+
+	clock.Advance(time.Hour)
+	if err := pm.SwitchProfile(p1.ID); err != nil {
+		t.Fatal(err)
+	}
+	want := start.Add(2 * time.Hour)
+	if got := pm.CurrentProfile(); !got.CreatedAt.Equal(start) || !got.LastUsedAt.Equal(want) {
+		t.Errorf("after switch CreatedAt, LastUsedAt = %v, %v; want %v, %v", got.CreatedAt, got.LastUsedAt, start, want)
+	}
+
+	// The timestamps survive a restart.
+	pm2, err := newProfileManagerWithGOOS(st, logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pm2.Profiles() {
+		if p.ID == p1.ID && !p.LastUsedAt.Equal(want) {
+			t.Errorf("reloaded LastUsedAt = %v; want %v", p.LastUsedAt, want)
+		}
+	}
+
+	if p1 := pm.CurrentProfile(); p1.IsStale(want.Add(time.Hour), 2*time.Hour) {
+		t.Errorf("profile used an hour ago is stale with a 2h threshold")
+	} else if !p1.IsStale(want.Add(3*time.Hour), 2*time.Hour) {
+		t.Errorf("profile used 3h ago is not stale with a 2h threshold")
+	}
+	if (&ipn.LoginProfile{}).IsStale(want, 0) {
+		t.Errorf("profile without LastUsedAt is stale")
+	}
+}
+
+func TestBackfillTailnetMagicDNSName(t *testing.T) {
+	store := new(mem.Store)
+	pm, err := newProfileManagerWithGOOS(store, logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newProfile := func(t *testing.T, node int, magicDNSName string) ipn.LoginProfile {
+		t.Helper()
+		pm.NewProfile()
+		p := pm.CurrentPrefs().AsStruct()
+		p.Persist = &persist.Persist{
+			NodeID:         tailcfg.StableNodeID(fmt.Sprintf("node%d", node)),
+			PrivateNodeKey: key.NewNode(),
+			UserProfile: tailcfg.UserProfile{
+				ID:        tailcfg.UserID(node),
+				LoginName: fmt.Sprintf("user%d@example.com", node),
+			},
+		}
+		if err := pm.SetPrefs(p.View(), magicDNSName); err != nil {
+			t.Fatal(err)
+		}
+		return pm.CurrentProfile()
+	}
+	old := newProfile(t, 1, "")
+	set := newProfile(t, 2, "set.ts.net")
+
+	if err := pm.SwitchProfile(old.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.BackfillTailnetMagicDNSName("old.ts.net"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pm.CurrentProfile().TailnetMagicDNSName; got != "old.ts.net" {
+		t.Errorf("TailnetMagicDNSName after backfill = %q; want %q", got, "old.ts.net")
+	}
+
+	if err := pm.SwitchProfile(set.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.BackfillTailnetMagicDNSName("other.ts.net"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pm.CurrentProfile().TailnetMagicDNSName; got != "set.ts.net" {
+		t.Errorf("TailnetMagicDNSName = %q; want unchanged %q", got, "set.ts.net")
+	}
+
+	// The backfilled name must have been persisted.
+	pm2, err := newProfileManagerWithGOOS(store, logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pm2.Profiles() {
+		want := map[ipn.ProfileID]string{old.ID: "old.ts.net", set.ID: "set.ts.net"}[p.ID]
+		if p.TailnetMagicDNSName != want {
+			t.Errorf("reloaded profile %q TailnetMagicDNSName = %q; want %q", p.ID, p.TailnetMagicDNSName, want)
+		}
+	}
+}
+
+func TestLoadSavedPrefsControlURLNormalization(t *testing.T) {
+	pm, err := newProfileManagerWithGOOS(new(mem.Store), logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, normalize := range []bool{true, false} {
+		p := ipn.NewPrefs()
+		p.ControlURL = "https://login.tailscale.com"
+		p.NoControlURLNormalizeOnLoad = !normalize
+		key := ipn.StateKey(fmt.Sprintf("test-%v", normalize))
+		if err := pm.WriteState(key, p.ToBytes()); err != nil {
+			t.Fatal(err)
+		}
+		got, err := pm.loadSavedPrefs(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		if !normalize {
+			want = p.ControlURL
+		}
+		if got.ControlURL() != want {
+			t.Errorf("normalize=%v: ControlURL = %q; want %q", normalize, got.ControlURL(), want)
+		}
+	}
+}
+
+func TestLoadSavedPrefsFutureSchemaVersion(t *testing.T) {
+	pm, err := newProfileManagerWithGOOS(new(mem.Store), logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = ipn.StateKey("test-future")
+	data := fmt.Sprintf(`{"SchemaVersion":%d,"WantRunning":true}`, ipn.CurrentPrefsSchemaVersion+1)
+	if err := pm.WriteState(key, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pm.loadSavedPrefs(key); !errors.Is(err, ipn.ErrFuturePrefsVersion) {
+		t.Fatalf("loadSavedPrefs = %v; want ErrFuturePrefsVersion", err)
+	}
+}
+
+func TestLoadSavedPrefsKeepsInvalidFields(t *testing.T) {
+	pm, err := newProfileManagerWithGOOS(new(mem.Store), logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = ipn.StateKey("test-invalid")
+	data := `{"ControlURL":"http://headscale.lan:8080","AdvertiseRoutes":["10.1.2.3/8"],"WantRunning":true}`
+	if err := pm.WriteState(key, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := pm.loadSavedPrefs(key)
+	if err != nil {
+		t.Fatalf("loadSavedPrefs: %v", err)
+	}
+	if want := []netip.Prefix{netip.MustParsePrefix("10.1.2.3/8")}; !slices.Equal(got.AdvertiseRoutes().AsSlice(), want) {
+		t.Errorf("AdvertiseRoutes = %v; want %v kept", got.AdvertiseRoutes(), want)
+	}
+	if got.ControlURL() != "http://headscale.lan:8080" {
+		t.Errorf("ControlURL = %q; want it kept", got.ControlURL())
+	}
+	if !got.WantRunning() {
+		t.Error("WantRunning = false; want it kept")
+	}
+}
+
 func TestProfileList(t *testing.T) {
 	store := new(mem.Store)
 
@@ -138,6 +748,143 @@ func TestProfileList(t *testing.T) {
 	checkProfiles(t, "carol")
 }
 
+func TestProfileTags(t *testing.T) {
+	store := new(mem.Store)
+	pm, err := newProfileManagerWithGOOS(store, logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]ipn.ProfileID{}
+	for i, name := range []string{"alice", "bob", "carol"} {
+		pm.NewProfile()
+		p := pm.CurrentPrefs().AsStruct()
+		p.Persist = &persist.Persist{
+			NodeID:         tailcfg.StableNodeID(fmt.Sprint(i)),
+			PrivateNodeKey: key.NewNode(),
+			UserProfile: tailcfg.UserProfile{
+				ID:        tailcfg.UserID(i),
+				LoginName: name,
+			},
+		}
+		if err := pm.SetPrefs(p.View(), ""); err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = pm.CurrentProfile().ID
+	}
+	names := func(profiles []*ipn.LoginProfile) (out []string) {
+		for _, p := range profiles {
+			out = append(out, p.Name)
+		}
+		return out
+	}
+
+	tags := []string{"production", "europe"}
+	if err := pm.SetProfileTags(ids["carol"], tags); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.SetProfileTags(ids["alice"], []string{"production"}); err != nil {
+		t.Fatal(err)
+	}
+	tags[0] = "mutated"
+	if got, want := names(pm.ListByTag("production")), []string{"alice", "carol"}; !slices.Equal(got, want) {
+		t.Errorf("ListByTag(production) = %q; want %q", got, want)
+	}
+	if got, want := names(pm.ListByTag("europe")), []string{"carol"}; !slices.Equal(got, want) {
+		t.Errorf("ListByTag(europe) = %q; want %q", got, want)
+	}
+	if got := pm.ListByTag("test"); len(got) != 0 {
+		t.Errorf("ListByTag(test) = %q; want none", names(got))
+	}
+	pm.ListByTag("europe")[0].Tags[0] = "mutated"
+	if got, want := pm.knownProfiles[ids["carol"]].Tags, []string{"production", "europe"}; !slices.Equal(got, want) {
+		t.Errorf("carol's tags = %q; want %q", got, want)
+	}
+
+	// Tags are persisted with the known profiles.
+	pm2, err := newProfileManagerWithGOOS(store, logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(pm2.ListByTag("production")), []string{"alice", "carol"}; !slices.Equal(got, want) {
+		t.Errorf("after reload, ListByTag(production) = %q; want %q", got, want)
+	}
+
+	// Clearing the tags.
+	if err := pm.SetProfileTags(ids["alice"], nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(pm.ListByTag("production")), []string{"carol"}; !slices.Equal(got, want) {
+		t.Errorf("ListByTag(production) = %q; want %q", got, want)
+	}
+
+	// Validation.
+	for _, tags := range [][]string{
+		{""},
+		{"ok", strings.Repeat("x", ipn.MaxProfileTagLen+1)},
+	} {
+		if err := pm.SetProfileTags(ids["bob"], tags); err == nil {
+			t.Errorf("SetProfileTags(%q) succeeded; want error", tags)
+		}
+	}
+	if got := pm.knownProfiles[ids["bob"]].Tags; len(got) != 0 {
+		t.Errorf("bob's tags = %q after failed SetProfileTags; want none", got)
+	}
+	if err := pm.SetProfileTags(ids["bob"], []string{strings.Repeat("é", ipn.MaxProfileTagLen)}); err != nil {
+		t.Errorf("SetProfileTags with %d-character tag: %v", ipn.MaxProfileTagLen, err)
+	}
+	if err := pm.SetProfileTags("nope", []string{"test"}); err != errProfileNotFound {
+		t.Errorf("SetProfileTags(unknown) = %v; want %v", err, errProfileNotFound)
+	}
+}
+
+func TestMigrateCollidingV1IDs(t *testing.T) {
+	store := new(mem.Store)
+	known := map[ipn.ProfileID]*ipn.LoginProfile{
+		"1ab3":             {ID: "1ab3", Name: "colliding", Key: "profile-1ab3"},
+		"1ab3000000000000": {ID: "1ab3000000000000", Name: "v2", Key: "profile-1ab3000000000000"},
+		"ffff":             {ID: "ffff", Name: "v1", Key: "profile-ffff"},
+	}
+	store.WriteState(ipn.KnownProfilesStateKey, must.Get(json.Marshal(known)))
+	store.WriteState(ipn.ServeConfigKey("1ab3"), []byte(`{"TCP":{"443":{"HTTPS":true}}}`))
+
+	pm, err := newProfileManagerWithGOOS(store, logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]ipn.ProfileID{}
+	for _, p := range pm.Profiles() {
+		byName[p.Name] = p.ID
+	}
+	if got := byName["v1"]; got != "ffff" {
+		t.Errorf("non-colliding V1 ID = %q; want unchanged", got)
+	}
+	if got := byName["v2"]; got != "1ab3000000000000" {
+		t.Errorf("V2 ID = %q; want unchanged", got)
+	}
+	newID := byName["colliding"]
+	if !newID.IsV2() {
+		t.Fatalf("colliding V1 ID migrated to %q; want a V2 ID", newID)
+	}
+	if got := pm.knownProfiles[newID].Key; got != "profile-1ab3" {
+		t.Errorf("migrated profile Key = %q; want unchanged", got)
+	}
+	if _, err := store.ReadState(ipn.ServeConfigKey(newID)); err != nil {
+		t.Errorf("serve config not moved to new ID: %v", err)
+	}
+	if b, _ := store.ReadState(ipn.ServeConfigKey("1ab3")); len(b) != 0 {
+		t.Errorf("serve config left under old ID: %s", b)
+	}
+
+	// The migration is persisted, so loading again changes nothing.
+	pm2, err := newProfileManagerWithGOOS(store, logger.Discard, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pm2.knownProfiles[newID]; !ok || len(pm2.knownProfiles) != 3 {
+		t.Errorf("reloaded profiles = %v; want migrated ID %q", pm2.knownProfiles, newID)
+	}
+}
+
 func TestProfileDupe(t *testing.T) {
 	newPersist := func(user, node int) *persist.Persist {
 		return &persist.Persist{
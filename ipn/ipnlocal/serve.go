@@ -240,7 +240,7 @@ func (b *LocalBackend) SetServeConfig(config *ipn.ServeConfig, etag string) erro
 
 func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig, etag string) error {
 	prefs := b.pm.CurrentPrefs()
-	if config.IsFunnelOn() && prefs.ShieldsUp() {
+	if config.IsFunnelOn() && prefs.ShieldsUpBlocksInbound() {
 		return errors.New("Unable to turn on Funnel while shields-up is enabled")
 	}
 
@@ -16,6 +16,7 @@
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -23,6 +24,7 @@
 	"slices"
 	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/tailscale/golang-x-crypto/ssh"
 	"go4.org/mem"
@@ -109,13 +111,87 @@ func (b *LocalBackend) getSSHUsernames(req *tailcfg.C2NSSHUsernamesRequest) (*ta
 }
 
 func (b *LocalBackend) GetSSH_HostKeys() (keys []ssh.Signer, err error) {
+	b.mu.Lock()
+	keyPath := b.pm.CurrentPrefs().SSHKeyPath()
+	b.mu.Unlock()
+	return b.getSSH_HostKeys(keyPath)
+}
+
+// getSSH_HostKeys returns the SSH host keys to use. If keyPath is
+// non-empty, the Ed25519 key read from it is used in place of the system's
+// or a generated one.
+func (b *LocalBackend) getSSH_HostKeys(keyPath string) (keys []ssh.Signer, err error) {
 	var existing map[string]ssh.Signer
 	if os.Geteuid() == 0 {
 		existing = b.getSystemSSH_HostKeys()
 	}
+	if keyPath != "" {
+		signer, err := b.loadSSHHostKeyFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		mak.Set(&existing, "ed25519", signer)
+	}
 	return b.getTailscaleSSH_HostKeys(existing)
 }
 
+// errInvalidSSHKeyPath is returned by loadSSHHostKeyFile when the file named
+// by Prefs.SSHKeyPath can't be used as a host key. It deliberately says
+// nothing about the file, which tailscaled may be able to read when the
+// user who set the pref can't; the details are logged instead.
+var errInvalidSSHKeyPath = errors.New("SSHKeyPath does not name a usable Ed25519 SSH host key")
+
+// loadSSHHostKeyFile reads the Ed25519 SSH host key from path, as named by
+// Prefs.SSHKeyPath.
+func (b *LocalBackend) loadSSHHostKeyFile(path string) (ssh.Signer, error) {
+	signer, err := parseSSHHostKeyFile(path)
+	if err != nil {
+		b.logf("ssh: SSHKeyPath: %v", err)
+		return nil, errInvalidSSHKeyPath
+	}
+	return signer, nil
+}
+
+// parseSSHHostKeyFile is the part of loadSSHHostKeyFile that reads and
+// checks the key, returning a detailed error for the log.
+//
+// Like OpenSSH, it only accepts a regular file owned by the user tailscaled
+// runs as and not accessible to anyone else. Otherwise a local user who
+// may edit prefs could have tailscaled serve a key they know, or learn
+// from its errors about files they can't read.
+func parseSSHHostKeyFile(path string) (ssh.Signer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SSH host key: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("reading SSH host key: %w", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("SSH host key %s is not a regular file", path)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return nil, fmt.Errorf("SSH host key %s is owned by uid %d, not %d", path, st.Uid, os.Geteuid())
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return nil, fmt.Errorf("SSH host key %s has mode %v; must not be accessible by group or others", path, perm)
+	}
+	hostKey, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading SSH host key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(hostKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SSH host key %s: %w", path, err)
+	}
+	if typ := signer.PublicKey().Type(); typ != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("SSH host key %s is of type %q; want %q", path, typ, ssh.KeyAlgoED25519)
+	}
+	return signer, nil
+}
+
 // getTailscaleSSH_HostKeys returns the three (rsa, ecdsa, ed25519) SSH host
 // keys, reusing the provided ones in existing if present in the map.
 func (b *LocalBackend) getTailscaleSSH_HostKeys(existing map[string]ssh.Signer) (keys []ssh.Signer, err error) {
@@ -210,8 +286,11 @@ func (b *LocalBackend) getSystemSSH_HostKeys() (ret map[string]ssh.Signer) {
 	return ret
 }
 
-func (b *LocalBackend) getSSHHostKeyPublicStrings() (ret []string) {
-	signers, _ := b.GetSSH_HostKeys()
+func (b *LocalBackend) getSSHHostKeyPublicStrings(keyPath string) (ret []string) {
+	signers, err := b.getSSH_HostKeys(keyPath)
+	if err != nil {
+		b.logf("getting SSH host keys: %v", err)
+	}
 	for _, signer := range signers {
 		ret = append(ret, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))))
 	}
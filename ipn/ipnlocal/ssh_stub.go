@@ -11,7 +11,7 @@
 	"tailscale.com/tailcfg"
 )
 
-func (b *LocalBackend) getSSHHostKeyPublicStrings() []string {
+func (b *LocalBackend) getSSHHostKeyPublicStrings(keyPath string) []string {
 	return nil
 }
 
@@ -6,10 +6,24 @@
 package ipnlocal
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/tailscale/golang-x-crypto/ssh"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/tailcfg"
 	"tailscale.com/util/must"
@@ -44,6 +58,94 @@ func TestSSHKeyGen(t *testing.T) {
 	}
 }
 
+func TestSSHKeyPath(t *testing.T) {
+	dir := t.TempDir()
+	lb := &LocalBackend{varRoot: dir, logf: t.Logf}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "host_key")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := lb.getSSH_HostKeys(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, k := range keys {
+		if k.PublicKey().Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+		found = true
+		if !bytes.Equal(k.PublicKey().Marshal(), want.PublicKey().Marshal()) {
+			t.Errorf("ed25519 host key is not the one from SSHKeyPath")
+		}
+	}
+	if !found {
+		t.Fatalf("no ed25519 host key in %d keys", len(keys))
+	}
+
+	var logs []string
+	lb.logf = func(format string, args ...any) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	missing := filepath.Join(dir, "missing")
+	_, err = lb.getSSH_HostKeys(missing)
+	if !errors.Is(err, errInvalidSSHKeyPath) {
+		t.Errorf("missing key file: err = %v; want errInvalidSSHKeyPath", err)
+	}
+	if err != nil && strings.Contains(err.Error(), missing) {
+		t.Errorf("missing key file: err %q reveals the path", err)
+	}
+	if !slices.ContainsFunc(logs, func(l string) bool { return strings.Contains(l, "no such file") }) {
+		t.Errorf("missing key file: reason not logged; logs: %q", logs)
+	}
+	ecKey := must.Get(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	ecPath := filepath.Join(dir, "ecdsa_key")
+	ecPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: must.Get(x509.MarshalPKCS8PrivateKey(ecKey))})
+	if err := os.WriteFile(ecPath, ecPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.getSSH_HostKeys(ecPath); !errors.Is(err, errInvalidSSHKeyPath) {
+		t.Errorf("ECDSA key file: err = %v; want errInvalidSSHKeyPath", err)
+	}
+	if !slices.ContainsFunc(logs, func(l string) bool { return strings.Contains(l, `want "ssh-ed25519"`) }) {
+		t.Errorf("ECDSA key file: key type not logged; logs: %q", logs)
+	}
+	if got := lb.getSSHHostKeyPublicStrings(ecPath); len(got) != 0 {
+		t.Errorf("getSSHHostKeyPublicStrings with bad key = %q; want none", got)
+	}
+
+	// A key that others can read isn't used.
+	if err := os.Chmod(keyPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.getSSH_HostKeys(keyPath); !errors.Is(err, errInvalidSSHKeyPath) {
+		t.Errorf("world-readable key file: err = %v; want errInvalidSSHKeyPath", err)
+	}
+	if !slices.ContainsFunc(logs, func(l string) bool { return strings.Contains(l, "must not be accessible") }) {
+		t.Errorf("world-readable key file: mode not logged; logs: %q", logs)
+	}
+	if err := os.Chmod(keyPath, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.getSSH_HostKeys(dir); !errors.Is(err, errInvalidSSHKeyPath) {
+		t.Errorf("directory: err = %v; want errInvalidSSHKeyPath", err)
+	}
+}
+
 type fakeSSHServer struct {
 	SSHServer
 }
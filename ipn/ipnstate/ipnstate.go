@@ -292,6 +292,17 @@ type PeerStatus struct {
 	KeyExpiry *time.Time `json:",omitempty"`
 
 	Location *tailcfg.Location `json:",omitempty"`
+
+	// Stats are the packet counters for traffic with this peer. They're
+	// only collected when the PeerMetricsEnabled pref is set.
+	Stats *PeerStats `json:",omitempty"`
+}
+
+// PeerStats are packet counters for traffic with a peer, counted since
+// PeerMetricsEnabled was last turned on.
+type PeerStats struct {
+	TxPackets uint64 // sent to the peer
+	RxPackets uint64 // received from the peer
 }
 
 // HasCap reports whether ps has the given capability.
@@ -437,6 +448,9 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.LastHandshake; !v.IsZero() {
 		e.LastHandshake = v
 	}
+	if v := st.Stats; v != nil {
+		e.Stats = v
+	}
 	if v := st.Created; !v.IsZero() {
 		e.Created = v
 	}
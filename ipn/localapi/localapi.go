@@ -95,6 +95,7 @@
 	"metrics":                     (*Handler).serveMetrics,
 	"ping":                        (*Handler).servePing,
 	"prefs":                       (*Handler).servePrefs,
+	"prepare-suspend":             (*Handler).servePrepareSuspend,
 	"pprof":                       (*Handler).servePprof,
 	"reload-config":               (*Handler).reloadConfig,
 	"reset-auth":                  (*Handler).serveResetAuth,
@@ -1435,6 +1436,25 @@ func (h *Handler) serveSetExpirySooner(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "done\n")
 }
 
+// servePrepareSuspend is called by the platform's power management
+// integration when the OS is about to suspend.
+func (h *Handler) servePrepareSuspend(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if h.b.PrepareForSuspend() {
+		io.WriteString(w, "sent keepalives\n")
+	} else {
+		io.WriteString(w, "done\n")
+	}
+}
+
 func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	if r.Method != "POST" {
@@ -1988,6 +2008,8 @@ func (h *Handler) serveTKASubmitRecoveryAUM(w http.ResponseWriter, r *http.Reque
 //   - GET /profiles/<id>: output profile (JSON-ecoded ipn.LoginProfile)
 //   - POST /profiles/<id>: switch to profile (no response)
 //   - DELETE /profiles/<id>: delete profile (no response)
+//   - POST /profiles/<id>/merge?into=<dst>: merge profile into dst and
+//     delete it (no response)
 func (h *Handler) serveProfiles(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "profiles access denied", http.StatusForbidden)
@@ -2030,6 +2052,23 @@ func (h *Handler) serveProfiles(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if src, ok := strings.CutSuffix(suffix, "/merge"); ok {
+		if r.Method != httpm.POST {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		dst := r.FormValue("into")
+		if dst == "" {
+			http.Error(w, "missing 'into' parameter", http.StatusBadRequest)
+			return
+		}
+		if err := h.b.MergeProfiles(ipn.ProfileID(src), ipn.ProfileID(dst)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
 	profileID := ipn.ProfileID(suffix)
 	switch r.Method {
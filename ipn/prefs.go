@@ -10,12 +10,21 @@
 	"fmt"
 	"log"
 	"net/netip"
+	"net/url"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"golang.org/x/net/idna"
 	"tailscale.com/atomicfile"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netaddr"
@@ -23,8 +32,15 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
+	"tailscale.com/types/ptr"
 	"tailscale.com/types/views"
+	"tailscale.com/util/cmpver"
 	"tailscale.com/util/dnsname"
+	"tailscale.com/util/multierr"
+	"tailscale.com/util/set"
+	"tailscale.com/util/testenv"
+	"tailscale.com/util/winutil"
+	"tailscale.com/version"
 )
 
 // DefaultControlURL is the URL base of the control plane
@@ -32,18 +48,178 @@
 // The default control plane is the hosted version run by Tailscale.com.
 const DefaultControlURL = "https://controlplane.tailscale.com"
 
+// MaxTailscaleSSHMaxSessions is the largest permitted value of
+// Prefs.TailscaleSSHMaxSessions.
+const MaxTailscaleSSHMaxSessions = 1000
+
+// MinWireGuardPQVersion is the minimum tailscaled version that accepts
+// Prefs.WireGuardPQEnabled.
+const MinWireGuardPQVersion = "1.51.0"
+
+// MaxProfileDescriptionLen is the maximum length, in characters, of
+// Prefs.ProfileDescription.
+const MaxProfileDescriptionLen = 512
+
+// MinMetricsPort is the lowest non-zero port allowed for
+// Prefs.MetricsPort, so that the metrics server can't take over a
+// well-known service's port.
+const MinMetricsPort = 1024
+
+// MaxLocallyServedPorts is the maximum number of entries in
+// Prefs.LocallyServedPorts.
+const MaxLocallyServedPorts = 32
+
+// MaxLocalForwardPorts is the maximum number of entries in
+// Prefs.LocalForwardPorts.
+const MaxLocalForwardPorts = 32
+
+// MaxAllowedSources is the maximum number of entries in
+// Prefs.AllowedSources.
+const MaxAllowedSources = 64
+
+// MaxTailscaleZoneIDLen is the maximum length of Prefs.TailscaleZoneID.
+const MaxTailscaleZoneIDLen = 64
+
+const (
+	// DefaultMaxLogLineLength is the log line length cap used when
+	// Prefs.MaxLogLineLength is zero. Many log aggregation systems reject
+	// lines over 8 KB.
+	DefaultMaxLogLineLength = 8192
+
+	// MaxPostureCheckPolicyLen is the maximum length of
+	// Prefs.PostureCheckPolicy.
+	MaxPostureCheckPolicyLen = 128
+
+	// MinMaxLogLineLength and MaxMaxLogLineLength bound a non-zero
+	// Prefs.MaxLogLineLength.
+	MinMaxLogLineLength = 256
+	MaxMaxLogLineLength = 65535
+)
+
+// MaxProfileTagLen is the maximum length, in characters, of each of
+// LoginProfile.Tags.
+const MaxProfileTagLen = 32
+
+const (
+	// DefaultStatsInterval is the peer statistics poll interval used when
+	// Prefs.StatsInterval is nil.
+	DefaultStatsInterval = 30 * time.Second
+
+	// MinStatsInterval and MaxStatsInterval bound Prefs.StatsInterval.
+	MinStatsInterval = 5 * time.Second
+	MaxStatsInterval = 300 * time.Second
+
+	// MinWireGuardRoamInterval and MaxWireGuardRoamInterval bound
+	// Prefs.WireGuardRoamInterval.
+	MinWireGuardRoamInterval = 1 * time.Second
+	MaxWireGuardRoamInterval = 60 * time.Second
+
+	// MinDNSTTLOverride and MaxDNSTTLOverride bound Prefs.DNSTTLOverride.
+	MinDNSTTLOverride = 1 * time.Second
+	MaxDNSTTLOverride = 3600 * time.Second
+
+	// DefaultExitNodeRotateInterval is the exit node rotation interval used
+	// when Prefs.ExitNodeRotateInterval is zero.
+	DefaultExitNodeRotateInterval = time.Hour
+
+	// DefaultCacheDNSTTL is how long DNS responses for names matching
+	// Prefs.CacheDNSFor are cached when Prefs.CacheDNSTTL is zero.
+	DefaultCacheDNSTTL = 300 * time.Second
+)
+
+// Valid values of Prefs.PrivacyMode.
+const (
+	PrivacyModeStandard = "standard"
+	PrivacyModeStrict   = "strict"
+	PrivacyModeParanoid = "paranoid"
+)
+
+// Valid values of Prefs.NameserverPolicy. The empty string means
+// NameserverPolicyAuto.
+const (
+	NameserverPolicyAuto          = "auto"
+	NameserverPolicyTailscaleOnly = "tailscale-only"
+	NameserverPolicySystemOnly    = "system-only"
+)
+
+// Valid values of Prefs.ConnectionPriorityMode. The empty string means
+// ConnectionPriorityLatency.
+const (
+	ConnectionPriorityLatency     = "latency"
+	ConnectionPriorityReliability = "reliability"
+	ConnectionPriorityBandwidth   = "bandwidth"
+)
+
+// Valid values of AutoUpdatePrefs.Channel. The empty string means
+// UpdateChannelStable.
+const (
+	UpdateChannelStable     = "stable"
+	UpdateChannelUnstable   = "unstable"
+	UpdateChannelEnterprise = "enterprise"
+)
+
+// Valid values of Prefs.ShieldsUpMode. The empty string means to use the
+// legacy Prefs.ShieldsUp field.
+const (
+	ShieldsUpModeAll          = "all"
+	ShieldsUpModeInboundOnly  = "inbound-only"
+	ShieldsUpModeOutboundOnly = "outbound-only"
+)
+
+// Valid values of Prefs.TunnelProtocol. The empty string means
+// TunnelProtocolWireGuard.
+const (
+	TunnelProtocolWireGuard = "wireguard"
+	TunnelProtocolQUIC      = "quic"
+)
+
 var (
 	// ErrExitNodeIDAlreadySet is returned from (*Prefs).SetExitNodeIP when the
 	// Prefs.ExitNodeID field is already set.
 	ErrExitNodeIDAlreadySet = errors.New("cannot set ExitNodeIP when ExitNodeID is already set")
+
+	// ErrExitNodeIDAndIPSet is returned from (*Prefs).ApplyEdits when the
+	// edits would leave both Prefs.ExitNodeID and Prefs.ExitNodeIP set,
+	// and (wrapped) from (*Prefs).Validate when both are set.
+	ErrExitNodeIDAndIPSet = errors.New("cannot set both ExitNodeID and ExitNodeIP")
+
+	// ErrInvalidAdvertiseRoute is returned (wrapped) from (*Prefs).ApplyEdits
+	// and (*Prefs).Validate when Prefs.AdvertiseRoutes contains an invalid
+	// or non-canonical prefix.
+	ErrInvalidAdvertiseRoute = errors.New("invalid AdvertiseRoutes entry")
+
+	// ErrInvalidControlURL is returned (wrapped) from (*Prefs).ApplyEdits
+	// and (*Prefs).Validate when Prefs.ControlURL is not an acceptable
+	// control URL.
+	ErrInvalidControlURL = errors.New("invalid ControlURL")
+
+	// ErrInvalidPrefs is returned (wrapped) by PrefsFromBytes and LoadPrefs
+	// when the decoded Prefs fail validation.
+	ErrInvalidPrefs = errors.New("invalid prefs")
+
+	// ErrFuturePrefsVersion is returned, wrapped with the version found,
+	// by PrefsFromBytes when the prefs have a SchemaVersion newer than
+	// CurrentPrefsSchemaVersion.
+	ErrFuturePrefsVersion = errors.New("prefs file is from a newer version")
 )
 
+// CurrentPrefsSchemaVersion is the Prefs.SchemaVersion written by this
+// version of Tailscale.
+const CurrentPrefsSchemaVersion = 1
+
 // IsLoginServerSynonym reports whether a URL is a drop-in replacement
 // for the primary Tailscale login server.
 func IsLoginServerSynonym(val any) bool {
 	return val == "https://login.tailscale.com" || val == "https://controlplane.tailscale.com"
 }
 
+// IsFileControlURL reports whether u is a file:// control URL, naming a
+// local netmap JSON file to use instead of a control server. It is meant
+// for testing against a captured netmap.
+func IsFileControlURL(u string) bool {
+	return strings.HasPrefix(u, "file://")
+}
+
 // Prefs are the user modifiable settings of the Tailscale node agent.
 type Prefs struct {
 	// ControlURL is the URL of the control server to use.
@@ -58,6 +234,10 @@ type Prefs struct {
 	// It would be more consistent to restart controlclient
 	// automatically whenever this variable changes.
 	//
+	// A file:// URL (see IsFileControlURL) makes the node read its
+	// netmap from a local JSON file instead of connecting to a control
+	// server. It is only meant for testing.
+	//
 	// Meanwhile, you have to provide this as part of
 	// Options.LegacyMigrationPrefs or Options.UpdatePrefs when
 	// calling Backend.Start().
@@ -75,10 +255,10 @@ type Prefs struct {
 	// This corresponds to the "tailscale up --host-routes" value,
 	// which defaults to true.
 	//
-	// TODO(danderson): why do we have this? It dumps a lot of stuff
-	// into the routing table, and a single network route _should_ be
-	// all that we need. But when I turn this off in my tailscaled,
-	// packets stop flowing. What's up with that?
+	// Deprecated: setting AllowSingleHosts to false stops packets from
+	// flowing, so LocalBackend always treats it as true, and it is set to
+	// true when prefs are loaded (see MigrateAllowSingleHosts). It will be
+	// removed in a future version of the prefs format.
 	AllowSingleHosts bool
 
 	// ExitNodeID and ExitNodeIP specify the node that should be used
@@ -105,6 +285,9 @@ type Prefs struct {
 
 	// CorpDNS specifies whether to install the Tailscale network's
 	// DNS configuration, if it exists.
+	//
+	// Deprecated: use NameserverPolicy instead. CorpDNS is only consulted
+	// when NameserverPolicy is NameserverPolicyAuto or empty.
 	CorpDNS bool
 
 	// RunSSH bool is whether this node should run an SSH
@@ -128,6 +311,11 @@ type Prefs struct {
 	// regardless of the control-provided packet filter. If false, we
 	// use the packet filter as provided. If true, we block incoming
 	// connections. This overrides tailcfg.Hostinfo's ShieldsUp.
+	//
+	// Deprecated: use ShieldsUpMode. ShieldsUp is only consulted when
+	// ShieldsUpMode is empty, in which case true means
+	// ShieldsUpModeInboundOnly;
+	// saved prefs are migrated to ShieldsUpMode when loaded.
 	ShieldsUp bool
 
 	// AdvertiseTags specifies groups that this node wants to join, for
@@ -138,7 +326,8 @@ type Prefs struct {
 	AdvertiseTags []string
 
 	// Hostname is the hostname to use for identifying the node. If
-	// not set, os.Hostname is used.
+	// not set, os.Hostname is used. Internationalized names are stored in
+	// their ASCII (punycode) form; see SetHostname and HostnameDisplay.
 	Hostname string
 
 	// NotepadURLs is a debugging setting that opens OAuth URLs in
@@ -204,6 +393,298 @@ type Prefs struct {
 	// posture checks.
 	PostureChecking bool
 
+	// TailscaleSSHMaxSessions is the maximum number of concurrent Tailscale
+	// SSH sessions this node accepts when RunSSH is set. Zero means
+	// unlimited. It must not exceed MaxTailscaleSSHMaxSessions.
+	TailscaleSSHMaxSessions int `json:",omitempty"`
+
+	// StatsInterval is how often the daemon polls for peer connection
+	// statistics. If nil, DefaultStatsInterval is used. Otherwise it must be
+	// between MinStatsInterval and MaxStatsInterval.
+	StatsInterval *time.Duration `json:",omitempty"`
+
+	// ExitNodeIDs is the ordered list of exit nodes to cycle through when
+	// ExitNodeRotate is set.
+	ExitNodeIDs []tailcfg.StableNodeID `json:",omitempty"`
+
+	// ExitNodeRotate, if true, periodically advances ExitNodeID to the next
+	// entry in ExitNodeIDs. It requires ExitNodeIDs to be non-empty.
+	ExitNodeRotate bool `json:",omitempty"`
+
+	// ExitNodeRotateInterval is how often the exit node is rotated when
+	// ExitNodeRotate is set. If zero, DefaultExitNodeRotateInterval is used.
+	ExitNodeRotateInterval time.Duration `json:",omitempty"`
+
+	// NoControlURLNormalizeOnLoad disables the mapping of legacy synonyms of
+	// DefaultControlURL (such as https://login.tailscale.com) to
+	// DefaultControlURL by ControlURLOrDefault. If true, ControlURL is
+	// returned verbatim.
+	NoControlURLNormalizeOnLoad bool `json:",omitempty"`
+
+	// PrivacyMode is a preset of privacy-related settings: one of
+	// PrivacyModeStandard, PrivacyModeStrict or PrivacyModeParanoid, or empty
+	// for none. When set through MaskedPrefs, ApplyEdits expands it into the
+	// individual fields (see PrivacyModePreset); fields set explicitly in the
+	// same edit take precedence.
+	PrivacyMode string `json:",omitempty"`
+
+	// SSHCertAuth, if true, requires Tailscale SSH clients to authenticate
+	// with an SSH user certificate signed by one of SSHTrustedUserCAKeys;
+	// "none" and password authentication are refused. It requires RunSSH.
+	SSHCertAuth bool `json:",omitempty"`
+
+	// NameserverPolicy controls which resolvers the node uses: one of
+	// NameserverPolicyAuto (the default, also used when empty), in which case
+	// CorpDNS decides; NameserverPolicyTailscaleOnly, which sends all queries
+	// through Tailscale's resolver; or NameserverPolicySystemOnly, which leaves
+	// the system resolver configuration alone.
+	NameserverPolicy string `json:",omitempty"`
+
+	// ProfileDescription is an optional longer human-readable description of
+	// the profile, such as "Production subnet router for EU region". Like
+	// ProfileName, it is only used for display purposes. It must not be longer
+	// than MaxProfileDescriptionLen characters.
+	ProfileDescription string `json:",omitempty"`
+
+	// Interface, if non-empty, is the name of the WireGuard (TUN) interface
+	// to create on Linux, instead of the default "tailscale0". It is only
+	// read at tailscaled startup when no explicit --tun flag was given, so
+	// changing it requires a restart. It must be a valid Linux interface
+	// name (at most 15 characters, no spaces or slashes) and must not
+	// collide with well-known system interface names.
+	Interface string `json:",omitempty"`
+
+	// TunnelProtocol selects the data plane tunnel protocol: one of
+	// TunnelProtocolWireGuard (the default, also used when empty) or
+	// TunnelProtocolQUIC. QUIC tunnels are not implemented yet; selecting it
+	// is accepted but the node still uses WireGuard.
+	TunnelProtocol string `json:",omitempty"`
+
+	// TailnetName is the name of the tailnet the node is connected to, as
+	// reported by the control server. It is populated by the backend from the
+	// network map for display purposes and cannot be set by users.
+	TailnetName string `json:",omitempty"`
+
+	// ShieldsUpMode selects which connections to block regardless of the
+	// control-provided packet filter: ShieldsUpModeAll blocks connections in
+	// both directions, ShieldsUpModeInboundOnly blocks only incoming
+	// connections and ShieldsUpModeOutboundOnly blocks only outgoing
+	// connections to peers. If empty, the legacy ShieldsUp field applies, and
+	// is treated as ShieldsUpModeInboundOnly. See EffectiveShieldsUpMode.
+	ShieldsUpMode string `json:",omitempty"`
+
+	// PeerRoutePropagation specifies whether subnet routes learned from peers
+	// are re-advertised by this node, so that in a hub-and-spoke topology a
+	// hub can share the routes of one spoke with the others. It requires
+	// RouteAll. Exit node (default) routes are never propagated.
+	PeerRoutePropagation bool `json:",omitempty"`
+
+	// WireGuardPQEnabled opts into a post-quantum (Kyber) hybrid WireGuard
+	// key exchange with peers. It requires tailscaled version
+	// MinWireGuardPQVersion or later. The WireGuard implementation does not
+	// support it yet, so for now enabling it is only logged by the engine.
+	WireGuardPQEnabled bool `json:",omitempty"`
+
+	// CacheDNSFor is a list of glob patterns (as matched by path.Match,
+	// without a trailing dot, e.g. "*.example.com") of DNS names whose
+	// responses from upstream resolvers are cached locally by the
+	// Tailscale DNS forwarder for CacheDNSTTL. It helps on flaky
+	// connections, typically on mobile.
+	CacheDNSFor []string `json:",omitempty"`
+
+	// CacheDNSTTL is how long responses for names matching CacheDNSFor
+	// are cached, overriding the TTLs of the records in the response.
+	// If zero, DefaultCacheDNSTTL is used.
+	CacheDNSTTL time.Duration `json:",omitempty"`
+
+	// UserspaceSockets specifies whether tailscaled should use its
+	// userspace network stack (netstack) instead of a kernel TUN device,
+	// as with --tun=userspace-networking. It is useful in container
+	// environments without /dev/net/tun. It is only read when tailscaled
+	// starts, it is ignored if --tun is set explicitly, and it is only
+	// supported on the platforms accepted by ValidateUserspaceSockets.
+	UserspaceSockets bool `json:",omitempty"`
+
+	// AuditLog specifies whether every change to these prefs is appended
+	// to a tamper-evident audit log at AuditLogPath. Each record is
+	// chained to the previous one and authenticated with a key derived
+	// from the node's machine key.
+	AuditLog bool `json:",omitempty"`
+
+	// AuditLogPath is the absolute path of the audit log file written
+	// when AuditLog is set. It must be within the tailscaled state
+	// directory, and an existing file must be owned by tailscaled.
+	AuditLogPath string `json:",omitempty"`
+
+	// LocallyServedPorts are ports on this node's Tailscale addresses
+	// that accept new inbound TCP, UDP and SCTP connections from any peer,
+	// regardless of the tailnet's packet filter and of ShieldsUp. It is
+	// meant for things like local health checks. At most
+	// MaxLocallyServedPorts ports may be listed.
+	LocallyServedPorts []uint16 `json:",omitempty"`
+
+	// KeepAliveOnSuspend specifies whether to send a WireGuard keepalive
+	// to every peer when the OS reports that it is about to suspend, so that
+	// sessions are still fresh on resume. The Windows service reports
+	// suspends to tailscaled; on other platforms, the GUI can report them
+	// through the LocalAPI prepare-suspend endpoint.
+	KeepAliveOnSuspend bool `json:",omitempty"`
+
+	// MetricsPort, if non-zero, is the port on 127.0.0.1 where tailscaled
+	// serves its client metrics in the Prometheus text format at /metrics.
+	// Zero, the default, disables the server. Ports below
+	// MinMetricsPort are rejected.
+	MetricsPort uint16 `json:",omitempty"`
+
+	// RouteAllFilter, if non-nil, limits the subnet routes accepted because
+	// of RouteAll to those contained within it, such as 10.0.0.0/8. Its
+	// prefix length must be at most 30. It has no effect when RouteAll is
+	// false, and when nil all advertised subnet routes are accepted.
+	RouteAllFilter *netip.Prefix `json:",omitempty"`
+
+	// TrafficShaping, if non-nil, limits the bandwidth of traffic to and
+	// from each remote Tailscale address, such as on a subnet router sharing
+	// a slow link. See TrafficShapingPrefs.
+	TrafficShaping *TrafficShapingPrefs `json:",omitempty"`
+
+	// TailscaleIPv4Only specifies that only the node's IPv4 Tailscale
+	// address is assigned to the Tailscale interface and only peers' IPv4
+	// Tailscale addresses are routed. It is for networks where IPv6 on the
+	// Tailscale interface conflicts with other software. It must not be set
+	// together with TailscaleIPv6Only.
+	TailscaleIPv4Only bool `json:",omitempty"`
+
+	// TailscaleIPv6Only is like TailscaleIPv4Only, but uses only IPv6
+	// Tailscale addresses.
+	TailscaleIPv6Only bool `json:",omitempty"`
+
+	// DiagnosticsEnabled specifies whether to automatically upload a
+	// diagnostics bundle to DiagnosticsUploadURL when connectivity has been
+	// lost for an extended period.
+	DiagnosticsEnabled bool `json:",omitempty"`
+
+	// DiagnosticsUploadURL is the HTTPS URL to which diagnostics bundles
+	// are POSTed when DiagnosticsEnabled is set.
+	DiagnosticsUploadURL string `json:",omitempty"`
+
+	// WireGuardRoamInterval, if non-nil, is how often a WireGuard handshake
+	// is initiated with each active peer, so that a change of network is
+	// noticed sooner at the cost of more battery use. It must be between
+	// MinWireGuardRoamInterval and MaxWireGuardRoamInterval. If nil, only
+	// WireGuard's own handshakes are done.
+	WireGuardRoamInterval *time.Duration `json:",omitempty"`
+
+	// PeerMetricsEnabled specifies whether to count the packets exchanged
+	// with each peer and report them in ipnstate.PeerStatus.Stats. Counting
+	// has a small per-packet cost, so it is off by default.
+	PeerMetricsEnabled bool `json:",omitempty"`
+
+	// AllowedSources are source prefixes whose traffic is still permitted
+	// while shields are up: inbound packets from them are accepted even when
+	// shields-up mode blocks inbound connections, and packets to them are
+	// sent even when it blocks outbound connections. It has no effect while
+	// shields are down. At most MaxAllowedSources prefixes may be listed.
+	AllowedSources []netip.Prefix `json:",omitempty"`
+
+	// TailscaleZoneID is the cloud availability zone this node runs in, such
+	// as "us-east-1a", reported to the control plane in Hostinfo.Location.Zone
+	// as a hint for latency-aware relay selection. It may be at most
+	// MaxTailscaleZoneIDLen ASCII letters, digits and hyphens. Empty means
+	// no zone is reported.
+	TailscaleZoneID string `json:",omitempty"`
+
+	// HeadscaleCompatibility enables compatibility with the open-source
+	// Headscale control server. When set, features Headscale does not
+	// implement, such as device posture checking and tailnet lock, are
+	// disabled even if otherwise enabled. It may only be set when a custom
+	// control server is in use; see IsUsingCustomControlServer.
+	HeadscaleCompatibility bool `json:",omitempty"`
+
+	// SchemaVersion is the version of the Prefs JSON schema these prefs
+	// were stored with; ToBytes sets it to CurrentPrefsSchemaVersion. Zero
+	// means they predate schema versioning. PrefsFromBytes refuses prefs with a
+	// version newer than CurrentPrefsSchemaVersion, as they may carry
+	// fields this version would silently drop. It describes the encoding
+	// rather than a preference, so Equals ignores it.
+	SchemaVersion int `json:",omitempty"`
+
+	// DNSTTLOverride, if non-nil, is the TTL given to every record in DNS
+	// responses returned to local clients by the Tailscale DNS resolver,
+	// both for MagicDNS names and for forwarded queries. It's for
+	// applications that cache responses for too long or too short a time.
+	// It must be between MinDNSTTLOverride and MaxDNSTTLOverride. If nil,
+	// the actual TTLs are passed through.
+	DNSTTLOverride *time.Duration `json:",omitempty"`
+
+	// MaxLogLineLength is the maximum length, in bytes, of each line
+	// logged by the Tailscale daemon. Longer lines are cut short and end
+	// with "... [truncated]". If zero, DefaultMaxLogLineLength is used.
+	// Otherwise it must be between MinMaxLogLineLength and
+	// MaxMaxLogLineLength.
+	MaxLogLineLength int `json:",omitempty"`
+
+	// ConnectionPriorityMode is a hint for what path selection between
+	// peers should optimize for: one of ConnectionPriorityLatency (the
+	// default, also used when empty), ConnectionPriorityReliability or
+	// ConnectionPriorityBandwidth. Only latency-based selection is
+	// implemented today; the other modes are for future multi-path
+	// support.
+	ConnectionPriorityMode string `json:",omitempty"`
+
+	// PostureCheckPolicy names the posture policy set that the control
+	// plane should evaluate this node against when PostureChecking is
+	// enabled. It is at most MaxPostureCheckPolicyLen ASCII letters,
+	// digits and hyphens. PostureChecking without a policy is deprecated.
+	PostureCheckPolicy string `json:",omitempty"`
+
+	// PacketFilterLogging logs every accept and drop decision of the
+	// packet filter, up to 1000 per second, for debugging ACL rules.
+	PacketFilterLogging bool `json:",omitempty"`
+
+	// ExitNodeCountry, if non-empty, is an ISO 3166-1 alpha-2 country code
+	// in upper case ("CA") used as a fallback when ExitNodeID is set but
+	// that node is no longer available. The exit node used is, in order of
+	// priority: ExitNodeID if that peer is in the netmap and not offline;
+	// otherwise the first available one of ExitNodeFallbacks; otherwise
+	// another exit node located in ExitNodeCountry, if any; otherwise none,
+	// and traffic for the exit node's routes is dropped as when
+	// ExitNodeCountry is unset.
+	ExitNodeCountry string `json:",omitempty"`
+
+	// SSHKeyPath, if non-empty, is the absolute path of a PEM-encoded
+	// PKCS #8 Ed25519 private key, such as written by "openssl genpkey
+	// -algorithm ed25519", for the Tailscale SSH server to use as its
+	// Ed25519 host key. This gives clients a stable known_hosts entry.
+	// When empty, the system's host key is used if tailscaled runs as
+	// root, or else one that tailscaled generates. The file is only read
+	// when the SSH server needs its host keys; if it's unusable, SSH
+	// connections fail and the reason is logged.
+	SSHKeyPath string `json:",omitempty"`
+
+	// ExitNodeFallbacks is an ordered list of exit nodes to switch to when
+	// the exit node in use becomes unavailable (it leaves the netmap or is
+	// reported offline). It is ignored if ExitNodeID is empty.
+	ExitNodeFallbacks []tailcfg.StableNodeID `json:",omitempty"`
+
+	// RoutePropagationFilter, if non-nil, limits the peer routes
+	// re-advertised because of PeerRoutePropagation to those contained
+	// within it, such as 10.0.0.0/8. Its prefix length must be at least 8.
+	// It is the propagation counterpart of RouteAllFilter, and when nil all
+	// learned subnet routes are propagated.
+	RoutePropagationFilter *netip.Prefix `json:",omitempty"`
+
+	// LocalForwardPorts are ports on 127.0.0.1 that tailscaled listens on
+	// and forwards to a port on a peer over Tailscale, like "ssh -L",
+	// without the peer having to advertise a subnet route. Each local port
+	// may be used once per protocol, and at most MaxLocalForwardPorts
+	// entries may be listed.
+	LocalForwardPorts []ForwardPort `json:",omitempty"`
+
+	// SSHTrustedUserCAKeys are the public keys, in authorized_keys format, of
+	// the certificate authorities trusted to sign SSH user certificates when
+	// SSHCertAuth is set. If empty, every certificate is rejected.
+	SSHTrustedUserCAKeys []string `json:",omitempty"`
+
 	// The Persist field is named 'Config' in the file for backward
 	// compatibility with earlier versions.
 	// TODO(apenwarr): We should move this out of here, it's not a pref.
@@ -222,53 +703,474 @@ type AutoUpdatePrefs struct {
 	// enabled, tailscaled will apply available updates in the background.
 	// Check must also be set when Apply is set.
 	Apply bool
+	// ApplyWindow, if non-nil, limits when tailscaled applies an update to
+	// the hours and days it describes. An update requested outside the
+	// window is deferred until the window opens. When nil, updates are
+	// applied as soon as they're requested.
+	ApplyWindow *UpdateWindow `json:",omitempty"`
+	// Channel is the release track to update from: UpdateChannelStable
+	// (the default, also used when empty), UpdateChannelUnstable for
+	// pre-release builds, or UpdateChannelEnterprise for the slower
+	// enterprise track.
+	Channel string `json:",omitempty"`
+}
+
+// ChannelOrDefault returns au.Channel, or UpdateChannelStable if it is not
+// set.
+func (au AutoUpdatePrefs) ChannelOrDefault() string {
+	if au.Channel == "" {
+		return UpdateChannelStable
+	}
+	return au.Channel
+}
+
+// Clone returns a deep copy of au.
+func (au *AutoUpdatePrefs) Clone() *AutoUpdatePrefs {
+	if au == nil {
+		return nil
+	}
+	dst := *au
+	if au.ApplyWindow != nil {
+		dst.ApplyWindow = ptr.To(*au.ApplyWindow)
+	}
+	return &dst
+}
+
+// Equals reports whether au and au2 are equal.
+func (au AutoUpdatePrefs) Equals(au2 AutoUpdatePrefs) bool {
+	if au.Check != au2.Check || au.Apply != au2.Apply || au.Channel != au2.Channel {
+		return false
+	}
+	if au.ApplyWindow == nil || au2.ApplyWindow == nil {
+		return au.ApplyWindow == au2.ApplyWindow
+	}
+	return *au.ApplyWindow == *au2.ApplyWindow
+}
+
+// UpdateWindow is a recurring period of local wall-clock time during which
+// auto-updates may be applied, such as 22:00 to 06:00 on weekends. See
+// AutoUpdatePrefs.ApplyWindow.
+type UpdateWindow struct {
+	// StartHour is the hour of the day, 0-23, at which the window opens.
+	StartHour int
+	// EndHour is the hour of the day, 0-23, at which the window closes. If
+	// it's less than StartHour, the window runs past midnight into the
+	// next day. It must not equal StartHour.
+	EndHour int
+	// Weekdays is a bitmask of the days on which the window opens, with bit
+	// 1<<time.Sunday for Sunday through 1<<time.Saturday for Saturday. A
+	// window that runs past midnight is counted as part of the day on
+	// which it opened. Zero means every day.
+	Weekdays uint8 `json:",omitempty"`
+}
+
+// Validate reports an error if w's hours or weekdays are out of range.
+func (w UpdateWindow) Validate() error {
+	if w.StartHour < 0 || w.StartHour > 23 || w.EndHour < 0 || w.EndHour > 23 {
+		return fmt.Errorf("UpdateWindow hours must be between 0 and 23, got %d-%d", w.StartHour, w.EndHour)
+	}
+	if w.StartHour == w.EndHour {
+		return fmt.Errorf("UpdateWindow must not start and end at the same hour, got %d", w.StartHour)
+	}
+	if w.Weekdays >= 1<<7 {
+		return fmt.Errorf("UpdateWindow.Weekdays has bits set above Saturday: %#x", w.Weekdays)
+	}
+	return nil
+}
+
+// Contains reports whether the local time t falls within w.
+func (w UpdateWindow) Contains(t time.Time) bool {
+	h, day := t.Hour(), t.Weekday()
+	if w.StartHour < w.EndHour {
+		return h >= w.StartHour && h < w.EndHour && w.onDay(day)
+	}
+	if h >= w.StartHour {
+		return w.onDay(day)
+	}
+	// Early morning of a window that opened the day before.
+	return h < w.EndHour && w.onDay((day+6)%7)
+}
+
+// onDay reports whether w opens on day.
+func (w UpdateWindow) onDay(day time.Weekday) bool {
+	return w.Weekdays == 0 || w.Weekdays&(1<<day) != 0
+}
+
+// String returns w in the form "22:00-06:00", followed by the days it
+// opens on, such as "[Sun,Sat]", unless it opens every day.
+func (w UpdateWindow) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%02d:00-%02d:00", w.StartHour, w.EndHour)
+	if w.Weekdays != 0 {
+		var days []string
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if w.Weekdays&(1<<d) != 0 {
+				days = append(days, d.String()[:3])
+			}
+		}
+		fmt.Fprintf(&sb, "[%s]", strings.Join(days, ","))
+	}
+	return sb.String()
+}
+
+// ForwardPort is an entry of Prefs.LocalForwardPorts.
+type ForwardPort struct {
+	// LocalPort is the port on 127.0.0.1 to listen on.
+	LocalPort uint16
+	// RemotePeer is the peer to forward connections to. If it isn't in
+	// the netmap when a connection arrives, the connection is closed.
+	RemotePeer tailcfg.StableNodeID
+	// RemotePort is the port on RemotePeer's Tailscale IP to connect to.
+	RemotePort uint16
+	// Proto is the protocol to forward. Only "tcp", which is also used
+	// when empty, is supported.
+	Proto string `json:",omitempty"`
+}
+
+// ProtoOrDefault returns fp.Proto, or "tcp" if it is not set.
+func (fp ForwardPort) ProtoOrDefault() string {
+	if fp.Proto == "" {
+		return "tcp"
+	}
+	return fp.Proto
+}
+
+// String returns fp in the form "8080->nodeID:80/tcp".
+func (fp ForwardPort) String() string {
+	return fmt.Sprintf("%d->%s:%d/%s", fp.LocalPort, fp.RemotePeer, fp.RemotePort, fp.ProtoOrDefault())
+}
+
+// validateForwardPorts reports an error for each invalid or conflicting
+// entry of fps, which are Prefs.LocalForwardPorts.
+func validateForwardPorts(fps []ForwardPort) []error {
+	var errs []error
+	if len(fps) > MaxLocalForwardPorts {
+		errs = append(errs, fmt.Errorf("LocalForwardPorts must have at most %d entries, got %d", MaxLocalForwardPorts, len(fps)))
+	}
+	type listener struct {
+		port  uint16
+		proto string
+	}
+	seen := set.Set[listener]{}
+	for _, fp := range fps {
+		if fp.LocalPort == 0 || fp.RemotePort == 0 {
+			errs = append(errs, fmt.Errorf("LocalForwardPorts %v: ports must be in the range 1-65535", fp))
+		}
+		if fp.RemotePeer.IsZero() {
+			errs = append(errs, fmt.Errorf("LocalForwardPorts %v: missing RemotePeer", fp))
+		}
+		if fp.ProtoOrDefault() != "tcp" {
+			errs = append(errs, fmt.Errorf("LocalForwardPorts %v: unsupported Proto %q", fp, fp.Proto))
+			continue
+		}
+		l := listener{fp.LocalPort, fp.ProtoOrDefault()}
+		if seen.Contains(l) {
+			errs = append(errs, fmt.Errorf("LocalForwardPorts: local port %d/%s is listed more than once", l.port, l.proto))
+		}
+		seen.Add(l)
+	}
+	return errs
+}
+
+// TrafficShapingPrefs are the bandwidth limits set by Prefs.TrafficShaping.
+// Each remote address gets its own token bucket per direction; packets
+// over the limit are dropped. A zero rate means unlimited.
+type TrafficShapingPrefs struct {
+	// DownloadKbps is the rate limit, in kilobits per second, for packets
+	// received from each remote address.
+	DownloadKbps uint32 `json:",omitempty"`
+	// UploadKbps is the rate limit, in kilobits per second, for packets
+	// sent to each remote address.
+	UploadKbps uint32 `json:",omitempty"`
+	// BurstKb is the size of each token bucket, in kilobits: how much
+	// traffic may be sent at once after a quiet period. If zero, it is
+	// one second's worth of the limit. The net/tstun shaper raises it to
+	// at least the largest packet size.
+	BurstKb uint32 `json:",omitempty"`
+}
+
+// MinTrafficShapingKbps is the lowest non-zero rate allowed in
+// TrafficShapingPrefs. Slower limits would starve even interactive
+// traffic.
+const MinTrafficShapingKbps = 64
+
+// Pretty returns ts as a string for Prefs.Pretty.
+func (ts TrafficShapingPrefs) Pretty() string {
+	return fmt.Sprintf("shaping=down:%d,up:%d,burst:%d ", ts.DownloadKbps, ts.UploadKbps, ts.BurstKb)
 }
 
 // MaskedPrefs is a Prefs with an associated bitmask of which fields are set.
 type MaskedPrefs struct {
 	Prefs
 
-	ControlURLSet             bool `json:",omitempty"`
-	RouteAllSet               bool `json:",omitempty"`
-	AllowSingleHostsSet       bool `json:",omitempty"`
-	ExitNodeIDSet             bool `json:",omitempty"`
-	ExitNodeIPSet             bool `json:",omitempty"`
-	ExitNodeAllowLANAccessSet bool `json:",omitempty"`
-	CorpDNSSet                bool `json:",omitempty"`
-	RunSSHSet                 bool `json:",omitempty"`
-	WantRunningSet            bool `json:",omitempty"`
-	LoggedOutSet              bool `json:",omitempty"`
-	ShieldsUpSet              bool `json:",omitempty"`
-	AdvertiseTagsSet          bool `json:",omitempty"`
-	HostnameSet               bool `json:",omitempty"`
-	NotepadURLsSet            bool `json:",omitempty"`
-	ForceDaemonSet            bool `json:",omitempty"`
-	EggSet                    bool `json:",omitempty"`
-	AdvertiseRoutesSet        bool `json:",omitempty"`
-	NoSNATSet                 bool `json:",omitempty"`
-	NetfilterModeSet          bool `json:",omitempty"`
-	OperatorUserSet           bool `json:",omitempty"`
-	ProfileNameSet            bool `json:",omitempty"`
-	AutoUpdateSet             bool `json:",omitempty"`
-	PostureCheckingSet        bool `json:",omitempty"`
+	ControlURLSet                  bool `json:",omitempty"`
+	RouteAllSet                    bool `json:",omitempty"`
+	AllowSingleHostsSet            bool `json:",omitempty"`
+	ExitNodeIDSet                  bool `json:",omitempty"`
+	ExitNodeIPSet                  bool `json:",omitempty"`
+	ExitNodeAllowLANAccessSet      bool `json:",omitempty"`
+	CorpDNSSet                     bool `json:",omitempty"`
+	RunSSHSet                      bool `json:",omitempty"`
+	WantRunningSet                 bool `json:",omitempty"`
+	LoggedOutSet                   bool `json:",omitempty"`
+	ShieldsUpSet                   bool `json:",omitempty"`
+	AdvertiseTagsSet               bool `json:",omitempty"`
+	HostnameSet                    bool `json:",omitempty"`
+	NotepadURLsSet                 bool `json:",omitempty"`
+	ForceDaemonSet                 bool `json:",omitempty"`
+	EggSet                         bool `json:",omitempty"`
+	AdvertiseRoutesSet             bool `json:",omitempty"`
+	NoSNATSet                      bool `json:",omitempty"`
+	NetfilterModeSet               bool `json:",omitempty"`
+	OperatorUserSet                bool `json:",omitempty"`
+	ProfileNameSet                 bool `json:",omitempty"`
+	AutoUpdateSet                  AutoUpdatePrefsMask
+	PostureCheckingSet             bool `json:",omitempty"`
+	TailscaleSSHMaxSessionsSet     bool `json:",omitempty"`
+	StatsIntervalSet               bool `json:",omitempty"`
+	ExitNodeIDsSet                 bool `json:",omitempty"`
+	ExitNodeRotateSet              bool `json:",omitempty"`
+	ExitNodeRotateIntervalSet      bool `json:",omitempty"`
+	NoControlURLNormalizeOnLoadSet bool `json:",omitempty"`
+	PrivacyModeSet                 bool `json:",omitempty"`
+	SSHCertAuthSet                 bool `json:",omitempty"`
+	NameserverPolicySet            bool `json:",omitempty"`
+	ProfileDescriptionSet          bool `json:",omitempty"`
+	InterfaceSet                   bool `json:",omitempty"`
+	TunnelProtocolSet              bool `json:",omitempty"`
+	TailnetNameSet                 bool `json:",omitempty"`
+	ShieldsUpModeSet               bool `json:",omitempty"`
+	PeerRoutePropagationSet        bool `json:",omitempty"`
+	WireGuardPQEnabledSet          bool `json:",omitempty"`
+	CacheDNSForSet                 bool `json:",omitempty"`
+	CacheDNSTTLSet                 bool `json:",omitempty"`
+	UserspaceSocketsSet            bool `json:",omitempty"`
+	AuditLogSet                    bool `json:",omitempty"`
+	AuditLogPathSet                bool `json:",omitempty"`
+	LocallyServedPortsSet          bool `json:",omitempty"`
+	KeepAliveOnSuspendSet          bool `json:",omitempty"`
+	MetricsPortSet                 bool `json:",omitempty"`
+	RouteAllFilterSet              bool `json:",omitempty"`
+	TrafficShapingSet              bool `json:",omitempty"`
+	TailscaleIPv4OnlySet           bool `json:",omitempty"`
+	TailscaleIPv6OnlySet           bool `json:",omitempty"`
+	DiagnosticsEnabledSet          bool `json:",omitempty"`
+	DiagnosticsUploadURLSet        bool `json:",omitempty"`
+	WireGuardRoamIntervalSet       bool `json:",omitempty"`
+	PeerMetricsEnabledSet          bool `json:",omitempty"`
+	AllowedSourcesSet              bool `json:",omitempty"`
+	TailscaleZoneIDSet             bool `json:",omitempty"`
+	HeadscaleCompatibilitySet      bool `json:",omitempty"`
+	SchemaVersionSet               bool `json:",omitempty"`
+	DNSTTLOverrideSet              bool `json:",omitempty"`
+	MaxLogLineLengthSet            bool `json:",omitempty"`
+	ConnectionPriorityModeSet      bool `json:",omitempty"`
+	PostureCheckPolicySet          bool `json:",omitempty"`
+	PacketFilterLoggingSet         bool `json:",omitempty"`
+	ExitNodeCountrySet             bool `json:",omitempty"`
+	SSHKeyPathSet                  bool `json:",omitempty"`
+	ExitNodeFallbacksSet           bool `json:",omitempty"`
+	RoutePropagationFilterSet      bool `json:",omitempty"`
+	LocalForwardPortsSet           bool `json:",omitempty"`
+	SSHTrustedUserCAKeysSet        bool `json:",omitempty"`
+}
+
+// AutoUpdatePrefsMask is the type of MaskedPrefs.AutoUpdateSet. Each field
+// reports whether the corresponding field of AutoUpdatePrefs is set, so
+// that, for instance, turning on auto-updates doesn't reset the Channel.
+type AutoUpdatePrefsMask struct {
+	CheckSet       bool `json:",omitempty"`
+	ApplySet       bool `json:",omitempty"`
+	ApplyWindowSet bool `json:",omitempty"`
+	ChannelSet     bool `json:",omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. For compatibility with clients
+// from before AutoUpdateSet was a mask, it also accepts a bool, where true
+// means all of AutoUpdatePrefs is set.
+func (m *AutoUpdatePrefsMask) UnmarshalJSON(b []byte) error {
+	var all bool
+	if err := json.Unmarshal(b, &all); err == nil {
+		*m = AutoUpdatePrefsMask{CheckSet: all, ApplySet: all, ApplyWindowSet: all, ChannelSet: all}
+		return nil
+	}
+	type mask AutoUpdatePrefsMask
+	return json.Unmarshal(b, (*mask)(m))
+}
+
+// maskIsSet reports whether the MaskedPrefs Set field m, either a bool or a
+// nested mask such as AutoUpdatePrefsMask, sets anything.
+func maskIsSet(m reflect.Value) bool {
+	if m.Kind() == reflect.Bool {
+		return m.Bool()
+	}
+	for i := 0; i < m.NumField(); i++ {
+		if maskIsSet(m.Field(i)) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyMaskField assigns src to dst if the MaskedPrefs Set field m is true.
+// If m is a nested mask, it recurses into the fields of dst and src that
+// parallel m's fields.
+func applyMaskField(dst, src, m reflect.Value) {
+	if m.Kind() == reflect.Bool {
+		if m.Bool() {
+			dst.Set(src)
+		}
+		return
+	}
+	for i := 0; i < m.NumField(); i++ {
+		applyMaskField(dst.Field(i), src.Field(i), m.Field(i))
+	}
+}
+
+// Validate reports an error if m attempts to edit a read-only field of
+// Prefs, such as TailnetName.
+func (m *MaskedPrefs) Validate() error {
+	if m.TailnetNameSet {
+		return errors.New("TailnetName is read-only")
+	}
+	if m.SchemaVersionSet {
+		return errors.New("SchemaVersion is read-only")
+	}
+	return nil
 }
 
 // ApplyEdits mutates p, assigning fields from m.Prefs for each MaskedPrefs
 // Set field that's true.
-func (p *Prefs) ApplyEdits(m *MaskedPrefs) {
+//
+// If m sets PrivacyMode, the preset's fields are applied first so that any
+// other fields set in m override them.
+//
+// ApplyEdits checks the result before modifying p. If the edits are
+// inconsistent, it returns an error and p is not modified:
+//
+//   - ExitNodeID and ExitNodeIP are mutually exclusive; if applying m would
+//     leave both set, the error is ErrExitNodeIDAndIPSet.
+//   - Each edited AdvertiseRoutes entry must be a valid, canonical prefix
+//     (no bits set past the prefix length); see ErrInvalidAdvertiseRoute.
+//   - An edited ControlURL must be empty, an https:// or http:// URL with
+//     a host, or a file:// URL; see ErrInvalidControlURL.
+func (p *Prefs) ApplyEdits(m *MaskedPrefs) error {
 	if p == nil {
 		panic("can't edit nil Prefs")
 	}
+	exitID, exitIP := p.ExitNodeID, p.ExitNodeIP
+	if m.ExitNodeIDSet {
+		exitID = m.ExitNodeID
+	}
+	if m.ExitNodeIPSet {
+		exitIP = m.ExitNodeIP
+	}
+	if !exitID.IsZero() && exitIP.IsValid() {
+		return ErrExitNodeIDAndIPSet
+	}
+	if m.AdvertiseRoutesSet {
+		for _, r := range m.AdvertiseRoutes {
+			if err := checkAdvertiseRoute(r); err != nil {
+				return err
+			}
+		}
+	}
+	if m.ControlURLSet {
+		if err := checkControlURL(m.ControlURL); err != nil {
+			return err
+		}
+	}
+	if m.PrivacyModeSet {
+		if preset, ok := PrivacyModePreset(m.PrivacyMode); ok {
+			p.applyMask(preset)
+		}
+	}
+	p.applyMask(m)
+
+	// Keep the deprecated ShieldsUp and ShieldsUpMode in sync for callers
+	// that only know about one of them.
+	switch {
+	case m.ShieldsUpSet && !m.ShieldsUpModeSet:
+		p.ShieldsUpMode = ""
+		p.MigrateShieldsUp()
+	case m.ShieldsUpModeSet && !m.ShieldsUpSet:
+		p.ShieldsUp = p.ShieldsUpMode != ""
+	}
+	return nil
+}
+
+// checkAdvertiseRoute reports an error wrapping ErrInvalidAdvertiseRoute if
+// r is not a valid, canonical prefix.
+func checkAdvertiseRoute(r netip.Prefix) error {
+	if !r.IsValid() || r != r.Masked() {
+		return fmt.Errorf("%w: %v is not a canonical prefix", ErrInvalidAdvertiseRoute, r)
+	}
+	return nil
+}
+
+// checkControlURL reports an error wrapping ErrInvalidControlURL if u is
+// not acceptable as a Prefs.ControlURL. Plain http:// is allowed to any
+// host, as self-hosted control servers on a LAN often don't have TLS
+// certificates; the control protocol is encrypted either way.
+func checkControlURL(u string) error {
+	if u == "" {
+		return nil
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidControlURL, err)
+	}
+	switch pu.Scheme {
+	case "https", "http":
+		if pu.Host == "" {
+			return fmt.Errorf("%w: %q has no host", ErrInvalidControlURL, u)
+		}
+		return nil
+	case "file":
+		return nil
+	}
+	return fmt.Errorf("%w: %q must be an https:// or http:// URL", ErrInvalidControlURL, u)
+}
+
+// applyMask assigns fields from m.Prefs to p for each MaskedPrefs Set
+// field that's true, without any further checks.
+func (p *Prefs) applyMask(m *MaskedPrefs) {
 	pv := reflect.ValueOf(p).Elem()
 	mv := reflect.ValueOf(m).Elem()
 	mpv := reflect.ValueOf(&m.Prefs).Elem()
 	fields := mv.NumField()
 	for i := 1; i < fields; i++ {
-		if mv.Field(i).Bool() {
-			newFieldValue := mpv.Field(i - 1)
-			pv.Field(i - 1).Set(newFieldValue)
-		}
+		applyMaskField(pv.Field(i-1), mpv.Field(i-1), mv.Field(i))
+	}
+}
+
+// PrivacyModePreset returns the edits that the named Prefs.PrivacyMode
+// expands to. It reports false if mode is not a known preset.
+//
+// Presets only ever move a field towards more privacy, so choosing one
+// never undoes a stricter setting made by hand. PrivacyModeStandard, the
+// current behavior, changes nothing. PrivacyModeStrict stops sharing the
+// LAN through an exit node and sending posture information, and
+// PrivacyModeParanoid also blocks all connections with shields-up and
+// turns off Tailscale SSH.
+func PrivacyModePreset(mode string) (_ *MaskedPrefs, ok bool) {
+	mp := new(MaskedPrefs)
+	switch mode {
+	case PrivacyModeStandard:
+	case PrivacyModeParanoid:
+		mp.ShieldsUpSet = true
+		mp.ShieldsUp = true
+		mp.ShieldsUpModeSet = true
+		mp.ShieldsUpMode = ShieldsUpModeAll
+		mp.RunSSHSet = true // RunSSH: false
+		fallthrough
+	case PrivacyModeStrict:
+		mp.ExitNodeAllowLANAccessSet = true // ExitNodeAllowLANAccess: false
+		mp.PostureCheckingSet = true        // PostureChecking: false
+	default:
+		return nil, false
 	}
+	return mp, true
 }
 
 // IsEmpty reports whether there are no masks set or if m is nil.
@@ -279,13 +1181,72 @@ func (m *MaskedPrefs) IsEmpty() bool {
 	mv := reflect.ValueOf(m).Elem()
 	fields := mv.NumField()
 	for i := 1; i < fields; i++ {
-		if mv.Field(i).Bool() {
+		if maskIsSet(mv.Field(i)) {
 			return false
 		}
 	}
 	return true
 }
 
+// Merge adds the edits in other to m, for combining two partial updates
+// into one. A field set in other is copied into m only if m doesn't set it
+// already, so m's edits win over other's. Merging a nil other is a no-op.
+func (m *MaskedPrefs) Merge(other *MaskedPrefs) {
+	m.merge(other, false)
+}
+
+// MergeOverride is like Merge, but other's edits win: a field set in both
+// m and other takes other's value.
+func (m *MaskedPrefs) MergeOverride(other *MaskedPrefs) {
+	m.merge(other, true)
+}
+
+func (m *MaskedPrefs) merge(other *MaskedPrefs, override bool) {
+	if m == nil {
+		panic("can't merge into nil MaskedPrefs")
+	}
+	if other == nil {
+		return
+	}
+	op := other.Prefs.Clone() // don't share slices or pointers with other
+	mv := reflect.ValueOf(m).Elem()
+	ov := reflect.ValueOf(other).Elem()
+	mpv := reflect.ValueOf(&m.Prefs).Elem()
+	opv := reflect.ValueOf(op).Elem()
+	fields := mv.NumField()
+	for i := 1; i < fields; i++ {
+		mergeMaskField(mpv.Field(i-1), mv.Field(i), opv.Field(i-1), ov.Field(i), override)
+	}
+}
+
+// mergeMaskField is the per-field part of MaskedPrefs.merge: it copies src
+// into dst and sets dstMask if srcMask is set and either dstMask isn't or
+// override is true. Nested masks are merged field by field.
+func mergeMaskField(dst, dstMask, src, srcMask reflect.Value, override bool) {
+	if srcMask.Kind() != reflect.Bool {
+		for i := 0; i < srcMask.NumField(); i++ {
+			mergeMaskField(dst.Field(i), dstMask.Field(i), src.Field(i), srcMask.Field(i), override)
+		}
+		return
+	}
+	if !srcMask.Bool() || (dstMask.Bool() && !override) {
+		return
+	}
+	dstMask.SetBool(true)
+	dst.Set(src)
+}
+
+// MarshalJSON implements json.Marshaler. It exists so that the
+// (*Prefs).MarshalJSON promoted from the embedded Prefs doesn't drop the
+// Set fields.
+func (m *MaskedPrefs) MarshalJSON() ([]byte, error) {
+	type maskedPrefs MaskedPrefs
+	return json.Marshal(struct {
+		*maskedPrefs
+		MarshalJSON struct{} `json:"-"` // shadows the promoted (*Prefs).MarshalJSON
+	}{maskedPrefs: (*maskedPrefs)(m)})
+}
+
 func (m *MaskedPrefs) Pretty() string {
 	if m == nil {
 		return "MaskedPrefs{<nil>}"
@@ -316,18 +1277,27 @@ func (m *MaskedPrefs) Pretty() string {
 		return "%s=%v"
 	}
 
-	for i := 1; i < mt.NumField(); i++ {
-		name := mt.Field(i).Name
-		if mv.Field(i).Bool() {
-			if !first {
-				sb.WriteString(" ")
+	// field writes the pref f named name if its Set field m is true, or
+	// each set field of f, named "name.Field", if m is a nested mask.
+	var field func(name string, f, m reflect.Value)
+	field = func(name string, f, m reflect.Value) {
+		if m.Kind() != reflect.Bool {
+			for j := 0; j < m.NumField(); j++ {
+				field(name+"."+strings.TrimSuffix(m.Type().Field(j).Name, "Set"), f.Field(j), m.Field(j))
 			}
-			first = false
-			f := mpv.Field(i - 1)
-			fmt.Fprintf(&sb, format(f),
-				strings.TrimSuffix(name, "Set"),
-				f.Interface())
+			return
+		}
+		if !m.Bool() {
+			return
 		}
+		if !first {
+			sb.WriteString(" ")
+		}
+		first = false
+		fmt.Fprintf(&sb, format(f), name, f.Interface())
+	}
+	for i := 1; i < mt.NumField(); i++ {
+		field(strings.TrimSuffix(mt.Field(i).Name, "Set"), mpv.Field(i-1), mv.Field(i))
 	}
 	sb.WriteString("}")
 	return sb.String()
@@ -336,20 +1306,105 @@ func (m *MaskedPrefs) Pretty() string {
 // IsEmpty reports whether p is nil or pointing to a Prefs zero value.
 func (p *Prefs) IsEmpty() bool { return p == nil || p.Equals(&Prefs{}) }
 
+// PrettyFormat is an output format for (*Prefs).PrettyAs.
+type PrettyFormat string
+
+const (
+	// PrettyFormatText is the compact human-readable format returned by
+	// (*Prefs).Pretty.
+	PrettyFormatText PrettyFormat = ""
+
+	// PrettyFormatJSON is the JSON encoding of (*Prefs).SanitizeForExport,
+	// on a single line. Like PrettyFormatText, it's safe to log: it has no
+	// private keys or other Persist state.
+	PrettyFormatJSON PrettyFormat = "json"
+)
+
 func (p PrefsView) Pretty() string { return p.ж.Pretty() }
 
+func (p PrefsView) PrettyAs(format PrettyFormat) string { return p.ж.PrettyAs(format) }
+
 func (p *Prefs) Pretty() string { return p.pretty(runtime.GOOS) }
+
+// PrettyAs returns p formatted as format. Unknown formats are treated as
+// PrettyFormatText.
+func (p *Prefs) PrettyAs(format PrettyFormat) string {
+	switch format {
+	case PrettyFormatJSON:
+		data, err := json.Marshal(p.SanitizeForExport())
+		if err != nil {
+			log.Fatalf("Prefs marshal: %v\n", err)
+		}
+		return string(data)
+	}
+	return p.Pretty()
+}
+
 func (p *Prefs) pretty(goos string) string {
 	var sb strings.Builder
 	sb.WriteString("Prefs{")
 	fmt.Fprintf(&sb, "ra=%v ", p.RouteAll)
+	if p.RouteAllFilter != nil {
+		fmt.Fprintf(&sb, "rafilter=%v ", *p.RouteAllFilter)
+	}
 	if !p.AllowSingleHosts {
 		sb.WriteString("mesh=false ")
 	}
 	fmt.Fprintf(&sb, "dns=%v want=%v ", p.CorpDNS, p.WantRunning)
+	if p.TailscaleIPv4Only {
+		sb.WriteString("ipv4only=true ")
+	}
+	if p.TailscaleIPv6Only {
+		sb.WriteString("ipv6only=true ")
+	}
+	if p.NameserverPolicy != "" && p.NameserverPolicy != NameserverPolicyAuto {
+		fmt.Fprintf(&sb, "nspolicy=%s ", p.NameserverPolicy)
+	}
 	if p.RunSSH {
 		sb.WriteString("ssh=true ")
 	}
+	if p.TailscaleSSHMaxSessions != 0 {
+		fmt.Fprintf(&sb, "sshmax=%d ", p.TailscaleSSHMaxSessions)
+	}
+	if p.SSHCertAuth {
+		sb.WriteString("sshcert=true ")
+	}
+	if n := len(p.SSHTrustedUserCAKeys); n > 0 {
+		fmt.Fprintf(&sb, "sshcas=%d ", n)
+	}
+	if p.SSHKeyPath != "" {
+		fmt.Fprintf(&sb, "sshkey=%s ", p.SSHKeyPath)
+	}
+	if p.WireGuardPQEnabled {
+		sb.WriteString("wgpq=true ")
+	}
+	if p.WireGuardRoamInterval != nil {
+		fmt.Fprintf(&sb, "wgroam=%v ", *p.WireGuardRoamInterval)
+	}
+	if p.KeepAliveOnSuspend {
+		sb.WriteString("keepalive-suspend=true ")
+	}
+	if p.MetricsPort != 0 {
+		fmt.Fprintf(&sb, "metrics=%d ", p.MetricsPort)
+	}
+	if p.PeerMetricsEnabled {
+		sb.WriteString("peermetrics=true ")
+	}
+	if p.DiagnosticsEnabled {
+		fmt.Fprintf(&sb, "diag=%q ", sanitizeUploadURL(p.DiagnosticsUploadURL))
+	}
+	if p.TrafficShaping != nil {
+		sb.WriteString(p.TrafficShaping.Pretty())
+	}
+	if p.UserspaceSockets {
+		sb.WriteString("userspace=true ")
+	}
+	if p.AuditLog {
+		fmt.Fprintf(&sb, "auditlog=%q ", p.AuditLogPath)
+	}
+	if len(p.LocallyServedPorts) > 0 {
+		fmt.Fprintf(&sb, "localports=%v ", p.LocallyServedPorts)
+	}
 	if p.LoggedOut {
 		sb.WriteString("loggedout=true ")
 	}
@@ -362,17 +1417,44 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ShieldsUp {
 		sb.WriteString("shields=true ")
 	}
+	if p.ShieldsUpMode != "" {
+		fmt.Fprintf(&sb, "shieldsmode=%s ", p.ShieldsUpMode)
+	}
+	if len(p.AllowedSources) > 0 {
+		fmt.Fprintf(&sb, "allowsrc=%v ", p.AllowedSources)
+	}
+	if p.PrivacyMode != "" {
+		fmt.Fprintf(&sb, "privacy=%s ", p.PrivacyMode)
+	}
 	if p.ExitNodeIP.IsValid() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeIP, p.ExitNodeAllowLANAccess)
 	} else if !p.ExitNodeID.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeID, p.ExitNodeAllowLANAccess)
 	}
+	if len(p.ExitNodeFallbacks) > 0 {
+		fmt.Fprintf(&sb, "exitfallbacks=%v ", p.ExitNodeFallbacks)
+	}
+	if p.ExitNodeCountry != "" {
+		fmt.Fprintf(&sb, "exitcountry=%s ", p.ExitNodeCountry)
+	}
+	if p.ExitNodeRotate {
+		fmt.Fprintf(&sb, "exitrotate=%v every=%v ", p.ExitNodeIDs, p.ExitNodeRotateIntervalOrDefault())
+	}
 	if len(p.AdvertiseRoutes) > 0 || goos == "linux" {
 		fmt.Fprintf(&sb, "routes=%v ", p.AdvertiseRoutes)
 	}
 	if len(p.AdvertiseRoutes) > 0 || p.NoSNAT {
 		fmt.Fprintf(&sb, "snat=%v ", !p.NoSNAT)
 	}
+	if p.PeerRoutePropagation {
+		sb.WriteString("propagate=true ")
+	}
+	if p.RoutePropagationFilter != nil {
+		fmt.Fprintf(&sb, "propfilter=%v ", *p.RoutePropagationFilter)
+	}
+	if len(p.LocalForwardPorts) > 0 {
+		fmt.Fprintf(&sb, "forward=%v ", p.LocalForwardPorts)
+	}
 	if len(p.AdvertiseTags) > 0 {
 		fmt.Fprintf(&sb, "tags=%s ", strings.Join(p.AdvertiseTags, ","))
 	}
@@ -381,13 +1463,55 @@ func (p *Prefs) pretty(goos string) string {
 	}
 	if p.ControlURL != "" && p.ControlURL != DefaultControlURL {
 		fmt.Fprintf(&sb, "url=%q ", p.ControlURL)
+		if p.NoControlURLNormalizeOnLoad && IsLoginServerSynonym(p.ControlURL) {
+			sb.WriteString("urlnorm=false ")
+		}
+	}
+	if p.TailnetName != "" {
+		fmt.Fprintf(&sb, "tailnet=%q ", p.TailnetName)
+	}
+	if p.HeadscaleCompatibility {
+		sb.WriteString("headscale=true ")
 	}
 	if p.Hostname != "" {
 		fmt.Fprintf(&sb, "host=%q ", p.Hostname)
 	}
+	if p.TailscaleZoneID != "" {
+		fmt.Fprintf(&sb, "zone=%s ", p.TailscaleZoneID)
+	}
 	if p.OperatorUser != "" {
 		fmt.Fprintf(&sb, "op=%q ", p.OperatorUser)
 	}
+	if p.Interface != "" {
+		fmt.Fprintf(&sb, "tun=%q ", p.Interface)
+	}
+	if p.TunnelProtocol != "" && p.TunnelProtocol != TunnelProtocolWireGuard {
+		fmt.Fprintf(&sb, "tunnel=%s ", p.TunnelProtocol)
+	}
+	if p.ProfileDescription != "" {
+		fmt.Fprintf(&sb, "desc=%q ", p.ProfileDescription)
+	}
+	if p.StatsInterval != nil {
+		fmt.Fprintf(&sb, "stats=%v ", *p.StatsInterval)
+	}
+	if len(p.CacheDNSFor) > 0 {
+		fmt.Fprintf(&sb, "cachedns=%s ttl=%v ", strings.Join(p.CacheDNSFor, ","), p.CacheDNSTTLOrDefault())
+	}
+	if p.DNSTTLOverride != nil {
+		fmt.Fprintf(&sb, "dnsttl=%v ", *p.DNSTTLOverride)
+	}
+	if p.MaxLogLineLength != 0 {
+		fmt.Fprintf(&sb, "maxlogline=%d ", p.MaxLogLineLength)
+	}
+	if p.ConnectionPriorityMode != "" && p.ConnectionPriorityMode != ConnectionPriorityLatency {
+		fmt.Fprintf(&sb, "priority=%s ", p.ConnectionPriorityMode)
+	}
+	if p.PostureCheckPolicy != "" {
+		fmt.Fprintf(&sb, "posturepolicy=%s ", p.PostureCheckPolicy)
+	}
+	if p.PacketFilterLogging {
+		sb.WriteString("filterlog=true ")
+	}
 	sb.WriteString(p.AutoUpdate.Pretty())
 	if p.Persist != nil {
 		sb.WriteString(p.Persist.Pretty())
@@ -398,12 +1522,79 @@ func (p *Prefs) pretty(goos string) string {
 	return sb.String()
 }
 
+// redacted replaces sensitive values in SanitizeForExport.
+const redacted = "<redacted>"
+
+// sanitizeUploadURL returns rawURL with any userinfo, query and fragment
+// removed, as they may carry upload credentials. If rawURL doesn't parse, it
+// returns "<redacted>".
+func sanitizeUploadURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+// SanitizeForExport returns a copy of p that is safe to share for
+// debugging. See (*Prefs).SanitizeForExport.
+func (p PrefsView) SanitizeForExport() *Prefs { return p.ж.SanitizeForExport() }
+
+// SanitizeForExport returns a copy of p with sensitive fields stripped so
+// that it can be shared, e.g. in a bug report. Persist, which holds the
+// node's private keys, is set to nil, a non-empty OperatorUser is replaced
+// with "<redacted>", and DiagnosticsUploadURL has its userinfo, query and
+// fragment removed. All other fields are preserved.
+func (p *Prefs) SanitizeForExport() *Prefs {
+	p2 := p.Clone()
+	p2.Persist = nil
+	if p2.OperatorUser != "" {
+		p2.OperatorUser = redacted
+	}
+	if p2.DiagnosticsUploadURL != "" {
+		p2.DiagnosticsUploadURL = sanitizeUploadURL(p2.DiagnosticsUploadURL)
+	}
+	return p2
+}
+
+// Clone returns a deep copy of the Prefs that p views, or nil if p is not
+// valid. It is the same as p.AsStruct.
+//
+// Use it rather than a ToBytes/PrefsFromBytes round trip, which is much
+// slower and doesn't preserve every field (see MarshalJSON and ToBytes).
+func (p PrefsView) Clone() *Prefs {
+	return p.AsStruct()
+}
+
 func (p PrefsView) ToBytes() []byte {
 	return p.ж.ToBytes()
 }
 
+// MarshalJSON implements json.Marshaler. It omits ExitNodeIP when
+// ExitNodeID is set, as ExitNodeID then takes precedence and the IP is
+// redundant. Unmarshaling still accepts both.
+func (p *Prefs) MarshalJSON() ([]byte, error) {
+	type prefs Prefs // without this method
+	if p.ExitNodeID == "" {
+		return json.Marshal((*prefs)(p))
+	}
+	return json.Marshal(struct {
+		*prefs
+		ExitNodeIP *netip.Addr `json:",omitempty"` // shadows prefs.ExitNodeIP
+	}{prefs: (*prefs)(p)})
+}
+
+// ToBytes returns p encoded as JSON for storage, with SchemaVersion set
+// to CurrentPrefsSchemaVersion.
 func (p *Prefs) ToBytes() []byte {
-	data, err := json.MarshalIndent(p, "", "\t")
+	p2 := *p
+	p2.SchemaVersion = CurrentPrefsSchemaVersion
+	data, err := json.MarshalIndent(&p2, "", "\t")
 	if err != nil {
 		log.Fatalf("Prefs marshal: %v\n", err)
 	}
@@ -425,6 +1616,7 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 	return p != nil && p2 != nil &&
 		p.ControlURL == p2.ControlURL &&
 		p.RouteAll == p2.RouteAll &&
+		comparePrefixPtrs(p.RouteAllFilter, p2.RouteAllFilter) &&
 		p.AllowSingleHosts == p2.AllowSingleHosts &&
 		p.ExitNodeID == p2.ExitNodeID &&
 		p.ExitNodeIP == p2.ExitNodeIP &&
@@ -444,32 +1636,110 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
 		p.Persist.Equals(p2.Persist) &&
 		p.ProfileName == p2.ProfileName &&
-		p.AutoUpdate == p2.AutoUpdate &&
-		p.PostureChecking == p2.PostureChecking
+		p.AutoUpdate.Equals(p2.AutoUpdate) &&
+		p.PostureChecking == p2.PostureChecking &&
+		p.TailscaleSSHMaxSessions == p2.TailscaleSSHMaxSessions &&
+		compareDurationPtrs(p.StatsInterval, p2.StatsInterval) &&
+		compareDurationPtrs(p.WireGuardRoamInterval, p2.WireGuardRoamInterval) &&
+		compareDurationPtrs(p.DNSTTLOverride, p2.DNSTTLOverride) &&
+		p.MaxLogLineLength == p2.MaxLogLineLength &&
+		p.ConnectionPriorityMode == p2.ConnectionPriorityMode &&
+		p.PostureCheckPolicy == p2.PostureCheckPolicy &&
+		p.PacketFilterLogging == p2.PacketFilterLogging &&
+		p.PeerMetricsEnabled == p2.PeerMetricsEnabled &&
+		compareStrings(p.CacheDNSFor, p2.CacheDNSFor) &&
+		p.CacheDNSTTL == p2.CacheDNSTTL &&
+		slices.Equal(p.ExitNodeIDs, p2.ExitNodeIDs) &&
+		p.ExitNodeCountry == p2.ExitNodeCountry &&
+		slices.Equal(p.ExitNodeFallbacks, p2.ExitNodeFallbacks) &&
+		p.ExitNodeRotate == p2.ExitNodeRotate &&
+		p.ExitNodeRotateInterval == p2.ExitNodeRotateInterval &&
+		p.NoControlURLNormalizeOnLoad == p2.NoControlURLNormalizeOnLoad &&
+		p.PrivacyMode == p2.PrivacyMode &&
+		p.Interface == p2.Interface &&
+		p.TunnelProtocol == p2.TunnelProtocol &&
+		p.TailnetName == p2.TailnetName &&
+		p.ShieldsUpMode == p2.ShieldsUpMode &&
+		p.PeerRoutePropagation == p2.PeerRoutePropagation &&
+		comparePrefixPtrs(p.RoutePropagationFilter, p2.RoutePropagationFilter) &&
+		slices.Equal(p.LocalForwardPorts, p2.LocalForwardPorts) &&
+		p.WireGuardPQEnabled == p2.WireGuardPQEnabled &&
+		p.UserspaceSockets == p2.UserspaceSockets &&
+		p.KeepAliveOnSuspend == p2.KeepAliveOnSuspend &&
+		p.MetricsPort == p2.MetricsPort &&
+		p.DiagnosticsEnabled == p2.DiagnosticsEnabled &&
+		p.DiagnosticsUploadURL == p2.DiagnosticsUploadURL &&
+		p.TailscaleIPv4Only == p2.TailscaleIPv4Only &&
+		p.TailscaleIPv6Only == p2.TailscaleIPv6Only &&
+		compareTrafficShapingPtrs(p.TrafficShaping, p2.TrafficShaping) &&
+		p.AuditLog == p2.AuditLog &&
+		p.AuditLogPath == p2.AuditLogPath &&
+		slices.Equal(p.LocallyServedPorts, p2.LocallyServedPorts) &&
+		slices.Equal(p.AllowedSources, p2.AllowedSources) &&
+		p.TailscaleZoneID == p2.TailscaleZoneID &&
+		p.HeadscaleCompatibility == p2.HeadscaleCompatibility &&
+		p.SSHCertAuth == p2.SSHCertAuth &&
+		slices.Equal(p.SSHTrustedUserCAKeys, p2.SSHTrustedUserCAKeys) &&
+		p.SSHKeyPath == p2.SSHKeyPath &&
+		p.NameserverPolicy == p2.NameserverPolicy &&
+		p.ProfileDescription == p2.ProfileDescription
 }
 
 func (au AutoUpdatePrefs) Pretty() string {
-	if au.Apply {
-		return "update=on "
+	var sb strings.Builder
+	switch {
+	case au.Apply:
+		sb.WriteString("update=on ")
+		if au.ApplyWindow != nil {
+			fmt.Fprintf(&sb, "window=%v ", au.ApplyWindow)
+		}
+	case au.Check:
+		sb.WriteString("update=check ")
+	default:
+		sb.WriteString("update=off ")
 	}
-	if au.Check {
-		return "update=check "
+	if au.Channel != "" {
+		fmt.Fprintf(&sb, "channel=%s ", au.Channel)
 	}
-	return "update=off "
+	return sb.String()
 }
 
+// compareIPNets reports whether a and b contain the same prefixes in the
+// same order. Prefixes are compared by the network they represent, so
+// 192.168.1.5/24 and 192.168.1.0/24 are considered equal.
 func compareIPNets(a, b []netip.Prefix) bool {
 	if len(a) != len(b) {
 		return false
 	}
 	for i := range a {
-		if a[i] != b[i] {
+		if a[i].Masked() != b[i].Masked() {
 			return false
 		}
 	}
 	return true
 }
 
+func compareDurationPtrs(a, b *time.Duration) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func compareTrafficShapingPtrs(a, b *TrafficShapingPrefs) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func comparePrefixPtrs(a, b *netip.Prefix) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
 func compareStrings(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -482,7 +1752,110 @@ func compareStrings(a, b []string) bool {
 	return true
 }
 
-// NewPrefs returns the default preferences to use.
+// Diff returns a human-readable description of how other differs from p,
+// for debugging prefs transitions; see (*Prefs).Diff.
+func (p PrefsView) Diff(other PrefsView) string { return p.ж.Diff(other.ж) }
+
+// Diff returns a human-readable description of how other differs from p.
+// Each differing field, in struct order, gets a pair of lines such as
+// "- RouteAll: true" and "+ RouteAll: false" giving its old and new values.
+// Slice fields such as AdvertiseRoutes and AdvertiseTags are diffed by
+// element, with a "-" line for each element only in p and a "+" line for
+// each element only in other; if only their order differs, the whole
+// slices are shown. Persist is skipped, as it holds login state and keys
+// rather than settings. A nil p or other is treated as the zero Prefs. It
+// returns the empty string if there are no differences.
+func (p *Prefs) Diff(other *Prefs) string {
+	if p == nil {
+		p = new(Prefs)
+	}
+	if other == nil {
+		other = new(Prefs)
+	}
+	var sb strings.Builder
+	ov := reflect.ValueOf(p).Elem()
+	nv := reflect.ValueOf(other).Elem()
+	for _, name := range p.ChangedFields(other) {
+		f, _ := nv.Type().FieldByName(name)
+		a, b := ov.FieldByIndex(f.Index), nv.FieldByIndex(f.Index)
+		if a.Kind() == reflect.Slice && f.Type.Elem().Comparable() && diffSliceElems(&sb, f.Name, a, b) {
+			continue
+		}
+		fmt.Fprintf(&sb, "- %s: %s\n+ %s: %s\n", f.Name, diffValueString(a), f.Name, diffValueString(b))
+	}
+	return sb.String()
+}
+
+// ChangedFields returns the names of the fields that differ between p and
+// other, in struct order. Like Diff, it skips Persist and treats a nil p or
+// other as the zero Prefs.
+func (p *Prefs) ChangedFields(other *Prefs) []string {
+	if p == nil {
+		p = new(Prefs)
+	}
+	if other == nil {
+		other = new(Prefs)
+	}
+	var names []string
+	ov := reflect.ValueOf(p).Elem()
+	nv := reflect.ValueOf(other).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		f := nv.Type().Field(i)
+		if f.Name == "Persist" || !f.IsExported() {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// diffSliceElems writes to sb a "-" line for each element of slice a not
+// in b and a "+" line for each element of b not in a. It reports whether
+// it wrote anything; it doesn't if a and b differ only in order.
+func diffSliceElems(sb *strings.Builder, name string, a, b reflect.Value) bool {
+	contains := func(s reflect.Value, v any) bool {
+		for i := 0; i < s.Len(); i++ {
+			if s.Index(i).Interface() == v {
+				return true
+			}
+		}
+		return false
+	}
+	n := sb.Len()
+	for i := 0; i < a.Len(); i++ {
+		if v := a.Index(i); !contains(b, v.Interface()) {
+			fmt.Fprintf(sb, "- %s: %s\n", name, diffValueString(v))
+		}
+	}
+	for i := 0; i < b.Len(); i++ {
+		if v := b.Index(i); !contains(a, v.Interface()) {
+			fmt.Fprintf(sb, "+ %s: %s\n", name, diffValueString(v))
+		}
+	}
+	return sb.Len() > n
+}
+
+// diffValueString formats v for Diff: strings are quoted, pointers are
+// shown as "nil" or their dereferenced value, and structs include their
+// field names.
+func diffValueString(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return "nil"
+		}
+		return diffValueString(v.Elem())
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Struct:
+		return fmt.Sprintf("%+v", v.Interface())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// NewPrefs returns the default preferences to use.
 func NewPrefs() *Prefs {
 	// Provide default values for options which might be missing
 	// from the json data for any reason. The json can still
@@ -500,6 +1873,7 @@ func NewPrefs() *Prefs {
 		CorpDNS:          true,
 		WantRunning:      false,
 		NetfilterMode:    preftype.NetfilterOn,
+
 		AutoUpdate: AutoUpdatePrefs{
 			Check: true,
 			Apply: false,
@@ -518,10 +1892,11 @@ func (p PrefsView) ControlURLOrDefault() string {
 // ControlURLOrDefault returns the coordination server's URL base.
 //
 // If not configured, or if the configured value is a legacy name equivalent to
-// the default, then DefaultControlURL is returned instead.
+// the default and NoControlURLNormalizeOnLoad is not set, then DefaultControlURL is
+// returned instead. A file:// URL is returned unchanged.
 func (p *Prefs) ControlURLOrDefault() string {
 	if p.ControlURL != "" {
-		if p.ControlURL != DefaultControlURL && IsLoginServerSynonym(p.ControlURL) {
+		if !p.NoControlURLNormalizeOnLoad && p.ControlURL != DefaultControlURL && IsLoginServerSynonym(p.ControlURL) {
 			return DefaultControlURL
 		}
 		return p.ControlURL
@@ -529,6 +1904,16 @@ func (p *Prefs) ControlURLOrDefault() string {
 	return DefaultControlURL
 }
 
+// IsUsingCustomControlServer reports whether p uses a coordination server
+// other than Tailscale's own.
+func (p PrefsView) IsUsingCustomControlServer() bool { return p.ж.IsUsingCustomControlServer() }
+
+// IsUsingCustomControlServer reports whether p uses a coordination server
+// other than Tailscale's own.
+func (p *Prefs) IsUsingCustomControlServer() bool {
+	return !IsLoginServerSynonym(p.ControlURLOrDefault())
+}
+
 // AdminPageURL returns the admin web site URL for the current ControlURL.
 func (p PrefsView) AdminPageURL() string { return p.ж.AdminPageURL() }
 
@@ -576,6 +1961,89 @@ func (p *Prefs) SetAdvertiseExitNode(runExit bool) {
 		netip.PrefixFrom(netip.IPv6Unspecified(), 0))
 }
 
+// SetHostname validates and sets p.Hostname from a user-provided name.
+// A name containing non-ASCII characters is converted to its ASCII
+// (punycode) form using IDNA, so "東京" is stored as "xn--1lqs71d". The
+// resulting name must be a valid RFC 1123 hostname. ASCII names are
+// stored unchanged.
+func (p *Prefs) SetHostname(name string) error {
+	ascii := name
+	if !isASCII(name) {
+		var err error
+		ascii, err = idna.Lookup.ToASCII(name)
+		if err != nil {
+			return fmt.Errorf("invalid hostname %q: %w", name, err)
+		}
+	}
+	if err := dnsname.ValidHostname(ascii); err != nil {
+		return err
+	}
+	p.Hostname = ascii
+	return nil
+}
+
+// HostnameDisplay returns p.Hostname in the Unicode form suitable for
+// showing to users, reversing the IDNA conversion done by SetHostname.
+func (p PrefsView) HostnameDisplay() string { return p.ж.HostnameDisplay() }
+
+// HostnameDisplay returns p.Hostname in the Unicode form suitable for
+// showing to users, reversing the IDNA conversion done by SetHostname. If
+// the hostname can't be converted, it's returned unchanged.
+func (p *Prefs) HostnameDisplay() string {
+	u, err := idna.Lookup.ToUnicode(p.Hostname)
+	if err != nil {
+		return p.Hostname
+	}
+	return u
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// SetAdvertiseTags sets p.AdvertiseTags to tags, dropping any duplicates
+// but otherwise keeping their order. It does nothing if p is nil.
+func (p *Prefs) SetAdvertiseTags(tags []string) {
+	if p == nil {
+		return
+	}
+	p.AdvertiseTags = nil
+	seen := make(set.Set[string], len(tags))
+	for _, tag := range tags {
+		if seen.Contains(tag) {
+			continue
+		}
+		seen.Add(tag)
+		p.AdvertiseTags = append(p.AdvertiseTags, tag)
+	}
+}
+
+// TagSet returns the set of tags in p.AdvertiseTags. Callers checking
+// many tags should use it rather than calling HasTag for each one.
+func (p PrefsView) TagSet() set.Set[string] { return p.ж.TagSet() }
+
+// TagSet returns the set of tags in p.AdvertiseTags. Callers checking
+// many tags should use it rather than calling HasTag for each one.
+func (p *Prefs) TagSet() set.Set[string] {
+	if p == nil {
+		return nil
+	}
+	return set.SetOf(p.AdvertiseTags)
+}
+
+// HasTag reports whether p advertises tag.
+func (p PrefsView) HasTag(tag string) bool { return p.ж.HasTag(tag) }
+
+// HasTag reports whether p advertises tag.
+func (p *Prefs) HasTag(tag string) bool {
+	return p != nil && slices.Contains(p.AdvertiseTags, tag)
+}
+
 // peerWithTailscaleIP returns the peer in st with the provided
 // Tailscale IP.
 func peerWithTailscaleIP(st *ipnstate.Status, ip netip.Addr) (ps *ipnstate.PeerStatus, ok bool) {
@@ -679,6 +2147,631 @@ func (p *Prefs) SetExitNodeIP(s string, st *ipnstate.Status) error {
 	return err
 }
 
+// Validate reports an error if p contains values that are out of range or
+// otherwise invalid.
+func (p PrefsView) Validate() error { return p.ж.Validate() }
+
+// Validate reports an error if p contains values that are out of range or
+// otherwise invalid. Likely misconfigurations that are not invalid are
+// reported by Warnings instead.
+//
+// Every violation found is reported; the returned error is a multierr.Error
+// if there is more than one.
+//
+// Validate does not look up local users or binaries; see
+// ValidateOperatorUser and ValidateSSHAvailability for those checks.
+func (p *Prefs) Validate() error {
+	errs := p.validateFields()
+	if err := p.ValidateUserspaceSockets(runtime.GOOS); err != nil {
+		errs = append(errs, err)
+	}
+	if err := p.ValidateInterface(runtime.GOOS); err != nil {
+		errs = append(errs, err)
+	}
+	if p.WireGuardPQEnabled {
+		if err := checkWireGuardPQVersion(version.Short()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return multierr.New(errs...)
+}
+
+// validateFields returns the errors found by Validate that depend only on
+// the contents of p, and not on the local machine (its OS, files or
+// tailscaled version). PrefsFromBytes checks only these, so that saved
+// prefs moved to another machine or kept across a tailscaled downgrade
+// aren't reported as invalid for reasons that may not apply there.
+func (p *Prefs) validateFields() []error {
+	var errs []error
+	if !p.ExitNodeID.IsZero() && p.ExitNodeIP.IsValid() {
+		errs = append(errs, ErrExitNodeIDAndIPSet)
+	}
+	for _, r := range p.AdvertiseRoutes {
+		if err := checkAdvertiseRoute(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := checkControlURL(p.ControlURL); err != nil {
+		errs = append(errs, err)
+	}
+	if w := p.AutoUpdate.ApplyWindow; w != nil {
+		if err := w.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("AutoUpdate.ApplyWindow: %w", err))
+		}
+	}
+	switch p.AutoUpdate.Channel {
+	case "", UpdateChannelStable, UpdateChannelUnstable, UpdateChannelEnterprise:
+	default:
+		errs = append(errs, fmt.Errorf("unknown AutoUpdate.Channel %q", p.AutoUpdate.Channel))
+	}
+	if p.TailscaleSSHMaxSessions < 0 || p.TailscaleSSHMaxSessions > MaxTailscaleSSHMaxSessions {
+		errs = append(errs, fmt.Errorf("TailscaleSSHMaxSessions must be between 0 and %d, got %d", MaxTailscaleSSHMaxSessions, p.TailscaleSSHMaxSessions))
+	}
+	if f := p.RouteAllFilter; f != nil {
+		if !f.IsValid() {
+			errs = append(errs, errors.New("RouteAllFilter is not a valid prefix"))
+		} else if f.Bits() > 30 {
+			errs = append(errs, fmt.Errorf("RouteAllFilter %v must have a prefix length of at most 30", *f))
+		}
+	}
+	if ts := p.TrafficShaping; ts != nil {
+		for _, lim := range []struct {
+			name string
+			kbps uint32
+		}{{"DownloadKbps", ts.DownloadKbps}, {"UploadKbps", ts.UploadKbps}} {
+			if lim.kbps != 0 && lim.kbps < MinTrafficShapingKbps {
+				errs = append(errs, fmt.Errorf("TrafficShaping.%s must be 0 (unlimited) or at least %d, got %d", lim.name, MinTrafficShapingKbps, lim.kbps))
+			}
+		}
+	}
+	if p.DiagnosticsUploadURL != "" {
+		if u, err := url.Parse(p.DiagnosticsUploadURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("DiagnosticsUploadURL %q must be an https:// URL", p.DiagnosticsUploadURL))
+		}
+	}
+	if p.TailscaleIPv4Only && p.TailscaleIPv6Only {
+		errs = append(errs, errors.New("TailscaleIPv4Only and TailscaleIPv6Only cannot both be set"))
+	}
+	if p.MetricsPort != 0 && p.MetricsPort < MinMetricsPort {
+		errs = append(errs, fmt.Errorf("MetricsPort must be 0 (disabled) or in the range %d-65535, got %d", MinMetricsPort, p.MetricsPort))
+	}
+	if n := len(p.LocallyServedPorts); n > MaxLocallyServedPorts {
+		errs = append(errs, fmt.Errorf("LocallyServedPorts must have at most %d entries, got %d", MaxLocallyServedPorts, n))
+	}
+	if slices.Contains(p.LocallyServedPorts, 0) {
+		errs = append(errs, errors.New("LocallyServedPorts must be in the range 1-65535, got 0"))
+	}
+	if n := len(p.AllowedSources); n > MaxAllowedSources {
+		errs = append(errs, fmt.Errorf("AllowedSources must have at most %d entries, got %d", MaxAllowedSources, n))
+	}
+	if slices.ContainsFunc(p.AllowedSources, func(pfx netip.Prefix) bool { return !pfx.IsValid() }) {
+		errs = append(errs, errors.New("AllowedSources contains an invalid prefix"))
+	}
+	if err := validateZoneID(p.TailscaleZoneID); err != nil {
+		errs = append(errs, err)
+	}
+	if p.HeadscaleCompatibility && !p.IsUsingCustomControlServer() {
+		errs = append(errs, errors.New("HeadscaleCompatibility requires a custom control server"))
+	}
+	if p.AuditLog {
+		if p.AuditLogPath == "" {
+			errs = append(errs, errors.New("AuditLog requires AuditLogPath"))
+		} else if !filepath.IsAbs(p.AuditLogPath) {
+			errs = append(errs, fmt.Errorf("AuditLogPath must be an absolute path, got %q", p.AuditLogPath))
+		}
+	}
+	if n := utf8.RuneCountInString(p.ProfileDescription); n > MaxProfileDescriptionLen {
+		errs = append(errs, fmt.Errorf("ProfileDescription must be at most %d characters, got %d", MaxProfileDescriptionLen, n))
+	}
+	if p.SSHKeyPath != "" && !filepath.IsAbs(p.SSHKeyPath) {
+		errs = append(errs, fmt.Errorf("SSHKeyPath must be an absolute path, got %q", p.SSHKeyPath))
+	}
+	if p.SSHCertAuth && !p.RunSSH {
+		errs = append(errs, errors.New("SSHCertAuth requires RunSSH"))
+	}
+	if p.PeerRoutePropagation && !p.RouteAll {
+		errs = append(errs, errors.New("PeerRoutePropagation requires RouteAll"))
+	}
+	if f := p.RoutePropagationFilter; f != nil {
+		if !f.IsValid() {
+			errs = append(errs, errors.New("RoutePropagationFilter is not a valid prefix"))
+		} else if f.Bits() < 8 {
+			errs = append(errs, fmt.Errorf("RoutePropagationFilter %v must have a prefix length of at least 8", *f))
+		}
+	}
+	errs = append(errs, validateForwardPorts(p.LocalForwardPorts)...)
+	if d := p.StatsInterval; d != nil && (*d < MinStatsInterval || *d > MaxStatsInterval) {
+		errs = append(errs, fmt.Errorf("StatsInterval must be between %v and %v, got %v", MinStatsInterval, MaxStatsInterval, *d))
+	}
+	if d := p.WireGuardRoamInterval; d != nil && (*d < MinWireGuardRoamInterval || *d > MaxWireGuardRoamInterval) {
+		errs = append(errs, fmt.Errorf("WireGuardRoamInterval must be between %v and %v, got %v", MinWireGuardRoamInterval, MaxWireGuardRoamInterval, *d))
+	}
+	for _, pat := range p.CacheDNSFor {
+		if pat == "" {
+			errs = append(errs, errors.New("CacheDNSFor contains an empty pattern"))
+		} else if _, err := path.Match(pat, ""); err != nil {
+			errs = append(errs, fmt.Errorf("CacheDNSFor pattern %q is not a valid glob: %w", pat, err))
+		}
+	}
+	if d := p.DNSTTLOverride; d != nil && (*d < MinDNSTTLOverride || *d > MaxDNSTTLOverride) {
+		errs = append(errs, fmt.Errorf("DNSTTLOverride must be between %v and %v, got %v", MinDNSTTLOverride, MaxDNSTTLOverride, *d))
+	}
+	if n := p.MaxLogLineLength; n != 0 && (n < MinMaxLogLineLength || n > MaxMaxLogLineLength) {
+		errs = append(errs, fmt.Errorf("MaxLogLineLength must be 0 (default) or between %d and %d, got %d", MinMaxLogLineLength, MaxMaxLogLineLength, n))
+	}
+	switch p.ConnectionPriorityMode {
+	case "", ConnectionPriorityLatency, ConnectionPriorityReliability, ConnectionPriorityBandwidth:
+	default:
+		errs = append(errs, fmt.Errorf("unknown ConnectionPriorityMode %q", p.ConnectionPriorityMode))
+	}
+	if p.PostureCheckPolicy != "" && !validPostureCheckPolicy(p.PostureCheckPolicy) {
+		errs = append(errs, fmt.Errorf("PostureCheckPolicy %q must be at most %d letters, digits and hyphens", p.PostureCheckPolicy, MaxPostureCheckPolicyLen))
+	}
+	if p.CacheDNSTTL < 0 {
+		errs = append(errs, fmt.Errorf("CacheDNSTTL must not be negative, got %v", p.CacheDNSTTL))
+	}
+	if p.ExitNodeCountry != "" && !validCountryCode(p.ExitNodeCountry) {
+		errs = append(errs, fmt.Errorf("ExitNodeCountry %q must be a two-letter upper case ISO 3166-1 country code", p.ExitNodeCountry))
+	}
+	if slices.Contains(p.ExitNodeFallbacks, "") {
+		errs = append(errs, errors.New("ExitNodeFallbacks contains an empty node ID"))
+	}
+	if p.ExitNodeRotate && len(p.ExitNodeIDs) == 0 {
+		errs = append(errs, errors.New("ExitNodeRotate requires a non-empty ExitNodeIDs list"))
+	}
+	switch p.PrivacyMode {
+	case "", PrivacyModeStandard, PrivacyModeStrict, PrivacyModeParanoid:
+	default:
+		errs = append(errs, fmt.Errorf("unknown PrivacyMode %q", p.PrivacyMode))
+	}
+	switch p.NameserverPolicy {
+	case "", NameserverPolicyAuto, NameserverPolicyTailscaleOnly, NameserverPolicySystemOnly:
+	default:
+		errs = append(errs, fmt.Errorf("unknown NameserverPolicy %q", p.NameserverPolicy))
+	}
+	switch p.ShieldsUpMode {
+	case "", ShieldsUpModeAll, ShieldsUpModeInboundOnly, ShieldsUpModeOutboundOnly:
+	default:
+		errs = append(errs, fmt.Errorf("unknown ShieldsUpMode %q", p.ShieldsUpMode))
+	}
+	switch p.TunnelProtocol {
+	case "", TunnelProtocolWireGuard, TunnelProtocolQUIC:
+	default:
+		errs = append(errs, fmt.Errorf("unknown TunnelProtocol %q", p.TunnelProtocol))
+	}
+	if p.ExitNodeRotateInterval < 0 {
+		errs = append(errs, fmt.Errorf("ExitNodeRotateInterval must not be negative, got %v", p.ExitNodeRotateInterval))
+	}
+	return errs
+}
+
+// validCountryCode reports whether s has the form of an ISO 3166-1 alpha-2
+// country code in upper case, as used in tailcfg.Location.CountryCode.
+func validCountryCode(s string) bool {
+	return len(s) == 2 && 'A' <= s[0] && s[0] <= 'Z' && 'A' <= s[1] && s[1] <= 'Z'
+}
+
+// validPostureCheckPolicy reports whether s is a well-formed
+// Prefs.PostureCheckPolicy.
+func validPostureCheckPolicy(s string) bool {
+	return len(s) <= MaxPostureCheckPolicyLen && isAlnumHyphen(s)
+}
+
+// isAlnumHyphen reports whether s is non-empty and made of only ASCII
+// letters, digits and hyphens.
+func isAlnumHyphen(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Warnings returns human-readable warnings about settings in p that are
+// valid, and so not reported by Validate, but likely to be a
+// misconfiguration.
+func (p PrefsView) Warnings() []string { return p.ж.Warnings() }
+
+// Warnings returns human-readable warnings about settings in p that are
+// valid, and so not reported by Validate, but likely to be a
+// misconfiguration.
+func (p *Prefs) Warnings() []string {
+	var warns []string
+	if p.NoSNAT {
+		switch {
+		case len(p.AdvertiseRoutes) == 0:
+			warns = append(warns, "NoSNAT has no effect without AdvertiseRoutes")
+		case !slices.ContainsFunc(p.AdvertiseRoutes, func(r netip.Prefix) bool { return r.Bits() != 0 }):
+			warns = append(warns, "NoSNAT with only exit node routes advertised can cause routing loops; SNAT should stay enabled on exit nodes")
+		}
+	}
+	if p.DiagnosticsEnabled && p.DiagnosticsUploadURL == "" {
+		warns = append(warns, "DiagnosticsEnabled has no effect without DiagnosticsUploadURL")
+	}
+	switch {
+	case p.PostureChecking && p.PostureCheckPolicy == "":
+		warns = append(warns, "PostureChecking without a PostureCheckPolicy is deprecated")
+	case !p.PostureChecking && p.PostureCheckPolicy != "":
+		warns = append(warns, "PostureCheckPolicy has no effect without PostureChecking")
+	}
+	if w := p.UserspaceSocketsWarning(runtime.GOOS); w != "" {
+		warns = append(warns, w)
+	}
+	if w := p.fileControlURLWarning(testenv.InTest()); w != "" {
+		warns = append(warns, w)
+	}
+	if len(p.TagSet()) != len(p.AdvertiseTags) {
+		seen, dups := set.Set[string]{}, set.Set[string]{}
+		for _, tag := range p.AdvertiseTags {
+			if seen.Contains(tag) && !dups.Contains(tag) {
+				dups.Add(tag)
+				warns = append(warns, fmt.Sprintf("AdvertiseTags contains duplicate tag %q", tag))
+			}
+			seen.Add(tag)
+		}
+	}
+	return warns
+}
+
+// checkWireGuardPQVersion reports an error if daemonVersion is older than
+// MinWireGuardPQVersion.
+func checkWireGuardPQVersion(daemonVersion string) error {
+	if cmpver.Compare(daemonVersion, MinWireGuardPQVersion) < 0 {
+		return fmt.Errorf("WireGuardPQEnabled requires tailscaled %s or later, have %s", MinWireGuardPQVersion, daemonVersion)
+	}
+	return nil
+}
+
+// ValidateOperatorUser reports an error if OperatorUser is set but does not
+// name a local user. The check is only done when goos is "linux" or
+// "darwin"; elsewhere, including Windows where OperatorUser is ignored, it
+// always returns nil.
+func (p PrefsView) ValidateOperatorUser(goos string) error {
+	return p.ж.ValidateOperatorUser(goos)
+}
+
+// ValidateOperatorUser reports an error if OperatorUser is set but does not
+// name a local user. The check is only done when goos is "linux" or
+// "darwin"; elsewhere, including Windows where OperatorUser is ignored, it
+// always returns nil.
+func (p *Prefs) ValidateOperatorUser(goos string) error {
+	if p.OperatorUser == "" {
+		return nil
+	}
+	switch goos {
+	case "linux", "darwin":
+	default:
+		return nil
+	}
+	if _, err := user.Lookup(p.OperatorUser); err != nil {
+		return fmt.Errorf("invalid OperatorUser %q: %w", p.OperatorUser, err)
+	}
+	return nil
+}
+
+// ValidateUserspaceSockets reports an error if UserspaceSockets is set but
+// tailscaled on goos can't use its userspace network stack in place of a
+// TUN device.
+func (p PrefsView) ValidateUserspaceSockets(goos string) error {
+	return p.ж.ValidateUserspaceSockets(goos)
+}
+
+// ValidateUserspaceSockets reports an error if UserspaceSockets is set but
+// tailscaled on goos can't use its userspace network stack in place of a
+// TUN device.
+func (p *Prefs) ValidateUserspaceSockets(goos string) error {
+	if !p.UserspaceSockets {
+		return nil
+	}
+	switch goos {
+	case "linux", "windows", "freebsd", "openbsd":
+		return nil
+	}
+	return fmt.Errorf("UserspaceSockets is not supported on %s", goos)
+}
+
+// UserspaceSocketsWarning returns a warning to show the user if
+// UserspaceSockets is set on goos, where the userspace network stack is
+// significantly slower than the kernel TUN device it replaces. It returns
+// the empty string if there is nothing to warn about.
+func (p PrefsView) UserspaceSocketsWarning(goos string) string {
+	return p.ж.UserspaceSocketsWarning(goos)
+}
+
+// UserspaceSocketsWarning returns a warning to show the user if
+// UserspaceSockets is set on goos, where the userspace network stack is
+// significantly slower than the kernel TUN device it replaces. It returns
+// the empty string if there is nothing to warn about.
+func (p *Prefs) UserspaceSocketsWarning(goos string) string {
+	if !p.UserspaceSockets {
+		return ""
+	}
+	switch goos {
+	case "windows", "freebsd", "openbsd":
+		return fmt.Sprintf("UserspaceSockets has a significant performance impact on %s; prefer a TUN device where available", goos)
+	}
+	return ""
+}
+
+// fileControlURLWarning returns a warning to show the user if ControlURL
+// is a file:// URL outside of a test binary (per inTest), or the empty
+// string otherwise.
+func (p *Prefs) fileControlURLWarning(inTest bool) string {
+	if inTest || !IsFileControlURL(p.ControlURL) {
+		return ""
+	}
+	return fmt.Sprintf("ControlURL %q reads a fixed netmap from a local file and is only meant for testing", p.ControlURL)
+}
+
+// ErrSSHNotAvailable is returned by ValidateSSHAvailability when RunSSH is
+// set but the Tailscale SSH helper binary is missing.
+var ErrSSHNotAvailable = errors.New("Tailscale SSH is not available: SSH helper binary not found")
+
+// lookupSSHHelper returns the path of the binary that Tailscale SSH execs as
+// its per-session helper (tailscaled itself, run as "be-child ssh"), or an
+// error if it can't be found. It's a variable for testing.
+var lookupSSHHelper = func() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(exe); err != nil {
+		return "", err
+	}
+	return exe, nil
+}
+
+// ValidateSSHAvailability reports whether the Tailscale SSH server can run
+// when RunSSH is set. It returns an error wrapping ErrSSHNotAvailable if the
+// SSH helper binary is missing, as can happen on minimal container images.
+// The check is only done when goos is "linux"; elsewhere it always returns
+// nil.
+func (p PrefsView) ValidateSSHAvailability(goos string) error {
+	return p.ж.ValidateSSHAvailability(goos)
+}
+
+// ValidateSSHAvailability reports whether the Tailscale SSH server can run
+// when RunSSH is set. It returns an error wrapping ErrSSHNotAvailable if the
+// SSH helper binary is missing, as can happen on minimal container images.
+// The check is only done when goos is "linux"; elsewhere it always returns
+// nil.
+func (p *Prefs) ValidateSSHAvailability(goos string) error {
+	if !p.RunSSH || goos != "linux" {
+		return nil
+	}
+	if _, err := lookupSSHHelper(); err != nil {
+		return fmt.Errorf("%w: %v", ErrSSHNotAvailable, err)
+	}
+	return nil
+}
+
+// reservedInterfaceNames are well-known system interface names that
+// Prefs.Interface may not use, to avoid clobbering or confusing an
+// interface that's managed by something other than tailscaled.
+var reservedInterfaceNames = map[string]bool{
+	"lo":      true,
+	"eth0":    true,
+	"eth1":    true,
+	"wlan0":   true,
+	"wlan1":   true,
+	"docker0": true,
+	"virbr0":  true,
+	"br0":     true,
+	"bond0":   true,
+	"tun0":    true,
+	"wg0":     true,
+}
+
+// ValidateInterface reports an error if Interface is set but is not a
+// valid Linux network interface name, or if it collides with a well-known
+// system interface name. The check is only done when goos is "linux", the
+// only platform on which Interface is used; elsewhere it always returns nil.
+func (p PrefsView) ValidateInterface(goos string) error {
+	return p.ж.ValidateInterface(goos)
+}
+
+// ValidateInterface reports an error if Interface is set but is not a
+// valid Linux network interface name, or if it collides with a well-known
+// system interface name. The check is only done when goos is "linux", the
+// only platform on which Interface is used; elsewhere it always returns nil.
+func (p *Prefs) ValidateInterface(goos string) error {
+	name := p.Interface
+	if name == "" || goos != "linux" {
+		return nil
+	}
+	// Linux limits interface names to IFNAMSIZ-1 (15) bytes and rejects
+	// "." and "..", slashes, colons and whitespace.
+	if len(name) > 15 {
+		return fmt.Errorf("invalid Interface %q: must be at most 15 bytes, got %d", name, len(name))
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/: \t\n\r\v\f") {
+		return fmt.Errorf("invalid Interface %q: not a valid interface name", name)
+	}
+	if reservedInterfaceNames[name] {
+		return fmt.Errorf("invalid Interface %q: conflicts with a common system interface name", name)
+	}
+	return nil
+}
+
+// EffectiveShieldsUpMode returns the shields-up mode in effect: ShieldsUpMode
+// if set, otherwise ShieldsUpModeInboundOnly if the legacy ShieldsUp is true,
+// or the empty string if shields are down.
+func (p PrefsView) EffectiveShieldsUpMode() string { return p.ж.EffectiveShieldsUpMode() }
+
+// EffectiveShieldsUpMode returns the shields-up mode in effect: ShieldsUpMode
+// if set, otherwise ShieldsUpModeInboundOnly if the legacy ShieldsUp is true,
+// or the empty string if shields are down.
+func (p *Prefs) EffectiveShieldsUpMode() string {
+	if p.ShieldsUpMode != "" {
+		return p.ShieldsUpMode
+	}
+	if p.ShieldsUp {
+		return ShieldsUpModeInboundOnly
+	}
+	return ""
+}
+
+// ShieldsUpBlocksInbound reports whether the effective shields-up mode
+// blocks incoming connections.
+func (p PrefsView) ShieldsUpBlocksInbound() bool { return p.ж.ShieldsUpBlocksInbound() }
+
+// ShieldsUpBlocksInbound reports whether the effective shields-up mode
+// blocks incoming connections.
+func (p *Prefs) ShieldsUpBlocksInbound() bool {
+	switch p.EffectiveShieldsUpMode() {
+	case ShieldsUpModeAll, ShieldsUpModeInboundOnly:
+		return true
+	}
+	return false
+}
+
+// ShieldsUpBlocksOutbound reports whether the effective shields-up mode
+// blocks outgoing connections to peers.
+func (p PrefsView) ShieldsUpBlocksOutbound() bool { return p.ж.ShieldsUpBlocksOutbound() }
+
+// ShieldsUpBlocksOutbound reports whether the effective shields-up mode
+// blocks outgoing connections to peers.
+func (p *Prefs) ShieldsUpBlocksOutbound() bool {
+	switch p.EffectiveShieldsUpMode() {
+	case ShieldsUpModeAll, ShieldsUpModeOutboundOnly:
+		return true
+	}
+	return false
+}
+
+// MigrateAllowSingleHosts sets the deprecated AllowSingleHosts field to
+// true, its only supported value. It reports whether p was modified.
+func (p *Prefs) MigrateAllowSingleHosts() bool {
+	if p.AllowSingleHosts {
+		return false
+	}
+	p.AllowSingleHosts = true
+	return true
+}
+
+// MigrateShieldsUp converts the deprecated ShieldsUp field to ShieldsUpMode.
+// If ShieldsUpMode is empty and ShieldsUp is true, it sets ShieldsUpMode to
+// ShieldsUpModeInboundOnly, which is what ShieldsUp has always meant. It
+// reports whether p was modified.
+func (p *Prefs) MigrateShieldsUp() bool {
+	if p.ShieldsUpMode != "" || !p.ShieldsUp {
+		return false
+	}
+	p.ShieldsUpMode = ShieldsUpModeInboundOnly
+	return true
+}
+
+// UseTailscaleDNS reports whether the node should install the tailnet's DNS
+// configuration, according to NameserverPolicy and, for
+// NameserverPolicyAuto, CorpDNS.
+func (p PrefsView) UseTailscaleDNS() bool { return p.ж.UseTailscaleDNS() }
+
+// UseTailscaleDNS reports whether the node should install the tailnet's DNS
+// configuration, according to NameserverPolicy and, for
+// NameserverPolicyAuto, CorpDNS.
+func (p *Prefs) UseTailscaleDNS() bool {
+	switch p.NameserverPolicy {
+	case NameserverPolicyTailscaleOnly:
+		return true
+	case NameserverPolicySystemOnly:
+		return false
+	}
+	return p.CorpDNS
+}
+
+// StatsIntervalOrDefault returns p.StatsInterval, or DefaultStatsInterval if
+// it is not set.
+func (p PrefsView) StatsIntervalOrDefault() time.Duration { return p.ж.StatsIntervalOrDefault() }
+
+// StatsIntervalOrDefault returns p.StatsInterval, or DefaultStatsInterval if
+// it is not set.
+func (p *Prefs) StatsIntervalOrDefault() time.Duration {
+	if p.StatsInterval == nil {
+		return DefaultStatsInterval
+	}
+	return *p.StatsInterval
+}
+
+// MaxLogLineLengthOrDefault returns p.MaxLogLineLength, or
+// DefaultMaxLogLineLength if it is not set.
+func (p PrefsView) MaxLogLineLengthOrDefault() int { return p.ж.MaxLogLineLengthOrDefault() }
+
+// MaxLogLineLengthOrDefault returns p.MaxLogLineLength, or
+// DefaultMaxLogLineLength if it is not set.
+func (p *Prefs) MaxLogLineLengthOrDefault() int {
+	if p.MaxLogLineLength == 0 {
+		return DefaultMaxLogLineLength
+	}
+	return p.MaxLogLineLength
+}
+
+// ConnectionPriorityModeOrDefault returns p.ConnectionPriorityMode, or
+// ConnectionPriorityLatency if it is not set.
+func (p PrefsView) ConnectionPriorityModeOrDefault() string {
+	return p.ж.ConnectionPriorityModeOrDefault()
+}
+
+// ConnectionPriorityModeOrDefault returns p.ConnectionPriorityMode, or
+// ConnectionPriorityLatency if it is not set.
+func (p *Prefs) ConnectionPriorityModeOrDefault() string {
+	if p.ConnectionPriorityMode == "" {
+		return ConnectionPriorityLatency
+	}
+	return p.ConnectionPriorityMode
+}
+
+// CacheDNSTTLOrDefault returns p.CacheDNSTTL, or DefaultCacheDNSTTL if it
+// is not set.
+func (p PrefsView) CacheDNSTTLOrDefault() time.Duration { return p.ж.CacheDNSTTLOrDefault() }
+
+// CacheDNSTTLOrDefault returns p.CacheDNSTTL, or DefaultCacheDNSTTL if it
+// is not set.
+func (p *Prefs) CacheDNSTTLOrDefault() time.Duration {
+	if p.CacheDNSTTL == 0 {
+		return DefaultCacheDNSTTL
+	}
+	return p.CacheDNSTTL
+}
+
+// ExitNodeRotateIntervalOrDefault returns p.ExitNodeRotateInterval, or
+// DefaultExitNodeRotateInterval if it is not set.
+func (p PrefsView) ExitNodeRotateIntervalOrDefault() time.Duration {
+	return p.ж.ExitNodeRotateIntervalOrDefault()
+}
+
+// ExitNodeRotateIntervalOrDefault returns p.ExitNodeRotateInterval, or
+// DefaultExitNodeRotateInterval if it is not set.
+func (p *Prefs) ExitNodeRotateIntervalOrDefault() time.Duration {
+	if p.ExitNodeRotateInterval <= 0 {
+		return DefaultExitNodeRotateInterval
+	}
+	return p.ExitNodeRotateInterval
+}
+
+// NextExitNodeID returns the entry of ExitNodeIDs following the current
+// ExitNodeID, wrapping around at the end of the list. If ExitNodeID is not
+// in the list, the first entry is returned. It returns the empty string if
+// ExitNodeIDs is empty.
+func (p PrefsView) NextExitNodeID() tailcfg.StableNodeID { return p.ж.NextExitNodeID() }
+
+// NextExitNodeID returns the entry of ExitNodeIDs following the current
+// ExitNodeID, wrapping around at the end of the list. If ExitNodeID is not
+// in the list, the first entry is returned. It returns the empty string if
+// ExitNodeIDs is empty.
+func (p *Prefs) NextExitNodeID() tailcfg.StableNodeID {
+	if len(p.ExitNodeIDs) == 0 {
+		return ""
+	}
+	i := slices.Index(p.ExitNodeIDs, p.ExitNodeID)
+	return p.ExitNodeIDs[(i+1)%len(p.ExitNodeIDs)]
+}
+
 // ShouldSSHBeRunning reports whether the SSH server should be running based on
 // the prefs.
 func (p PrefsView) ShouldSSHBeRunning() bool {
@@ -691,7 +2784,15 @@ func (p *Prefs) ShouldSSHBeRunning() bool {
 	return p.WantRunning && p.RunSSH
 }
 
-// PrefsFromBytes deserializes Prefs from a JSON blob.
+// PrefsFromBytes deserializes Prefs from a JSON blob. It returns an error
+// wrapping ErrFuturePrefsVersion if the blob has a SchemaVersion newer than
+// CurrentPrefsSchemaVersion.
+//
+// If the decoded prefs fail the checks of Validate that don't depend on the
+// local machine, PrefsFromBytes returns them along with an error wrapping
+// ErrInvalidPrefs that lists every violation. Callers that must not lose
+// saved settings, such as when loading a profile, may keep using the prefs
+// after reporting the error.
 func PrefsFromBytes(b []byte) (*Prefs, error) {
 	p := NewPrefs()
 	if len(b) == 0 {
@@ -701,13 +2802,25 @@ func PrefsFromBytes(b []byte) (*Prefs, error) {
 	if err := json.Unmarshal(b, p); err != nil {
 		return nil, err
 	}
+	if p.SchemaVersion > CurrentPrefsSchemaVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrFuturePrefsVersion, p.SchemaVersion)
+	}
+	if err := multierr.New(p.validateFields()...); err != nil {
+		return p, fmt.Errorf("%w: %w", ErrInvalidPrefs, err)
+	}
 	return p, nil
 }
 
 var jsonEscapedZero = []byte(`\u0000`)
 
+// warnAllowSingleHostsOnce limits LoadPrefs to one warning per process
+// about a deprecated AllowSingleHosts=false.
+var warnAllowSingleHostsOnce sync.Once
+
 // LoadPrefs loads a legacy relaynode config file into Prefs
-// with sensible migration defaults set.
+// with sensible migration defaults set, including the deprecated
+// AllowSingleHosts being set to true. The first time it does that to a
+// false value, it logs a warning.
 func LoadPrefs(filename string) (*Prefs, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -725,6 +2838,11 @@ func LoadPrefs(filename string) (*Prefs, error) {
 	if err != nil {
 		return nil, fmt.Errorf("LoadPrefs(%q) decode: %w", filename, err)
 	}
+	if p.MigrateAllowSingleHosts() {
+		warnAllowSingleHostsOnce.Do(func() {
+			log.Printf("LoadPrefs: %s has deprecated AllowSingleHosts=false, which stops packets from flowing; using true", filename)
+		})
+	}
 	return p, nil
 }
 
@@ -738,15 +2856,50 @@ func SavePrefs(filename string, p *Prefs) {
 }
 
 // ProfileID is an auto-generated system-wide unique identifier for a login
-// profile. It is a 4 character hex string like "1ab3".
+// profile. It is a 4 character hex string like "1ab3" (see IsV1) or, in the
+// longer format, a 16 character hex string (see IsV2).
 type ProfileID string
 
+// IsV1 reports whether id is in the original profile ID format: exactly 4
+// lowercase hex characters.
+func (id ProfileID) IsV1() bool {
+	return len(id) == 4 && isLowerHex(string(id))
+}
+
+// IsV2 reports whether id is in the longer profile ID format: exactly 16
+// lowercase hex characters.
+func (id ProfileID) IsV2() bool {
+	return len(id) == 16 && isLowerHex(string(id))
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 // WindowsUserID is a userid (suitable for passing to ipnauth.LookupUserFromID
 // or os/user.LookupId) but only set on Windows. It's empty on all other
 // platforms, unless envknob.GOOS is in used, making Linux act like Windows for
 // tests.
 type WindowsUserID string
 
+// IsValid reports whether w is non-empty and, on Windows, refers to a valid
+// security principal.
+func (w WindowsUserID) IsValid() bool {
+	if w == "" {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return winutil.IsSIDValidPrincipal(string(w))
+	}
+	return true
+}
+
 // LoginProfile represents a single login profile as managed
 // by the ProfileManager.
 type LoginProfile struct {
@@ -761,6 +2914,10 @@ type LoginProfile struct {
 	// It is filled in from the UserProfile.LoginName field.
 	Name string
 
+	// Description is the profile's Prefs.ProfileDescription, cached here so
+	// that profiles can be listed without loading their prefs.
+	Description string `json:",omitempty"`
+
 	// TailnetMagicDNSName is filled with the MagicDNS suffix for this
 	// profile's node (even if MagicDNS isn't necessarily in use).
 	// It will neither start nor end with a period.
@@ -792,4 +2949,93 @@ type LoginProfile struct {
 	// ControlURL is the URL of the control server that this profile is logged
 	// into.
 	ControlURL string
+
+	// Tags are free-form labels, such as "production" or "europe", that an
+	// admin has attached to this profile to organize profiles in the UI.
+	// They have no effect on the profile's behavior. See ValidateProfileTags.
+	Tags []string `json:",omitempty"`
+
+	// CreatedAt is when the profile was first saved. It is the zero time
+	// for profiles created before the field existed.
+	CreatedAt time.Time `json:",omitempty"`
+
+	// LastUsedAt is when the profile was last created or switched to. It
+	// is the zero time for profiles not used since the field was added.
+	LastUsedAt time.Time `json:",omitempty"`
+}
+
+// IsStale reports whether the profile has not been used for longer than
+// threshold as of now. Profiles with no LastUsedAt recorded are never
+// stale, as their age is unknown.
+func (lp *LoginProfile) IsStale(now time.Time, threshold time.Duration) bool {
+	return !lp.LastUsedAt.IsZero() && now.Sub(lp.LastUsedAt) > threshold
+}
+
+// EffectiveProfileName returns the name to show for the profile: Name if it
+// was set from an explicit Prefs.ProfileName, or else the
+// SanitizeProfileName form of the user's LoginName.
+func (lp *LoginProfile) EffectiveProfileName() string {
+	if lp.Name != "" && lp.Name != lp.UserProfile.LoginName {
+		return lp.Name
+	}
+	if n := SanitizeProfileName(lp.UserProfile.LoginName); n != "" {
+		return n
+	}
+	return lp.Name
+}
+
+// EffectiveProfileName returns ProfileName if set, or else the
+// SanitizeProfileName form of the logged-in user's LoginName, if any.
+func (p PrefsView) EffectiveProfileName() string { return p.ж.EffectiveProfileName() }
+
+// EffectiveProfileName returns ProfileName if set, or else the
+// SanitizeProfileName form of the logged-in user's LoginName, if any.
+func (p *Prefs) EffectiveProfileName() string {
+	if p.ProfileName != "" {
+		return p.ProfileName
+	}
+	if p.Persist == nil {
+		return ""
+	}
+	return SanitizeProfileName(p.Persist.UserProfile.LoginName)
+}
+
+// SanitizeProfileName returns a short profile name derived from the login
+// name loginName: the part before the last "@", with each "+" replaced by
+// "_". For example, "alice+work@example.com" becomes "alice_work". If
+// there is nothing before the "@", the domain is kept.
+func SanitizeProfileName(loginName string) string {
+	name := loginName
+	if i := strings.LastIndexByte(name, '@'); i > 0 {
+		name = name[:i]
+	}
+	return strings.ReplaceAll(name, "+", "_")
+}
+
+// validateZoneID reports an error if zone is not a valid
+// Prefs.TailscaleZoneID.
+func validateZoneID(zone string) error {
+	if len(zone) > MaxTailscaleZoneIDLen {
+		return fmt.Errorf("TailscaleZoneID must be at most %d characters, got %d", MaxTailscaleZoneIDLen, len(zone))
+	}
+	for _, r := range zone {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return fmt.Errorf("TailscaleZoneID %q must contain only ASCII letters, digits and hyphens", zone)
+		}
+	}
+	return nil
+}
+
+// ValidateProfileTags reports an error if any of tags is empty or longer
+// than MaxProfileTagLen characters.
+func ValidateProfileTags(tags []string) error {
+	var errs []error
+	for _, tag := range tags {
+		if tag == "" {
+			errs = append(errs, errors.New("profile tag must not be empty"))
+		} else if n := utf8.RuneCountInString(tag); n > MaxProfileTagLen {
+			errs = append(errs, fmt.Errorf("profile tag %q must be at most %d characters, got %d", tag, MaxProfileTagLen, n))
+		}
+	}
+	return multierr.New(errs...)
 }
@@ -0,0 +1,52 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateInterface(t *testing.T) {
+	tests := []struct {
+		name    string
+		iface   string
+		wantErr string
+	}{
+		{name: "empty", iface: ""},
+		{name: "tenant", iface: "ts-tenant1"},
+		{name: "max_len", iface: strings.Repeat("t", 15)},
+		{name: "too_long", iface: strings.Repeat("t", 16), wantErr: "must be at most 15 bytes, got 16"},
+		{name: "space", iface: "ts tenant", wantErr: "not a valid interface name"},
+		{name: "slash", iface: "ts/tenant", wantErr: "not a valid interface name"},
+		{name: "dotdot", iface: "..", wantErr: "not a valid interface name"},
+		{name: "loopback", iface: "lo", wantErr: "conflicts with a common system interface name"},
+		{name: "docker", iface: "docker0", wantErr: "conflicts with a common system interface name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Prefs{Interface: tt.iface}
+			err := p.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v; want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateInterfaceNonLinux(t *testing.T) {
+	p := &Prefs{Interface: "lo"}
+	if err := p.ValidateInterface("linux"); err == nil {
+		t.Error("ValidateInterface(linux) = nil; want error")
+	}
+	if err := p.ValidateInterface("windows"); err != nil {
+		t.Errorf("ValidateInterface(windows) = %v; want nil", err)
+	}
+}
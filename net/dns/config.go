@@ -8,6 +8,7 @@
 	"fmt"
 	"net/netip"
 	"sort"
+	"time"
 
 	"tailscale.com/net/dns/publicdns"
 	"tailscale.com/net/dns/resolver"
@@ -44,6 +45,17 @@ type Config struct {
 	// OnlyIPv6, if true, uses the IPv6 service IP (for MagicDNS)
 	// instead of the IPv4 version (100.100.100.100).
 	OnlyIPv6 bool
+	// CacheDomains are glob patterns (see path.Match) of DNS names,
+	// without a trailing dot, whose upstream responses quad-100
+	// caches for CacheTTL. They only take effect for queries that
+	// are forwarded by quad-100.
+	CacheDomains []string
+	// CacheTTL is how long responses for CacheDomains are cached.
+	CacheTTL time.Duration
+	// TTLOverride, if non-zero, is the TTL quad-100 gives every record
+	// in the responses it returns, whether answered locally or
+	// forwarded.
+	TTLOverride time.Duration
 }
 
 func (c *Config) serviceIP() netip.Addr {
@@ -15,6 +15,8 @@
 	"net/http"
 	"net/netip"
 	"net/url"
+	"path"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -213,6 +215,10 @@ type forwarder struct {
 	// /etc/resolv.conf is missing/corrupt, and the peerapi ExitDNS stub
 	// resolver lookup.
 	cloudHostFallback []resolverAndDelay
+
+	// cache holds responses for names configured to be cached.
+	// It has its own lock.
+	cache responseCache
 }
 
 func init() {
@@ -358,6 +364,12 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]*dnstype.Resolve
 	f.cloudHostFallback = cloudHostFallback
 }
 
+// setCache configures which names have their responses cached, and for how
+// long. Any previously cached responses are dropped.
+func (f *forwarder) setCache(patterns []string, ttl time.Duration) {
+	f.cache.setConfig(patterns, ttl)
+}
+
 var stdNetPacketListener nettype.PacketListenerWithNetIP = nettype.MakePacketListenerWithNetIP(new(net.ListenConfig))
 
 func (f *forwarder) packetListener(ip netip.Addr) (nettype.PacketListenerWithNetIP, error) {
@@ -855,6 +867,21 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 
 	clampEDNSSize(query.bs, maxResponseBytes)
 
+	// Only cache our own queries, not those using explicit resolvers
+	// (such as exit node DNS proxy queries from peers).
+	useCache := len(resolvers) == 0 && f.cache.matches(domain)
+	if useCache {
+		if res, ok := f.cache.get(query.bs, time.Now()); ok {
+			metricDNSFwdCacheHit.Add(1)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case responseChan <- packet{res, query.family, query.addr}:
+				return nil
+			}
+		}
+	}
+
 	if len(resolvers) == 0 {
 		resolvers = f.resolvers(domain)
 		if len(resolvers) == 0 {
@@ -917,6 +944,9 @@ func (f *forwarder) forwardWithDestChan(ctx context.Context, query packet, respo
 	for {
 		select {
 		case v := <-resc:
+			if useCache {
+				f.cache.put(query.bs, v, time.Now())
+			}
 			select {
 			case <-ctx.Done():
 				metricDNSFwdErrorContext.Add(1)
@@ -1024,6 +1054,141 @@ func servfailResponse(req packet) (res packet, err error) {
 	return res, err
 }
 
+// maxCachedResponses is the maximum number of responses held by a
+// responseCache. When it is full, expired entries are evicted, and if
+// none have expired, new responses are not cached.
+const maxCachedResponses = 1000
+
+// responseCache is a cache of successful upstream DNS responses for
+// names matching a set of glob patterns. Responses are cached for a fixed
+// TTL, regardless of the TTLs of the records they contain.
+//
+// The zero value caches nothing.
+type responseCache struct {
+	mu       sync.Mutex
+	patterns []string // lowercase, without trailing dot
+	ttl      time.Duration
+	entries  map[responseCacheKey]responseCacheEntry
+}
+
+type responseCacheKey struct {
+	name   dnsname.FQDN
+	qtype  dns.Type
+	qclass dns.Class
+}
+
+type responseCacheEntry struct {
+	res     []byte
+	expires time.Time
+}
+
+// setConfig replaces the cache's patterns and TTL. If either changed, all
+// cached responses are dropped.
+func (c *responseCache) setConfig(patterns []string, ttl time.Duration) {
+	var normalized []string
+	for _, p := range patterns {
+		normalized = append(normalized, strings.ToLower(strings.TrimSuffix(p, ".")))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl == c.ttl && slices.Equal(normalized, c.patterns) {
+		return
+	}
+	c.patterns = normalized
+	c.ttl = ttl
+	c.entries = nil
+}
+
+// matches reports whether responses for name should be cached.
+func (c *responseCache) matches(name dnsname.FQDN) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 {
+		return false
+	}
+	n := name.WithoutTrailingDot()
+	for _, p := range c.patterns {
+		if ok, _ := path.Match(p, n); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// responseCacheKeyOf returns the cache key for the question in the DNS
+// packet bs.
+func responseCacheKeyOf(bs []byte) (k responseCacheKey, ok bool) {
+	var parser dns.Parser
+	if _, err := parser.Start(bs); err != nil {
+		return k, false
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return k, false
+	}
+	name, err := dnsname.ToFQDN(rawNameToLower(q.Name.Data[:q.Name.Length]))
+	if err != nil {
+		return k, false
+	}
+	return responseCacheKey{name, q.Type, q.Class}, true
+}
+
+// get returns a cached response to query, with its transaction ID
+// rewritten to match query, if there's one that hasn't expired as of now.
+func (c *responseCache) get(query []byte, now time.Time) (res []byte, ok bool) {
+	k, ok := responseCacheKeyOf(query)
+	if !ok {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[k]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, k)
+		return nil, false
+	}
+	res = bytes.Clone(e.res)
+	copy(res[:2], query[:2])
+	return res, true
+}
+
+// put caches res as the response to query until now plus the cache's TTL.
+// Only successful, untruncated responses are cached.
+func (c *responseCache) put(query, res []byte, now time.Time) {
+	if len(res) < headerBytes || getRCode(res) != dns.RCodeSuccess || truncatedFlagSet(res) {
+		return
+	}
+	k, ok := responseCacheKeyOf(query)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[responseCacheKey]responseCacheEntry)
+	}
+	if _, ok := c.entries[k]; !ok && len(c.entries) >= maxCachedResponses {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCachedResponses {
+			return
+		}
+	}
+	c.entries[k] = responseCacheEntry{
+		res:     bytes.Clone(res),
+		expires: now.Add(c.ttl),
+	}
+}
+
 // closePool is a dynamic set of io.Closers to close as a group.
 // It's intended to be Closed at most once.
 //
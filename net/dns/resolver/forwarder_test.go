@@ -27,6 +27,7 @@
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/types/dnstype"
+	"tailscale.com/util/dnsname"
 )
 
 func (rr resolverAndDelay) String() string {
@@ -647,3 +648,118 @@ func TestForwarderTCPFallbackError(t *testing.T) {
 		t.Errorf("wanted errServerFailure, got: %v", err)
 	}
 }
+
+func makeTestQuery(tb testing.TB, id uint16, domain string, rcode dns.RCode, response bool) []byte {
+	builder := dns.NewBuilder(nil, dns.Header{ID: id, Response: response, RCode: rcode})
+	builder.StartQuestions()
+	builder.Question(dns.Question{
+		Name:  dns.MustNewName(domain),
+		Type:  dns.TypeA,
+		Class: dns.ClassINET,
+	})
+	b, err := builder.Finish()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var c responseCache
+	if c.matches("foo.example.com.") {
+		t.Fatal("zero responseCache matches")
+	}
+	c.setConfig([]string{"*.Example.com", "exact.test."}, time.Minute)
+
+	for name, want := range map[dnsname.FQDN]bool{
+		"foo.example.com.":   true,
+		"a.b.example.com.":   true,
+		"example.com.":       false,
+		"exact.test.":        true,
+		"sub.exact.test.":    false,
+		"foo.example.org.":   false,
+		"fooexample.com.":    false,
+		"foo.example.com.x.": false,
+	} {
+		if got := c.matches(name); got != want {
+			t.Errorf("matches(%q) = %v; want %v", name, got, want)
+		}
+	}
+
+	query := makeTestQuery(t, 1, "foo.example.com.", dns.RCodeSuccess, false)
+	res := makeTestQuery(t, 1, "foo.example.com.", dns.RCodeSuccess, true)
+	if _, ok := c.get(query, now); ok {
+		t.Fatal("get on empty cache succeeded")
+	}
+	c.put(query, makeTestQuery(t, 1, "foo.example.com.", dns.RCodeServerFailure, true), now)
+	if _, ok := c.get(query, now); ok {
+		t.Fatal("SERVFAIL response was cached")
+	}
+	c.put(query, res, now)
+
+	// A later query with a different ID and case gets the cached response
+	// with its own ID.
+	query2 := makeTestQuery(t, 2, "FOO.example.com.", dns.RCodeSuccess, false)
+	got, ok := c.get(query2, now.Add(time.Minute-time.Second))
+	if !ok {
+		t.Fatal("cached response not found")
+	}
+	if id := binary.BigEndian.Uint16(got); id != 2 {
+		t.Errorf("cached response ID = %d; want 2", id)
+	}
+	if !bytes.Equal(got[2:], res[2:]) {
+		t.Errorf("cached response = %x; want %x", got, res)
+	}
+	if _, ok := c.get(query, now.Add(time.Minute)); ok {
+		t.Error("expired response returned")
+	}
+
+	// Reapplying the same config keeps cached responses; changing it drops them.
+	c.put(query, res, now)
+	c.setConfig([]string{"*.example.com", "exact.test"}, time.Minute)
+	if _, ok := c.get(query, now); !ok {
+		t.Error("unchanged config dropped cached responses")
+	}
+	c.setConfig([]string{"*.example.com"}, time.Minute)
+	if _, ok := c.get(query, now); ok {
+		t.Error("changed config kept cached responses")
+	}
+}
+
+func TestForwarderCache(t *testing.T) {
+	const domain = "cached.example.com."
+	request := makeTestQuery(t, 0, domain, dns.RCodeSuccess, false)
+	response := makeTestQuery(t, 0, domain, dns.RCodeSuccess, true)
+
+	var requests atomic.Int32
+	port := runDNSServer(t, nil, response, func(isTCP bool, gotRequest []byte) {
+		requests.Add(1)
+	})
+
+	netMon, err := netmon.New(t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialer tsdial.Dialer
+	dialer.SetNetMon(netMon)
+	fwd := newForwarder(t.Logf, netMon, nil, &dialer, nil)
+	defer fwd.Close()
+	fwd.setRoutes(map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: fmt.Sprintf("127.0.0.1:%d", port)}},
+	})
+	fwd.setCache([]string{"*.example.com"}, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		ch := make(chan packet, 1)
+		if err := fwd.forwardWithDestChan(context.Background(), packet{bytes.Clone(request), "udp", netip.AddrPort{}}, ch); err != nil {
+			t.Fatal(err)
+		}
+		if got := (<-ch).bs; !bytes.Equal(got, response) {
+			t.Fatalf("query %d: response = %x; want %x", i, got, response)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream saw %d requests; want 1", n)
+	}
+}
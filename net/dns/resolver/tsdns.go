@@ -76,6 +76,15 @@ type Config struct {
 	// LocalDomains is a list of DNS name suffixes that should not be
 	// routed to upstream resolvers.
 	LocalDomains []dnsname.FQDN
+	// CacheDomains are glob patterns (see path.Match) of DNS names,
+	// without a trailing dot, whose forwarded responses are cached
+	// for CacheTTL.
+	CacheDomains []string
+	// CacheTTL is how long responses for CacheDomains are cached.
+	CacheTTL time.Duration
+	// TTLOverride, if non-zero, replaces the TTL of every record in
+	// responses returned by Query, both local and forwarded.
+	TTLOverride time.Duration
 }
 
 // WriteToBufioWriter write a debug version of c for logs to w, omitting
@@ -197,6 +206,7 @@ type Resolver struct {
 	localDomains []dnsname.FQDN
 	hostToIP     map[dnsname.FQDN][]netip.Addr
 	ipToHost     map[netip.Addr]dnsname.FQDN
+	ttlOverride  time.Duration // or zero; see Config.TTLOverride
 }
 
 type ForwardLinkSelector interface {
@@ -240,12 +250,14 @@ func (r *Resolver) SetConfig(cfg Config) error {
 	}
 
 	r.forwarder.setRoutes(cfg.Routes)
+	r.forwarder.setCache(cfg.CacheDomains, cfg.CacheTTL)
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.localDomains = cfg.LocalDomains
 	r.hostToIP = cfg.Hosts
 	r.ipToHost = reverse
+	r.ttlOverride = cfg.TTLOverride
 	return nil
 }
 
@@ -295,10 +307,43 @@ func (r *Resolver) Query(ctx context.Context, bs []byte, family string, from net
 				return nil, err
 			}
 		}
-		return (<-responses).bs, nil
+		out = (<-responses).bs
 	}
+	if err != nil {
+		return out, err
+	}
+
+	r.mu.Lock()
+	ttl := r.ttlOverride
+	r.mu.Unlock()
+	if ttl > 0 {
+		out = setResponseTTLs(out, ttl)
+	}
+	return out, nil
+}
 
-	return out, err
+// setResponseTTLs returns a copy of the DNS response bs with the TTL of
+// every resource record set to ttl. OPT pseudo-records are left alone, as
+// their TTL field holds EDNS flags rather than a TTL. If bs can't be
+// parsed, it's returned unchanged.
+func setResponseTTLs(bs []byte, ttl time.Duration) []byte {
+	var msg dns.Message
+	if err := msg.Unpack(bs); err != nil {
+		return bs
+	}
+	secs := uint32(ttl / time.Second)
+	for _, rrs := range [][]dns.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range rrs {
+			if rrs[i].Header.Type != dns.TypeOPT {
+				rrs[i].Header.TTL = secs
+			}
+		}
+	}
+	out, err := msg.Pack()
+	if err != nil {
+		return bs
+	}
+	return out
 }
 
 // parseExitNodeQuery parses a DNS request packet.
@@ -1299,6 +1344,7 @@ func unARPA(a string) (ipStr string, ok bool) {
 
 	metricDNSFwd                     = clientmetric.NewCounter("dns_query_fwd")
 	metricDNSFwdDropBonjour          = clientmetric.NewCounter("dns_query_fwd_drop_bonjour")
+	metricDNSFwdCacheHit             = clientmetric.NewCounter("dns_query_fwd_cache_hit")
 	metricDNSFwdErrorName            = clientmetric.NewCounter("dns_query_fwd_error_name")
 	metricDNSFwdErrorNoUpstream      = clientmetric.NewCounter("dns_query_fwd_error_no_upstream")
 	metricDNSFwdSuccess              = clientmetric.NewCounter("dns_query_fwd_success")
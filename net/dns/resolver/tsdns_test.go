@@ -16,6 +16,7 @@
 	"net/netip"
 	"reflect"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
@@ -29,6 +30,7 @@
 	"tailscale.com/tstest"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/util/dnsname"
+	"tailscale.com/util/must"
 )
 
 var (
@@ -901,6 +903,84 @@ func TestFull(t *testing.T) {
 	}
 }
 
+func TestTTLOverride(t *testing.T) {
+	server := serveDNS(t, "127.0.0.1:0",
+		"test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."))
+	defer server.Shutdown()
+
+	r := newResolver(t)
+	defer r.Close()
+
+	answerTTLs := func(query []byte) []uint32 {
+		t.Helper()
+		res, err := syncRespond(r, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg dns.Message
+		if err := msg.Unpack(res); err != nil {
+			t.Fatal(err)
+		}
+		var ttls []uint32
+		for _, rr := range msg.Answers {
+			ttls = append(ttls, rr.Header.TTL)
+		}
+		return ttls
+	}
+	local := dnspacket("test1.ipn.dev.", dns.TypeA, noEdns)
+	forwarded := dnspacket("test.site.", dns.TypeA, noEdns)
+
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]*dnstype.Resolver{
+		".": {{Addr: server.PacketConn.LocalAddr().String()}},
+	}
+	r.SetConfig(cfg)
+	if got, want := answerTTLs(local), []uint32{uint32(defaultTTL / time.Second)}; !slices.Equal(got, want) {
+		t.Errorf("local TTLs without override = %v; want %v", got, want)
+	}
+	if got, want := answerTTLs(forwarded), []uint32{0}; !slices.Equal(got, want) {
+		t.Errorf("forwarded TTLs without override = %v; want %v", got, want)
+	}
+
+	cfg.TTLOverride = 30 * time.Second
+	r.SetConfig(cfg)
+	if got, want := answerTTLs(local), []uint32{30}; !slices.Equal(got, want) {
+		t.Errorf("local TTLs = %v; want %v", got, want)
+	}
+	if got, want := answerTTLs(forwarded), []uint32{30}; !slices.Equal(got, want) {
+		t.Errorf("forwarded TTLs = %v; want %v", got, want)
+	}
+}
+
+func TestSetResponseTTLs(t *testing.T) {
+	b := dns.NewBuilder(nil, dns.Header{Response: true})
+	b.EnableCompression()
+	must.Do(b.StartQuestions())
+	name := dns.MustNewName("example.com.")
+	must.Do(b.Question(dns.Question{Name: name, Type: dns.TypeA, Class: dns.ClassINET}))
+	must.Do(b.StartAnswers())
+	must.Do(b.AResource(dns.ResourceHeader{Name: name, Class: dns.ClassINET, TTL: 86400}, dns.AResource{A: [4]byte{1, 2, 3, 4}}))
+	must.Do(b.StartAdditionals())
+	var opt dns.ResourceHeader
+	must.Do(opt.SetEDNS0(1232, dns.RCodeSuccess, true))
+	must.Do(b.OPTResource(opt, dns.OPTResource{}))
+	res := must.Get(b.Finish())
+
+	var msg dns.Message
+	must.Do(msg.Unpack(setResponseTTLs(res, time.Minute)))
+	if got := msg.Answers[0].Header.TTL; got != 60 {
+		t.Errorf("answer TTL = %d; want 60", got)
+	}
+	if got, want := msg.Additionals[0].Header.TTL, opt.TTL; got != want {
+		t.Errorf("OPT TTL = %#x; want unchanged %#x", got, want)
+	}
+
+	bogus := []byte("not a DNS message")
+	if got := setResponseTTLs(bogus, time.Minute); !bytes.Equal(got, bogus) {
+		t.Errorf("setResponseTTLs(bogus) = %q; want unchanged", got)
+	}
+}
+
 func TestAllocs(t *testing.T) {
 	r := newResolver(t)
 	defer r.Close()
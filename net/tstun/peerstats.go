@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tstun
+
+import (
+	"maps"
+	"net/netip"
+	"sync"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
+)
+
+// PeerCounts are the number of packets exchanged with a remote address.
+type PeerCounts struct {
+	TxPackets uint64 // sent to the address
+	RxPackets uint64 // received from the address
+}
+
+// PeerStats counts the packets to and from each remote Tailscale IP that
+// pass the packet filter. Other addresses, such as those reached through an
+// exit node or subnet router, are not counted, which keeps the number of
+// tracked addresses bounded by the size of the tailnet. It is safe for
+// concurrent use.
+type PeerStats struct {
+	mu sync.Mutex
+	m  map[netip.Addr]PeerCounts
+}
+
+// NewPeerStats returns a new, empty PeerStats.
+func NewPeerStats() *PeerStats {
+	return &PeerStats{m: map[netip.Addr]PeerCounts{}}
+}
+
+// countIn counts p as received from its source address, if that is a
+// Tailscale IP.
+func (s *PeerStats) countIn(p *packet.Parsed) {
+	addr := p.Src.Addr()
+	if !tsaddr.IsTailscaleIP(addr) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.m[addr]
+	c.RxPackets++
+	s.m[addr] = c
+}
+
+// countOut counts p as sent to its destination address, if that is a
+// Tailscale IP.
+func (s *PeerStats) countOut(p *packet.Parsed) {
+	addr := p.Dst.Addr()
+	if !tsaddr.IsTailscaleIP(addr) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.m[addr]
+	c.TxPackets++
+	s.m[addr] = c
+}
+
+// Snapshot returns a copy of the counts so far, by remote address.
+func (s *PeerStats) Snapshot() map[netip.Addr]PeerCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.m)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package tstun
+
+import (
+	"net/netip"
+	"sync"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/rate"
+)
+
+// maxShaperPacketSize is the smallest burst size a Shaper uses, so that
+// any single packet can get through an idle bucket.
+const maxShaperPacketSize = 64 << 10
+
+// maxShaperAddrs is the number of remote addresses a Shaper tracks per
+// direction before it starts over with fresh buckets.
+const maxShaperAddrs = 4096
+
+// Shaper limits the bandwidth of packets to and from each remote address
+// with a token bucket per address and direction. Packets over the limit are
+// dropped. It is safe for concurrent use.
+type Shaper struct {
+	download, upload rate.Limit // bytes per second, or 0 for unlimited
+	burst            int        // bytes
+
+	mu  sync.Mutex
+	in  map[netip.Addr]*rate.Limiter // by source address
+	out map[netip.Addr]*rate.Limiter // by destination address
+}
+
+// NewShaper returns a Shaper limiting packets received from each remote
+// address to downloadKbps and packets sent to each remote address to
+// uploadKbps, in kilobits per second. A zero rate is unlimited. burstKb is
+// the bucket size in kilobits; if zero, it is one second of the higher
+// rate. The burst is always at least enough for the largest packet.
+func NewShaper(downloadKbps, uploadKbps, burstKb uint32) *Shaper {
+	burst := int(burstKb) * 1000 / 8
+	if burstKb == 0 {
+		burst = int(max(downloadKbps, uploadKbps)) * 1000 / 8
+	}
+	return &Shaper{
+		download: rate.Limit(downloadKbps) * 1000 / 8,
+		upload:   rate.Limit(uploadKbps) * 1000 / 8,
+		burst:    max(burst, maxShaperPacketSize),
+		in:       map[netip.Addr]*rate.Limiter{},
+		out:      map[netip.Addr]*rate.Limiter{},
+	}
+}
+
+// allow reports whether a packet of size bytes to or from addr fits within
+// the limit r, using and updating the bucket for addr in m.
+func (s *Shaper) allow(m map[netip.Addr]*rate.Limiter, r rate.Limit, addr netip.Addr, size int) bool {
+	if r == 0 {
+		return true
+	}
+	s.mu.Lock()
+	lim, ok := m[addr]
+	if !ok {
+		if len(m) >= maxShaperAddrs {
+			clear(m)
+		}
+		lim = rate.NewLimiter(r, s.burst)
+		m[addr] = lim
+	}
+	s.mu.Unlock()
+	return lim.AllowN(size)
+}
+
+// AllowIn reports whether p, received from a peer, is within the download
+// limit for its source address.
+func (s *Shaper) AllowIn(p *packet.Parsed) bool {
+	return s.allow(s.in, s.download, p.Src.Addr(), len(p.Buffer()))
+}
+
+// AllowOut reports whether p, about to be sent to a peer, is within the
+// upload limit for its destination address.
+func (s *Shaper) AllowOut(p *packet.Parsed) bool {
+	return s.allow(s.out, s.upload, p.Dst.Addr(), len(p.Buffer()))
+}
@@ -156,6 +156,12 @@ type Wrapper struct {
 	// filterFlags control the verbosity of logging packet drops/accepts.
 	filterFlags filter.RunFlags
 
+	// shaper, if non-nil, rate limits packets that the filter accepted.
+	shaper atomic.Pointer[Shaper]
+
+	// peerStats, if non-nil, counts packets that the filter accepted.
+	peerStats atomic.Pointer[PeerStats]
+
 	// PreFilterPacketInboundFromWireGuard is the inbound filter function that runs before the main filter
 	// and therefore sees the packets that may be later dropped by it.
 	PreFilterPacketInboundFromWireGuard FilterFunc
@@ -833,6 +839,14 @@ func (t *Wrapper) filterPacketOutboundToWireGuard(p *packet.Parsed) filter.Respo
 		return filter.Drop
 	}
 
+	if s := t.shaper.Load(); s != nil && !s.AllowOut(p) {
+		metricPacketOutDropShaper.Add(1)
+		return filter.Drop
+	}
+	if s := t.peerStats.Load(); s != nil {
+		s.countOut(p)
+	}
+
 	if t.PostFilterPacketOutboundToWireGuard != nil {
 		if res := t.PostFilterPacketOutboundToWireGuard(p, t); res.IsDrop() {
 			return res
@@ -1046,6 +1060,14 @@ func (t *Wrapper) filterPacketInboundFromWireGuard(p *packet.Parsed, captHook ca
 		return filter.Drop
 	}
 
+	if s := t.shaper.Load(); s != nil && !s.AllowIn(p) {
+		metricPacketInDropShaper.Add(1)
+		return filter.Drop
+	}
+	if s := t.peerStats.Load(); s != nil {
+		s.countIn(p)
+	}
+
 	if t.PostFilterPacketInboundFromWireGaurd != nil {
 		if res := t.PostFilterPacketInboundFromWireGaurd(p, t); res.IsDrop() {
 			return res
@@ -1105,6 +1127,18 @@ func (t *Wrapper) SetFilter(filt *filter.Filter) {
 	t.filter.Store(filt)
 }
 
+// SetShaper sets the rate limiter applied to packets accepted by the
+// filter. A nil Shaper disables rate limiting.
+func (t *Wrapper) SetShaper(s *Shaper) {
+	t.shaper.Store(s)
+}
+
+// SetPeerStats sets the per-address counters for packets accepted by the
+// filter. A nil PeerStats disables counting.
+func (t *Wrapper) SetPeerStats(s *PeerStats) {
+	t.peerStats.Store(s)
+}
+
 // InjectInboundPacketBuffer makes the Wrapper device behave as if a packet
 // with the given contents was received from the network.
 // It takes ownership of one reference count on the packet. The injected
@@ -1259,11 +1293,13 @@ func (t *Wrapper) SetStatistics(stats *connstats.Statistics) {
 	metricPacketInDrop          = clientmetric.NewCounter("tstun_in_from_wg_drop")
 	metricPacketInDropFilter    = clientmetric.NewCounter("tstun_in_from_wg_drop_filter")
 	metricPacketInDropSelfDisco = clientmetric.NewCounter("tstun_in_from_wg_drop_self_disco")
+	metricPacketInDropShaper    = clientmetric.NewCounter("tstun_in_from_wg_drop_shaper")
 
 	metricPacketOut              = clientmetric.NewCounter("tstun_out_to_wg")
 	metricPacketOutDrop          = clientmetric.NewCounter("tstun_out_to_wg_drop")
 	metricPacketOutDropFilter    = clientmetric.NewCounter("tstun_out_to_wg_drop_filter")
 	metricPacketOutDropSelfDisco = clientmetric.NewCounter("tstun_out_to_wg_drop_self_disco")
+	metricPacketOutDropShaper    = clientmetric.NewCounter("tstun_out_to_wg_drop_shaper")
 )
 
 func (t *Wrapper) InstallCaptureHook(cb capture.Callback) {
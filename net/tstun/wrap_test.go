@@ -911,3 +911,95 @@ type captureRecord struct {
 			captured, want)
 	}
 }
+
+func TestShaper(t *testing.T) {
+	udp4Big := func(src, dst string) *packet.Parsed {
+		header := &packet.UDP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netip.MustParseAddr(src),
+				Dst: netip.MustParseAddr(dst),
+			},
+			SrcPort: 123,
+			DstPort: 456,
+		}
+		p := new(packet.Parsed)
+		p.Decode(packet.Generate(header, make([]byte, 1000)))
+		return p
+	}
+
+	// 64 kbps is 8000 bytes/sec, so the 64 KiB minimum burst is what
+	// limits a quick run of packets.
+	s := NewShaper(64, 0, 0)
+	const n = 100
+	countIn := func(p *packet.Parsed) (allowed int) {
+		for i := 0; i < n; i++ {
+			if s.AllowIn(p) {
+				allowed++
+			}
+		}
+		return allowed
+	}
+
+	p1 := udp4Big("1.2.3.4", "100.64.0.1")
+	size := len(p1.Buffer())
+	wantMax := maxShaperPacketSize/size + 1
+	if got := countIn(p1); got < wantMax-2 || got > wantMax {
+		t.Errorf("allowed %d packets of %d bytes from a fresh bucket; want about %d", got, size, wantMax)
+	}
+	if s.AllowIn(p1) {
+		t.Errorf("packet allowed after bucket was drained")
+	}
+
+	// Buckets are per remote address.
+	p2 := udp4Big("5.6.7.8", "100.64.0.1")
+	if !s.AllowIn(p2) {
+		t.Errorf("packet from a different source was dropped")
+	}
+
+	// A zero rate is unlimited.
+	out := udp4Big("100.64.0.1", "1.2.3.4")
+	for i := 0; i < n; i++ {
+		if !s.AllowOut(out) {
+			t.Fatalf("outbound packet %d dropped with no upload limit", i)
+		}
+	}
+}
+
+func TestPeerStats(t *testing.T) {
+	udp := func(src, dst string) *packet.Parsed {
+		header := &packet.UDP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netip.MustParseAddr(src),
+				Dst: netip.MustParseAddr(dst),
+			},
+			SrcPort: 123,
+			DstPort: 456,
+		}
+		p := new(packet.Parsed)
+		p.Decode(packet.Generate(header, []byte("payload")))
+		return p
+	}
+	self, peer1, peer2 := "100.64.0.1", "100.64.0.2", "100.64.0.3"
+
+	s := NewPeerStats()
+	s.countIn(udp(peer1, self))
+	s.countIn(udp(peer1, self))
+	s.countOut(udp(self, peer1))
+	s.countOut(udp(self, peer2))
+	s.countOut(udp(self, "8.8.8.8")) // via an exit node; not counted
+
+	snap := s.Snapshot()
+	want := map[netip.Addr]PeerCounts{
+		netip.MustParseAddr(peer1): {TxPackets: 1, RxPackets: 2},
+		netip.MustParseAddr(peer2): {TxPackets: 1},
+	}
+	if !reflect.DeepEqual(snap, want) {
+		t.Errorf("Snapshot = %v; want %v", snap, want)
+	}
+
+	// Later counts don't change an earlier snapshot.
+	s.countIn(udp(peer2, self))
+	if got := snap[netip.MustParseAddr(peer2)]; got.RxPackets != 0 {
+		t.Errorf("snapshot changed after Snapshot: %+v", got)
+	}
+}
@@ -24,6 +24,7 @@
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,6 +34,7 @@
 
 	gossh "github.com/tailscale/golang-x-crypto/ssh"
 	"tailscale.com/envknob"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/tsaddr"
@@ -70,6 +72,7 @@ type ipnLocalBackend interface {
 	Dialer() *tsdial.Dialer
 	TailscaleVarRoot() string
 	NodeKey() key.NodePublic
+	Prefs() ipn.PrefsView
 }
 
 type server struct {
@@ -112,19 +115,80 @@ func init() {
 	})
 }
 
+var (
+	errServerShutdown  = errors.New("tailscale SSH is shutting down")
+	errTooManySessions = errors.New("too many concurrent Tailscale SSH sessions")
+)
+
 // attachSessionToConnIfNotShutdown ensures that srv is not shutdown before
 // attaching the session to the conn. This ensures that once Shutdown is called,
 // new sessions are not allowed and existing ones are cleaned up.
-// It reports whether ss was attached to the conn.
-func (srv *server) attachSessionToConnIfNotShutdown(ss *sshSession) bool {
+//
+// It also enforces Prefs.TailscaleSSHMaxSessions, refusing to attach ss if
+// the node already has that many sessions running.
+//
+// It returns nil if ss was attached to the conn.
+func (srv *server) attachSessionToConnIfNotShutdown(ss *sshSession) error {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	if srv.shutdownCalled {
 		// Do not start any new sessions.
-		return false
+		return errServerShutdown
+	}
+	if limit := srv.maxSessions(); limit > 0 && srv.numSessionsLocked() >= limit {
+		return errTooManySessions
 	}
 	ss.conn.attachSession(ss)
-	return true
+	return nil
+}
+
+// maxSessions returns the maximum number of concurrent sessions permitted by
+// the current prefs, or 0 if there is no limit.
+func (srv *server) maxSessions() int {
+	if p := srv.lb.Prefs(); p.Valid() {
+		return p.TailscaleSSHMaxSessions()
+	}
+	return 0
+}
+
+// requireCertAuth reports whether the current prefs require clients to
+// authenticate with an SSH user certificate.
+func (srv *server) requireCertAuth() bool {
+	if p := srv.lb.Prefs(); p.Valid() {
+		return p.SSHCertAuth()
+	}
+	return false
+}
+
+// userCertAuthorities returns the CA keys trusted to sign SSH user
+// certificates, parsed from Prefs.SSHTrustedUserCAKeys. Entries that fail to
+// parse are logged and skipped.
+func (srv *server) userCertAuthorities() []gossh.PublicKey {
+	p := srv.lb.Prefs()
+	if !p.Valid() {
+		return nil
+	}
+	var cas []gossh.PublicKey
+	for _, k := range p.SSHTrustedUserCAKeys().AsSlice() {
+		ca, _, _, _, err := gossh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			srv.logf("ignoring invalid SSHTrustedUserCAKeys entry %q: %v", k, err)
+			continue
+		}
+		cas = append(cas, ca)
+	}
+	return cas
+}
+
+// numSessionsLocked returns the number of sessions attached to all active
+// conns. srv.mu must be held.
+func (srv *server) numSessionsLocked() (n int) {
+	for c := range srv.activeConns {
+		c.mu.Lock()
+		n += len(c.sessions)
+		c.mu.Unlock()
+	}
+	return n
 }
 
 func (srv *server) trackActiveConn(c *conn, add bool) {
@@ -293,6 +357,9 @@ func (c *conn) NoClientAuthCallback(ctx ssh.Context) error {
 	if c.insecureSkipTailscaleAuth {
 		return nil
 	}
+	if c.srv.requireCertAuth() {
+		return errPubKeyRequired
+	}
 	if err := c.doPolicyAuth(ctx, nil /* no pub key */); err != nil {
 		return err
 	}
@@ -338,6 +405,12 @@ func (c *conn) fakePasswordHandler(ctx ssh.Context, password string) bool {
 // PublicKeyHandler implements ssh.PublicKeyHandler is called by the
 // ssh.Server when the client presents a public key.
 func (c *conn) PublicKeyHandler(ctx ssh.Context, pubKey ssh.PublicKey) error {
+	if c.srv.requireCertAuth() {
+		if err := c.checkCertAuth(ctx, pubKey); err != nil {
+			c.logf("rejecting SSH public key %s: %v", bytes.TrimSpace(gossh.MarshalAuthorizedKey(pubKey)), err)
+			return err
+		}
+	}
 	if err := c.doPolicyAuth(ctx, pubKey); err != nil {
 		// TODO(maisem/bradfitz): surface the error here.
 		c.logf("rejecting SSH public key %s: %v", bytes.TrimSpace(gossh.MarshalAuthorizedKey(pubKey)), err)
@@ -350,6 +423,49 @@ func (c *conn) PublicKeyHandler(ctx ssh.Context, pubKey ssh.PublicKey) error {
 	return nil
 }
 
+// errCertRequired is returned by checkUserCert when the client presented a
+// plain public key but Prefs.SSHCertAuth requires a certificate.
+var errCertRequired = fmt.Errorf("%w: SSH user certificate required", gossh.ErrDenied)
+
+// checkCertAuth returns nil if pubKey is an SSH user certificate that
+// passes checkUserCert for the SSH user requested in ctx, as required by
+// Prefs.SSHCertAuth.
+func (c *conn) checkCertAuth(ctx ssh.Context, pubKey ssh.PublicKey) error {
+	cert, ok := pubKey.(*gossh.Certificate)
+	if !ok {
+		return errCertRequired
+	}
+	sshUser := strings.TrimSuffix(ctx.User(), forcePasswordSuffix)
+	return checkUserCert(cert, sshUser, c.srv.userCertAuthorities(), c.srv.now())
+}
+
+// checkUserCert returns nil if cert is an SSH user certificate signed by one
+// of cas, valid at now and issued for the principal sshUser. If cas is empty,
+// every certificate is rejected.
+func checkUserCert(cert *gossh.Certificate, sshUser string, cas []gossh.PublicKey, now time.Time) error {
+	if cert.CertType != gossh.UserCert {
+		return fmt.Errorf("%w: certificate is not a user certificate", gossh.ErrDenied)
+	}
+	if len(cas) == 0 {
+		return fmt.Errorf("%w: no trusted SSH user certificate authorities configured", gossh.ErrDenied)
+	}
+	checker := &gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			return slices.ContainsFunc(cas, func(ca gossh.PublicKey) bool {
+				return bytes.Equal(ca.Marshal(), auth.Marshal())
+			})
+		},
+		Clock: func() time.Time { return now },
+	}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return fmt.Errorf("%w: certificate signed by untrusted authority", gossh.ErrDenied)
+	}
+	if err := checker.CheckCert(sshUser, cert); err != nil {
+		return fmt.Errorf("%w: %v", gossh.ErrDenied, err)
+	}
+	return nil
+}
+
 // doPolicyAuth verifies that conn can proceed with the specified (optional)
 // pubKey. It returns nil if the matching policy action is Accept or
 // HoldAndDelegate. If pubKey is nil, there was no policy match but there is a
@@ -1033,8 +1149,11 @@ func (ss *sshSession) run() {
 	defer metricActiveSessions.Add(-1)
 	defer ss.cancelCtx(errSessionDone)
 
-	if attached := ss.conn.srv.attachSessionToConnIfNotShutdown(ss); !attached {
-		fmt.Fprintf(ss, "Tailscale SSH is shutting down\r\n")
+	if err := ss.conn.srv.attachSessionToConnIfNotShutdown(ss); err != nil {
+		if err == errTooManySessions {
+			ss.logf("rejecting session: %v", err)
+		}
+		fmt.Fprintf(ss, "%v\r\n", err)
 		ss.Exit(1)
 		return
 	}
@@ -32,6 +32,7 @@
 	"time"
 
 	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/memnet"
@@ -228,6 +229,9 @@ func timePtr(t time.Time) *time.Time { return &t }
 type localState struct {
 	sshEnabled   bool
 	matchingRule *tailcfg.SSHRule
+	maxSessions  int
+	certAuth     bool
+	trustedCAs   []string
 
 	// serverActions is a map of the action name to the action.
 	// It is served for paths like https://unused/ssh-action/<action-name>.
@@ -284,11 +288,11 @@ func (ts *localState) NetMap() *netmap.NetworkMap {
 
 func (ts *localState) WhoIs(ipp netip.AddrPort) (n tailcfg.NodeView, u tailcfg.UserProfile, ok bool) {
 	return (&tailcfg.Node{
-			ID:       2,
-			StableID: "peer-id",
-		}).View(), tailcfg.UserProfile{
-			LoginName: "peer",
-		}, true
+		ID:       2,
+		StableID: "peer-id",
+	}).View(), tailcfg.UserProfile{
+		LoginName: "peer",
+	}, true
 
 }
 
@@ -318,6 +322,15 @@ func (ts *localState) NodeKey() key.NodePublic {
 	return key.NewNode().Public()
 }
 
+func (ts *localState) Prefs() ipn.PrefsView {
+	return (&ipn.Prefs{
+		RunSSH:                  ts.sshEnabled,
+		TailscaleSSHMaxSessions: ts.maxSessions,
+		SSHCertAuth:             ts.certAuth,
+		SSHTrustedUserCAKeys:    ts.trustedCAs,
+	}).View()
+}
+
 func newSSHRule(action *tailcfg.SSHAction) *tailcfg.SSHRule {
 	return &tailcfg.SSHRule{
 		SSHUsers: map[string]string{
@@ -332,6 +345,64 @@ func newSSHRule(action *tailcfg.SSHAction) *tailcfg.SSHRule {
 	}
 }
 
+func TestMaxSessions(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxSessions int
+		attach      int
+		wantErr     error
+	}{
+		{name: "unlimited", maxSessions: 0, attach: 50, wantErr: nil},
+		{name: "under_limit", maxSessions: 3, attach: 2, wantErr: nil},
+		{name: "at_limit", maxSessions: 3, attach: 3, wantErr: errTooManySessions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &server{
+				logf: t.Logf,
+				lb:   &localState{sshEnabled: true, maxSessions: tt.maxSessions},
+			}
+			c1 := &conn{srv: srv}
+			c2 := &conn{srv: srv}
+			srv.trackActiveConn(c1, true)
+			srv.trackActiveConn(c2, true)
+
+			var attached []*sshSession
+			for i := 0; i < tt.attach; i++ {
+				c := c1
+				if i%2 == 1 {
+					c = c2 // spread sessions across conns
+				}
+				ss := &sshSession{conn: c, sharedID: fmt.Sprintf("sess-%d", i)}
+				if err := srv.attachSessionToConnIfNotShutdown(ss); err != nil {
+					t.Fatalf("attach %d: %v", i, err)
+				}
+				attached = append(attached, ss)
+			}
+
+			extra := &sshSession{conn: c1, sharedID: "extra"}
+			err := srv.attachSessionToConnIfNotShutdown(extra)
+			if err != tt.wantErr {
+				t.Fatalf("attach extra = %v; want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				attached = append(attached, extra)
+			} else {
+				// Freeing a slot permits a new session.
+				attached[0].conn.detachSession(attached[0])
+				attached = attached[1:]
+				if err := srv.attachSessionToConnIfNotShutdown(extra); err != nil {
+					t.Fatalf("attach after detach: %v", err)
+				}
+				attached = append(attached, extra)
+			}
+			for _, ss := range attached {
+				ss.conn.detachSession(ss)
+			}
+		})
+	}
+}
+
 func TestSSHRecordingCancelsSessionsOnUploadFailure(t *testing.T) {
 	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
 		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
@@ -1159,3 +1230,107 @@ func TestStdOsUserUserAssumptions(t *testing.T) {
 		t.Errorf("os/user.User has %v fields; this package assumes %v", got, want)
 	}
 }
+
+func TestCertAuth(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	newSigner := func() gossh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return must.Get(gossh.NewSignerFromKey(priv))
+	}
+	caSigner := newSigner()
+	otherCASigner := newSigner()
+	userPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainKey := must.Get(gossh.NewPublicKey(userPub))
+
+	newCert := func(signer gossh.Signer, certType uint32, principal string, validAfter, validBefore uint64) *gossh.Certificate {
+		cert := &gossh.Certificate{
+			Key:             plainKey,
+			CertType:        certType,
+			ValidPrincipals: []string{principal},
+			ValidAfter:      validAfter,
+			ValidBefore:     validBefore,
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	unix := uint64(now.Unix())
+	cas := []gossh.PublicKey{caSigner.PublicKey()}
+
+	tests := []struct {
+		name    string
+		cert    *gossh.Certificate
+		cas     []gossh.PublicKey
+		wantErr bool
+	}{
+		{"user_cert", newCert(caSigner, gossh.UserCert, "alice", unix-60, unix+60), cas, false},
+		{"user_cert_forever", newCert(caSigner, gossh.UserCert, "alice", 0, gossh.CertTimeInfinity), cas, false},
+		{"host_cert", newCert(caSigner, gossh.HostCert, "alice", 0, gossh.CertTimeInfinity), cas, true},
+		{"not_yet_valid", newCert(caSigner, gossh.UserCert, "alice", unix+60, unix+120), cas, true},
+		{"expired", newCert(caSigner, gossh.UserCert, "alice", unix-120, unix), cas, true},
+		{"untrusted_ca", newCert(otherCASigner, gossh.UserCert, "alice", 0, gossh.CertTimeInfinity), cas, true},
+		{"principal_mismatch", newCert(caSigner, gossh.UserCert, "bob", 0, gossh.CertTimeInfinity), cas, true},
+		{"no_trusted_cas", newCert(caSigner, gossh.UserCert, "alice", 0, gossh.CertTimeInfinity), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkUserCert(tt.cert, "alice", tt.cas, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkUserCert = %v; wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, gossh.ErrDenied) {
+				t.Errorf("checkUserCert = %v; want wrapped ErrDenied", err)
+			}
+		})
+	}
+
+	t.Run("trusted_cas_from_prefs", func(t *testing.T) {
+		srv := &server{
+			logf: t.Logf,
+			lb: &localState{
+				sshEnabled: true,
+				certAuth:   true,
+				trustedCAs: []string{
+					"not a key",
+					string(gossh.MarshalAuthorizedKey(caSigner.PublicKey())),
+				},
+			},
+		}
+		got := srv.userCertAuthorities()
+		if len(got) != 1 || !bytes.Equal(got[0].Marshal(), caSigner.PublicKey().Marshal()) {
+			t.Errorf("userCertAuthorities = %v; want just the CA key", got)
+		}
+	})
+
+	t.Run("none_auth", func(t *testing.T) {
+		for _, certAuth := range []bool{false, true} {
+			srv := &server{
+				logf: t.Logf,
+				lb:   &localState{sshEnabled: true, certAuth: certAuth},
+			}
+			if got := srv.requireCertAuth(); got != certAuth {
+				t.Errorf("requireCertAuth = %v; want %v", got, certAuth)
+			}
+			if !certAuth {
+				continue
+			}
+			c := &conn{srv: srv}
+			if err := c.NoClientAuthCallback(nil); err != errPubKeyRequired {
+				t.Errorf("NoClientAuthCallback = %v; want %v", err, errPubKeyRequired)
+			}
+			if c.fakePasswordHandler(nil, "hunter2") {
+				t.Error("password auth accepted with SSHCertAuth set")
+			}
+			if err := c.PublicKeyHandler(nil, plainKey); err != errCertRequired {
+				t.Errorf("PublicKeyHandler(plain key) = %v; want %v", err, errCertRequired)
+			}
+		}
+	})
+}
@@ -51,6 +51,10 @@ type C2NUpdateResponse struct {
 
 	// Started indicates whether the update has started.
 	Started bool
+
+	// Deferred indicates that the update was accepted but is waiting for
+	// the node's auto-update window to open before it starts.
+	Deferred bool `json:",omitempty"`
 }
 
 // C2NPostureIdentityResponse contains either a set of identifying serial number
@@ -63,4 +67,9 @@ type C2NPostureIdentityResponse struct {
 	// PostureDisabled indicates if the machine has opted out of
 	// device posture collection.
 	PostureDisabled bool `json:",omitempty"`
+
+	// PostureCheckPolicy is the posture policy set that the machine
+	// asks to be evaluated against, from its PostureCheckPolicy pref.
+	// It is empty if none is configured or PostureDisabled is true.
+	PostureCheckPolicy string `json:",omitempty"`
 }
@@ -150,6 +150,30 @@ func (u StableNodeID) IsZero() bool {
 	return u == ""
 }
 
+// ErrInvalidNodeID is the error (possibly wrapped) returned by
+// StableNodeID.Validate for a malformed ID.
+var ErrInvalidNodeID = errors.New("invalid StableNodeID")
+
+// maxStableNodeIDLen is the maximum length of a valid StableNodeID.
+const maxStableNodeIDLen = 256
+
+// Validate returns an error wrapping ErrInvalidNodeID if u is not
+// syntactically valid. StableNodeIDs are opaque strings chosen by the
+// control server, so only their shape is checked: a non-zero ID must be
+// at most 256 bytes of printable ASCII without spaces. The zero value is
+// valid and means no node.
+func (u StableNodeID) Validate() error {
+	if len(u) > maxStableNodeIDLen {
+		return fmt.Errorf("%w: %d bytes long, max %d", ErrInvalidNodeID, len(u), maxStableNodeIDLen)
+	}
+	for i := 0; i < len(u); i++ {
+		if c := u[i]; c <= ' ' || c > '~' {
+			return fmt.Errorf("%w: %q", ErrInvalidNodeID, u)
+		}
+	}
+	return nil
+}
+
 // User is an IPN user.
 //
 // A user can have multiple logins associated with it (e.g. gmail and github oauth).
@@ -688,6 +712,11 @@ type Location struct {
 	// A value of 0 means the exit node does not have a priority
 	// preference. A negative int is not allowed.
 	Priority int `json:",omitempty"`
+
+	// Zone is the cloud availability zone the node reports being in, as
+	// set by the node's TailscaleZoneID pref ("us-east-1a"). It is a hint
+	// for latency-aware relay selection.
+	Zone string `json:",omitempty"`
 }
 
 // Hostinfo contains a summary of a Tailscale host.
@@ -575,6 +575,7 @@ func (src *Location) Clone() *Location {
 	City        string
 	CityCode    string
 	Priority    int
+	Zone        string
 }{})
 
 // Clone makes a deep copy of UserProfile.
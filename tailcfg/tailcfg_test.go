@@ -6,6 +6,7 @@
 import (
 	"encoding"
 	"encoding/json"
+	"errors"
 	"net/netip"
 	"os"
 	"reflect"
@@ -604,6 +605,33 @@ func TestNodeEqual(t *testing.T) {
 	}
 }
 
+func TestStableNodeIDValidate(t *testing.T) {
+	tests := []struct {
+		id      StableNodeID
+		wantErr bool
+	}{
+		{"", false},
+		{"n1", false},
+		{"nDEADBEEFCNTRL", false},
+		{"12345", false},
+		{StableNodeID(strings.Repeat("n", 256)), false},
+		{StableNodeID(strings.Repeat("n", 257)), true},
+		{"n 1", true},
+		{"n1\n", true},
+		{"n\x001", true},
+		{"nöde", true},
+	}
+	for _, tt := range tests {
+		err := tt.id.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("StableNodeID(%q).Validate() = %v; want error: %v", tt.id, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidNodeID) {
+			t.Errorf("StableNodeID(%q).Validate() = %v; want ErrInvalidNodeID", tt.id, err)
+		}
+	}
+}
+
 func TestNetInfoFields(t *testing.T) {
 	handled := []string{
 		"MappingVariesByDestIP",
@@ -1373,6 +1373,7 @@ func (v LocationView) CountryCode() string { return v.ж.CountryCode }
 func (v LocationView) City() string        { return v.ж.City }
 func (v LocationView) CityCode() string    { return v.ж.CityCode }
 func (v LocationView) Priority() int       { return v.ж.Priority }
+func (v LocationView) Zone() string        { return v.ж.Zone }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _LocationViewNeedsRegeneration = Location(struct {
@@ -1381,6 +1382,7 @@ func (v LocationView) Priority() int       { return v.ж.Priority }
 	City        string
 	CityCode    string
 	Priority    int
+	Zone        string
 }{})
 
 // View returns a readonly view of UserProfile.
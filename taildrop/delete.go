@@ -6,11 +6,15 @@
 import (
 	"container/list"
 	"context"
+	"errors"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"tailscale.com/syncs"
@@ -18,39 +22,234 @@
 	"tailscale.com/types/logger"
 )
 
-// deleteDelay is the amount of time to wait before we delete a file.
+// deleteDelay is the default amount of time to wait before we delete a
+// file, used when fileDeleter.Init is passed a zero delay.
 // A shorter value ensures timely deletion of deleted and partial files, while
 // a longer value provides more opportunity for partial files to be resumed.
 const deleteDelay = time.Hour
 
-// fileDeleter manages asynchronous deletion of files after deleteDelay.
+// maxRetryDelay caps how long a file whose deletion keeps failing waits
+// between attempts. The wait starts at the delete delay and doubles after
+// each consecutive failure.
+const maxRetryDelay = 24 * time.Hour
+
+// osRemove is os.Remove, overridden by tests.
+var osRemove = os.Remove
+
+// diskFree is diskFreeBytes, overridden by tests.
+var diskFree = diskFreeBytes
+
+// removeFile removes the named file.
+//
+// If the removal fails with EXDEV, as can happen when the Taildrop directory
+// is on a separate mount, the file is instead truncated to zero length to
+// release its contents and is treated as removed.
+func removeFile(path string) error {
+	err := osRemove(path)
+	if errors.Is(err, syscall.EXDEV) {
+		return os.Truncate(path, 0)
+	}
+	return err
+}
+
+// deleterClock is the subset of tstime.Clock used by fileDeleter.
+// tstime.DefaultClock implements it.
+type deleterClock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) (tstime.TimerController, <-chan time.Time)
+}
+
+// normalizeNameForOS returns the function that maps a file name to the
+// name under which the filesystem on goos stores it. File names on Windows
+// and Apple platforms are case-insensitive by default, so they are
+// lowercased there.
+func normalizeNameForOS(goos string) func(string) string {
+	switch goos {
+	case "windows", "darwin", "ios":
+		return strings.ToLower
+	}
+	return func(name string) string { return name }
+}
+
+// fileDeleter manages asynchronous deletion of files after a delay.
 type fileDeleter struct {
-	logf  logger.Logf
-	clock tstime.DefaultClock
-	event func(string) // called for certain events; for testing only
-	dir   string
+	logf      logger.Logf
+	clock     deleterClock
+	event     func(string) // called for certain events; for testing only
+	dir       string
+	baseDelay time.Duration // delete delay passed to Init, or deleteDelay
+
+	// normalizeName maps a file name to its key in byName, so that names
+	// referring to the same file on a case-insensitive filesystem share
+	// a queue entry. If nil when Init is called, it is set to
+	// normalizeNameForOS(runtime.GOOS).
+	normalizeName func(string) string
+
+	// FilterFunc, if non-nil, reports whether the named file should be
+	// managed by the deleter. Files for which it returns false are never
+	// enqueued by Insert. It must be set before Init is called.
+	FilterFunc func(name string) bool
+
+	// IsTransferring, if non-nil, reports whether the named partial file
+	// is currently being written to by an active transfer. Such files are
+	// requeued rather than deleted. It is called with mu held.
+	// It must be set before Init is called.
+	IsTransferring func(baseName string) bool
 
-	mu     sync.Mutex
-	queue  list.List
-	byName map[string]*list.Element
+	// PreDeleteHook, if non-nil, is called with the base name of each
+	// queued file just before it is deleted, such as to record its
+	// metadata. If it returns an error, the file is not deleted on this
+	// pass and is retried after another delete delay. It is called with mu
+	// held. It must be set before Init is called.
+	PreDeleteHook func(baseName string) error
 
-	emptySignal chan struct{} // signal that the queue is empty
+	// PassSummaryFunc, if non-nil, is called at the end of each deletion
+	// pass with the number of files deleted and failed during the pass,
+	// and the number of files still queued afterwards. A file fails if
+	// its PreDeleteHook or its removal returned an error; failed files
+	// remain queued. It is called with mu held. It must be set before
+	// Init is called.
+	PassSummaryFunc func(deleted, failed, remaining int)
+
+	// AfterDeleteHook, if non-nil, is called with the base name of each
+	// queued file just after it is deleted and the number of bytes its
+	// deletion freed, as measured by os.Stat before removal. For a
+	// deleted-marker file, freed includes the size of the file it marks.
+	// A file that was already gone reports 0 bytes. It is called with mu
+	// held. It must be set before Init is called.
+	AfterDeleteHook func(name string, freed int64)
+
+	// MinFreeBytes, if positive, is the free disk space above which
+	// deletion is less urgent: while more than MinFreeBytes are free on
+	// the filesystem holding dir, files stay queued for twice the delete
+	// delay, giving partial files more time to be resumed. If free space
+	// can't be determined, the delete delay is used. It must be set before Init is called.
+	MinFreeBytes int64
+
+	mu          sync.Mutex
+	initialized bool // whether Init has been called
+	dirGone     bool // dir was found missing; nothing is deleted until Init
+	queue       list.List
+	byName      map[string]*list.Element
+	deleted     int64            // files deleted since Init
+	latency     LatencyHistogram // of files deleted since Init
+
+	emptySignal chan struct{}          // signal that the queue is empty
+	timer       tstime.TimerController // of the pending waitAndDelete, if any
+	wakeAt      time.Time              // when timer fires
 	group       syncs.WaitGroup
 	shutdownCtx context.Context
 	shutdown    context.CancelFunc
 }
 
-// deleteFile is a specific file to delete after deleteDelay.
+// deleteFile is a specific file to delete after the delete delay.
 type deleteFile struct {
 	name     string
-	inserted time.Time
+	queued   time.Time // when first inserted
+	inserted time.Time // when inserted or last requeued
+	size     int64     // size when inserted, or -1 if unknown
+	mtime    time.Time // modification time when inserted, or zero if unknown
+
+	// failures counts consecutive failed deletion attempts, and
+	// retryAfter is how long after inserted to wait before the next one,
+	// backing off exponentially. While failures is zero, retryAfter is
+	// zero and the delete delay is used.
+	failures   int
+	retryAfter time.Duration
+}
+
+// wait returns how long after f.inserted f is due for deletion, given the
+// current delete delay.
+func (f *deleteFile) wait(delay time.Duration) time.Duration {
+	if f.retryAfter > 0 {
+		return f.retryAfter
+	}
+	return delay
+}
+
+// backOff records a failed deletion attempt of f, doubling its wait after
+// each consecutive failure, from delay up to maxRetryDelay.
+func (f *deleteFile) backOff(delay time.Duration) {
+	f.failures++
+	wait := delay
+	for i := 1; i < f.failures && wait < maxRetryDelay; i++ {
+		wait *= 2
+	}
+	f.retryAfter = max(min(wait, maxRetryDelay), delay)
 }
 
-func (d *fileDeleter) Init(logf logger.Logf, clock tstime.DefaultClock, event func(string), dir string) {
+// latencyBuckets are the upper bounds of the buckets of a
+// LatencyHistogram, except for the last bucket, which is unbounded.
+var latencyBuckets = [...]time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+	4 * time.Hour,
+}
+
+// LatencyHistogram counts deleted files by the time between their
+// insertion and their deletion. Bucket i counts latencies of at most
+// latencyBuckets[i] (1m, 5m, 30m, 1h, 2h and 4h) that don't fit in an
+// earlier bucket; the last bucket counts latencies over 4h.
+type LatencyHistogram [len(latencyBuckets) + 1]int64
+
+// add records a deletion latency of d.
+func (h *LatencyHistogram) add(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h[i]++
+}
+
+// FileDeleterStats are statistics about a fileDeleter, returned by Stats.
+type FileDeleterStats struct {
+	Queued  int              // files currently queued for deletion
+	Deleted int64            // files deleted since Init
+	Latency LatencyHistogram // deletion latency of the Deleted files
+}
+
+// initSummary counts the files found by the directory scan in Init.
+type initSummary struct {
+	partial int // partial files found
+	deleted int // deleted-marker files found
+	removed int // deleted-marker files removed immediately, with their file
+}
+
+// Init starts the deleter, scanning dir in the background for partial and
+// deleted-marker files to enqueue. Queued files are deleted after delay,
+// or after deleteDelay (one hour) if delay is zero. Calls after the first
+// are no-ops that log a warning, unless the deleter stopped because dir
+// was removed, in which case Init starts it again.
+func (d *fileDeleter) Init(logf logger.Logf, clock deleterClock, event func(string), dir string, delay time.Duration) {
+	d.mu.Lock()
+	if d.initialized && !d.dirGone {
+		d.mu.Unlock()
+		d.logf("warning: taildrop deleter already initialized; ignoring Init(%q)", dir)
+		return
+	}
+	if d.dirGone {
+		d.shutdown() // nothing is running, but release the old context
+		d.dirGone = false
+		d.deleted = 0
+		d.latency = LatencyHistogram{}
+	}
+	d.initialized = true
+	d.mu.Unlock()
+
 	d.logf = logf
 	d.clock = clock
 	d.dir = dir
 	d.event = event
+	d.baseDelay = delay
+	if d.baseDelay <= 0 {
+		d.baseDelay = deleteDelay
+	}
+	if d.normalizeName == nil {
+		d.normalizeName = normalizeNameForOS(runtime.GOOS)
+	}
 
 	// From a cold-start, load the list of partial and deleted files.
 	d.byName = make(map[string]*list.Element)
@@ -59,6 +258,7 @@ func (d *fileDeleter) Init(logf logger.Logf, clock tstime.DefaultClock, event fu
 	d.group.Go(func() {
 		d.event("start init")
 		defer d.event("end init")
+		var sum initSummary
 		rangeDir(dir, func(de fs.DirEntry) bool {
 			switch {
 			case d.shutdownCtx.Err() != nil:
@@ -66,12 +266,15 @@ func (d *fileDeleter) Init(logf logger.Logf, clock tstime.DefaultClock, event fu
 			case !de.Type().IsRegular():
 				return true
 			case strings.Contains(de.Name(), partialSuffix):
+				sum.partial++
 				d.Insert(de.Name())
 			case strings.Contains(de.Name(), deletedSuffix):
+				sum.deleted++
 				// Best-effort immediate deletion of deleted files.
 				name := strings.TrimSuffix(de.Name(), deletedSuffix)
-				if os.Remove(filepath.Join(dir, name)) == nil {
-					if os.Remove(filepath.Join(dir, de.Name())) == nil {
+				if removeFile(filepath.Join(dir, name)) == nil {
+					if removeFile(filepath.Join(dir, de.Name())) == nil {
+						sum.removed++
 						break
 					}
 				}
@@ -80,30 +283,70 @@ func (d *fileDeleter) Init(logf logger.Logf, clock tstime.DefaultClock, event fu
 			}
 			return true
 		})
+		d.logf("taildrop deleter init: found %d partial, %d deleted-marker files; immediately removed %d", sum.partial, sum.deleted, sum.removed)
+		if fi, err := os.Stat(dir); err == nil && fi.Mode().Perm()&0002 != 0 {
+			d.logf("warning: Taildrop directory %q is world-writable (mode %v); other local users can tamper with received files", dir, fi.Mode().Perm())
+		}
 	})
 }
 
 // Insert enqueues baseName for eventual deletion.
+// It is a no-op if baseName is not a plain file name in the managed
+// directory, e.g. if it contains a path separator.
 func (d *fileDeleter) Insert(baseName string) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if d.shutdownCtx.Err() != nil {
+	if d.shutdownCtx.Err() != nil || d.dirGone {
+		return
+	}
+	if baseName == "." || baseName == ".." || filepath.Base(baseName) != baseName {
+		d.logf("warning: not deleting %q: not a file name within the Taildrop directory", baseName)
+		return
+	}
+	if d.FilterFunc != nil && !d.FilterFunc(baseName) {
 		return
 	}
-	if _, ok := d.byName[baseName]; ok {
+	key := d.normalizeName(baseName)
+	if _, ok := d.byName[key]; ok {
 		return // already queued for deletion
 	}
-	d.byName[baseName] = d.queue.PushBack(&deleteFile{baseName, d.clock.Now()})
-	if d.queue.Len() == 1 && d.shutdownCtx.Err() == nil {
-		d.group.Go(func() { d.waitAndDelete(deleteDelay) })
+	now := d.clock.Now()
+	size, mtime := d.fileInfo(baseName)
+	d.byName[key] = d.queue.PushBack(&deleteFile{
+		name:     baseName,
+		queued:   now,
+		inserted: now,
+		size:     size,
+		mtime:    mtime,
+	})
+	if d.shutdownCtx.Err() != nil {
+		return
 	}
+	delay := d.delay()
+	switch {
+	case d.queue.Len() == 1:
+		d.scheduleLocked(now, delay)
+	case d.wakeAt.After(now.Add(delay)):
+		// The pending pass is waiting for files that are backing off
+		// after failed deletions. Run it in time for this file instead.
+		d.timer.Reset(delay)
+		d.wakeAt = now.Add(delay)
+	}
+}
+
+// scheduleLocked starts a waitAndDelete goroutine to run a deletion pass
+// after wait. d.mu must be held.
+func (d *fileDeleter) scheduleLocked(now time.Time, wait time.Duration) {
+	tc, ch := d.clock.NewTimer(wait)
+	d.timer, d.wakeAt = tc, now.Add(wait)
+	d.group.Go(func() { d.waitAndDelete(tc, ch) })
 }
 
-// waitAndDelete is an asynchronous deletion goroutine.
+// waitAndDelete is an asynchronous deletion goroutine, started by
+// scheduleLocked, that runs a deletion pass when ch fires.
 // At most one waitAndDelete routine is ever running at a time.
 // It is not started unless there is at least one file in the queue.
-func (d *fileDeleter) waitAndDelete(wait time.Duration) {
-	tc, ch := d.clock.NewTimer(wait)
+func (d *fileDeleter) waitAndDelete(tc tstime.TimerController, ch <-chan time.Time) {
 	defer tc.Stop() // cleanup the timer resource if we stop early
 	d.event("start waitAndDelete")
 	defer d.event("end waitAndDelete")
@@ -114,54 +357,199 @@ func (d *fileDeleter) waitAndDelete(wait time.Duration) {
 		d.mu.Lock()
 		defer d.mu.Unlock()
 
+		// If the directory itself is gone, such as when the user deleted
+		// the Taildrop folder, every file would fail. Stop until Init is
+		// called again.
+		if _, err := os.Stat(d.dir); os.IsNotExist(err) {
+			d.logf("warning: Taildrop directory %q is gone; dropping %d queued files and stopping deletions until reinitialized", d.dir, d.queue.Len())
+			d.dirGone = true
+			d.queue.Init()
+			clear(d.byName)
+			d.event("dir gone")
+			return
+		}
+
 		// Iterate over all files to delete, and delete anything old enough.
+		delay := d.delay()
 		var next *list.Element
-		var failed []*list.Element
+		var retry []*list.Element
+		var deleted, failed int
+		// fail records a failed attempt to delete file, which is retried
+		// after backing off.
+		fail := func(elem *list.Element, file *deleteFile) {
+			file.backOff(delay)
+			failed++
+			retry = append(retry, elem)
+		}
 		for elem := d.queue.Front(); elem != nil; elem = next {
 			next = elem.Next()
 			file := elem.Value.(*deleteFile)
-			if now.Sub(file.inserted) < deleteDelay {
-				break // everything after this is recently inserted
+			if now.Sub(file.inserted) < file.wait(delay) {
+				continue // not due yet
+			}
+
+			// A file whose size or mtime changed is likely still being
+			// written to by an active transfer, so give it another delete
+			// delay. The mtime catches writes that don't change the size,
+			// such as a resumed transfer rewriting a block in place.
+			if size, mtime := d.fileInfo(file.name); size != file.size || !mtime.Equal(file.mtime) {
+				file.size, file.mtime = size, mtime
+				file.failures, file.retryAfter = 0, 0
+				retry = append(retry, elem)
+				d.event("requeued " + file.name)
+				continue
+			}
+			if d.IsTransferring != nil && strings.Contains(file.name, partialSuffix) && d.IsTransferring(file.name) {
+				file.failures, file.retryAfter = 0, 0
+				retry = append(retry, elem)
+				d.event("requeued " + file.name)
+				continue
+			}
+
+			if d.PreDeleteHook != nil {
+				if err := d.PreDeleteHook(file.name); err != nil {
+					fail(elem, file)
+					d.logf("pre-delete hook for %q: %v (failure %d, retrying in %v)", file.name, redactError(err), file.failures, file.retryAfter)
+					d.event("requeued " + file.name)
+					continue
+				}
 			}
 
-			// Delete the expired file.
+			// Delete the expired file. Its size was just checked above;
+			// a deleted marker also frees the file it marks.
+			freed := max(file.size, 0)
 			if name, ok := strings.CutSuffix(file.name, deletedSuffix); ok {
-				if err := os.Remove(filepath.Join(d.dir, name)); err != nil && !os.IsNotExist(err) {
-					d.logf("could not delete: %v", redactError(err))
-					failed = append(failed, elem)
+				freed += max(d.fileSize(name), 0)
+				if err := removeFile(filepath.Join(d.dir, name)); err != nil && !os.IsNotExist(err) {
+					fail(elem, file)
+					d.logf("could not delete: %v (failure %d, retrying in %v)", redactError(err), file.failures, file.retryAfter)
 					continue
 				}
 			}
-			if err := os.Remove(filepath.Join(d.dir, file.name)); err != nil && !os.IsNotExist(err) {
-				d.logf("could not delete: %v", redactError(err))
-				failed = append(failed, elem)
+			if err := removeFile(filepath.Join(d.dir, file.name)); err != nil && !os.IsNotExist(err) {
+				fail(elem, file)
+				d.logf("could not delete: %v (failure %d, retrying in %v)", redactError(err), file.failures, file.retryAfter)
 				continue
 			}
 			d.queue.Remove(elem)
-			delete(d.byName, file.name)
+			delete(d.byName, d.normalizeName(file.name))
+			d.deleted++
+			deleted++
+			d.latency.add(now.Sub(file.queued))
+			if d.AfterDeleteHook != nil {
+				d.AfterDeleteHook(file.name, freed)
+			}
 			d.event("deleted " + file.name)
 		}
-		for _, elem := range failed {
-			elem.Value.(*deleteFile).inserted = now // retry after deleteDelay
+		for _, elem := range retry {
+			elem.Value.(*deleteFile).inserted = now // retry after its wait
 			d.queue.MoveToBack(elem)
 		}
+		if d.PassSummaryFunc != nil {
+			d.PassSummaryFunc(deleted, failed, d.queue.Len())
+		}
 
-		// If there are still some files to delete, retry again later.
+		// If there are still some files to delete, retry when the first
+		// of them is due.
 		if d.queue.Len() > 0 && d.shutdownCtx.Err() == nil {
-			file := d.queue.Front().Value.(*deleteFile)
-			retryAfter := deleteDelay - now.Sub(file.inserted)
-			d.group.Go(func() { d.waitAndDelete(retryAfter) })
+			dueIn := func(elem *list.Element) time.Duration {
+				file := elem.Value.(*deleteFile)
+				return file.wait(delay) - now.Sub(file.inserted)
+			}
+			retryAfter := dueIn(d.queue.Front())
+			for elem := d.queue.Front().Next(); elem != nil; elem = elem.Next() {
+				retryAfter = min(retryAfter, dueIn(elem))
+			}
+			d.scheduleLocked(now, retryAfter)
 		}
 	}
 }
 
+// delay returns how long files stay queued before they are deleted: the
+// delay passed to Init, or twice that while free space is above
+// MinFreeBytes.
+func (d *fileDeleter) delay() time.Duration {
+	if d.MinFreeBytes <= 0 {
+		return d.baseDelay
+	}
+	free, err := diskFree(d.dir)
+	if err != nil || free <= d.MinFreeBytes {
+		return d.baseDelay
+	}
+	return 2 * d.baseDelay
+}
+
+// fileSize returns the size of baseName in d.dir, or -1 if it cannot be
+// determined.
+func (d *fileDeleter) fileSize(baseName string) int64 {
+	size, _ := d.fileInfo(baseName)
+	return size
+}
+
+// fileInfo returns the size and modification time of baseName in d.dir,
+// or -1 and the zero time if they cannot be determined.
+func (d *fileDeleter) fileInfo(baseName string) (size int64, mtime time.Time) {
+	fi, err := os.Stat(filepath.Join(d.dir, baseName))
+	if err != nil {
+		return -1, time.Time{}
+	}
+	return fi.Size(), fi.ModTime()
+}
+
+// Stats returns statistics about the files queued and deleted.
+func (d *fileDeleter) Stats() FileDeleterStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return FileDeleterStats{
+		Queued:  d.queue.Len(),
+		Deleted: d.deleted,
+		Latency: d.latency,
+	}
+}
+
+// Len returns the number of files queued for deletion.
+func (d *fileDeleter) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queue.Len()
+}
+
+// Names returns the base names of the files queued for deletion, in queue
+// order. The returned slice is a copy owned by the caller.
+func (d *fileDeleter) Names() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, d.queue.Len())
+	for elem := d.queue.Front(); elem != nil; elem = elem.Next() {
+		names = append(names, elem.Value.(*deleteFile).name)
+	}
+	return names
+}
+
+// PendingNames is like Names, but returns the names sorted, for callers
+// such as tests that shouldn't depend on queue order. Each name is the one
+// the file was first queued under rather than its normalized key, so the
+// result doesn't depend on the platform's case sensitivity. Queued names
+// are distinct, so the order is fully determined.
+func (d *fileDeleter) PendingNames() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.byName))
+	for _, elem := range d.byName {
+		names = append(names, elem.Value.(*deleteFile).name)
+	}
+	slices.Sort(names)
+	return names
+}
+
 // Remove dequeues baseName from eventual deletion.
 func (d *fileDeleter) Remove(baseName string) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if elem := d.byName[baseName]; elem != nil {
+	key := d.normalizeName(baseName)
+	if elem := d.byName[key]; elem != nil {
 		d.queue.Remove(elem)
-		delete(d.byName, baseName)
+		delete(d.byName, key)
 		// Signal to terminate any waitAndDelete goroutines.
 		if d.queue.Len() == 0 {
 			select {
@@ -172,6 +560,24 @@ func (d *fileDeleter) Remove(baseName string) {
 	}
 }
 
+// Reset dequeues all files from eventual deletion and stops any running
+// waitAndDelete goroutine, but unlike Shutdown leaves the deleter usable:
+// later calls to Insert enqueue files as usual.
+func (d *fileDeleter) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.queue.Len() == 0 {
+		return
+	}
+	d.queue.Init()
+	clear(d.byName)
+	// Signal to terminate any waitAndDelete goroutines.
+	select {
+	case <-d.shutdownCtx.Done():
+	case d.emptySignal <- struct{}{}:
+	}
+}
+
 // Shutdown shuts down the deleter.
 // It blocks until all goroutines are stopped.
 func (d *fileDeleter) Shutdown() {
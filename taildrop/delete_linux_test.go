@@ -0,0 +1,54 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"tailscale.com/tstest"
+	"tailscale.com/util/must"
+)
+
+func TestDeleterCrossDevice(t *testing.T) {
+	tstest.Replace(t, &osRemove, func(name string) error {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EXDEV}
+	})
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.partial")
+	must.Do(os.WriteFile(path, []byte("partial contents"), 0644))
+
+	fd, clock, events := newTestDeleter(t, dir, testDeleterOpts{})
+	events.wait("start waitAndDelete")
+
+	clock.Advance(deleteDelay)
+	events.wait("deleted foo.partial")
+
+	fi := must.Get(os.Stat(path))
+	if fi.Size() != 0 {
+		t.Errorf("size after cross-device delete = %d; want 0", fi.Size())
+	}
+	fd.mu.Lock()
+	n := fd.queue.Len()
+	fd.mu.Unlock()
+	if n != 0 {
+		t.Errorf("queue length = %d; want 0", n)
+	}
+}
+
+func TestDiskFreeBytes(t *testing.T) {
+	free, err := diskFreeBytes(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free <= 0 {
+		t.Errorf("diskFreeBytes = %d; want positive", free)
+	}
+	if _, err := diskFreeBytes(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("diskFreeBytes of a missing directory succeeded; want error")
+	}
+}
@@ -4,15 +4,23 @@
 package taildrop
 
 import (
+	"errors"
+	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"runtime"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"tailscale.com/tstest"
 	"tailscale.com/tstime"
+	"tailscale.com/types/logger"
 	"tailscale.com/util/must"
 )
 
@@ -68,7 +76,7 @@ func TestDeleter(t *testing.T) {
 	eventHook := func(event string) { eventsChan <- event }
 
 	var fd fileDeleter
-	fd.Init(t.Logf, tstime.DefaultClock{Clock: clock}, eventHook, dir)
+	fd.Init(t.Logf, tstime.DefaultClock{Clock: clock}, eventHook, dir, 0)
 	defer fd.Shutdown()
 	insert := func(name string) {
 		t.Helper()
@@ -130,3 +138,935 @@ func TestDeleter(t *testing.T) {
 	remove("wuzz.partial")
 	checkEvents("end waitAndDelete")
 }
+
+// testDeleterOpts configures a fileDeleter started by newTestDeleter.
+type testDeleterOpts struct {
+	logf  logger.Logf        // or t.Logf if nil
+	setup func(*fileDeleter) // if non-nil, called before Init to set hooks
+}
+
+// newTestDeleter starts a fileDeleter on dir with a fake clock starting at
+// 2000-01-01 UTC, to be shut down when the test ends. It returns the
+// deleter, its clock, and the events it reports.
+func newTestDeleter(t *testing.T, dir string, opts testDeleterOpts) (*fileDeleter, *tstest.Clock, *deleterEvents) {
+	t.Helper()
+	logf := opts.logf
+	if logf == nil {
+		logf = t.Logf
+	}
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)})
+	events := &deleterEvents{t: t, c: make(chan string, 1000)}
+	fd := new(fileDeleter)
+	if opts.setup != nil {
+		opts.setup(fd)
+	}
+	fd.Init(logf, tstime.DefaultClock{Clock: clock}, func(e string) { events.c <- e }, dir, 0)
+	t.Cleanup(fd.Shutdown)
+	return fd, clock, events
+}
+
+// deleterEvents receives the events of a fileDeleter started by
+// newTestDeleter.
+type deleterEvents struct {
+	t *testing.T
+	c chan string
+}
+
+// wait waits for all of the events in want, in any order, ignoring any
+// others.
+func (e *deleterEvents) wait(want ...string) {
+	e.t.Helper()
+	tm := time.NewTimer(10 * time.Second)
+	defer tm.Stop()
+	for len(want) > 0 {
+		select {
+		case event := <-e.c:
+			want = slices.DeleteFunc(want, func(s string) bool { return s == event })
+		case <-tm.C:
+			e.t.Fatalf("timed out waiting for events %q", want)
+		}
+	}
+}
+
+// none fails the test if any event has been reported and not yet waited
+// for.
+func (e *deleterEvents) none() {
+	e.t.Helper()
+	select {
+	case event := <-e.c:
+		e.t.Fatalf("unexpected event: %q", event)
+	default:
+	}
+}
+
+func TestDeleterFilterFunc(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "foo.partial")))
+	must.Do(touchFile(filepath.Join(dir, "other-tool.partial")))
+
+	fd, clock, events := newTestDeleter(t, dir, testDeleterOpts{setup: func(fd *fileDeleter) {
+		fd.FilterFunc = func(name string) bool { return name != "other-tool.partial" }
+	}})
+	events.wait("end init", "start waitAndDelete")
+
+	fd.Insert("other-tool.partial") // explicitly inserting is also filtered
+	if slices.Contains(fd.PendingNames(), "other-tool.partial") {
+		t.Fatalf("filtered file was queued for deletion")
+	}
+
+	clock.Advance(deleteDelay)
+	events.wait("deleted foo.partial", "end waitAndDelete")
+
+	var got []string
+	for _, de := range must.Get(os.ReadDir(dir)) {
+		got = append(got, de.Name())
+	}
+	if want := []string{"other-tool.partial"}; !slices.Equal(got, want) {
+		t.Fatalf("directory = %q; want %q", got, want)
+	}
+}
+
+func TestDeleterSizeChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.partial")
+	must.Do(os.WriteFile(path, []byte("hello"), 0644))
+
+	_, clock, events := newTestDeleter(t, dir, testDeleterOpts{})
+	events.wait("end init", "start waitAndDelete")
+
+	// Simulate an active transfer appending to the partial file.
+	clock.Advance(deleteDelay / 2)
+	f := must.Get(os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0))
+	must.Get(f.WriteString(", world"))
+	must.Do(f.Close())
+
+	clock.Advance(deleteDelay / 2)
+	events.wait("requeued foo.partial", "end waitAndDelete", "start waitAndDelete")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("file deleted while its size was changing: %v", err)
+	}
+
+	// Once the size is stable for a full deleteDelay, the file is deleted.
+	clock.Advance(deleteDelay)
+	events.wait("deleted foo.partial")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Stat after delete = %v; want not exist", err)
+	}
+}
+
+// manualClock is a deleterClock whose time only moves when one of its
+// timers is fired. Each timer it creates is sent on timers, so tests can
+// check what the deleter waits for and fire it deterministically.
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers chan *manualTimer
+}
+
+func newManualClock(start time.Time) *manualClock {
+	return &manualClock{now: start, timers: make(chan *manualTimer, 10)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) NewTimer(d time.Duration) (tstime.TimerController, <-chan time.Time) {
+	tm := &manualTimer{clock: c, d: d, ch: make(chan time.Time, 1)}
+	c.timers <- tm
+	return tm, tm.ch
+}
+
+// next returns the next timer created by c, failing the test if none is
+// created within a few seconds.
+func (c *manualClock) next(t *testing.T) *manualTimer {
+	t.Helper()
+	select {
+	case tm := <-c.timers:
+		return tm
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a timer")
+		return nil
+	}
+}
+
+type manualTimer struct {
+	clock   *manualClock
+	d       time.Duration
+	ch      chan time.Time
+	stopped atomic.Bool
+}
+
+// fire advances the clock by the timer's duration and fires it.
+func (tm *manualTimer) fire() {
+	tm.clock.mu.Lock()
+	tm.clock.now = tm.clock.now.Add(tm.d)
+	now := tm.clock.now
+	tm.clock.mu.Unlock()
+	tm.ch <- now
+}
+
+func (tm *manualTimer) Reset(d time.Duration) bool {
+	tm.d = d
+	return !tm.stopped.Swap(false)
+}
+
+func (tm *manualTimer) Stop() bool { return !tm.stopped.Swap(true) }
+
+func TestDeleterMtimeChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.partial")
+	must.Do(os.WriteFile(path, []byte("hello"), 0644))
+	mtime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	must.Do(os.Chtimes(path, mtime, mtime))
+
+	_, clock, events := newTestDeleter(t, dir, testDeleterOpts{})
+	events.wait("end init", "start waitAndDelete")
+
+	// Simulate an active transfer rewriting the partial file in place,
+	// which changes its mtime but not its size.
+	clock.Advance(deleteDelay / 2)
+	must.Do(os.WriteFile(path, []byte("HELLO"), 0644))
+	mtime = mtime.Add(time.Minute)
+	must.Do(os.Chtimes(path, mtime, mtime))
+
+	clock.Advance(deleteDelay / 2)
+	events.wait("requeued foo.partial", "end waitAndDelete", "start waitAndDelete")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("file deleted while it was being written: %v", err)
+	}
+
+	// Once the mtime is stable for a full deleteDelay, the file is deleted.
+	clock.Advance(deleteDelay)
+	events.wait("deleted foo.partial")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Stat after delete = %v; want not exist", err)
+	}
+}
+
+func TestDeleterManualClock(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "foo.partial")))
+
+	clock := newManualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	eventsChan := make(chan string, 1000)
+	var fd fileDeleter
+	fd.Init(t.Logf, clock, func(e string) { eventsChan <- e }, dir, 0)
+	defer fd.Shutdown()
+
+	tm := clock.next(t)
+	if tm.d != deleteDelay {
+		t.Fatalf("deleter waits %v; want %v", tm.d, deleteDelay)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo.partial")); err != nil {
+		t.Fatalf("file deleted before the timer fired: %v", err)
+	}
+	tm.fire()
+	for event := range eventsChan {
+		if event == "deleted foo.partial" {
+			break
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo.partial")); !os.IsNotExist(err) {
+		t.Fatalf("Stat after delete = %v; want not exist", err)
+	}
+	select {
+	case tm := <-clock.timers:
+		t.Errorf("unexpected timer for %v with an empty queue", tm.d)
+	default:
+	}
+}
+
+func TestDeleterCustomDelay(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "foo.partial")))
+
+	const delay = 6 * time.Hour
+	clock := newManualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	eventsChan := make(chan string, 1000)
+	var fd fileDeleter
+	fd.Init(t.Logf, clock, func(e string) { eventsChan <- e }, dir, delay)
+	defer fd.Shutdown()
+
+	tm := clock.next(t)
+	if tm.d != delay {
+		t.Fatalf("deleter waits %v; want %v", tm.d, delay)
+	}
+	tm.fire()
+	for event := range eventsChan {
+		if event == "deleted foo.partial" {
+			break
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo.partial")); !os.IsNotExist(err) {
+		t.Fatalf("Stat after delete = %v; want not exist", err)
+	}
+}
+
+func TestDeleterBackoff(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "stuck.partial")))
+
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	clock := newManualClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	eventsChan := make(chan string, 1000)
+	var fd fileDeleter
+	fd.PreDeleteHook = func(baseName string) error {
+		if baseName == "stuck.partial" {
+			return errors.New("file in use")
+		}
+		return nil
+	}
+	fd.Init(logf, clock, func(e string) { eventsChan <- e }, dir, 0)
+	defer fd.Shutdown()
+
+	// The wait doubles after each failure, up to maxRetryDelay.
+	h := time.Hour
+	var tm *manualTimer
+	for i, want := range []time.Duration{h, h, 2 * h, 4 * h, 8 * h, 16 * h, 24 * h, 24 * h} {
+		tm = clock.next(t)
+		if tm.d != want {
+			t.Fatalf("wait %d = %v; want %v", i, tm.d, want)
+		}
+		if i < 7 {
+			tm.fire()
+		}
+	}
+	mu.Lock()
+	if !slices.ContainsFunc(logs, func(s string) bool { return strings.Contains(s, "(failure 7, retrying in 24h0m0s)") }) {
+		t.Errorf("no log with the failure count; logs = %q", logs)
+	}
+	mu.Unlock()
+
+	// A new file doesn't wait for the stuck one's backoff.
+	must.Do(touchFile(filepath.Join(dir, "new.partial")))
+	fd.Insert("new.partial")
+	if tm.d != deleteDelay {
+		t.Fatalf("after Insert, pending wait = %v; want %v", tm.d, deleteDelay)
+	}
+	tm.fire()
+	for event := range eventsChan {
+		if event == "deleted new.partial" {
+			break
+		}
+	}
+	if tm := clock.next(t); tm.d != 23*h {
+		t.Errorf("next wait = %v; want %v", tm.d, 23*h)
+	}
+}
+
+func TestDeleterReset(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "foo.partial")))
+	must.Do(touchFile(filepath.Join(dir, "bar.partial")))
+
+	fd, clock, events := newTestDeleter(t, dir, testDeleterOpts{})
+	events.wait("end init", "start waitAndDelete")
+
+	fd.Reset()
+	events.wait("end waitAndDelete")
+	fd.mu.Lock()
+	n, m := fd.queue.Len(), len(fd.byName)
+	fd.mu.Unlock()
+	if n != 0 || m != 0 {
+		t.Fatalf("after Reset: queue has %d entries, byName has %d; want 0, 0", n, m)
+	}
+
+	// Nothing is deleted once the queue has been reset.
+	clock.Advance(deleteDelay)
+	events.none()
+	for _, name := range []string{"foo.partial", "bar.partial"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// Reset of an empty deleter is a no-op, and the deleter remains usable.
+	fd.Reset()
+	fd.Insert("foo.partial")
+	events.wait("start waitAndDelete")
+	clock.Advance(deleteDelay)
+	events.wait("deleted foo.partial", "end waitAndDelete")
+}
+
+func TestDeleterIsTransferring(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.partial")
+	must.Do(touchFile(path))
+
+	var transferring atomic.Bool
+	transferring.Store(true)
+	var calledWith []string
+	fd, clock, events := newTestDeleter(t, dir, testDeleterOpts{setup: func(fd *fileDeleter) {
+		fd.IsTransferring = func(baseName string) bool {
+			calledWith = append(calledWith, baseName) // called with fd.mu held
+			return transferring.Load()
+		}
+	}})
+	events.wait("end init", "start waitAndDelete")
+
+	// The file is not deleted while a transfer is still writing to it.
+	clock.Advance(deleteDelay)
+	events.wait("requeued foo.partial", "end waitAndDelete", "start waitAndDelete")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("file deleted while transferring: %v", err)
+	}
+
+	// Once the transfer is gone, the file is deleted after another deleteDelay.
+	transferring.Store(false)
+	clock.Advance(deleteDelay)
+	events.wait("deleted foo.partial", "end waitAndDelete")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Stat after delete = %v; want not exist", err)
+	}
+	fd.mu.Lock()
+	got := slices.Clone(calledWith)
+	fd.mu.Unlock()
+	if want := []string{"foo.partial", "foo.partial"}; !slices.Equal(got, want) {
+		t.Errorf("IsTransferring called with %q; want %q", got, want)
+	}
+}
+
+func TestDeleterPreDeleteHook(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.partial")
+	must.Do(touchFile(path))
+
+	var hookErr atomic.Bool
+	hookErr.Store(true)
+	var calledWith []string
+	fd, clock, events := newTestDeleter(t, dir, testDeleterOpts{setup: func(fd *fileDeleter) {
+		fd.PreDeleteHook = func(baseName string) error {
+			calledWith = append(calledWith, baseName) // called with fd.mu held
+			if _, err := os.Stat(filepath.Join(dir, baseName)); err != nil {
+				t.Errorf("hook called after %q was deleted: %v", baseName, err)
+			}
+			if hookErr.Load() {
+				return errors.New("audit log unavailable")
+			}
+			return nil
+		}
+	}})
+	events.wait("end init", "start waitAndDelete")
+
+	// A failing hook cancels the deletion for this pass.
+	clock.Advance(deleteDelay)
+	events.wait("requeued foo.partial", "end waitAndDelete", "start waitAndDelete")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("file deleted despite hook error: %v", err)
+	}
+
+	// The file is retried on the next pass.
+	hookErr.Store(false)
+	clock.Advance(deleteDelay)
+	events.wait("deleted foo.partial", "end waitAndDelete")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Stat after delete = %v; want not exist", err)
+	}
+	fd.mu.Lock()
+	got := slices.Clone(calledWith)
+	fd.mu.Unlock()
+	if want := []string{"foo.partial", "foo.partial"}; !slices.Equal(got, want) {
+		t.Errorf("PreDeleteHook called with %q; want %q", got, want)
+	}
+}
+
+func TestDeleterInsertOutsideDir(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "taildrop")
+	must.Do(os.Mkdir(dir, 0700))
+	must.Do(touchFile(filepath.Join(root, "victim.partial")))
+
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	fd, clock, _ := newTestDeleter(t, dir, testDeleterOpts{logf: logf})
+
+	bad := []string{
+		"../victim.partial",
+		"sub/foo.partial",
+		"/etc/passwd.partial",
+		"..",
+		".",
+	}
+	if runtime.GOOS == "windows" {
+		bad = append(bad, `..\victim.partial`)
+	}
+	for _, name := range bad {
+		fd.Insert(name)
+	}
+	fd.mu.Lock()
+	n := fd.queue.Len()
+	fd.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("queue has %d entries after inserting invalid names; want 0", n)
+	}
+
+	mu.Lock()
+	var warnings int
+	for _, l := range logs {
+		if strings.Contains(l, "not a file name within the Taildrop directory") {
+			warnings++
+		}
+	}
+	mu.Unlock()
+	if warnings != len(bad) {
+		t.Errorf("got %d warnings; want %d", warnings, len(bad))
+	}
+
+	clock.Advance(deleteDelay)
+	if _, err := os.Stat(filepath.Join(root, "victim.partial")); err != nil {
+		t.Errorf("file outside dir was touched: %v", err)
+	}
+}
+
+func TestDeleterWorldWritableWarning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix permission bits not supported on Windows")
+	}
+	for _, mode := range []os.FileMode{0700, 0777} {
+		dir := t.TempDir()
+		must.Do(os.Chmod(dir, mode))
+
+		var mu sync.Mutex
+		var logs []string
+		logf := func(format string, args ...any) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		}
+		done := make(chan struct{})
+		event := func(e string) {
+			if e == "end init" {
+				close(done)
+			}
+		}
+
+		var fd fileDeleter
+		fd.Init(logf, tstime.DefaultClock{Clock: tstest.NewClock(tstest.ClockOpts{})}, event, dir, 0)
+		<-done
+		fd.Shutdown()
+
+		mu.Lock()
+		warned := slices.ContainsFunc(logs, func(s string) bool { return strings.Contains(s, "world-writable") })
+		mu.Unlock()
+		if want := mode == 0777; warned != want {
+			t.Errorf("mode %v: warned = %v; want %v (logs: %q)", mode, warned, want, logs)
+		}
+	}
+}
+
+func TestDeleterInitSummary(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "foo.partial")))
+	must.Do(touchFile(filepath.Join(dir, "bar.n12345CNTRL.partial")))
+	must.Do(touchFile(filepath.Join(dir, "fizz")))
+	must.Do(touchFile(filepath.Join(dir, "fizz.deleted")))
+	must.Do(touchFile(filepath.Join(dir, "buzz.deleted"))) // lacks a matching "buzz" file
+	must.Do(touchFile(filepath.Join(dir, "unrelated.txt")))
+
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	done := make(chan struct{})
+	event := func(e string) {
+		if e == "end init" {
+			close(done)
+		}
+	}
+
+	var fd fileDeleter
+	fd.Init(logf, tstime.DefaultClock{Clock: tstest.NewClock(tstest.ClockOpts{})}, event, dir, 0)
+	<-done
+	fd.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	const want = "taildrop deleter init: found 2 partial, 2 deleted-marker files; immediately removed 1"
+	if !slices.Contains(logs, want) {
+		t.Errorf("logs = %q; want %q", logs, want)
+	}
+}
+
+func TestDeleterInitTwice(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "foo.partial")))
+
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	eventsChan := make(chan string, 1000)
+	event := func(e string) { eventsChan <- e }
+	clock := tstime.DefaultClock{Clock: tstest.NewClock(tstest.ClockOpts{})}
+
+	var fd fileDeleter
+	fd.Init(logf, clock, event, dir, 0)
+	for e := range eventsChan {
+		if e == "end init" {
+			break
+		}
+	}
+	fd.mu.Lock()
+	emptySignal := fd.emptySignal
+	fd.mu.Unlock()
+
+	fd.Init(logf, clock, event, t.TempDir(), 0)
+
+	if got, want := fd.PendingNames(), []string{"foo.partial"}; !slices.Equal(got, want) {
+		t.Errorf("after second Init, PendingNames = %q; want %q", got, want)
+	}
+	fd.mu.Lock()
+	if fd.emptySignal != emptySignal {
+		t.Error("second Init replaced emptySignal")
+	}
+	if fd.dir != dir {
+		t.Errorf("dir = %q; want %q", fd.dir, dir)
+	}
+	fd.mu.Unlock()
+
+	fd.Shutdown()
+	close(eventsChan)
+	for e := range eventsChan {
+		if e == "start init" {
+			t.Error("init ran again after second Init")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.ContainsFunc(logs, func(s string) bool { return strings.Contains(s, "already initialized") }) {
+		t.Errorf("no warning logged for second Init; logs = %q", logs)
+	}
+}
+
+func TestDeleterCaseInsensitive(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "Partial.dat.partial")))
+
+	fd, clock, events := newTestDeleter(t, dir, testDeleterOpts{setup: func(fd *fileDeleter) {
+		fd.normalizeName = strings.ToLower
+	}})
+	events.wait("end init", "start waitAndDelete")
+
+	// Names differing only in case refer to the queued file.
+	fd.Insert("partial.dat.partial")
+	fd.Insert("PARTIAL.DAT.partial")
+	if got, want := fd.PendingNames(), []string{"Partial.dat.partial"}; !slices.Equal(got, want) {
+		t.Fatalf("queue = %q; want %q", got, want)
+	}
+	fd.Remove("partial.DAT.partial")
+	events.wait("end waitAndDelete")
+	if got := fd.PendingNames(); len(got) != 0 {
+		t.Fatalf("queue after Remove = %q; want empty", got)
+	}
+
+	// The file is deleted under the name it was first queued with.
+	fd.Insert("Partial.dat.partial")
+	events.wait("start waitAndDelete")
+	clock.Advance(deleteDelay)
+	events.wait("deleted Partial.dat.partial", "end waitAndDelete")
+	fd.mu.Lock()
+	n := len(fd.byName)
+	fd.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("byName has %d entries after deletion; want 0", n)
+	}
+}
+
+func TestNormalizeNameForOS(t *testing.T) {
+	tests := []struct {
+		goos string
+		want string
+	}{
+		{"linux", "Photo.JPG.partial"},
+		{"android", "Photo.JPG.partial"},
+		{"windows", "photo.jpg.partial"},
+		{"darwin", "photo.jpg.partial"},
+		{"ios", "photo.jpg.partial"},
+	}
+	for _, tt := range tests {
+		if got := normalizeNameForOS(tt.goos)("Photo.JPG.partial"); got != tt.want {
+			t.Errorf("normalizeNameForOS(%q) = %q; want %q", tt.goos, got, tt.want)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int // bucket
+	}{
+		{0, 0},
+		{time.Minute, 0},
+		{time.Minute + 1, 1},
+		{5 * time.Minute, 1},
+		{10 * time.Minute, 2},
+		{30 * time.Minute, 2},
+		{time.Hour, 3},
+		{90 * time.Minute, 4},
+		{2 * time.Hour, 4},
+		{3 * time.Hour, 5},
+		{4 * time.Hour, 5},
+		{4*time.Hour + 1, 6},
+		{48 * time.Hour, 6},
+	}
+	for _, tt := range tests {
+		var h LatencyHistogram
+		h.add(tt.d)
+		var want LatencyHistogram
+		want[tt.want] = 1
+		if h != want {
+			t.Errorf("add(%v) = %v; want %v", tt.d, h, want)
+		}
+	}
+}
+
+func TestDeleterStats(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "foo.partial")))
+	must.Do(touchFile(filepath.Join(dir, "bar.partial")))
+
+	var busy atomic.Bool
+	busy.Store(true)
+	fd, clock, events := newTestDeleter(t, dir, testDeleterOpts{setup: func(fd *fileDeleter) {
+		fd.IsTransferring = func(baseName string) bool { return baseName == "bar.partial" && busy.Load() }
+	}})
+	events.wait("end init", "start waitAndDelete")
+	if got, want := fd.Stats(), (FileDeleterStats{Queued: 2}); got != want {
+		t.Fatalf("Stats = %+v; want %+v", got, want)
+	}
+
+	// foo.partial is deleted after deleteDelay; bar.partial is requeued.
+	clock.Advance(deleteDelay)
+	events.wait("deleted foo.partial", "requeued bar.partial", "end waitAndDelete", "start waitAndDelete")
+	want := FileDeleterStats{Queued: 1, Deleted: 1}
+	want.Latency[3] = 1 // at most 1h
+	if got := fd.Stats(); got != want {
+		t.Fatalf("Stats = %+v; want %+v", got, want)
+	}
+
+	// bar.partial's latency counts from its first insertion.
+	busy.Store(false)
+	clock.Advance(deleteDelay)
+	events.wait("deleted bar.partial", "end waitAndDelete")
+	want = FileDeleterStats{Queued: 0, Deleted: 2}
+	want.Latency[3] = 1
+	want.Latency[4] = 1 // at most 2h
+	if got := fd.Stats(); got != want {
+		t.Fatalf("Stats = %+v; want %+v", got, want)
+	}
+}
+
+func TestDeleterLenNames(t *testing.T) {
+	fd, _, events := newTestDeleter(t, t.TempDir(), testDeleterOpts{})
+	events.wait("end init")
+
+	if n, names := fd.Len(), fd.Names(); n != 0 || len(names) != 0 {
+		t.Fatalf("empty deleter: Len = %d, Names = %q; want 0, []", n, names)
+	}
+
+	fd.Insert("foo.partial")
+	fd.Insert("bar.partial")
+	if got := fd.Len(); got != 2 {
+		t.Errorf("Len = %d; want 2", got)
+	}
+	names := fd.Names()
+	if want := []string{"foo.partial", "bar.partial"}; !slices.Equal(names, want) {
+		t.Fatalf("Names = %q; want %q", names, want)
+	}
+
+	// The result is a copy.
+	names[0] = "changed"
+	if got := fd.Names(); got[0] != "foo.partial" {
+		t.Errorf("Names after modifying a previous result = %q", got)
+	}
+
+	// PendingNames sorts regardless of queue order.
+	fd.Insert("Baz.partial")
+	if got, want := fd.PendingNames(), []string{"Baz.partial", "bar.partial", "foo.partial"}; !slices.Equal(got, want) {
+		t.Errorf("PendingNames = %q; want %q", got, want)
+	}
+	fd.Remove("Baz.partial")
+
+	fd.Remove("foo.partial")
+	if got, want := fd.Names(), []string{"bar.partial"}; fd.Len() != 1 || !slices.Equal(got, want) {
+		t.Errorf("after Remove: Len = %d, Names = %q; want 1, %q", fd.Len(), got, want)
+	}
+	if got, want := fd.PendingNames(), []string{"bar.partial"}; !slices.Equal(got, want) {
+		t.Errorf("after Remove: PendingNames = %q; want %q", got, want)
+	}
+}
+
+func TestDeleterDirGone(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(touchFile(filepath.Join(dir, "foo.partial")))
+
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	fd, clock, events := newTestDeleter(t, dir, testDeleterOpts{logf: logf})
+	events.wait("end init", "start waitAndDelete")
+
+	must.Do(os.RemoveAll(dir))
+	clock.Advance(deleteDelay)
+	events.wait("dir gone", "end waitAndDelete")
+	if got := fd.Len(); got != 0 {
+		t.Errorf("Len after dir removed = %d; want 0", got)
+	}
+	mu.Lock()
+	if !slices.ContainsFunc(logs, func(s string) bool { return strings.Contains(s, "is gone") }) {
+		t.Errorf("no warning logged; logs = %q", logs)
+	}
+	mu.Unlock()
+
+	// Nothing is queued or retried while the directory is gone.
+	fd.Insert("bar.partial")
+	if got := fd.Len(); got != 0 {
+		t.Errorf("Len after Insert = %d; want 0", got)
+	}
+	clock.Advance(deleteDelay)
+	events.none()
+
+	// Init starts the deleter again once the directory is back.
+	must.Do(os.Mkdir(dir, 0700))
+	must.Do(touchFile(filepath.Join(dir, "foo.partial")))
+	fd.Init(logf, tstime.DefaultClock{Clock: clock}, fd.event, dir, 0)
+	events.wait("end init", "start waitAndDelete")
+	clock.Advance(deleteDelay)
+	events.wait("deleted foo.partial", "end waitAndDelete")
+}
+
+func TestDeleterMinFreeBytes(t *testing.T) {
+	const minFree = 1 << 30
+	tests := []struct {
+		name      string
+		free      int64
+		freeErr   error
+		wantDelay time.Duration
+	}{
+		{name: "scarce", free: minFree / 2, wantDelay: deleteDelay},
+		{name: "at_threshold", free: minFree, wantDelay: deleteDelay},
+		{name: "abundant", free: 2 * minFree, wantDelay: 2 * deleteDelay},
+		{name: "unknown", freeErr: errors.ErrUnsupported, wantDelay: deleteDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tstest.Replace(t, &diskFree, func(string) (int64, error) { return tt.free, tt.freeErr })
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "foo.partial")
+			must.Do(touchFile(path))
+
+			_, clock, events := newTestDeleter(t, dir, testDeleterOpts{setup: func(fd *fileDeleter) {
+				fd.MinFreeBytes = minFree
+			}})
+			events.wait("end init", "start waitAndDelete")
+
+			clock.Advance(tt.wantDelay - time.Second)
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("file deleted before %v: %v", tt.wantDelay, err)
+			}
+			clock.Advance(time.Second)
+			events.wait("deleted foo.partial", "end waitAndDelete")
+		})
+	}
+}
+
+func TestDeleterPassSummary(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.partial", "b.partial", "c.partial"} {
+		must.Do(touchFile(filepath.Join(dir, name)))
+	}
+
+	type summary struct{ deleted, failed, remaining int }
+	summaries := make(chan summary, 10)
+	var busy atomic.Bool
+	busy.Store(true)
+	_, clock, events := newTestDeleter(t, dir, testDeleterOpts{setup: func(fd *fileDeleter) {
+		fd.PreDeleteHook = func(baseName string) error {
+			if baseName == "b.partial" && busy.Load() {
+				return errors.New("audit log unavailable")
+			}
+			return nil
+		}
+		fd.IsTransferring = func(baseName string) bool { return baseName == "c.partial" && busy.Load() }
+		fd.PassSummaryFunc = func(deleted, failed, remaining int) {
+			summaries <- summary{deleted, failed, remaining}
+		}
+	}})
+	events.wait("end init", "start waitAndDelete")
+
+	// a.partial is deleted, b.partial fails its hook and c.partial is
+	// requeued while it is transferring, which isn't a failure.
+	clock.Advance(deleteDelay)
+	events.wait("deleted a.partial", "end waitAndDelete", "start waitAndDelete")
+	if got, want := <-summaries, (summary{deleted: 1, failed: 1, remaining: 2}); got != want {
+		t.Errorf("first pass summary = %+v; want %+v", got, want)
+	}
+
+	busy.Store(false)
+	clock.Advance(deleteDelay)
+	events.wait("deleted b.partial", "deleted c.partial", "end waitAndDelete")
+	if got, want := <-summaries, (summary{deleted: 2, failed: 0, remaining: 0}); got != want {
+		t.Errorf("second pass summary = %+v; want %+v", got, want)
+	}
+	select {
+	case s := <-summaries:
+		t.Errorf("unexpected extra summary %+v", s)
+	default:
+	}
+}
+
+func TestDeleterAfterDeleteHook(t *testing.T) {
+	dir := t.TempDir()
+	must.Do(os.WriteFile(filepath.Join(dir, "a.partial"), make([]byte, 100), 0644))
+	must.Do(os.WriteFile(filepath.Join(dir, "gone.partial"), make([]byte, 50), 0644))
+
+	freed := map[string]int64{}
+	fd, clock, events := newTestDeleter(t, dir, testDeleterOpts{setup: func(fd *fileDeleter) {
+		fd.AfterDeleteHook = func(name string, n int64) {
+			freed[name] = n // called with fd.mu held
+		}
+	}})
+	events.wait("end init", "start waitAndDelete")
+
+	// gone.partial disappears before the pass, so its size changes and it
+	// is requeued once; on the next pass it is dequeued with 0 bytes freed.
+	must.Do(os.Remove(filepath.Join(dir, "gone.partial")))
+	clock.Advance(deleteDelay)
+	events.wait("deleted a.partial", "requeued gone.partial", "end waitAndDelete", "start waitAndDelete")
+	clock.Advance(deleteDelay)
+	events.wait("deleted gone.partial", "end waitAndDelete")
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if want := map[string]int64{"a.partial": 100, "gone.partial": 0}; !maps.Equal(freed, want) {
+		t.Errorf("freed = %v; want %v", freed, want)
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux && !windows
+
+package taildrop
+
+import "errors"
+
+// diskFreeBytes is not implemented on this platform.
+func diskFreeBytes(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
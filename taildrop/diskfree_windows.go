@@ -0,0 +1,20 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package taildrop
+
+import "golang.org/x/sys/windows"
+
+// diskFreeBytes returns the number of bytes available to the current user
+// on the volume containing dir.
+func diskFreeBytes(dir string) (int64, error) {
+	dirp, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var avail, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(dirp, &avail, &total, &free); err != nil {
+		return 0, err
+	}
+	return int64(avail), nil
+}
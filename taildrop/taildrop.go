@@ -22,6 +22,7 @@
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -103,6 +104,11 @@ type ManagerOptions struct {
 	// to the function when reception completes.
 	// It is not called if nil.
 	SendFileNotify func()
+
+	// DeleteDelay is how long partial and deleted files are kept before
+	// they are removed, giving interrupted transfers time to resume.
+	// If zero, one hour is used.
+	DeleteDelay time.Duration
 }
 
 // Manager manages the state for receiving and managing taildropped files.
@@ -135,7 +141,8 @@ func (opts ManagerOptions) New() *Manager {
 		opts.SendFileNotify = func() {}
 	}
 	m := &Manager{opts: opts}
-	m.deleter.Init(opts.Logf, opts.Clock, func(string) {}, opts.Dir)
+	m.deleter.IsTransferring = m.isTransferring
+	m.deleter.Init(opts.Logf, opts.Clock, func(string) {}, opts.Dir, opts.DeleteDelay)
 	m.emptySince.Store(-1) // invalidate this cache
 	return m
 }
@@ -228,6 +235,16 @@ func rangeDir(dir string, fn func(fs.DirEntry) bool) error {
 	}
 }
 
+// isTransferring reports whether partialName is the partial file of an
+// active incoming transfer.
+func (m *Manager) isTransferring(partialName string) (found bool) {
+	m.incomingFiles.Range(func(k incomingFileKey, _ *incomingFile) bool {
+		found = k.name+k.id.partialSuffix() == partialName
+		return !found
+	})
+	return found
+}
+
 // IncomingFiles returns a list of active incoming files.
 func (m *Manager) IncomingFiles() []ipn.PartialFile {
 	// Make sure we always set n.IncomingFiles non-nil so it gets encoded
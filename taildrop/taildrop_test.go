@@ -66,3 +66,26 @@ func TestNextFilename(t *testing.T) {
 		}
 	}
 }
+
+func TestManagerIsTransferring(t *testing.T) {
+	m := ManagerOptions{Dir: t.TempDir()}.New()
+	defer m.Shutdown()
+	m.incomingFiles.Store(incomingFileKey{"n12345CNTRL", "foo.jpeg"}, &incomingFile{})
+	m.incomingFiles.Store(incomingFileKey{"", "bar.jpeg"}, &incomingFile{})
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"foo.jpeg.n12345CNTRL.partial", true},
+		{"foo.jpeg.nOTHER.partial", false},
+		{"foo.jpeg.partial", false},
+		{"bar.jpeg.partial", true},
+		{"baz.jpeg.partial", false},
+	}
+	for _, tt := range tests {
+		if got := m.isTransferring(tt.name); got != tt.want {
+			t.Errorf("isTransferring(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
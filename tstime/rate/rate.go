@@ -61,7 +61,18 @@ func (lim *Limiter) Allow() bool {
 	return lim.allow(mono.Now())
 }
 
+// AllowN reports whether n events may happen now, consuming n tokens if so.
+// It is useful for limiting a number of bytes rather than of events, in
+// which case n must be at most the burst size to ever be allowed.
+func (lim *Limiter) AllowN(n int) bool {
+	return lim.allowN(mono.Now(), n)
+}
+
 func (lim *Limiter) allow(now mono.Time) bool {
+	return lim.allowN(now, 1)
+}
+
+func (lim *Limiter) allowN(now mono.Time, n int) bool {
 	lim.mu.Lock()
 	defer lim.mu.Unlock()
 
@@ -77,8 +88,8 @@ func (lim *Limiter) allow(now mono.Time) bool {
 		tokens = lim.burst
 	}
 
-	// Consume a token.
-	tokens--
+	// Consume the tokens.
+	tokens -= float64(n)
 
 	// Update state.
 	ok := tokens >= 0
@@ -110,6 +110,29 @@ func TestLimiterJumpBackwards(t *testing.T) {
 	})
 }
 
+func TestLimiterAllowN(t *testing.T) {
+	// 10 tokens per second, so 1 token per d (100ms); burst of 5.
+	lim := NewLimiter(10, 5)
+	steps := []struct {
+		t  mono.Time
+		n  int
+		ok bool
+	}{
+		{t0, 3, true},  // 2 left
+		{t0, 3, false}, // not enough; nothing consumed
+		{t0, 2, true},  // 0 left
+		{t1, 2, false}, // 1 refilled
+		{t1, 1, true},  // 0 left
+		{t9, 6, false}, // refill capped at the burst size
+		{t9, 5, true},
+	}
+	for i, st := range steps {
+		if ok := lim.allowN(st.t, st.n); ok != st.ok {
+			t.Errorf("step %d: lim.allowN(%v, %d) = %v; want %v", i, st.t, st.n, ok, st.ok)
+		}
+	}
+}
+
 // Ensure that tokensFromDuration doesn't produce
 // rounding errors by truncating nanoseconds.
 // See golang.org/issues/34861.
@@ -17,6 +17,7 @@
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"context"
 
@@ -330,6 +331,36 @@ func Filtered(logf Logf, allow func(s string) bool) Logf {
 	}
 }
 
+// TruncatedSuffix is appended to log lines shortened by WithMaxLineLength.
+const TruncatedSuffix = "... [truncated]"
+
+// WithMaxLineLength returns a Logf that caps each line logged to logf at
+// maxLen() bytes. Longer lines are cut at a UTF-8 boundary and end with
+// TruncatedSuffix, which counts toward the limit. Lines within the limit
+// are passed to logf with their original format and args, so wrappers
+// such as RateLimitedFn that key on the format still see it. If maxLen
+// returns zero or less, lines are not capped. Structured JSON records
+// (see Logf.JSON) are never truncated, as that would corrupt them.
+func WithMaxLineLength(logf Logf, maxLen func() int) Logf {
+	return func(format string, args ...any) {
+		n := maxLen()
+		if n <= 0 || strings.HasPrefix(format, "[v\x00JSON]") {
+			logf(format, args...)
+			return
+		}
+		msg := fmt.Sprintf(format, args...)
+		if len(msg) <= n {
+			logf(format, args...)
+			return
+		}
+		keep := max(n-len(TruncatedSuffix), 0)
+		for keep > 0 && !utf8.RuneStart(msg[keep]) {
+			keep--
+		}
+		logf("%s%s", msg[:keep], TruncatedSuffix)
+	}
+}
+
 // LogfCloser wraps logf to create a logger that can be closed.
 // Calling close makes all future calls to newLogf into no-ops.
 func LogfCloser(logf Logf) (newLogf Logf, close func()) {
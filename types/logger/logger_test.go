@@ -9,6 +9,7 @@
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -258,3 +259,65 @@ func TestAsJSON(t *testing.T) {
 		t.Errorf("allocs = %v; want max 2", n)
 	}
 }
+
+func TestWithMaxLineLength(t *testing.T) {
+	var got []string
+	var formats []string
+	logf := func(format string, args ...any) {
+		formats = append(formats, format)
+		got = append(got, fmt.Sprintf(format, args...))
+	}
+	limit := 20
+	lf := WithMaxLineLength(logf, func() int { return limit })
+
+	tests := []struct {
+		name       string
+		msg        string
+		want       string
+		wantFormat string // if non-empty, the format logf should receive
+	}{
+		{"short", "hello", "hello", "%s"},
+		{"at_limit", strings.Repeat("a", 20), strings.Repeat("a", 20), "%s"},
+		{"over_limit", strings.Repeat("a", 21), "aaaaa" + TruncatedSuffix, "%s%s"},
+		{"far_over_limit", strings.Repeat("b", 1000), "bbbbb" + TruncatedSuffix, "%s%s"},
+		// "é" is two bytes; the cut must not split it.
+		{"utf8_boundary", "aaaaé" + strings.Repeat("c", 20), "aaaa" + TruncatedSuffix, "%s%s"},
+	}
+	for _, tt := range tests {
+		got, formats = nil, nil
+		lf("%s", tt.msg)
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: logged %q; want %q", tt.name, got, tt.want)
+			continue
+		}
+		if formats[0] != tt.wantFormat {
+			t.Errorf("%s: format %q; want %q", tt.name, formats[0], tt.wantFormat)
+		}
+		if len(got[0]) > limit {
+			t.Errorf("%s: logged %d bytes; want at most %d", tt.name, len(got[0]), limit)
+		}
+	}
+
+	// Lines within the limit keep their original format.
+	got, formats = nil, nil
+	lf("x=%d", 1)
+	if formats[0] != "x=%d" || got[0] != "x=1" {
+		t.Errorf("logged %q with format %q; want %q with format %q", got[0], formats[0], "x=1", "x=%d")
+	}
+
+	// JSON records are never truncated.
+	got, formats = nil, nil
+	Logf(lf).JSON(1, "foo", strings.Repeat("d", 100))
+	if len(got) != 1 || strings.HasSuffix(got[0], TruncatedSuffix) {
+		t.Errorf("JSON record was truncated: %q", got)
+	}
+
+	// A zero limit disables truncation.
+	limit = 0
+	got, formats = nil, nil
+	long := strings.Repeat("e", 1000)
+	lf("%s", long)
+	if got[0] != long {
+		t.Errorf("with no limit, logged %d bytes; want %d", len(got[0]), len(long))
+	}
+}
@@ -5,6 +5,7 @@
 package winutil
 
 import (
+	"context"
 	"os/user"
 )
 
@@ -39,7 +40,8 @@ func GetPolicyInteger(name string) (uint64, error) {
 }
 
 // GetRegString looks up a registry path in the local machine path, or returns
-// an empty string and error.
+// an empty string and error. If the value is of type REG_EXPAND_SZ, any
+// environment variable references in it are expanded.
 //
 // This function will only work on GOOS=windows. Trying to run it on any other
 // OS will always return an empty string and ErrNoValue.
@@ -58,6 +60,31 @@ func GetRegInteger(name string) (uint64, error) {
 	return getRegInteger(name)
 }
 
+// EnumerateRegValues reads all REG_SZ and REG_EXPAND_SZ values of the
+// registry key subkey, relative to the local machine's RegBase path, into a
+// map keyed by value name. If subkey is empty, the values of RegBase itself
+// are read. REG_EXPAND_SZ values have their environment variable references
+// expanded; values of other types are skipped.
+// Use this function instead of repeated calls to GetRegString when reading
+// several values from the same key.
+//
+// This function will only work on GOOS=windows. Trying to run it on any other
+// OS will always return nil, nil.
+func EnumerateRegValues(subkey string) (map[string]string, error) {
+	return enumerateRegValues(subkey)
+}
+
+// WatchRegValue calls onChange with the new value each time the REG_SZ or
+// REG_EXPAND_SZ value name in the local machine's RegBase path changes. If
+// the value is deleted, onChange is called with the empty string. It blocks
+// until ctx is done, without polling.
+//
+// This function will only work on GOOS=windows. On any other OS it returns
+// immediately.
+func WatchRegValue(ctx context.Context, name string, onChange func(newVal string)) {
+	watchRegValue(ctx, name, onChange)
+}
+
 // IsSIDValidPrincipal determines whether the SID contained in uid represents a
 // type that is a valid security principal under Windows. This check helps us
 // work around a bug in the standard library's Windows implementation of
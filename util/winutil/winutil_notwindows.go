@@ -6,6 +6,7 @@
 package winutil
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os/user"
@@ -24,6 +25,10 @@ func getRegString(name string) (string, error) { return "", ErrNoValue }
 
 func getRegInteger(name string) (uint64, error) { return 0, ErrNoValue }
 
+func enumerateRegValues(subkey string) (map[string]string, error) { return nil, nil }
+
+func watchRegValue(ctx context.Context, name string, onChange func(newVal string)) {}
+
 func isSIDValidPrincipal(uid string) bool { return false }
 
 func lookupPseudoUser(uid string) (*user.User, error) {
@@ -0,0 +1,25 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !windows
+
+package winutil
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEnumerateRegValuesNotWindows(t *testing.T) {
+	m, err := EnumerateRegValues("")
+	if m != nil || err != nil {
+		t.Errorf("EnumerateRegValues = %v, %v; want nil, nil", m, err)
+	}
+}
+
+func TestWatchRegValueNotWindows(t *testing.T) {
+	// Returns immediately even with a context that is never done.
+	WatchRegValue(context.Background(), "foo", func(string) {
+		t.Error("onChange called")
+	})
+}
@@ -4,6 +4,7 @@
 package winutil
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -12,6 +13,7 @@
 	"os/user"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -94,16 +96,154 @@ func getRegStringInternal(subKey, name string) (string, error) {
 	}
 	defer key.Close()
 
-	val, _, err := key.GetStringValue(name)
+	return getRegStringFromKey(key, name)
+}
+
+// getRegStringFromKey reads the REG_SZ or REG_EXPAND_SZ value name from key.
+// REG_EXPAND_SZ values have their environment variable references expanded.
+func getRegStringFromKey(key registry.Key, name string) (string, error) {
+	val, valType, err := key.GetStringValue(name)
 	if err != nil {
 		if err != ErrNoValue {
 			log.Printf("registry.GetStringValue(%v): %v", name, err)
 		}
 		return "", err
 	}
+	if valType == registry.EXPAND_SZ {
+		return expandEnvironmentStrings(val)
+	}
 	return val, nil
 }
 
+func enumerateRegValues(subkey string) (map[string]string, error) {
+	path := regBase
+	if subkey != "" {
+		path += `\` + subkey
+	}
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.READ)
+	if err != nil {
+		if err != ErrNoValue {
+			log.Printf("registry.OpenKey(%v): %v", path, err)
+		}
+		return nil, err
+	}
+	defer key.Close()
+
+	return enumerateRegValuesFromKey(key)
+}
+
+// enumerateRegValuesFromKey reads all REG_SZ and REG_EXPAND_SZ values of key.
+// Values of other types are skipped.
+func enumerateRegValuesFromKey(key registry.Key) (map[string]string, error) {
+	names, err := key.ReadValueNames(0)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(names))
+	for _, name := range names {
+		val, valType, err := key.GetStringValue(name)
+		if err == registry.ErrUnexpectedType {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if valType == registry.EXPAND_SZ {
+			if val, err = expandEnvironmentStrings(val); err != nil {
+				return nil, err
+			}
+		}
+		m[name] = val
+	}
+	return m, nil
+}
+
+func watchRegValue(ctx context.Context, name string, onChange func(newVal string)) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, regBase, registry.QUERY_VALUE|registry.NOTIFY)
+	if err != nil {
+		log.Printf("registry.OpenKey(%v): %v", regBase, err)
+		return
+	}
+	defer key.Close()
+
+	if err := watchRegValueInKey(ctx, key, name, onChange); err != nil {
+		log.Printf("WatchRegValue(%v): %v", name, err)
+	}
+}
+
+// watchRegValueInKey calls onChange each time the string value name in key
+// changes, until ctx is done. key must have been opened with
+// registry.NOTIFY access.
+func watchRegValueInKey(ctx context.Context, key registry.Key, name string, onChange func(newVal string)) error {
+	changed, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		return fmt.Errorf("windows.CreateEvent: %w", err)
+	}
+	defer windows.CloseHandle(changed)
+	done, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return fmt.Errorf("windows.CreateEvent: %w", err)
+	}
+	defer windows.CloseHandle(done)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	stop := context.AfterFunc(ctx, func() {
+		defer wg.Done()
+		windows.SetEvent(done)
+	})
+	defer func() {
+		// Don't let done be closed while the AfterFunc is using it.
+		if stop() {
+			wg.Done()
+		}
+		wg.Wait()
+	}()
+
+	last, _ := getRegStringFromKey(key, name)
+	for {
+		// Register before reading the value, so that a change made between
+		// the read and the wait isn't missed.
+		const filter = windows.REG_NOTIFY_CHANGE_LAST_SET | windows.REG_NOTIFY_THREAD_AGNOSTIC
+		if err := windows.RegNotifyChangeKeyValue(windows.Handle(key), false, filter, changed, true); err != nil {
+			return fmt.Errorf("windows.RegNotifyChangeKeyValue: %w", err)
+		}
+		ev, err := windows.WaitForMultipleObjects([]windows.Handle{changed, done}, false, windows.INFINITE)
+		if err != nil {
+			return fmt.Errorf("windows.WaitForMultipleObjects: %w", err)
+		}
+		if ev != windows.WAIT_OBJECT_0 {
+			return nil // ctx is done
+		}
+		// Any value in key changing signals the event; only report changes
+		// to name. A missing value reads as the empty string.
+		cur, _ := getRegStringFromKey(key, name)
+		if cur != last {
+			last = cur
+			onChange(cur)
+		}
+	}
+}
+
+// expandEnvironmentStrings expands the %VAR% environment variable references
+// in s using the current process's environment.
+func expandEnvironmentStrings(s string) (string, error) {
+	src, err := windows.UTF16PtrFromString(s)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]uint16, len(s)+1)
+	for {
+		n, err := windows.ExpandEnvironmentStrings(src, &buf[0], uint32(len(buf)))
+		if err != nil {
+			return "", err
+		}
+		if n <= uint32(len(buf)) {
+			return windows.UTF16ToString(buf[:n]), nil
+		}
+		buf = make([]uint16, n)
+	}
+}
+
 // GetRegStrings looks up a registry value in the local machine path, or returns
 // the given default if it can't.
 func GetRegStrings(name string, defval []string) []string {
@@ -4,7 +4,14 @@
 package winutil
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
 )
 
 const (
@@ -28,3 +35,159 @@ func TestLookupPseudoUser(t *testing.T) {
 		t.Errorf("LookupPseudoUser(%q) unexpectedly succeeded", networkSID)
 	}
 }
+
+func TestGetRegStringFromKey(t *testing.T) {
+	subKey := fmt.Sprintf(`SOFTWARE\Tailscale Test\%s`, t.Name())
+	key, _, err := registry.CreateKey(registry.CURRENT_USER, subKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	defer registry.DeleteKey(registry.CURRENT_USER, subKey)
+	defer key.Close()
+
+	t.Setenv("TS_WINUTIL_TEST", "expanded")
+	if err := key.SetStringValue("sz", `%TS_WINUTIL_TEST%\foo`); err != nil {
+		t.Fatal(err)
+	}
+	if err := key.SetExpandStringValue("expand_sz", `%TS_WINUTIL_TEST%\foo`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"sz", `%TS_WINUTIL_TEST%\foo`},
+		{"expand_sz", `expanded\foo`},
+	}
+	for _, tt := range tests {
+		got, err := getRegStringFromKey(key, tt.name)
+		if err != nil {
+			t.Errorf("getRegStringFromKey(%q): %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("getRegStringFromKey(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := getRegStringFromKey(key, "missing"); err != ErrNoValue {
+		t.Errorf("getRegStringFromKey(missing) error = %v; want ErrNoValue", err)
+	}
+}
+
+func TestEnumerateRegValuesFromKey(t *testing.T) {
+	subKey := fmt.Sprintf(`SOFTWARE\Tailscale Test\%s`, t.Name())
+	key, _, err := registry.CreateKey(registry.CURRENT_USER, subKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	defer registry.DeleteKey(registry.CURRENT_USER, subKey)
+	defer key.Close()
+
+	got, err := enumerateRegValuesFromKey(key)
+	if err != nil {
+		t.Fatalf("empty key: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("empty key: got %v; want no values", got)
+	}
+
+	t.Setenv("TS_WINUTIL_TEST", "expanded")
+	if err := key.SetStringValue("sz", "plain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := key.SetExpandStringValue("expand_sz", `%TS_WINUTIL_TEST%\foo`); err != nil {
+		t.Fatal(err)
+	}
+	if err := key.SetDWordValue("dword", 42); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = enumerateRegValuesFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"sz":        "plain",
+		"expand_sz": `expanded\foo`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestWatchRegValueInKey(t *testing.T) {
+	subKey := fmt.Sprintf(`SOFTWARE\Tailscale Test\%s`, t.Name())
+	key, _, err := registry.CreateKey(registry.CURRENT_USER, subKey, registry.ALL_ACCESS)
+	if err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	defer registry.DeleteKey(registry.CURRENT_USER, subKey)
+	defer key.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan string, 10)
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- watchRegValueInKey(ctx, key, "watched", func(v string) { changes <- v })
+	}()
+
+	wantChange := func(want string) {
+		t.Helper()
+		for {
+			select {
+			case got := <-changes:
+				if strings.HasPrefix(got, "one-") {
+					continue // a late write from the loop below
+				}
+				if got != want {
+					t.Fatalf("onChange(%q); want %q", got, want)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for onChange(%q)", want)
+			}
+			return
+		}
+	}
+
+	// The watcher may not have read the initial value yet, so write a new
+	// value until it reports one. Writes happen in a separate goroutine
+	// from the watcher, as they would from another process.
+	for i := 0; ; i++ {
+		val := fmt.Sprintf("one-%d", i)
+		go key.SetStringValue("watched", val)
+		select {
+		case got := <-changes:
+			if !strings.HasPrefix(got, "one-") {
+				t.Fatalf("onChange(%q); want one-N", got)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if i == 100 {
+				t.Fatal("timed out waiting for onChange")
+			}
+			continue
+		}
+		break
+	}
+	go key.SetStringValue("watched", "two")
+	wantChange("two")
+
+	// Changes to other values don't call onChange.
+	if err := key.SetStringValue("other", "x"); err != nil {
+		t.Fatal(err)
+	}
+	go key.DeleteValue("watched")
+	wantChange("")
+
+	cancel()
+	select {
+	case err := <-watchDone:
+		if err != nil {
+			t.Errorf("watchRegValueInKey: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("watchRegValueInKey didn't return after cancel")
+	}
+}
@@ -56,12 +56,35 @@ type Filter struct {
 	state *filterState
 
 	shieldsUp bool
+
+	// blockOutbound is whether packets this node sends to start new flows
+	// to Tailscale peers are dropped. See BlockOutbound.
+	blockOutbound bool
+
+	// localPorts and localPortDsts are the ports on local addresses that
+	// accept new inbound flows regardless of matches and shieldsUp.
+	// See AllowLocalPorts.
+	localPorts    map[uint16]bool
+	localPortDsts *netipx.IPSet
+
+	// allowedSrcs, if non-nil, are the peer addresses that are exempt
+	// from shields up in both directions. See AllowSources.
+	allowedSrcs *netipx.IPSet
+
+	// decisionLog, if non-nil, rate-limits the logging of every accept
+	// and drop decision. See LogDecisions.
+	decisionLog *rate.Limiter
 }
 
 // filterState is a state cache of past seen packets.
 type filterState struct {
 	mu  sync.Mutex
 	lru *flowtrack.Cache[struct{}] // from flowtrack.Tuple -> struct{}
+
+	// inbound holds the UDP and SCTP flows accepted by RunIn, keyed by the
+	// tuple of their outgoing replies, so that BlockOutbound lets those
+	// replies out.
+	inbound *flowtrack.Cache[struct{}] // from flowtrack.Tuple -> struct{}
 }
 
 // lruMax is the size of the LRU cache in filterState.
@@ -178,7 +201,8 @@ func New(matches []Match, localNets *netipx.IPSet, logIPs *netipx.IPSet, shareSt
 		state = shareStateWith.state
 	} else {
 		state = &filterState{
-			lru: &flowtrack.Cache[struct{}]{MaxEntries: lruMax},
+			lru:     &flowtrack.Cache[struct{}]{MaxEntries: lruMax},
+			inbound: &flowtrack.Cache[struct{}]{MaxEntries: lruMax},
 		}
 	}
 	f := &Filter{
@@ -276,6 +300,13 @@ func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction
 		return
 	}
 
+	if f.decisionLog != nil {
+		if (r == Accept || r == Drop) && f.decisionLog.Allow() {
+			f.logf("filter: %v %v: %s %d %s", r, dir, q.String(), len(q.Buffer()), why)
+		}
+		return
+	}
+
 	var verdict string
 	if r == Drop && (runflags&LogDrops) != 0 && dropBucket.Allow() {
 		verdict = "Drop"
@@ -358,6 +389,76 @@ func (f *Filter) CapsWithValues(srcIP, dstIP netip.Addr) tailcfg.PeerCapMap {
 // incoming) filter.
 func (f *Filter) ShieldsUp() bool { return f.shieldsUp }
 
+// BlockOutbound configures f to drop packets that this node sends to start
+// new flows to Tailscale peers, in addition to its other rules, and returns
+// f. Replies on flows that a peer started are still sent: TCP packets other
+// than an initial SYN, ICMP responses, and UDP and SCTP packets of flows
+// accepted by RunIn. It must be called before f is installed.
+func (f *Filter) BlockOutbound() *Filter {
+	f.blockOutbound = true
+	return f
+}
+
+// decisionLogRate is the maximum number of packet decisions per second
+// that a filter with LogDecisions set logs.
+const decisionLogRate = 1000
+
+// LogDecisions configures f to log every accept and drop decision, for
+// debugging ACL rules, instead of only occasional samples as selected by
+// the RunFlags. Logging is limited to decisionLogRate decisions per
+// second. It returns f and must be called before f is installed.
+func (f *Filter) LogDecisions() *Filter {
+	f.decisionLog = rate.NewLimiter(decisionLogRate, decisionLogRate)
+	return f
+}
+
+// BlocksOutbound reports whether f drops packets that this node sends to
+// start new flows to Tailscale peers.
+func (f *Filter) BlocksOutbound() bool { return f.blockOutbound }
+
+// AllowLocalPorts configures f to accept inbound TCP, UDP and SCTP packets
+// to any of ports on an address in dsts, regardless of its other rules,
+// including shields up, and returns f. It must be called before f is
+// installed.
+func (f *Filter) AllowLocalPorts(dsts *netipx.IPSet, ports []uint16) *Filter {
+	if len(ports) == 0 || dsts == nil {
+		return f
+	}
+	f.localPorts = make(map[uint16]bool, len(ports))
+	for _, p := range ports {
+		f.localPorts[p] = true
+	}
+	f.localPortDsts = dsts
+	return f
+}
+
+// AllowSources exempts the addresses in srcs from shields up, and returns
+// f: if f is a shields-up filter, it accepts inbound packets from them,
+// and if BlockOutbound is set, it still lets packets to them out. It has
+// no effect on other filters. It must be called before f is installed.
+func (f *Filter) AllowSources(srcs *netipx.IPSet) *Filter {
+	f.allowedSrcs = srcs
+	return f
+}
+
+// isAllowedSource reports whether addr was allowed by AllowSources.
+func (f *Filter) isAllowedSource(addr netip.Addr) bool {
+	return f.allowedSrcs != nil && f.allowedSrcs.Contains(addr)
+}
+
+// isLocalPort reports whether q is destined to a port allowed by
+// AllowLocalPorts.
+func (f *Filter) isLocalPort(q *packet.Parsed) bool {
+	if f.localPorts == nil {
+		return false
+	}
+	switch q.IPProto {
+	case ipproto.TCP, ipproto.UDP, ipproto.SCTP:
+		return f.localPorts[q.Dst.Port()] && f.localPortDsts.Contains(q.Dst.Addr())
+	}
+	return false
+}
+
 // RunIn determines whether this node is allowed to receive q from a
 // Tailscale peer.
 func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
@@ -377,10 +478,46 @@ func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
 	default:
 		r, why = Drop, "not-ip"
 	}
+	if r == Accept && f.blockOutbound {
+		f.trackInbound(q)
+	}
 	f.logRateLimit(rf, q, dir, r, why)
 	return r
 }
 
+// trackInbound records the UDP or SCTP flow of q, an inbound packet that
+// RunIn accepted, so that isOutboundReply lets its replies out.
+func (f *Filter) trackInbound(q *packet.Parsed) {
+	switch q.IPProto {
+	case ipproto.UDP, ipproto.SCTP:
+		tuple := flowtrack.Tuple{
+			Proto: q.IPProto,
+			Src:   q.Dst, Dst: q.Src, // src/dst reversed
+		}
+		f.state.mu.Lock()
+		f.state.inbound.Add(tuple, struct{}{})
+		f.state.mu.Unlock()
+	}
+}
+
+// isOutboundReply reports whether q, a packet this node is sending, is a
+// reply on a flow that a peer started rather than the start of a new flow.
+func (f *Filter) isOutboundReply(q *packet.Parsed) bool {
+	switch q.IPProto {
+	case ipproto.TCP:
+		return !q.IsTCPSyn()
+	case ipproto.ICMPv4, ipproto.ICMPv6:
+		return q.IsEchoResponse() || q.IsError()
+	case ipproto.UDP, ipproto.SCTP:
+		t := flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
+		f.state.mu.Lock()
+		_, ok := f.state.inbound.Get(t)
+		f.state.mu.Unlock()
+		return ok
+	}
+	return false
+}
+
 // RunOut determines whether this node is allowed to send q to a
 // Tailscale peer.
 func (f *Filter) RunOut(q *packet.Parsed, rf RunFlags) Response {
@@ -413,6 +550,12 @@ func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
 	if !f.local.Contains(q.Dst.Addr()) {
 		return Drop, "destination not allowed"
 	}
+	if f.isLocalPort(q) {
+		return Accept, "locally served port"
+	}
+	if f.shieldsUp && f.isAllowedSource(q.Src.Addr()) {
+		return Accept, "allowed source"
+	}
 
 	switch q.IPProto {
 	case ipproto.ICMPv4:
@@ -473,6 +616,12 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 	if !f.local.Contains(q.Dst.Addr()) {
 		return Drop, "destination not allowed"
 	}
+	if f.isLocalPort(q) {
+		return Accept, "locally served port"
+	}
+	if f.shieldsUp && f.isAllowedSource(q.Src.Addr()) {
+		return Accept, "allowed source"
+	}
 
 	switch q.IPProto {
 	case ipproto.ICMPv6:
@@ -528,6 +677,9 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 
 // runIn runs the output-specific part of the filter logic.
 func (f *Filter) runOut(q *packet.Parsed) (r Response, why string) {
+	if f.blockOutbound && !f.isAllowedSource(q.Dst.Addr()) && !f.isOutboundReply(q) {
+		return Drop, "shields up (outbound)"
+	}
 	switch q.IPProto {
 	case ipproto.UDP, ipproto.SCTP:
 		tuple := flowtrack.Tuple{
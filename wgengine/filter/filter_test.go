@@ -196,6 +196,199 @@ func TestUDPState(t *testing.T) {
 	}
 }
 
+func TestBlockOutbound(t *testing.T) {
+	acl := newFilter(t.Logf).BlockOutbound()
+	if !acl.BlocksOutbound() {
+		t.Fatal("BlocksOutbound = false after BlockOutbound")
+	}
+	flags := LogDrops | LogAccepts
+
+	out := parsed(ipproto.UDP, "102.102.102.102", "119.119.119.119", 4343, 4242)
+	if got := acl.RunOut(&out, flags); got != Drop {
+		t.Errorf("outbound packet not dropped, got=%v: %v", got, out)
+	}
+	// No UDP state was recorded, so the reply is not let back in.
+	reply := parsed(ipproto.UDP, "119.119.119.119", "102.102.102.102", 4242, 4343)
+	if got := acl.RunIn(&reply, flags); got != Drop {
+		t.Errorf("reply to blocked outbound packet not dropped, got=%v: %v", got, reply)
+	}
+	// Incoming traffic is still governed by the packet filter.
+	in := parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 999, 22)
+	if got := acl.RunIn(&in, flags); got != Accept {
+		t.Errorf("allowed inbound packet not accepted, got=%v: %v", got, in)
+	}
+
+	// Replies on flows that a peer started are still sent.
+	synAck := parsed(ipproto.TCP, "1.2.3.4", "8.1.1.1", 22, 999)
+	synAck.TCPFlags = packet.TCPSynAck
+	if got := acl.RunOut(&synAck, flags); got != Accept {
+		t.Errorf("TCP reply not accepted, got=%v: %v", got, synAck)
+	}
+	syn := parsed(ipproto.TCP, "1.2.3.4", "8.1.1.1", 22, 999)
+	if got := acl.RunOut(&syn, flags); got != Drop {
+		t.Errorf("outbound TCP SYN not dropped, got=%v: %v", got, syn)
+	}
+	udpReply := parsed(ipproto.UDP, "1.2.3.4", "8.1.1.1", 22, 999)
+	if got := acl.RunOut(&udpReply, flags); got != Drop {
+		t.Errorf("UDP packet with no inbound flow not dropped, got=%v: %v", got, udpReply)
+	}
+	udpIn := parsed(ipproto.UDP, "8.1.1.1", "1.2.3.4", 999, 22)
+	if got := acl.RunIn(&udpIn, flags); got != Accept {
+		t.Fatalf("allowed inbound UDP packet not accepted, got=%v: %v", got, udpIn)
+	}
+	if got := acl.RunOut(&udpReply, flags); got != Accept {
+		t.Errorf("UDP reply to inbound flow not accepted, got=%v: %v", got, udpReply)
+	}
+
+	shields := NewShieldsUpFilter(acl.local, acl.logIPs, nil, t.Logf).BlockOutbound()
+	if got := shields.RunIn(&in, flags); got != Drop {
+		t.Errorf("shields up: inbound packet not dropped, got=%v: %v", got, in)
+	}
+	if got := shields.RunOut(&out, flags); got != Drop {
+		t.Errorf("shields up: outbound packet not dropped, got=%v: %v", got, out)
+	}
+}
+
+func TestLogDecisions(t *testing.T) {
+	var accepts, drops int
+	logf := func(format string, args ...any) {
+		switch {
+		case strings.HasPrefix(format, "filter: "):
+			switch args[0].(Response) {
+			case Accept:
+				accepts++
+			case Drop:
+				drops++
+			}
+		default:
+			t.Errorf("unexpected log line: "+format, args...)
+		}
+	}
+	acl := newFilter(logf).LogDecisions()
+
+	// With no RunFlags, both decisions are still logged.
+	in := parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 999, 22)
+	if got := acl.RunIn(&in, 0); got != Accept {
+		t.Fatalf("RunIn = %v; want Accept", got)
+	}
+	denied := parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 999, 23)
+	if got := acl.RunIn(&denied, 0); got != Drop {
+		t.Fatalf("RunIn = %v; want Drop", got)
+	}
+	if accepts != 1 || drops != 1 {
+		t.Fatalf("logged %d accepts, %d drops; want 1, 1", accepts, drops)
+	}
+
+	// The rate limiter caps a flood of decisions at about decisionLogRate.
+	const n = 10 * decisionLogRate
+	for i := 0; i < n; i++ {
+		acl.RunIn(&denied, 0)
+	}
+	if drops < decisionLogRate/2 || drops >= n/2 {
+		t.Errorf("logged %d of %d drops; want about %d", drops, n, decisionLogRate)
+	}
+}
+
+func TestAllowLocalPorts(t *testing.T) {
+	var self netipx.IPSetBuilder
+	self.AddPrefix(netip.MustParsePrefix("1.2.3.4/32"))
+	self.AddPrefix(netip.MustParsePrefix("2001::2/128"))
+	selfSet, err := self.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := newFilter(t.Logf)
+	shields := NewShieldsUpFilter(acl.local, acl.logIPs, nil, t.Logf).AllowLocalPorts(selfSet, []uint16{9090, 53})
+	flags := LogDrops | LogAccepts
+
+	tests := []struct {
+		name string
+		p    packet.Parsed
+		want Response
+	}{
+		{"tcp4_local_port", parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 999, 9090), Accept},
+		{"udp4_local_port", parsed(ipproto.UDP, "8.1.1.1", "1.2.3.4", 999, 53), Accept},
+		{"sctp4_local_port", parsed(ipproto.SCTP, "8.1.1.1", "1.2.3.4", 999, 9090), Accept},
+		{"tcp6_local_port", parsed(ipproto.TCP, "2001::1", "2001::2", 999, 9090), Accept},
+		{"tcp4_other_port", parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 999, 22), Drop},
+		{"tcp4_other_local_addr", parsed(ipproto.TCP, "8.1.1.1", "5.6.7.8", 999, 9090), Drop},
+		{"tcp4_not_local", parsed(ipproto.TCP, "8.1.1.1", "9.9.9.9", 999, 9090), Drop},
+		{"icmp4", parsed(ipproto.ICMPv4, "8.1.1.1", "1.2.3.4", 0, 0), Drop},
+	}
+	for _, tt := range tests {
+		if got := shields.RunIn(&tt.p, flags); got != tt.want {
+			t.Errorf("%s: got %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Without AllowLocalPorts, shields up drops them all.
+	shields = NewShieldsUpFilter(acl.local, acl.logIPs, nil, t.Logf)
+	for _, tt := range tests {
+		if got := shields.RunIn(&tt.p, flags); got != Drop {
+			t.Errorf("%s: without AllowLocalPorts: got %v; want Drop", tt.name, got)
+		}
+	}
+}
+
+func TestAllowSources(t *testing.T) {
+	var srcs netipx.IPSetBuilder
+	srcs.AddPrefix(netip.MustParsePrefix("8.1.1.0/24"))
+	srcs.AddPrefix(netip.MustParsePrefix("2001::1/128"))
+	srcSet, err := srcs.IPSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := newFilter(t.Logf)
+	shields := NewShieldsUpFilter(acl.local, acl.logIPs, nil, t.Logf).BlockOutbound().AllowSources(srcSet)
+	flags := LogDrops | LogAccepts
+
+	inTests := []struct {
+		name string
+		p    packet.Parsed
+		want Response
+	}{
+		{"tcp4_allowed", parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 999, 22), Accept},
+		{"udp4_allowed", parsed(ipproto.UDP, "8.1.1.200", "1.2.3.4", 999, 53), Accept},
+		{"icmp4_allowed", parsed(ipproto.ICMPv4, "8.1.1.1", "1.2.3.4", 0, 0), Accept},
+		{"tcp6_allowed", parsed(ipproto.TCP, "2001::1", "2001::2", 999, 22), Accept},
+		{"tcp4_other_src", parsed(ipproto.TCP, "8.1.2.1", "1.2.3.4", 999, 22), Drop},
+		{"tcp6_other_src", parsed(ipproto.TCP, "2001::3", "2001::2", 999, 22), Drop},
+		{"tcp4_not_local", parsed(ipproto.TCP, "8.1.1.1", "9.9.9.9", 999, 22), Drop},
+	}
+	for _, tt := range inTests {
+		if got := shields.RunIn(&tt.p, flags); got != tt.want {
+			t.Errorf("in %s: got %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	outTests := []struct {
+		name string
+		p    packet.Parsed
+		want Response
+	}{
+		{"udp4_allowed", parsed(ipproto.UDP, "1.2.3.4", "8.1.1.1", 4343, 53), Accept},
+		{"udp4_other_dst", parsed(ipproto.UDP, "1.2.3.4", "119.119.119.119", 4343, 53), Drop},
+	}
+	for _, tt := range outTests {
+		if got := shields.RunOut(&tt.p, flags); got != tt.want {
+			t.Errorf("out %s: got %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Without AllowSources, shields up drops them all.
+	shields = NewShieldsUpFilter(acl.local, acl.logIPs, nil, t.Logf).BlockOutbound()
+	for _, tt := range inTests {
+		if got := shields.RunIn(&tt.p, flags); got != Drop {
+			t.Errorf("in %s: without AllowSources: got %v; want Drop", tt.name, got)
+		}
+	}
+	for _, tt := range outTests {
+		if got := shields.RunOut(&tt.p, flags); got != Drop {
+			t.Errorf("out %s: without AllowSources: got %v; want Drop", tt.name, got)
+		}
+	}
+}
+
 func TestNoAllocs(t *testing.T) {
 	acl := newFilter(t.Logf)
 
@@ -1129,7 +1129,7 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
 	if !isDerp {
 		thisPong := addrQuality{sp.to, latency, tstun.WireMTU(pingSizeToPktLen(sp.size, sp.to.Addr().Is6()))}
-		if betterAddr(thisPong, de.bestAddr) {
+		if betterAddrForMode(de.c.connPriorityMode.Load(), thisPong, de.bestAddr) {
 			de.c.logf("magicsock: disco: node %v %v now using %v mtu=%v tx=%x", de.publicKey.ShortString(), de.discoShort(), sp.to, thisPong.wireMTU, m.TxID[:6])
 			de.debugUpdates.Add(EndpointChange{
 				When: time.Now(),
@@ -1165,6 +1165,16 @@ func (a addrQuality) String() string {
 	return fmt.Sprintf("%v@%v+%v", a.AddrPort, a.latency, a.wireMTU)
 }
 
+// betterAddrForMode reports whether a is a better addr to use than b when
+// path selection optimizes for mode, as set by
+// Conn.SetConnectionPriorityMode.
+//
+// TODO: "reliability" and "bandwidth" are hints for future multi-path
+// support; until then, every mode uses the latency-based betterAddr.
+func betterAddrForMode(mode string, a, b addrQuality) bool {
+	return betterAddr(a, b)
+}
+
 // betterAddr reports whether a is a better addr to use than b.
 func betterAddr(a, b addrQuality) bool {
 	if a.AddrPort == b.AddrPort {
@@ -169,6 +169,10 @@ type Conn struct {
 	// peerMTUEnabled is whether path MTU discovery to peers is enabled.
 	peerMTUEnabled atomic.Bool
 
+	// connPriorityMode is the path selection hint set by
+	// SetConnectionPriorityMode; empty means "latency".
+	connPriorityMode syncs.AtomicValue[string]
+
 	// stats maintains per-connection counters.
 	stats atomic.Pointer[connstats.Statistics]
 
@@ -300,6 +304,14 @@ func (c *Conn) SetDebugLoggingEnabled(v bool) {
 	c.debugLogging.Store(v)
 }
 
+// SetConnectionPriorityMode sets what path selection between peers should
+// optimize for: "latency", "reliability" or "bandwidth". The empty string
+// means "latency". Only latency-based selection is implemented today; the
+// other modes are recorded for future multi-path support.
+func (c *Conn) SetConnectionPriorityMode(mode string) {
+	c.connPriorityMode.Store(mode)
+}
+
 // dlogf logs a debug message if debug logging is enabled via SetDebugLoggingEnabled.
 func (c *Conn) dlogf(format string, a ...any) {
 	if c.debugLogging.Load() {
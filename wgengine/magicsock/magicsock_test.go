@@ -1762,6 +1762,27 @@ func TestBetterAddr(t *testing.T) {
 
 }
 
+func TestBetterAddrForMode(t *testing.T) {
+	const ms = time.Millisecond
+	al := func(ipps string, d time.Duration) addrQuality {
+		return addrQuality{AddrPort: netip.MustParseAddrPort(ipps), latency: d}
+	}
+	pairs := []struct{ a, b addrQuality }{
+		{al("1.2.3.4:555", 5*ms), addrQuality{}},
+		{al("1.2.3.4:555", 100*ms), al("5.6.7.8:999", 30*ms)},
+		{al("10.0.0.2:123", 100*ms), al("1.2.3.4:555", 91*ms)},
+		{al("[2001::5]:123", 100*ms), al("1.2.3.4:555", 91*ms)},
+	}
+	// Until multi-path support exists, every mode selects by latency.
+	for _, mode := range []string{"", "latency", "reliability", "bandwidth"} {
+		for i, p := range pairs {
+			if got, want := betterAddrForMode(mode, p.a, p.b), betterAddr(p.a, p.b); got != want {
+				t.Errorf("mode %q: [%d] betterAddrForMode(%v, %v) = %v; want %v", mode, i, p.a, p.b, got, want)
+			}
+		}
+	}
+}
+
 func epFromTyped(eps []tailcfg.Endpoint) (ret []netip.AddrPort) {
 	for _, ep := range eps {
 		ret = append(ret, ep.Addr)
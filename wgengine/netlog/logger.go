@@ -30,8 +30,9 @@
 	"tailscale.com/wgengine/router"
 )
 
-// pollPeriod specifies how often to poll for network traffic.
-const pollPeriod = 5 * time.Second
+// defaultPollPeriod specifies how often to poll for network traffic
+// if Startup is not given an explicit period.
+const defaultPollPeriod = 5 * time.Second
 
 // Device is an abstraction over a tunnel device or a magic socket.
 // Both *tstun.Wrapper and *magicsock.Conn implement this interface.
@@ -93,7 +94,8 @@ func (nl *Logger) Running() bool {
 // The IP protocol and source port are always zero.
 // The sock is used to populated the PhysicalTraffic field in Message.
 // The netMon parameter is optional; if non-nil it's used to do faster interface lookups.
-func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, tun, sock Device, netMon *netmon.Monitor) error {
+// The pollPeriod is how often to poll for network traffic; if zero, a default is used.
+func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID logid.PrivateID, tun, sock Device, netMon *netmon.Monitor, pollPeriod time.Duration) error {
 	nl.mu.Lock()
 	defer nl.mu.Unlock()
 	if nl.logger != nil {
@@ -132,6 +134,9 @@ func (nl *Logger) Startup(nodeID tailcfg.StableNodeID, nodeLogID, domainLogID lo
 	// can upload to the Tailscale log service, so stay below this limit.
 	const maxLogSize = 256 << 10
 	const maxConns = (maxLogSize - netlogtype.MaxMessageJSONSize) / netlogtype.MaxConnectionCountsJSONSize
+	if pollPeriod <= 0 {
+		pollPeriod = defaultPollPeriod
+	}
 	nl.stats = connstats.NewStatistics(pollPeriod, maxConns, func(start, end time.Time, virtual, physical map[netlogtype.Connection]netlogtype.Counts) {
 		nl.mu.Lock()
 		addrs := nl.addrs
@@ -825,6 +825,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	if !engineChanged && !routerChanged && !listenPortChanged && !isSubnetRouterChanged && !peerMTUChanged {
 		return ErrNoChanges
 	}
+	if cfg.PostQuantum && !e.lastCfgFull.PostQuantum {
+		e.logf("wgengine: Reconfig: post-quantum key exchange requested but not yet supported; using the standard handshake")
+	}
 	newLogIDs := cfg.NetworkLogging
 	oldLogIDs := e.lastCfgFull.NetworkLogging
 	netLogIDsNowValid := !newLogIDs.NodeID.IsZero() && !newLogIDs.DomainID.IsZero()
@@ -884,7 +887,7 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		return err
 	}
 
-	// Shutdown the network logger because the IDs changed.
+	// Shutdown the network logger because the IDs or poll period changed.
 	// Let it be started back up by subsequent logic.
 	if netLogIDsChanged && e.networkLogger.Running() {
 		e.logf("wgengine: Reconfig: shutting down network logger")
@@ -901,7 +904,7 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		nid := cfg.NetworkLogging.NodeID
 		tid := cfg.NetworkLogging.DomainID
 		e.logf("wgengine: Reconfig: starting up network logger (node:%s tailnet:%s)", nid.Public(), tid.Public())
-		if err := e.networkLogger.Startup(cfg.NodeID, nid, tid, e.tundev, e.magicConn, e.netMon); err != nil {
+		if err := e.networkLogger.Startup(cfg.NodeID, nid, tid, e.tundev, e.magicConn, e.netMon, cfg.NetworkLogging.PollPeriod); err != nil {
 			e.logf("wgengine: Reconfig: error starting up network logger: %v", err)
 		}
 		e.networkLogger.ReconfigRoutes(routerCfg)
@@ -1000,6 +1003,34 @@ func (e *userspaceEngine) getPeerStatusLite(pk key.NodePublic) (status ipnstate.
 	return status, true
 }
 
+func (e *userspaceEngine) SendKeepalives() {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	if e.wgdev == nil {
+		return
+	}
+	for _, p := range e.lastCfgFull.Peers {
+		if peer := e.wgdev.LookupPeer(p.PublicKey.Raw32()); peer != nil {
+			peer.SendKeepalive()
+		}
+	}
+}
+
+func (e *userspaceEngine) SendHandshakes() {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	if e.wgdev == nil {
+		return
+	}
+	for _, p := range e.lastCfgFull.Peers {
+		if peer := e.wgdev.LookupPeer(p.PublicKey.Raw32()); peer != nil {
+			if err := peer.SendHandshakeInitiation(false); err != nil {
+				e.logf("[v1] wgengine: handshake with %v: %v", p.PublicKey.ShortString(), err)
+			}
+		}
+	}
+}
+
 func (e *userspaceEngine) getStatus() (*Status, error) {
 	// Grab derpConns before acquiring wgLock to not violate lock ordering;
 	// the DERPs method acquires magicsock.Conn.mu.
@@ -142,6 +142,12 @@ func (e *watchdogEngine) SetNetworkMap(nm *netmap.NetworkMap) {
 func (e *watchdogEngine) Ping(ip netip.Addr, pingType tailcfg.PingType, size int, cb func(*ipnstate.PingResult)) {
 	e.watchdog("Ping", func() { e.wrap.Ping(ip, pingType, size, cb) })
 }
+func (e *watchdogEngine) SendKeepalives() {
+	e.watchdog("SendKeepalives", e.wrap.SendKeepalives)
+}
+func (e *watchdogEngine) SendHandshakes() {
+	e.watchdog("SendHandshakes", e.wrap.SendHandshakes)
+}
 func (e *watchdogEngine) Close() {
 	e.watchdog("Close", e.wrap.Close)
 }
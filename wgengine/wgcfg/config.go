@@ -6,6 +6,7 @@
 
 import (
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
@@ -25,11 +26,20 @@ type Config struct {
 	DNS        []netip.Addr
 	Peers      []Peer
 
+	// PostQuantum requests a post-quantum (Kyber) hybrid key exchange
+	// with peers. wireguard-go does not implement it yet, so the engine
+	// only logs the request and uses the standard handshake.
+	PostQuantum bool
+
 	// NetworkLogging enables network logging.
 	// It is disabled if either ID is the zero value.
 	NetworkLogging struct {
 		NodeID   logid.PrivateID
 		DomainID logid.PrivateID
+
+		// PollPeriod is how often connection statistics are polled.
+		// If zero, the netlog package default is used.
+		PollPeriod time.Duration
 	}
 }
 
@@ -7,6 +7,7 @@
 
 import (
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
@@ -42,9 +43,11 @@ func (src *Config) Clone() *Config {
 	MTU            uint16
 	DNS            []netip.Addr
 	Peers          []Peer
+	PostQuantum    bool
 	NetworkLogging struct {
-		NodeID   logid.PrivateID
-		DomainID logid.PrivateID
+		NodeID     logid.PrivateID
+		DomainID   logid.PrivateID
+		PollPeriod time.Duration
 	}
 }{})
 
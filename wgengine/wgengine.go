@@ -111,6 +111,16 @@ type Engine interface {
 	// If size is zero too small, it is ignored. See tailscale.PingOpts for details.
 	Ping(ip netip.Addr, pingType tailcfg.PingType, size int, cb func(*ipnstate.PingResult))
 
+	// SendKeepalives sends a WireGuard keepalive packet to every
+	// configured peer, such as before the OS suspends.
+	SendKeepalives()
+
+	// SendHandshakes initiates a WireGuard handshake with every peer
+	// currently configured in the WireGuard device, such as to notice
+	// roaming sooner. WireGuard ignores handshakes requested within its
+	// rekey timeout (5s) of the last one sent to a peer.
+	SendHandshakes()
+
 	// InstallCaptureHook registers a function to be called to capture
 	// packets traversing the data path. The hook can be uninstalled by
 	// calling this function with a nil value.